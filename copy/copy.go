@@ -2,36 +2,42 @@ package copy
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"reflect"
-	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/containers/image/image"
+	internalblobinfocache "github.com/containers/image/internal/blobinfocache"
+	"github.com/containers/image/internal/platform"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/blobinfocache"
 	"github.com/containers/image/pkg/compression"
 	"github.com/containers/image/signature"
 	"github.com/containers/image/transports"
 	"github.com/containers/image/types"
 	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	pb "gopkg.in/cheggaaa/pb.v1"
 )
 
 type digestingReader struct {
-	source           io.Reader
-	digester         digest.Digester
-	expectedDigest   digest.Digest
-	validationFailed bool
+	source              io.Reader
+	digester            digest.Digester
+	expectedDigest      digest.Digest
+	validationFailed    bool
+	validationSucceeded bool
 }
 
 // newDigestingReader returns an io.Reader implementation with contents of source, which will eventually return a non-EOF error
 // and set validationFailed to true if the source stream does not match expectedDigest.
+// validationSucceeded is set to true if all of the source stream has been read, and it matches expectedDigest.
 func newDigestingReader(source io.Reader, expectedDigest digest.Digest) (*digestingReader, error) {
 	if err := expectedDigest.Validate(); err != nil {
 		return nil, errors.Errorf("Invalid digest specification %s", expectedDigest)
@@ -64,6 +70,7 @@ func (d *digestingReader) Read(p []byte) (int, error) {
 			d.validationFailed = true
 			return 0, errors.Errorf("Digest did not match, expected %s, got %s", d.expectedDigest, actualDigest)
 		}
+		d.validationSucceeded = true
 	}
 	return n, err
 }
@@ -71,27 +78,55 @@ func (d *digestingReader) Read(p []byte) (int, error) {
 // copier allows us to keep track of diffID values for blobs, and other
 // data shared across one or more images in a possible manifest list.
 type copier struct {
-	cachedDiffIDs    map[digest.Digest]digest.Digest
-	dest             types.ImageDestination
-	rawSource        types.ImageSource
-	reportWriter     io.Writer
-	progressInterval time.Duration
-	progress         chan types.ProgressProperties
+	dest              types.ImageDestination
+	rawSource         types.ImageSource
+	reportWriter      io.Writer
+	reportWriterLock  sync.Mutex    // Serializes writes to reportWriter by concurrent layer copies.
+	progressPool      *progressPool // Renders progress bars while layers are copied in parallel; nil otherwise.
+	progressInterval  time.Duration
+	progress          chan types.ProgressProperties
+	maxParallelCopies uint // Always at least 1; larger only if dest.HasThreadSafePutBlob().
+	blobInfoCache     types.BlobInfoCache
+	compressionFormat compression.Algorithm      // Used when compressing layers
+	recompressLayers  bool                       // Set if compressionFormat was explicitly requested; layers compressed using other algorithms are then recompressed
+	signingMechanism  signature.SigningMechanism // Used to create signatures if not nil; otherwise, signature.NewGPGSigningMechanism() is used
 }
 
 // imageCopier tracks state specific to a single image (possibly an item of a manifest list)
 type imageCopier struct {
-	c                 *copier
-	manifestUpdates   *types.ManifestUpdateOptions
-	src               types.Image
-	diffIDsAreNeeded  bool
-	canModifyManifest bool
+	c                  *copier
+	manifestUpdates    *types.ManifestUpdateOptions
+	src                types.Image
+	diffIDsAreNeeded   bool
+	canModifyManifest  bool
+	canSubstituteBlobs bool
 }
 
+// ImageListSelection is one of CopySystemImage, CopyAllImages, or
+// CopySpecificImages, to control whether, when the source reference is a list,
+// copy.Image() copies only an image which matches the current runtime
+// environment, or all images in the list, or only specific images from the list.
+type ImageListSelection int
+
+const (
+	// CopySystemImage is the default value which, for image lists, instructs
+	// us to copy only the image which matches the current runtime environment.
+	CopySystemImage ImageListSelection = iota
+	// CopyAllImages is a value which, when set in Options.ImageListSelection,
+	// instructs us to copy all of the images in the list, and the list itself.
+	CopyAllImages
+	// CopySpecificImages is a value which, when set in Options.ImageListSelection,
+	// instructs us to copy only the images listed in Options.Instances, and the list itself.
+	CopySpecificImages
+)
+
 // Options allows supplying non-default configuration modifying the behavior of CopyImage.
 type Options struct {
 	RemoveSignatures bool   // Remove any pre-existing signatures. SignBy will still add a new signature.
-	SignBy           string // If non-empty, asks for a signature to be added during the copy, and specifies a key ID, as accepted by signature.NewGPGSigningMechanism().SignDockerManifest(),
+	SignBy           string // If non-empty, asks for a signature to be added during the copy, and specifies a key ID, as accepted by SigningMechanism, or by signature.NewGPGSigningMechanism().SignDockerManifest() if SigningMechanism is nil
+	// If not nil, SigningMechanism is used to create the signature requested by SignBy, instead of the user’s default GPG configuration
+	// (e.g. a mechanism returned by signature.NewEphemeralGPGSigningMechanismWithPrivateKey).  The caller is responsible for closing it.
+	SigningMechanism signature.SigningMechanism
 	ReportWriter     io.Writer
 	SourceCtx        *types.SystemContext
 	DestinationCtx   *types.SystemContext
@@ -99,6 +134,14 @@ type Options struct {
 	Progress         chan types.ProgressProperties // Reported to when ProgressInterval has arrived for a single artifact+offset.
 	// manifest MIME type of image set by user. "" is default and means use the autodetection to the the manifest MIME type
 	ForceManifestMIMEType string
+	// If the source is a manifest list, ImageListSelection determines whether a single image matching the
+	// runtime environment (the default), all images, or only Instances are copied.
+	// If more than a single image is copied, the destination must be able to store the manifest list itself.
+	ImageListSelection ImageListSelection
+	Instances          []digest.Digest // Instance digests to copy if ImageListSelection is CopySpecificImages; ignored otherwise.
+	// Maximum number of layers copied at the same time; 0 and 1 both mean copying layers one at a time.
+	// Layers are only copied in parallel if the destination supports concurrent PutBlob calls.
+	MaxParallelCopies uint
 }
 
 // Image copies image from srcRef to destRef, using policyContext to validate
@@ -140,13 +183,28 @@ func Image(ctx context.Context, policyContext *signature.PolicyContext, destRef,
 		}
 	}()
 
+	maxParallelCopies := options.MaxParallelCopies
+	if maxParallelCopies == 0 || !dest.HasThreadSafePutBlob() {
+		maxParallelCopies = 1
+	}
+
 	c := &copier{
-		cachedDiffIDs:    make(map[digest.Digest]digest.Digest),
-		dest:             dest,
-		rawSource:        rawSource,
-		reportWriter:     reportWriter,
-		progressInterval: options.ProgressInterval,
-		progress:         options.Progress,
+		dest:              dest,
+		rawSource:         rawSource,
+		reportWriter:      reportWriter,
+		progressInterval:  options.ProgressInterval,
+		progress:          options.Progress,
+		maxParallelCopies: maxParallelCopies,
+		// FIXME? The cache is used for sources and destinations equally, but we only have a SourceCtx and DestinationCtx.
+		// For now, use DestinationCtx (because blob reuse changes the behavior of the destination side more); eventually
+		// we might want to add a separate CommonCtx — or would that be too confusing?
+		blobInfoCache:     blobinfocache.DefaultCache(options.DestinationCtx),
+		compressionFormat: compression.Gzip,
+		signingMechanism:  options.SigningMechanism,
+	}
+	if options.DestinationCtx != nil && options.DestinationCtx.CompressionFormat != nil {
+		c.compressionFormat = *options.DestinationCtx.CompressionFormat
+		c.recompressLayers = true
 	}
 
 	unparsedToplevel := image.UnparsedInstance(rawSource, nil)
@@ -157,12 +215,11 @@ func Image(ctx context.Context, policyContext *signature.PolicyContext, destRef,
 
 	if !multiImage {
 		// The simple case: Just copy a single image.
-		if manifest, err = c.copyOneImage(ctx, policyContext, options, unparsedToplevel); err != nil {
+		if manifest, err = c.copyOneImage(ctx, policyContext, options, unparsedToplevel, nil); err != nil {
 			return nil, err
 		}
-	} else {
-		// This is a manifest list. Choose a single image and copy it.
-		// FIXME: Copy to destinations which support manifest lists, one image at a time.
+	} else if options.ImageListSelection == CopySystemImage {
+		// This is a manifest list, and we weren't asked to copy multiple images. Choose a single image and copy it.
 		instanceDigest, err := image.ChooseManifestInstanceFromManifestList(ctx, options.SourceCtx, unparsedToplevel)
 		if err != nil {
 			return nil, errors.Wrapf(err, "Error choosing an image from manifest list %s", transports.ImageName(srcRef))
@@ -170,7 +227,12 @@ func Image(ctx context.Context, policyContext *signature.PolicyContext, destRef,
 		logrus.Debugf("Source is a manifest list; copying (only) instance %s", instanceDigest)
 		unparsedInstance := image.UnparsedInstance(rawSource, &instanceDigest)
 
-		if manifest, err = c.copyOneImage(ctx, policyContext, options, unparsedInstance); err != nil {
+		if manifest, err = c.copyOneImage(ctx, policyContext, options, unparsedInstance, nil); err != nil {
+			return nil, err
+		}
+	} else {
+		// This is a manifest list, and we were asked to copy multiple images. Copy them, and the list itself.
+		if manifest, err = c.copyMultipleImages(ctx, policyContext, options, unparsedToplevel); err != nil {
 			return nil, err
 		}
 	}
@@ -182,9 +244,12 @@ func Image(ctx context.Context, policyContext *signature.PolicyContext, destRef,
 	return manifest, nil
 }
 
-// Image copies a single (on-manifest-list) image unparsedImage, using policyContext to validate
+// copyOneImage copies a single (non-manifest-list) image unparsedImage, using policyContext to validate
 // source image admissibility.
-func (c *copier) copyOneImage(ctx context.Context, policyContext *signature.PolicyContext, options *Options, unparsedImage *image.UnparsedImage) (manifest []byte, retErr error) {
+// If targetInstance is not nil, the image is an instance of a manifest list being copied as a whole, and it is stored
+// at the destination as a list instance identified by the digest of the (possibly updated) manifest; in that case,
+// targetInstance contains the digest of the instance in the source list.
+func (c *copier) copyOneImage(ctx context.Context, policyContext *signature.PolicyContext, options *Options, unparsedImage *image.UnparsedImage, targetInstance *digest.Digest) (copiedManifest []byte, retErr error) {
 	// The caller is handling manifest lists; this could happen only if a manifest list contains a manifest list.
 	// Make sure we fail cleanly in such cases.
 	multiImage, err := isMultiImage(ctx, unparsedImage)
@@ -243,13 +308,26 @@ func (c *copier) copyOneImage(ctx context.Context, policyContext *signature.Poli
 
 	// We compute preferredManifestMIMEType only to show it in error messages.
 	// Without having to add this context in an error message, we would be happy enough to know only that no conversion is needed.
-	preferredManifestMIMEType, otherManifestMIMETypeCandidates, err := ic.determineManifestConversion(ctx, c.dest.SupportedManifestMIMETypes(), options.ForceManifestMIMEType)
+	// Only OCI manifests can describe zstd-compressed layers; if such layers may be created, use OCI if the destination supports it.
+	forceManifestMIMEType := options.ForceManifestMIMEType
+	zstdLayers := ic.canModifyManifest && c.compressionFormat.Name() == compression.Zstd.Name() && c.dest.DesiredLayerCompression() == types.Compress
+	if zstdLayers && forceManifestMIMEType == "" && destSupportsManifestMIMEType(c.dest.SupportedManifestMIMETypes(), imgspecv1.MediaTypeImageManifest) {
+		forceManifestMIMEType = imgspecv1.MediaTypeImageManifest
+	}
+	preferredManifestMIMEType, otherManifestMIMETypeCandidates, err := ic.determineManifestConversion(ctx, c.dest.SupportedManifestMIMETypes(), forceManifestMIMEType)
 	if err != nil {
 		return nil, err
 	}
+	// Fail early instead of after uploading all layers.
+	if zstdLayers && preferredManifestMIMEType != imgspecv1.MediaTypeImageManifest {
+		return nil, errors.Errorf("zstd layer compression requires an OCI manifest, but %s would be used; use a destination which supports OCI manifests, or force the OCI manifest type", preferredManifestMIMEType)
+	}
 
 	// If src.UpdatedImageNeedsLayerDiffIDs(ic.manifestUpdates) will be true, it needs to be true by the time we get here.
 	ic.diffIDsAreNeeded = src.UpdatedImageNeedsLayerDiffIDs(*ic.manifestUpdates)
+	// Substituting a blob changes the layer digests in the manifest; only do that if we are not also converting
+	// the manifest, so that the conversion works with the layers it expects.
+	ic.canSubstituteBlobs = ic.canModifyManifest && ic.manifestUpdates.ManifestMIMEType == ""
 
 	if err := ic.copyLayers(ctx); err != nil {
 		return nil, err
@@ -259,7 +337,7 @@ func (c *copier) copyOneImage(ctx context.Context, policyContext *signature.Poli
 	// and at least with the OpenShift registry "acceptschema2" option, there is no way to detect the support
 	// without actually trying to upload something and getting a types.ManifestTypeRejectedError.
 	// So, try the preferred manifest MIME type. If the process succeeds, fine…
-	manifest, err = ic.copyUpdatedConfigAndManifest(ctx)
+	copiedManifest, manifestDigest, err := ic.copyUpdatedConfigAndManifest(ctx, targetInstance)
 	if err != nil {
 		logrus.Debugf("Writing manifest using preferred type %s failed: %v", preferredManifestMIMEType, err)
 		// … if it fails, _and_ the failure is because the manifest is rejected, we may have other options.
@@ -282,7 +360,7 @@ func (c *copier) copyOneImage(ctx context.Context, policyContext *signature.Poli
 		for _, manifestMIMEType := range otherManifestMIMETypeCandidates {
 			logrus.Debugf("Trying to use manifest type %s…", manifestMIMEType)
 			ic.manifestUpdates.ManifestMIMEType = manifestMIMEType
-			attemptedManifest, err := ic.copyUpdatedConfigAndManifest(ctx)
+			attemptedManifest, attemptedManifestDigest, err := ic.copyUpdatedConfigAndManifest(ctx, targetInstance)
 			if err != nil {
 				logrus.Debugf("Upload of manifest type %s failed: %v", manifestMIMEType, err)
 				errs = append(errs, fmt.Sprintf("%s(%v)", manifestMIMEType, err))
@@ -290,7 +368,8 @@ func (c *copier) copyOneImage(ctx context.Context, policyContext *signature.Poli
 			}
 
 			// We have successfully uploaded a manifest.
-			manifest = attemptedManifest
+			copiedManifest = attemptedManifest
+			manifestDigest = attemptedManifestDigest
 			errs = nil // Mark this as a success so that we don't abort below.
 			break
 		}
@@ -300,19 +379,23 @@ func (c *copier) copyOneImage(ctx context.Context, policyContext *signature.Poli
 	}
 
 	if options.SignBy != "" {
-		newSig, err := c.createSignature(manifest, options.SignBy)
+		newSig, err := c.createSignature(copiedManifest, options.SignBy)
 		if err != nil {
 			return nil, err
 		}
 		sigs = append(sigs, newSig)
 	}
 
+	var instanceDigest *digest.Digest
+	if targetInstance != nil {
+		instanceDigest = &manifestDigest
+	}
 	c.Printf("Storing signatures\n")
-	if err := c.dest.PutSignatures(ctx, sigs); err != nil {
+	if err := c.dest.PutSignatures(ctx, sigs, instanceDigest); err != nil {
 		return nil, errors.Wrap(err, "Error writing signatures")
 	}
 
-	return manifest, nil
+	return copiedManifest, nil
 }
 
 // Printf writes a formatted string to c.reportWriter.
@@ -321,15 +404,18 @@ func (c *copier) copyOneImage(ctx context.Context, policyContext *signature.Poli
 // which have their format strings checked; for other names we would have
 // to pass a parameter to every (go tool vet) invocation.
 func (c *copier) Printf(format string, a ...interface{}) {
+	c.reportWriterLock.Lock()
+	defer c.reportWriterLock.Unlock()
+	if c.progressPool != nil {
+		c.progressPool.printf(format, a...)
+		return
+	}
 	fmt.Fprintf(c.reportWriter, format, a...)
 }
 
 func checkImageDestinationForCurrentRuntimeOS(ctx context.Context, sys *types.SystemContext, src types.Image, dest types.ImageDestination) error {
 	if dest.MustMatchRuntimeOS() {
-		wantedOS := runtime.GOOS
-		if sys != nil && sys.OSChoice != "" {
-			wantedOS = sys.OSChoice
-		}
+		wantedOS := platform.WantedPlatform(sys).OS
 		c, err := src.OCIConfig(ctx)
 		if err != nil {
 			return errors.Wrapf(err, "Error parsing image configuration")
@@ -368,8 +454,6 @@ func (ic *imageCopier) updateEmbeddedDockerReference() error {
 // copyLayers copies layers from ic.src/ic.c.rawSource to dest, using and updating ic.manifestUpdates if necessary and ic.canModifyManifest.
 func (ic *imageCopier) copyLayers(ctx context.Context) error {
 	srcInfos := ic.src.LayerInfos()
-	destInfos := []types.BlobInfo{}
-	diffIDs := []digest.Digest{}
 	updatedSrcInfos, err := ic.src.LayerInfosForCopy(ctx)
 	if err != nil {
 		return err
@@ -382,29 +466,67 @@ func (ic *imageCopier) copyLayers(ctx context.Context) error {
 		srcInfos = updatedSrcInfos
 		srcInfosUpdated = true
 	}
-	for _, srcLayer := range srcInfos {
-		var (
-			destInfo types.BlobInfo
-			diffID   digest.Digest
-			err      error
-		)
+	destInfos := make([]types.BlobInfo, len(srcInfos))
+	diffIDs := make([]digest.Digest, len(srcInfos))
+	if ic.c.maxParallelCopies > 1 {
+		logrus.Debugf("Copying up to %d layers in parallel", ic.c.maxParallelCopies)
+		// Progress bars of concurrent copies would overwrite each other if printed independently.
+		ic.c.progressPool = newProgressPool(ic.c)
+		defer func() {
+			ic.c.progressPool.finish()
+			ic.c.progressPool = nil
+		}()
+	}
+
+	// A failure to copy any layer cancels copies of all other layers, and only the first failure is reported.
+	copyCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var copyErr error
+	copyErrOnce := sync.Once{}
+	copySemaphore := make(chan struct{}, ic.c.maxParallelCopies)
+	wg := sync.WaitGroup{}
+	copyOneLayer := func(index int, srcLayer types.BlobInfo) {
+		defer wg.Done()
+		defer func() { <-copySemaphore }()
+		var err error
 		if ic.c.dest.AcceptsForeignLayerURLs() && len(srcLayer.URLs) != 0 {
 			// DiffIDs are, currently, needed only when converting from schema1.
 			// In which case src.LayerInfos will not have URLs because schema1
 			// does not support them.
 			if ic.diffIDsAreNeeded {
-				return errors.New("getting DiffID for foreign layers is unimplemented")
+				err = errors.New("getting DiffID for foreign layers is unimplemented")
+			} else {
+				destInfos[index] = srcLayer
+				ic.c.Printf("Skipping foreign layer %q copy to %s\n", srcLayer.Digest, ic.c.dest.Reference().Transport().Name())
 			}
-			destInfo = srcLayer
-			ic.c.Printf("Skipping foreign layer %q copy to %s\n", destInfo.Digest, ic.c.dest.Reference().Transport().Name())
 		} else {
-			destInfo, diffID, err = ic.copyLayer(ctx, srcLayer)
-			if err != nil {
-				return err
-			}
+			// Each goroutine writes only its own elements of destInfos and diffIDs.
+			destInfos[index], diffIDs[index], err = ic.copyLayer(copyCtx, srcLayer)
+		}
+		if err != nil {
+			copyErrOnce.Do(func() {
+				copyErr = err
+				cancel()
+			})
 		}
-		destInfos = append(destInfos, destInfo)
-		diffIDs = append(diffIDs, diffID)
+	}
+
+	for i, srcLayer := range srcInfos {
+		// Acquire the semaphore here, not in copyOneLayer, so that layer copies are started in order.
+		copySemaphore <- struct{}{}
+		if copyCtx.Err() != nil { // A copy has failed, or ctx was canceled; do not start any more copies.
+			<-copySemaphore
+			break
+		}
+		wg.Add(1)
+		go copyOneLayer(i, srcLayer)
+	}
+	wg.Wait()
+	if copyErr != nil {
+		return copyErr
+	}
+	if err := ctx.Err(); err != nil { // ctx was canceled by our caller before all copies were started.
+		return err
 	}
 	ic.manifestUpdates.InformationOnly.LayerInfos = destInfos
 	if ic.diffIDsAreNeeded {
@@ -430,12 +552,13 @@ func layerDigestsDiffer(a, b []types.BlobInfo) bool {
 }
 
 // copyUpdatedConfigAndManifest updates the image per ic.manifestUpdates, if necessary,
-// stores the resulting config and manifest to the destination, and returns the stored manifest.
-func (ic *imageCopier) copyUpdatedConfigAndManifest(ctx context.Context) ([]byte, error) {
+// stores the resulting config and manifest to the destination, and returns the stored manifest and its digest.
+// If targetInstance is not nil, the manifest is stored as an instance of a manifest list, identified by its own digest.
+func (ic *imageCopier) copyUpdatedConfigAndManifest(ctx context.Context, targetInstance *digest.Digest) ([]byte, digest.Digest, error) {
 	pendingImage := ic.src
 	if !reflect.DeepEqual(*ic.manifestUpdates, types.ManifestUpdateOptions{InformationOnly: ic.manifestUpdates.InformationOnly}) {
 		if !ic.canModifyManifest {
-			return nil, errors.Errorf("Internal error: copy needs an updated manifest but that was known to be forbidden")
+			return nil, "", errors.Errorf("Internal error: copy needs an updated manifest but that was known to be forbidden")
 		}
 		if !ic.diffIDsAreNeeded && ic.src.UpdatedImageNeedsLayerDiffIDs(*ic.manifestUpdates) {
 			// We have set ic.diffIDsAreNeeded based on the preferred MIME type returned by determineManifestConversion.
@@ -444,28 +567,36 @@ func (ic *imageCopier) copyUpdatedConfigAndManifest(ctx context.Context) ([]byte
 			// when ic.c.dest.SupportedManifestMIMETypes() includes both s1 and s2, the upload using s1 failed, and we are now trying s2.
 			// Supposedly s2-only registries do not exist or are extremely rare, so failing with this error message is good enough for now.
 			// If handling such registries turns out to be necessary, we could compute ic.diffIDsAreNeeded based on the full list of manifest MIME type candidates.
-			return nil, errors.Errorf("Can not convert image to %s, preparing DiffIDs for this case is not supported", ic.manifestUpdates.ManifestMIMEType)
+			return nil, "", errors.Errorf("Can not convert image to %s, preparing DiffIDs for this case is not supported", ic.manifestUpdates.ManifestMIMEType)
 		}
 		pi, err := ic.src.UpdatedImage(ctx, *ic.manifestUpdates)
 		if err != nil {
-			return nil, errors.Wrap(err, "Error creating an updated image manifest")
+			return nil, "", errors.Wrap(err, "Error creating an updated image manifest")
 		}
 		pendingImage = pi
 	}
-	manifest, _, err := pendingImage.Manifest(ctx)
+	man, _, err := pendingImage.Manifest(ctx)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Error reading manifest")
+	}
+	manifestDigest, err := manifest.Digest(man)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error reading manifest")
+		return nil, "", errors.Wrap(err, "Error computing manifest digest")
 	}
 
 	if err := ic.c.copyConfig(ctx, pendingImage); err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
+	var instanceDigest *digest.Digest
+	if targetInstance != nil {
+		instanceDigest = &manifestDigest
+	}
 	ic.c.Printf("Writing manifest to image destination\n")
-	if err := ic.c.dest.PutManifest(ctx, manifest); err != nil {
-		return nil, errors.Wrap(err, "Error writing manifest")
+	if err := ic.c.dest.PutManifest(ctx, man, instanceDigest); err != nil {
+		return nil, "", errors.Wrap(err, "Error writing manifest")
 	}
-	return manifest, nil
+	return man, manifestDigest, nil
 }
 
 // copyConfig copies config.json, if any, from src to dest.
@@ -498,32 +629,55 @@ type diffIDResult struct {
 // copyLayer copies a layer with srcInfo (with known Digest and possibly known Size) in src to dest, perhaps compressing it if canCompress,
 // and returns a complete blobInfo of the copied layer, and a value for LayerDiffIDs if diffIDIsNeeded
 func (ic *imageCopier) copyLayer(ctx context.Context, srcInfo types.BlobInfo) (types.BlobInfo, digest.Digest, error) {
-	// Check if we already have a blob with this digest
-	haveBlob, extantBlobSize, err := ic.c.dest.HasBlob(ctx, srcInfo)
-	if err != nil {
-		return types.BlobInfo{}, "", errors.Wrapf(err, "Error checking for blob %s at destination", srcInfo.Digest)
-	}
+	cachedDiffID := ic.c.blobInfoCache.UncompressedDigest(srcInfo.Digest) // May be ""
 	// If we already have a cached diffID for this blob, we don't need to compute it
-	diffIDIsNeeded := ic.diffIDsAreNeeded && (ic.c.cachedDiffIDs[srcInfo.Digest] == "")
-	// If we already have the blob, and we don't need to recompute the diffID, then we might be able to avoid reading it again
-	if haveBlob && !diffIDIsNeeded {
-		// Check the blob sizes match, if we were given a size this time
-		if srcInfo.Size != -1 && srcInfo.Size != extantBlobSize {
-			return types.BlobInfo{}, "", errors.Errorf("Error: blob %s is already present, but with size %d instead of %d", srcInfo.Digest, extantBlobSize, srcInfo.Size)
-		}
-		srcInfo.Size = extantBlobSize
-		// Tell the image destination that this blob's delta is being applied again.  For some image destinations, this can be faster than using GetBlob/PutBlob
-		blobinfo, err := ic.c.dest.ReapplyBlob(ctx, srcInfo)
+	diffIDIsNeeded := ic.diffIDsAreNeeded && cachedDiffID == ""
+
+	// If we don't need to compute the diffID, then we might be able to avoid reading the blob at all,
+	// if the destination already has it, or an equivalent of it.
+	// If a specific compression was requested, only blobs known to use it can be reused; copying would recompress the others.
+	srcCompressorName := internalblobinfocache.DigestCompressorName(ic.c.blobInfoCache, srcInfo.Digest)
+	requiredCompressorName := internalblobinfocache.UnknownCompression
+	if ic.canModifyManifest && ic.c.recompressLayers && ic.c.dest.DesiredLayerCompression() == types.Compress {
+		requiredCompressorName = ic.c.compressionFormat.Name()
+	}
+	if !diffIDIsNeeded && (requiredCompressorName == internalblobinfocache.UnknownCompression || srcCompressorName == requiredCompressorName) {
+		// Substitutes are only acceptable if we know their compression, so that the manifest can use the correct MIME type;
+		// all manifest formats can describe uncompressed and gzip-compressed layers, other algorithms only if the original uses them as well.
+		cache := substituteFilteringCache{
+			BlobInfoCache: ic.c.blobInfoCache,
+			accept: func(substitute digest.Digest) bool {
+				name := internalblobinfocache.DigestCompressorName(ic.c.blobInfoCache, substitute)
+				if requiredCompressorName != internalblobinfocache.UnknownCompression {
+					return name == requiredCompressorName
+				}
+				return name == internalblobinfocache.Uncompressed || name == compression.Gzip.Name() ||
+					(name != internalblobinfocache.UnknownCompression && name == srcCompressorName)
+			},
+		}
+		reused, blobInfo, err := ic.c.dest.TryReusingBlob(ctx, srcInfo, cache, ic.canSubstituteBlobs)
 		if err != nil {
-			return types.BlobInfo{}, "", errors.Wrapf(err, "Error reapplying blob %s at destination", srcInfo.Digest)
+			return types.BlobInfo{}, "", errors.Wrapf(err, "Error trying to reuse blob %s at destination", srcInfo.Digest)
+		}
+		if reused {
+			// Check the blob sizes match, if we were given a size this time
+			if blobInfo.Digest == srcInfo.Digest && srcInfo.Size != -1 && srcInfo.Size != blobInfo.Size {
+				return types.BlobInfo{}, "", errors.Errorf("Error: blob %s is already present, but with size %d instead of %d", srcInfo.Digest, blobInfo.Size, srcInfo.Size)
+			}
+			if blobInfo.Digest != srcInfo.Digest {
+				logrus.Debugf("Reusing blob %s as a substitute for %s", blobInfo.Digest, srcInfo.Digest)
+				if err := ic.c.setSubstituteCompression(&blobInfo); err != nil {
+					return types.BlobInfo{}, "", err
+				}
+			}
+			ic.c.Printf("Skipping fetch of repeat blob %s\n", srcInfo.Digest)
+			return blobInfo, cachedDiffID, nil
 		}
-		ic.c.Printf("Skipping fetch of repeat blob %s\n", srcInfo.Digest)
-		return blobinfo, ic.c.cachedDiffIDs[srcInfo.Digest], err
 	}
 
 	// Fallback: copy the layer, computing the diffID if we need to do so
 	ic.c.Printf("Copying blob %s\n", srcInfo.Digest)
-	srcStream, srcBlobSize, err := ic.c.rawSource.GetBlob(ctx, srcInfo)
+	srcStream, srcBlobSize, err := ic.c.rawSource.GetBlob(ctx, srcInfo, ic.c.blobInfoCache)
 	if err != nil {
 		return types.BlobInfo{}, "", errors.Wrapf(err, "Error reading blob %s", srcInfo.Digest)
 	}
@@ -543,12 +697,55 @@ func (ic *imageCopier) copyLayer(ctx context.Context, srcInfo types.BlobInfo) (t
 				return types.BlobInfo{}, "", errors.Wrap(diffIDResult.err, "Error computing layer DiffID")
 			}
 			logrus.Debugf("Computed DiffID %s for layer %s", diffIDResult.digest, srcInfo.Digest)
-			ic.c.cachedDiffIDs[srcInfo.Digest] = diffIDResult.digest
+			// This is safe because computeDiffID has read the blob from copyBlobFromStream, which verified srcInfo.Digest.
+			ic.c.blobInfoCache.RecordDigestUncompressedPair(srcInfo.Digest, diffIDResult.digest)
 			return blobInfo, diffIDResult.digest, nil
 		}
 	} else {
-		return blobInfo, ic.c.cachedDiffIDs[srcInfo.Digest], nil
+		return blobInfo, cachedDiffID, nil
+	}
+}
+
+// substituteFilteringCache is a types.BlobInfoCache which only returns replacement candidates
+// with the primary digest, or with a digest accepted by accept.
+type substituteFilteringCache struct {
+	types.BlobInfoCache
+	accept func(substitute digest.Digest) bool
+}
+
+// CandidateLocations implements types.BlobInfoCache.CandidateLocations.
+func (c substituteFilteringCache) CandidateLocations(transport types.ImageTransport, scope types.BICTransportScope, primaryDigest digest.Digest, canSubstitute bool) []types.BICReplacementCandidate {
+	res := []types.BICReplacementCandidate{}
+	for _, candidate := range c.BlobInfoCache.CandidateLocations(transport, scope, primaryDigest, canSubstitute) {
+		if candidate.Digest == primaryDigest || c.accept(candidate.Digest) {
+			res = append(res, candidate)
+		}
+	}
+	return res
+}
+
+// setSubstituteCompression updates blobInfo, describing a blob reused as a substitute for a layer, so that the manifest
+// uses a MIME type matching the compression of the substitute.
+func (c *copier) setSubstituteCompression(blobInfo *types.BlobInfo) error {
+	name := internalblobinfocache.DigestCompressorName(c.blobInfoCache, blobInfo.Digest)
+	if name == internalblobinfocache.UnknownCompression && c.blobInfoCache.UncompressedDigest(blobInfo.Digest) == blobInfo.Digest {
+		name = internalblobinfocache.Uncompressed
+	}
+	switch name {
+	case internalblobinfocache.UnknownCompression:
+		// The destination has found the substitute without using the cache; assume it is compressed like the original layer.
+		logrus.Debugf("Compression of blob %s is not known, using the MIME type of the original layer", blobInfo.Digest)
+	case internalblobinfocache.Uncompressed:
+		blobInfo.CompressionOperation = types.Decompress
+	default:
+		algorithm, err := compression.AlgorithmByName(name)
+		if err != nil {
+			return errors.Wrapf(err, "Error determining compression of blob %s", blobInfo.Digest)
+		}
+		blobInfo.CompressionOperation = types.Compress
+		blobInfo.CompressionAlgorithm = &algorithm
 	}
+	return nil
 }
 
 // copyLayerFromStream is an implementation detail of copyLayer; mostly providing a separate “defer” scope.
@@ -635,7 +832,7 @@ func (c *copier) copyBlobFromStream(ctx context.Context, srcStream io.Reader, sr
 
 	// === Detect compression of the input stream.
 	// This requires us to “peek ahead” into the stream to read the initial part, which requires us to chain through another io.Reader returned by DetectCompression.
-	decompressor, destStream, err := compression.DetectCompression(destStream) // We could skip this in some cases, but let's keep the code path uniform
+	srcCompressionFormat, decompressor, destStream, err := compression.DetectCompressionFormat(destStream) // We could skip this in some cases, but let's keep the code path uniform
 	if err != nil {
 		return types.BlobInfo{}, errors.Wrapf(err, "Error reading blob %s", srcInfo.Digest)
 	}
@@ -647,7 +844,12 @@ func (c *copier) copyBlobFromStream(ctx context.Context, srcStream io.Reader, sr
 	bar.SetMaxWidth(80)
 	bar.ShowTimeLeft = false
 	bar.ShowPercent = false
-	bar.Start()
+	if c.progressPool != nil {
+		bar.Prefix(srcInfo.Digest.Hex()[:12])
+		c.progressPool.startBar(bar)
+	} else {
+		bar.Start()
+	}
 	destStream = bar.NewProxyReader(destStream)
 	defer bar.Finish()
 
@@ -660,20 +862,39 @@ func (c *copier) copyBlobFromStream(ctx context.Context, srcStream io.Reader, sr
 
 	// === Deal with layer compression/decompression if necessary
 	var inputInfo types.BlobInfo
+	compressionOperation := types.PreserveOriginal
 	if canModifyBlob && c.dest.DesiredLayerCompression() == types.Compress && !isCompressed {
-		logrus.Debugf("Compressing blob on the fly")
+		logrus.Debugf("Compressing blob on the fly using %s", c.compressionFormat.Name())
+		compressionOperation = types.Compress
 		pipeReader, pipeWriter := io.Pipe()
 		defer pipeReader.Close()
 
 		// If this fails while writing data, it will do pipeWriter.CloseWithError(); if it fails otherwise,
 		// e.g. because we have exited and due to pipeReader.Close() above further writing to the pipe has failed,
 		// we don’t care.
-		go compressGoroutine(pipeWriter, destStream) // Closes pipeWriter
+		go compressGoroutine(pipeWriter, destStream, c.compressionFormat) // Closes pipeWriter
+		destStream = pipeReader
+		inputInfo.Digest = ""
+		inputInfo.Size = -1
+	} else if canModifyBlob && c.dest.DesiredLayerCompression() == types.Compress && isCompressed &&
+		c.recompressLayers && srcCompressionFormat.Name() != c.compressionFormat.Name() {
+		logrus.Debugf("Blob will be recompressed from %s to %s", srcCompressionFormat.Name(), c.compressionFormat.Name())
+		compressionOperation = types.Compress
+		s, err := decompressor(destStream)
+		if err != nil {
+			return types.BlobInfo{}, err
+		}
+		defer s.Close()
+		pipeReader, pipeWriter := io.Pipe()
+		defer pipeReader.Close()
+
+		go compressGoroutine(pipeWriter, s, c.compressionFormat) // Closes pipeWriter
 		destStream = pipeReader
 		inputInfo.Digest = ""
 		inputInfo.Size = -1
 	} else if canModifyBlob && c.dest.DesiredLayerCompression() == types.Decompress && isCompressed {
 		logrus.Debugf("Blob will be decompressed")
+		compressionOperation = types.Decompress
 		s, err := decompressor(destStream)
 		if err != nil {
 			return types.BlobInfo{}, err
@@ -699,7 +920,7 @@ func (c *copier) copyBlobFromStream(ctx context.Context, srcStream io.Reader, sr
 	}
 
 	// === Finally, send the layer stream to dest.
-	uploadedInfo, err := c.dest.PutBlob(ctx, destStream, inputInfo, isConfig)
+	uploadedInfo, err := c.dest.PutBlob(ctx, destStream, inputInfo, c.blobInfoCache, isConfig)
 	if err != nil {
 		return types.BlobInfo{}, errors.Wrap(err, "Error writing blob")
 	}
@@ -722,17 +943,58 @@ func (c *copier) copyBlobFromStream(ctx context.Context, srcStream io.Reader, sr
 	if inputInfo.Digest != "" && uploadedInfo.Digest != inputInfo.Digest {
 		return types.BlobInfo{}, errors.Errorf("Internal error writing blob %s, blob with digest %s saved with digest %s", srcInfo.Digest, inputInfo.Digest, uploadedInfo.Digest)
 	}
+	// Record the relationship between the source and the uploaded blob, so that later copies can reuse either of them.
+	// This is safe because compressing or decompressing the stream consumed all of it, so digestingReader has verified srcInfo.Digest,
+	// and the destination has computed uploadedInfo.Digest itself.
+	switch compressionOperation {
+	case types.Compress:
+		if isCompressed { // Recompressed; srcInfo.Digest is not the uncompressed digest.
+			if uncompressedDigest := c.blobInfoCache.UncompressedDigest(srcInfo.Digest); uncompressedDigest != "" {
+				c.blobInfoCache.RecordDigestUncompressedPair(uploadedInfo.Digest, uncompressedDigest)
+			}
+		} else {
+			c.blobInfoCache.RecordDigestUncompressedPair(uploadedInfo.Digest, srcInfo.Digest)
+		}
+	case types.Decompress:
+		c.blobInfoCache.RecordDigestUncompressedPair(srcInfo.Digest, uploadedInfo.Digest)
+	}
+	// Record the compression of the blobs, so that they can be reused as substitutes with the correct MIME type.
+	// As above, this is safe for the uploaded blob only if we have created it ourselves, and for the source blob if digestingReader
+	// has verified all of it.
+	if !isConfig {
+		if digestingReader.validationSucceeded {
+			srcCompressorName := internalblobinfocache.Uncompressed
+			if isCompressed {
+				srcCompressorName = srcCompressionFormat.Name()
+			}
+			internalblobinfocache.RecordDigestCompressorName(c.blobInfoCache, srcInfo.Digest, srcCompressorName)
+		}
+		switch compressionOperation {
+		case types.Compress:
+			internalblobinfocache.RecordDigestCompressorName(c.blobInfoCache, uploadedInfo.Digest, c.compressionFormat.Name())
+		case types.Decompress:
+			internalblobinfocache.RecordDigestCompressorName(c.blobInfoCache, uploadedInfo.Digest, internalblobinfocache.Uncompressed)
+		}
+	}
+	// Let the manifest update use the correct MIME type for the modified layer.
+	uploadedInfo.CompressionOperation = compressionOperation
+	if compressionOperation == types.Compress {
+		uploadedInfo.CompressionAlgorithm = &c.compressionFormat
+	}
 	return uploadedInfo, nil
 }
 
-// compressGoroutine reads all input from src and writes its compressed equivalent to dest.
-func compressGoroutine(dest *io.PipeWriter, src io.Reader) {
+// compressGoroutine reads all input from src and writes its compressed equivalent, using algo, to dest.
+func compressGoroutine(dest *io.PipeWriter, src io.Reader, algo compression.Algorithm) {
 	err := errors.New("Internal error: unexpected panic in compressGoroutine")
 	defer func() { // Note that this is not the same as {defer dest.CloseWithError(err)}; we need err to be evaluated lazily.
 		dest.CloseWithError(err) // CloseWithError(nil) is equivalent to Close()
 	}()
 
-	zipper := gzip.NewWriter(dest)
+	zipper, err := compression.CompressStream(dest, algo)
+	if err != nil {
+		return
+	}
 	defer zipper.Close()
 
 	_, err = io.Copy(zipper, src) // Sets err to nil, i.e. causes dest.Close()
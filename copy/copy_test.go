@@ -2,14 +2,22 @@ package copy
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/pkg/errors"
 
+	internalblobinfocache "github.com/containers/image/internal/blobinfocache"
+	"github.com/containers/image/pkg/blobinfocache"
 	"github.com/containers/image/pkg/compression"
+	"github.com/containers/image/types"
 	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -122,3 +130,350 @@ func TestComputeDiffID(t *testing.T) {
 	_, err = computeDiffID(reader, nil)
 	assert.Error(t, err)
 }
+
+func TestCompressGoroutine(t *testing.T) {
+	input := bytes.Repeat([]byte("Hello"), 1000)
+	for _, algo := range []compression.Algorithm{compression.Gzip, compression.Zstd} {
+		reader, writer := io.Pipe()
+		go compressGoroutine(writer, bytes.NewReader(input), algo)
+		detected, decompressor, stream, err := compression.DetectCompressionFormat(reader)
+		require.NoError(t, err, algo.Name())
+		require.NotNil(t, decompressor, algo.Name())
+		assert.Equal(t, algo.Name(), detected.Name())
+		s, err := decompressor(stream)
+		require.NoError(t, err, algo.Name())
+		output := bytes.Buffer{}
+		_, err = io.Copy(&output, s)
+		s.Close()
+		require.NoError(t, err, algo.Name())
+		assert.Equal(t, input, output.Bytes(), algo.Name())
+		reader.Close()
+	}
+
+	// Compression not supported
+	reader, writer := io.Pipe()
+	go compressGoroutine(writer, bytes.NewReader(input), compression.Bzip2)
+	_, err := io.Copy(&bytes.Buffer{}, reader)
+	assert.Error(t, err)
+}
+
+// parallelTestImage is a types.Image with the specified layers; other methods are not implemented.
+type parallelTestImage struct {
+	types.Image
+	layers []types.BlobInfo
+}
+
+func (i parallelTestImage) LayerInfos() []types.BlobInfo {
+	return i.layers
+}
+
+func (i parallelTestImage) LayerInfosForCopy(ctx context.Context) ([]types.BlobInfo, error) {
+	return nil, nil
+}
+
+// parallelTestSource is a types.ImageSource returning blobs from a map; other methods are not implemented.
+type parallelTestSource struct {
+	types.ImageSource
+	blobs map[digest.Digest][]byte
+}
+
+func (s parallelTestSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	blob, ok := s.blobs[info.Digest]
+	if !ok {
+		return nil, -1, errors.Errorf("Unknown blob %s", info.Digest)
+	}
+	return ioutil.NopCloser(bytes.NewReader(blob)), int64(len(blob)), nil
+}
+
+// parallelTestDestination is a thread-safe types.ImageDestination which records the number of concurrent PutBlob calls;
+// other methods are not implemented.
+type parallelTestDestination struct {
+	types.ImageDestination
+	delays   map[digest.Digest]time.Duration // PutBlob waits this long before reading the blob
+	failures map[digest.Digest]error         // PutBlob fails with this error after the delay
+	blocking map[digest.Digest]bool          // PutBlob waits until ctx is canceled
+
+	mutex       sync.Mutex
+	active      int
+	maxActive   int
+	started     []digest.Digest
+	interrupted []digest.Digest
+}
+
+func (d *parallelTestDestination) HasThreadSafePutBlob() bool {
+	return true
+}
+
+func (d *parallelTestDestination) AcceptsForeignLayerURLs() bool {
+	return false
+}
+
+func (d *parallelTestDestination) DesiredLayerCompression() types.LayerCompression {
+	return types.PreserveOriginal
+}
+
+func (d *parallelTestDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	return false, types.BlobInfo{}, nil
+}
+
+func (d *parallelTestDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	d.mutex.Lock()
+	d.active++
+	if d.active > d.maxActive {
+		d.maxActive = d.active
+	}
+	d.started = append(d.started, inputInfo.Digest)
+	d.mutex.Unlock()
+	defer func() {
+		d.mutex.Lock()
+		d.active--
+		d.mutex.Unlock()
+	}()
+
+	if d.blocking[inputInfo.Digest] {
+		<-ctx.Done()
+		d.mutex.Lock()
+		d.interrupted = append(d.interrupted, inputInfo.Digest)
+		d.mutex.Unlock()
+		return types.BlobInfo{}, ctx.Err()
+	}
+	select {
+	case <-time.After(d.delays[inputInfo.Digest]):
+	case <-ctx.Done():
+		return types.BlobInfo{}, ctx.Err()
+	}
+	if err := d.failures[inputInfo.Digest]; err != nil {
+		return types.BlobInfo{}, err
+	}
+	size, err := io.Copy(ioutil.Discard, stream)
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	return types.BlobInfo{Digest: inputInfo.Digest, Size: size}, nil
+}
+
+// newParallelTestCopier returns an imageCopier copying count layers from a parallelTestSource to dest, using up to maxParallelCopies,
+// and the layers of the source image.
+func newParallelTestCopier(dest *parallelTestDestination, count int, maxParallelCopies uint, reportWriter io.Writer) (*imageCopier, []types.BlobInfo) {
+	blobs := map[digest.Digest][]byte{}
+	layers := []types.BlobInfo{}
+	for i := 0; i < count; i++ {
+		blob := []byte(fmt.Sprintf("layer %d", i))
+		d := digest.FromBytes(blob)
+		blobs[d] = blob
+		layers = append(layers, types.BlobInfo{Digest: d, Size: int64(len(blob))})
+	}
+	return &imageCopier{
+		c: &copier{
+			dest:              dest,
+			rawSource:         parallelTestSource{blobs: blobs},
+			reportWriter:      reportWriter,
+			maxParallelCopies: maxParallelCopies,
+			blobInfoCache:     blobinfocache.NoCache,
+			compressionFormat: compression.Gzip,
+		},
+		manifestUpdates: &types.ManifestUpdateOptions{},
+		src:             parallelTestImage{layers: layers},
+	}, layers
+}
+
+func TestCopyLayersParallel(t *testing.T) {
+	// Later layers finish first, and at most maxParallelCopies are copied at once.
+	for _, maxParallelCopies := range []uint{1, 3, 10} {
+		dest := &parallelTestDestination{delays: map[digest.Digest]time.Duration{}}
+		report := bytes.Buffer{}
+		ic, layers := newParallelTestCopier(dest, 8, maxParallelCopies, &report)
+		for i, l := range layers {
+			dest.delays[l.Digest] = time.Duration(len(layers)-i) * 5 * time.Millisecond
+		}
+		err := ic.copyLayers(context.Background())
+		require.NoError(t, err, maxParallelCopies)
+
+		// The results are in the order of the source layers, regardless of the order of completion.
+		assert.Equal(t, layers, ic.manifestUpdates.InformationOnly.LayerInfos, maxParallelCopies)
+		assert.Nil(t, ic.manifestUpdates.LayerInfos, maxParallelCopies)
+		// Every layer is copied exactly once, and the limit is respected and reached.
+		started := []digest.Digest{}
+		for _, l := range layers {
+			started = append(started, l.Digest)
+		}
+		assert.ElementsMatch(t, started, dest.started, maxParallelCopies)
+		expectedMax := int(maxParallelCopies)
+		if expectedMax > len(layers) {
+			expectedMax = len(layers)
+		}
+		assert.Equal(t, expectedMax, dest.maxActive, maxParallelCopies)
+
+		// Every layer is reported, and with parallel copies each layer has its own progress bar.
+		for _, l := range layers {
+			assert.Contains(t, report.String(), "Copying blob "+l.Digest.String(), maxParallelCopies)
+			if maxParallelCopies > 1 {
+				assert.Contains(t, report.String(), l.Digest.Hex()[:12], maxParallelCopies)
+			}
+		}
+		assert.Nil(t, ic.c.progressPool, maxParallelCopies)
+	}
+}
+
+func TestCopyLayersParallelFailure(t *testing.T) {
+	dest := &parallelTestDestination{
+		delays:   map[digest.Digest]time.Duration{},
+		failures: map[digest.Digest]error{},
+		blocking: map[digest.Digest]bool{},
+	}
+	ic, layers := newParallelTestCopier(dest, 10, 3, ioutil.Discard)
+	// Layer 0 blocks until canceled, layer 1 fails, layer 2 is still in progress at that time;
+	// no further copies should be started.
+	dest.blocking[layers[0].Digest] = true
+	dest.delays[layers[1].Digest] = 20 * time.Millisecond
+	dest.failures[layers[1].Digest] = errors.New("Expected failure")
+	dest.blocking[layers[2].Digest] = true
+
+	err := ic.copyLayers(context.Background())
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "Expected failure"), err.Error())
+	assert.ElementsMatch(t, []digest.Digest{layers[0].Digest, layers[1].Digest, layers[2].Digest}, dest.started)
+	assert.ElementsMatch(t, []digest.Digest{layers[0].Digest, layers[2].Digest}, dest.interrupted)
+	assert.Nil(t, ic.manifestUpdates.InformationOnly.LayerInfos)
+
+	// Cancellation by the caller is reported as well.
+	dest = &parallelTestDestination{blocking: map[digest.Digest]bool{}}
+	ic, layers = newParallelTestCopier(dest, 5, 2, ioutil.Discard)
+	for _, l := range layers {
+		dest.blocking[l.Digest] = true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = ic.copyLayers(ctx)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.Len(t, dest.started, 2)
+}
+
+// reuseTestTransport is a types.ImageTransport which only provides a name.
+type reuseTestTransport struct {
+	types.ImageTransport
+}
+
+func (t reuseTestTransport) Name() string {
+	return "reuse-test"
+}
+
+// reuseTestDestination is a types.ImageDestination containing blobs, which reuses them like a registry would:
+// the blob itself if it is present, or a present substitute among the candidates returned by the cache.
+// Other methods are not implemented.
+type reuseTestDestination struct {
+	types.ImageDestination
+	blobs map[digest.Digest]int64 // Sizes of the present blobs
+	put   []digest.Digest         // Digests of blobs written by PutBlob
+}
+
+func (d *reuseTestDestination) HasThreadSafePutBlob() bool {
+	return false
+}
+
+func (d *reuseTestDestination) AcceptsForeignLayerURLs() bool {
+	return false
+}
+
+func (d *reuseTestDestination) DesiredLayerCompression() types.LayerCompression {
+	return types.Compress
+}
+
+func (d *reuseTestDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	if size, ok := d.blobs[info.Digest]; ok {
+		return true, types.BlobInfo{Digest: info.Digest, Size: size}, nil
+	}
+	for _, candidate := range cache.CandidateLocations(reuseTestTransport{}, types.BICTransportScope{Opaque: "scope"}, info.Digest, canSubstitute) {
+		if size, ok := d.blobs[candidate.Digest]; ok {
+			return true, types.BlobInfo{Digest: candidate.Digest, Size: size}, nil
+		}
+	}
+	return false, types.BlobInfo{}, nil
+}
+
+func (d *reuseTestDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	blob, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	d.put = append(d.put, digest.FromBytes(blob))
+	return types.BlobInfo{Digest: digest.FromBytes(blob), Size: int64(len(blob))}, nil
+}
+
+func TestCopyLayerReuseCompression(t *testing.T) {
+	uncompressed := bytes.Repeat([]byte("layer contents"), 100)
+	compress := func(algo compression.Algorithm) []byte {
+		buf := bytes.Buffer{}
+		w, err := compression.CompressStream(&buf, algo)
+		require.NoError(t, err)
+		_, err = w.Write(uncompressed)
+		require.NoError(t, err)
+		err = w.Close()
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+	gzipBlob, zstdBlob := compress(compression.Gzip), compress(compression.Zstd)
+	uncompressedDigest, gzipDigest, zstdDigest := digest.FromBytes(uncompressed), digest.FromBytes(gzipBlob), digest.FromBytes(zstdBlob)
+	blobs := map[digest.Digest][]byte{uncompressedDigest: uncompressed, gzipDigest: gzipBlob, zstdDigest: zstdBlob}
+
+	for _, c := range []struct {
+		name              string
+		src, present      digest.Digest
+		requested         *compression.Algorithm
+		expectedDigest    digest.Digest // "" if the layer is expected to be copied, with an unknown digest
+		expectedOperation types.LayerCompression
+		expectedAlgorithm string
+	}{
+		{"zstd layer, gzip substitute", zstdDigest, gzipDigest, nil, gzipDigest, types.Compress, compression.Gzip.Name()},
+		{"gzip layer, uncompressed substitute", gzipDigest, uncompressedDigest, nil, uncompressedDigest, types.Decompress, ""},
+		{"uncompressed layer, zstd not acceptable as a substitute", uncompressedDigest, zstdDigest, nil, "", types.Compress, compression.Gzip.Name()},
+		{"zstd requested, gzip not acceptable as a substitute", zstdDigest, gzipDigest, &compression.Zstd, zstdDigest, types.PreserveOriginal, ""},
+		{"zstd requested, existing gzip layer not reused", gzipDigest, gzipDigest, &compression.Zstd, "", types.Compress, compression.Zstd.Name()},
+		{"zstd requested, gzip layer recompressed even if a substitute exists", gzipDigest, zstdDigest, &compression.Zstd, "", types.Compress, compression.Zstd.Name()},
+	} {
+		cache := blobinfocache.NewMemoryCache()
+		for _, d := range []digest.Digest{gzipDigest, zstdDigest} {
+			cache.RecordDigestUncompressedPair(d, uncompressedDigest)
+			cache.RecordKnownLocation(reuseTestTransport{}, types.BICTransportScope{Opaque: "scope"}, d, types.BICLocationReference{Opaque: "location"})
+		}
+		cache.RecordDigestUncompressedPair(uncompressedDigest, uncompressedDigest)
+		cache.RecordKnownLocation(reuseTestTransport{}, types.BICTransportScope{Opaque: "scope"}, uncompressedDigest, types.BICLocationReference{Opaque: "location"})
+		internalblobinfocache.RecordDigestCompressorName(cache, gzipDigest, compression.Gzip.Name())
+		internalblobinfocache.RecordDigestCompressorName(cache, zstdDigest, compression.Zstd.Name())
+		internalblobinfocache.RecordDigestCompressorName(cache, uncompressedDigest, internalblobinfocache.Uncompressed)
+
+		dest := &reuseTestDestination{blobs: map[digest.Digest]int64{c.present: int64(len(blobs[c.present]))}}
+		ic := &imageCopier{
+			c: &copier{
+				dest:              dest,
+				rawSource:         parallelTestSource{blobs: blobs},
+				reportWriter:      ioutil.Discard,
+				blobInfoCache:     cache,
+				compressionFormat: compression.Gzip,
+			},
+			manifestUpdates:    &types.ManifestUpdateOptions{},
+			canModifyManifest:  true,
+			canSubstituteBlobs: true,
+		}
+		if c.requested != nil {
+			ic.c.compressionFormat = *c.requested
+			ic.c.recompressLayers = true
+		}
+
+		blobInfo, _, err := ic.copyLayer(context.Background(), types.BlobInfo{Digest: c.src, Size: int64(len(blobs[c.src]))})
+		require.NoError(t, err, c.name)
+		if c.expectedDigest != "" {
+			assert.Equal(t, c.expectedDigest, blobInfo.Digest, c.name)
+		} else {
+			require.Len(t, dest.put, 1, c.name)
+			assert.Equal(t, dest.put[0], blobInfo.Digest, c.name)
+		}
+		assert.Equal(t, c.expectedOperation, blobInfo.CompressionOperation, c.name)
+		if c.expectedAlgorithm != "" {
+			require.NotNil(t, blobInfo.CompressionAlgorithm, c.name)
+			assert.Equal(t, c.expectedAlgorithm, blobInfo.CompressionAlgorithm.Name(), c.name)
+			// The compression of the copied blob is recorded for later reuse.
+			assert.Equal(t, c.expectedAlgorithm, internalblobinfocache.DigestCompressorName(cache, blobInfo.Digest), c.name)
+		}
+	}
+}
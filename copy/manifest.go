@@ -15,6 +15,19 @@ import (
 // Include v2s1 signed but not v2s1 unsigned, because docker/distribution requires a signature even if the unsigned MIME type is used.
 var preferredManifestMIMETypes = []string{manifest.DockerV2Schema2MediaType, manifest.DockerV2Schema1SignedMediaType}
 
+// destSupportsManifestMIMEType returns true if a destination with destSupportedManifestMIMETypes can store a manifest of mimeType.
+func destSupportsManifestMIMEType(destSupportedManifestMIMETypes []string, mimeType string) bool {
+	if len(destSupportedManifestMIMETypes) == 0 {
+		return true // Anything goes
+	}
+	for _, t := range destSupportedManifestMIMETypes {
+		if t == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
 // orderedSet is a list of strings (MIME types in our case), with each string appearing at most once.
 type orderedSet struct {
 	list     []string
@@ -94,7 +107,11 @@ func (ic *imageCopier) determineManifestConversion(ctx context.Context, destSupp
 	}
 
 	// Finally, try anything else the destination supports.
+	// A single image can never be converted into a manifest list, so skip those.
 	for _, t := range destSupportedManifestMIMETypes {
+		if manifest.MIMETypeIsMultiImage(t) {
+			continue
+		}
 		prioritizedTypes.append(t)
 	}
 
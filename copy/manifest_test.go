@@ -28,6 +28,21 @@ func TestOrderedSet(t *testing.T) {
 	}
 }
 
+func TestDestSupportsManifestMIMEType(t *testing.T) {
+	for _, c := range []struct {
+		supported []string
+		mimeType  string
+		expected  bool
+	}{
+		{[]string{}, v1.MediaTypeImageManifest, true},
+		{nil, manifest.DockerV2Schema2MediaType, true},
+		{[]string{v1.MediaTypeImageManifest, manifest.DockerV2Schema2MediaType}, v1.MediaTypeImageManifest, true},
+		{[]string{manifest.DockerV2Schema2MediaType, manifest.DockerV2Schema1SignedMediaType}, v1.MediaTypeImageManifest, false},
+	} {
+		assert.Equal(t, c.expected, destSupportsManifestMIMEType(c.supported, c.mimeType), fmt.Sprintf("%#v", c))
+	}
+}
+
 // fakeImageSource is an implementation of types.Image which only returns itself as a MIME type in Manifest
 // except that "" means “reading the manifest should fail”
 type fakeImageSource string
@@ -111,6 +126,8 @@ func TestDetermineManifestConversion(t *testing.T) {
 		{"s1→s1s2", manifest.DockerV2Schema1SignedMediaType, supportS1S2, "", []string{manifest.DockerV2Schema2MediaType, manifest.DockerV2Schema1MediaType}},
 		{"s2→s1s2", manifest.DockerV2Schema2MediaType, supportS1S2, "", supportOnlyS1},
 		{"s1→s1", manifest.DockerV2Schema1SignedMediaType, supportOnlyS1, "", []string{manifest.DockerV2Schema1MediaType}},
+		// Manifest list types supported by the destination are never used as conversion candidates
+		{"s2→s1s2list", manifest.DockerV2Schema2MediaType, append([]string{manifest.DockerV2ListMediaType}, supportS1S2...), "", supportOnlyS1},
 		// text/plain is normalized to s1, and if the destination accepts s1, no conversion happens.
 		{"text→s1s2", "text/plain", supportS1S2, "", []string{manifest.DockerV2Schema2MediaType, manifest.DockerV2Schema1MediaType}},
 		{"text→s1", "text/plain", supportOnlyS1, "", []string{manifest.DockerV2Schema1MediaType}},
@@ -0,0 +1,195 @@
+package copy
+
+import (
+	"context"
+
+	"github.com/containers/image/image"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/signature"
+	"github.com/containers/image/transports"
+	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// copyMultipleImages copies some or all of the instances of the manifest list unparsedToplevel, and the list itself,
+// using policyContext to validate source image admissibility.  It returns the manifest list which was written to the destination.
+func (c *copier) copyMultipleImages(ctx context.Context, policyContext *signature.PolicyContext, options *Options, unparsedToplevel *image.UnparsedImage) (copiedList []byte, retErr error) {
+	// Please keep this policy check BEFORE reading any other information about the image.
+	if allowed, err := policyContext.IsRunningImageAllowed(ctx, unparsedToplevel); !allowed || err != nil { // Be paranoid and fail if either return value indicates so.
+		return nil, errors.Wrap(err, "Source image rejected")
+	}
+
+	manifestList, manifestType, err := unparsedToplevel.Manifest(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error reading manifest list")
+	}
+	originalList, err := manifest.ListFromBlob(manifestList, manifestType)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing manifest list %q", string(manifestList))
+	}
+	instanceDigests := originalList.Instances()
+	if options.ImageListSelection == CopySpecificImages {
+		for _, requested := range options.Instances {
+			if !containsDigest(instanceDigests, requested) {
+				return nil, errors.Errorf("Instance %s requested for copying is not present in the manifest list", requested)
+			}
+		}
+	}
+
+	var sigs [][]byte
+	if options.RemoveSignatures {
+		sigs = [][]byte{}
+	} else {
+		c.Printf("Getting image list signatures\n")
+		s, err := unparsedToplevel.Signatures(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error reading signatures")
+		}
+		sigs = s
+	}
+	if len(sigs) != 0 {
+		c.Printf("Checking if image list destination supports signatures\n")
+		if err := c.dest.SupportsSignatures(ctx); err != nil {
+			return nil, errors.Wrap(err, "Can not copy signatures")
+		}
+	}
+	canModifyManifestList := len(sigs) == 0
+
+	// Determine the list type to write; convert the list if the destination does not support the original one.
+	listType, err := determineListConversion(c.dest, originalList.MIMEType(), canModifyManifestList)
+	if err != nil {
+		return nil, err
+	}
+
+	imagesToCopy := len(instanceDigests)
+	if options.ImageListSelection == CopySpecificImages {
+		imagesToCopy = len(options.Instances)
+	}
+	c.Printf("Copying %d of %d images in list\n", imagesToCopy, len(instanceDigests))
+
+	// Copy each image, or just the ones we want to copy, recording their updated digests, sizes and MIME types.
+	updates := make([]manifest.ListUpdate, len(instanceDigests))
+	instancesCopied := 0
+	for i, instanceDigest := range instanceDigests {
+		original, err := originalList.Instance(instanceDigest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error looking up instance %s in the manifest list", instanceDigest)
+		}
+		if options.ImageListSelection == CopySpecificImages && !containsDigest(options.Instances, instanceDigest) {
+			updates[i] = original
+			logrus.Debugf("Skipping instance %s (%d/%d)", instanceDigest, i+1, len(instanceDigests))
+			continue
+		}
+		logrus.Debugf("Copying instance %s (%d/%d)", instanceDigest, i+1, len(instanceDigests))
+		c.Printf("Copying image %s (%d/%d)\n", instanceDigest, instancesCopied+1, imagesToCopy)
+		instance := instanceDigest // A separate variable, so that the pointer below does not change with the loop variable.
+		unparsedInstance := image.UnparsedInstance(c.rawSource, &instance)
+		updatedManifest, err := c.copyOneImage(ctx, policyContext, options, unparsedInstance, &instance)
+		if err != nil {
+			return nil, err
+		}
+		instancesCopied++
+		updatedManifestDigest, err := manifest.Digest(updatedManifest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error computing digest of the copy of instance %s", instanceDigest)
+		}
+		updatedManifestType := manifest.GuessMIMEType(updatedManifest)
+		if updatedManifestType == "" {
+			updatedManifestType = original.MediaType
+		}
+		updates[i] = manifest.ListUpdate{
+			Digest:    updatedManifestDigest,
+			Size:      int64(len(updatedManifest)),
+			MediaType: updatedManifestType,
+		}
+	}
+
+	// Now reset the digest/size/types of the manifests in the list to account for any conversions that we made,
+	// and convert the list itself if necessary.
+	listModified := listType != originalList.MIMEType()
+	for i, instanceDigest := range instanceDigests {
+		if original, _ := originalList.Instance(instanceDigest); original != updates[i] {
+			listModified = true
+		}
+	}
+	if listModified {
+		if !canModifyManifestList {
+			return nil, errors.Errorf("Copying the image list to %s would modify the list, invalidating its existing signatures. Explicitly enable signature removal to proceed anyway",
+				transports.ImageName(c.dest.Reference()))
+		}
+		updatedList := originalList.Clone()
+		if err := updatedList.UpdateInstances(updates); err != nil {
+			return nil, errors.Wrap(err, "Error updating manifest list")
+		}
+		if listType != updatedList.MIMEType() {
+			logrus.Debugf("Converting manifest list from %s to %s", updatedList.MIMEType(), listType)
+			if updatedList, err = updatedList.ConvertToMIMEType(listType); err != nil {
+				return nil, errors.Wrapf(err, "Error converting manifest list to %s", listType)
+			}
+		}
+		manifestList, err = updatedList.Serialize()
+		if err != nil {
+			return nil, errors.Wrap(err, "Error encoding updated manifest list")
+		}
+	}
+
+	c.Printf("Writing manifest list to image destination\n")
+	if err := c.dest.PutManifest(ctx, manifestList, nil); err != nil {
+		return nil, errors.Wrap(err, "Error writing manifest list")
+	}
+
+	if options.SignBy != "" {
+		newSig, err := c.createSignature(manifestList, options.SignBy)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, newSig)
+	}
+
+	c.Printf("Storing list signatures\n")
+	if err := c.dest.PutSignatures(ctx, sigs, nil); err != nil {
+		return nil, errors.Wrap(err, "Error writing signatures")
+	}
+
+	return manifestList, nil
+}
+
+// determineListConversion returns the manifest list MIME type to use when writing a list of srcListMIMEType to dest:
+// srcListMIMEType itself if dest supports it, or, if canModifyManifestList, another list type supported by dest.
+// Returns a types.ManifestTypeRejectedError if dest can not store any suitable manifest list.
+func determineListConversion(dest types.ImageDestination, srcListMIMEType string, canModifyManifestList bool) (string, error) {
+	supported := dest.SupportedManifestMIMETypes()
+	if len(supported) == 0 {
+		return srcListMIMEType, nil // Anything goes; just use the original as is, do not try any conversions.
+	}
+	supportedLists := []string{}
+	for _, t := range supported {
+		if t == srcListMIMEType {
+			return srcListMIMEType, nil
+		}
+		if manifest.MIMETypeIsMultiImage(t) {
+			supportedLists = append(supportedLists, t)
+		}
+	}
+	if len(supportedLists) == 0 {
+		return "", types.ManifestTypeRejectedError{Err: errors.Errorf("Destination %s does not support manifest lists, copying more than one image of a list is not possible",
+			transports.ImageName(dest.Reference()))}
+	}
+	if !canModifyManifestList {
+		return "", types.ManifestTypeRejectedError{Err: errors.Errorf("Destination %s does not support manifest lists of type %s, and converting the list would invalidate its existing signatures. Explicitly enable signature removal to proceed anyway",
+			transports.ImageName(dest.Reference()), srcListMIMEType)}
+	}
+	return supportedLists[0], nil
+}
+
+// containsDigest returns true if digests contains d.
+func containsDigest(digests []digest.Digest, d digest.Digest) bool {
+	for _, candidate := range digests {
+		if candidate == d {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package copy
+
+import (
+	"fmt"
+	"time"
+
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+// progressPool renders progress bars of concurrently copied blobs to copier.reportWriter, one line per bar.
+// The bars are redrawn in place periodically; other output of the copier is printed above them.
+type progressPool struct {
+	c     *copier // All state below is protected by c.reportWriterLock.
+	bars  []*pb.ProgressBar
+	lines int // Number of lines currently used by the bars on the output
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// newProgressPool returns a progressPool printing to c.reportWriter.
+// The caller must call .finish() on the returned progressPool.
+func newProgressPool(c *copier) *progressPool {
+	p := &progressPool{
+		c:    c,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go p.refresh()
+	return p
+}
+
+// refresh periodically redraws the bars until p.stop is closed.
+func (p *progressPool) refresh() {
+	defer close(p.done)
+	ticker := time.NewTicker(pb.DefaultRefreshRate)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.c.reportWriterLock.Lock()
+			p.render()
+			p.c.reportWriterLock.Unlock()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// startBar starts bar, which must not have been started yet, and adds it to the pool.
+func (p *progressPool) startBar(bar *pb.ProgressBar) {
+	// Make the bar only record its state; the pool does all of the printing.
+	bar.Output = nil
+	bar.NotPrint = true
+	bar.ManualUpdate = true
+
+	p.c.reportWriterLock.Lock()
+	defer p.c.reportWriterLock.Unlock()
+	bar.Start()
+	p.bars = append(p.bars, bar)
+}
+
+// printf prints a message above the bars.
+// The caller must hold p.c.reportWriterLock.
+func (p *progressPool) printf(format string, a ...interface{}) {
+	p.clear()
+	fmt.Fprintf(p.c.reportWriter, format, a...)
+	p.render()
+}
+
+// clear moves the cursor to the start of the first line of the bars and erases them.
+// The caller must hold p.c.reportWriterLock.
+func (p *progressPool) clear() {
+	if p.lines > 0 {
+		fmt.Fprintf(p.c.reportWriter, "\033[%dA\r\033[J", p.lines)
+		p.lines = 0
+	}
+}
+
+// render redraws all bars.
+// The caller must hold p.c.reportWriterLock.
+func (p *progressPool) render() {
+	if p.lines > 0 {
+		fmt.Fprintf(p.c.reportWriter, "\033[%dA", p.lines)
+	}
+	for _, bar := range p.bars {
+		bar.Update()
+		fmt.Fprintf(p.c.reportWriter, "\r%s\n", bar.String())
+	}
+	p.lines = len(p.bars)
+}
+
+// finish stops refreshing the bars, and leaves their final state on the output.
+func (p *progressPool) finish() {
+	close(p.stop)
+	<-p.done
+	p.c.reportWriterLock.Lock()
+	defer p.c.reportWriterLock.Unlock()
+	p.render()
+}
@@ -8,11 +8,15 @@ import (
 
 // createSignature creates a new signature of manifest using keyIdentity.
 func (c *copier) createSignature(manifest []byte, keyIdentity string) ([]byte, error) {
-	mech, err := signature.NewGPGSigningMechanism()
-	if err != nil {
-		return nil, errors.Wrap(err, "Error initializing GPG")
+	mech := c.signingMechanism
+	if mech == nil {
+		m, err := signature.NewGPGSigningMechanism()
+		if err != nil {
+			return nil, errors.Wrap(err, "Error initializing GPG")
+		}
+		defer m.Close()
+		mech = m
 	}
-	defer mech.Close()
 	if err := mech.SupportsSigning(); err != nil {
 		return nil, errors.Wrap(err, "Signing not supported")
 	}
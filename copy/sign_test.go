@@ -4,6 +4,7 @@ import (
 	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/containers/image/directory"
@@ -80,3 +81,48 @@ func TestCreateSignature(t *testing.T) {
 	assert.Equal(t, "docker.io/library/busybox:latest", verified.DockerReference)
 	assert.Equal(t, manifestDigest, verified.DockerManifestDigest)
 }
+
+func TestCreateSignatureWithSigningMechanism(t *testing.T) {
+	manifestBlob := []byte("Something")
+	manifestDigest, err := manifest.Digest(manifestBlob)
+	require.NoError(t, err)
+
+	secring, err := ioutil.ReadFile(filepath.Join(testGPGHomeDirectory, "secring.gpg"))
+	require.NoError(t, err)
+	mech, _, err := signature.NewEphemeralGPGSigningMechanismWithPrivateKey(secring, nil)
+	require.NoError(t, err)
+	defer mech.Close()
+
+	// Make sure the user’s default GPG configuration is not used.
+	os.Setenv("GNUPGHOME", "/this/does/not/exist")
+	defer os.Unsetenv("GNUPGHOME")
+
+	dockerRef, err := docker.ParseReference("//busybox")
+	require.NoError(t, err)
+	dockerDest, err := dockerRef.NewImageDestination(context.Background(),
+		&types.SystemContext{RegistriesDirPath: "/this/doesnt/exist", DockerPerHostCertDirPath: "/this/doesnt/exist"})
+	require.NoError(t, err)
+	defer dockerDest.Close()
+	c := &copier{
+		dest:             dockerDest,
+		reportWriter:     ioutil.Discard,
+		signingMechanism: mech,
+	}
+
+	// Signing with an unknown key fails
+	_, err = c.createSignature(manifestBlob, "this key does not exist")
+	assert.Error(t, err)
+
+	// Success
+	sig, err := c.createSignature(manifestBlob, testKeyFingerprint)
+	require.NoError(t, err)
+	publicKey, err := ioutil.ReadFile(filepath.Join(testGPGHomeDirectory, "public-key.gpg"))
+	require.NoError(t, err)
+	verifyMech, _, err := signature.NewEphemeralGPGSigningMechanism(publicKey)
+	require.NoError(t, err)
+	defer verifyMech.Close()
+	verified, err := signature.VerifyDockerManifestSignature(sig, manifestBlob, "docker.io/library/busybox:latest", verifyMech, testKeyFingerprint)
+	require.NoError(t, err)
+	assert.Equal(t, "docker.io/library/busybox:latest", verified.DockerReference)
+	assert.Equal(t, manifestDigest, verified.DockerManifestDigest)
+}
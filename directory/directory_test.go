@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/blobinfocache"
 	"github.com/containers/image/types"
 	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
@@ -34,7 +35,12 @@ func TestGetPutManifest(t *testing.T) {
 	dest, err := ref.NewImageDestination(context.Background(), nil)
 	require.NoError(t, err)
 	defer dest.Close()
-	err = dest.PutManifest(context.Background(), man)
+	err = dest.PutManifest(context.Background(), man, nil)
+	assert.NoError(t, err)
+	instanceMan := []byte("test-instance-manifest")
+	md, err := manifest.Digest(instanceMan)
+	require.NoError(t, err)
+	err = dest.PutManifest(context.Background(), instanceMan, &md)
 	assert.NoError(t, err)
 	err = dest.Commit(context.Background())
 	assert.NoError(t, err)
@@ -47,10 +53,15 @@ func TestGetPutManifest(t *testing.T) {
 	assert.Equal(t, man, m)
 	assert.Equal(t, "", mt)
 
-	// Non-default instances are not supported
-	md, err := manifest.Digest(man)
-	require.NoError(t, err)
-	_, _, err = src.GetManifest(context.Background(), &md)
+	// Non-default instances
+	m, mt, err = src.GetManifest(context.Background(), &md)
+	assert.NoError(t, err)
+	assert.Equal(t, instanceMan, m)
+	assert.Equal(t, "", mt)
+
+	// Unknown instances
+	unknownDigest := digest.Digest("sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	_, _, err = src.GetManifest(context.Background(), &unknownDigest)
 	assert.Error(t, err)
 }
 
@@ -58,22 +69,31 @@ func TestGetPutBlob(t *testing.T) {
 	ref, tmpDir := refToTempDir(t)
 	defer os.RemoveAll(tmpDir)
 
+	cache := blobinfocache.NewMemoryCache()
+
 	blob := []byte("test-blob")
 	dest, err := ref.NewImageDestination(context.Background(), nil)
 	require.NoError(t, err)
 	defer dest.Close()
 	assert.Equal(t, types.PreserveOriginal, dest.DesiredLayerCompression())
-	info, err := dest.PutBlob(context.Background(), bytes.NewReader(blob), types.BlobInfo{Digest: digest.Digest("sha256:digest-test"), Size: int64(9)}, false)
+	reused, _, err := dest.TryReusingBlob(context.Background(), types.BlobInfo{Digest: digest.FromBytes(blob), Size: -1}, cache, false)
 	assert.NoError(t, err)
-	err = dest.Commit(context.Background())
+	assert.False(t, reused)
+	info, err := dest.PutBlob(context.Background(), bytes.NewReader(blob), types.BlobInfo{Digest: digest.Digest("sha256:digest-test"), Size: int64(9)}, cache, false)
 	assert.NoError(t, err)
 	assert.Equal(t, int64(9), info.Size)
 	assert.Equal(t, digest.FromBytes(blob), info.Digest)
+	reused, reusedInfo, err := dest.TryReusingBlob(context.Background(), types.BlobInfo{Digest: info.Digest, Size: -1}, cache, false)
+	assert.NoError(t, err)
+	assert.True(t, reused)
+	assert.Equal(t, info, reusedInfo)
+	err = dest.Commit(context.Background())
+	assert.NoError(t, err)
 
 	src, err := ref.NewImageSource(context.Background(), nil)
 	require.NoError(t, err)
 	defer src.Close()
-	rc, size, err := src.GetBlob(context.Background(), info)
+	rc, size, err := src.GetBlob(context.Background(), info, cache)
 	assert.NoError(t, err)
 	defer rc.Close()
 	b, err := ioutil.ReadAll(rc)
@@ -120,7 +140,7 @@ func TestPutBlobDigestFailure(t *testing.T) {
 	dest, err := ref.NewImageDestination(context.Background(), nil)
 	require.NoError(t, err)
 	defer dest.Close()
-	_, err = dest.PutBlob(context.Background(), reader, types.BlobInfo{Digest: blobDigest, Size: -1}, false)
+	_, err = dest.PutBlob(context.Background(), reader, types.BlobInfo{Digest: blobDigest, Size: -1}, blobinfocache.NewMemoryCache(), false)
 	assert.Error(t, err)
 	assert.Contains(t, digestErrorString, err.Error())
 	err = dest.Commit(context.Background())
@@ -145,10 +165,15 @@ func TestGetPutSignatures(t *testing.T) {
 	}
 	err = dest.SupportsSignatures(context.Background())
 	assert.NoError(t, err)
-	err = dest.PutManifest(context.Background(), man)
+	err = dest.PutManifest(context.Background(), man, nil)
+	require.NoError(t, err)
+	instanceSignatures := [][]byte{[]byte("instance-sig")}
+	md, err := manifest.Digest(man)
 	require.NoError(t, err)
 
-	err = dest.PutSignatures(context.Background(), signatures)
+	err = dest.PutSignatures(context.Background(), signatures, nil)
+	assert.NoError(t, err)
+	err = dest.PutSignatures(context.Background(), instanceSignatures, &md)
 	assert.NoError(t, err)
 	err = dest.Commit(context.Background())
 	assert.NoError(t, err)
@@ -160,11 +185,10 @@ func TestGetPutSignatures(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, signatures, sigs)
 
-	// Non-default instances are not supported
-	md, err := manifest.Digest(man)
-	require.NoError(t, err)
-	_, err = src.GetSignatures(context.Background(), &md)
-	assert.Error(t, err)
+	// Non-default instances
+	sigs, err = src.GetSignatures(context.Background(), &md)
+	assert.NoError(t, err)
+	assert.Equal(t, instanceSignatures, sigs)
 }
 
 func TestSourceReference(t *testing.T) {
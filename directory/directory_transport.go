@@ -166,7 +166,11 @@ func (ref dirReference) DeleteImage(ctx context.Context, sys *types.SystemContex
 }
 
 // manifestPath returns a path for the manifest within a directory using our conventions.
-func (ref dirReference) manifestPath() string {
+// If instanceDigest is not nil, it returns a path for the manifest of that specific instance of a manifest list.
+func (ref dirReference) manifestPath(instanceDigest *digest.Digest) string {
+	if instanceDigest != nil {
+		return filepath.Join(ref.path, instanceDigest.Hex()+".manifest.json")
+	}
 	return filepath.Join(ref.path, "manifest.json")
 }
 
@@ -177,7 +181,11 @@ func (ref dirReference) layerPath(digest digest.Digest) string {
 }
 
 // signaturePath returns a path for a signature within a directory using our conventions.
-func (ref dirReference) signaturePath(index int) string {
+// If instanceDigest is not nil, it returns a path for a signature of that specific instance of a manifest list.
+func (ref dirReference) signaturePath(index int, instanceDigest *digest.Digest) string {
+	if instanceDigest != nil {
+		return filepath.Join(ref.path, fmt.Sprintf("%s.signature-%d", instanceDigest.Hex(), index+1))
+	}
 	return filepath.Join(ref.path, fmt.Sprintf("signature-%d", index+1))
 }
 
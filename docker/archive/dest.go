@@ -13,38 +13,65 @@ import (
 type archiveImageDestination struct {
 	*tarfile.Destination // Implements most of types.ImageDestination
 	ref                  archiveReference
-	writer               io.Closer
+	writer               io.Closer // nil if ref.writer is used
 }
 
 func newImageDestination(sys *types.SystemContext, ref archiveReference) (types.ImageDestination, error) {
-	// ref.path can be either a pipe or a regular file
+	if ref.sourceIndex != -1 {
+		return nil, errors.Errorf("Destination reference must not contain a manifest index @%d", ref.sourceIndex)
+	}
+
+	var tarDest *tarfile.Destination
+	var writer io.Closer
+	if ref.writer != nil {
+		tarDest = tarfile.NewDestinationForArchive(ref.writer.archive, ref.ref)
+	} else {
+		fh, err := openArchiveForWriting(ref.path)
+		if err != nil {
+			return nil, err
+		}
+		tarDest = tarfile.NewDestination(fh, ref.ref)
+		writer = fh
+	}
+	if sys != nil && sys.DockerArchiveAdditionalTags != nil {
+		tarDest.AddRepoTags(sys.DockerArchiveAdditionalTags)
+	}
+	return &archiveImageDestination{
+		Destination: tarDest,
+		ref:         ref,
+		writer:      writer,
+	}, nil
+}
+
+// openArchiveForWriting opens path for writing a new archive.
+func openArchiveForWriting(path string) (*os.File, error) {
+	// path can be either a pipe or a regular file
 	// in the case of a pipe, we require that we can open it for write
 	// in the case of a regular file, we don't want to overwrite any pre-existing file
 	// so we check for Size() == 0 below (This is racy, but using O_EXCL would also be racy,
 	// only in a different way. Either way, it’s up to the user to not have two writers to the same path.)
-	fh, err := os.OpenFile(ref.path, os.O_WRONLY|os.O_CREATE, 0644)
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error opening file %q", ref.path)
+		return nil, errors.Wrapf(err, "error opening file %q", path)
 	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			fh.Close()
+		}
+	}()
 
 	fhStat, err := fh.Stat()
 	if err != nil {
-		return nil, errors.Wrapf(err, "error statting file %q", ref.path)
+		return nil, errors.Wrapf(err, "error statting file %q", path)
 	}
 
 	if fhStat.Mode().IsRegular() && fhStat.Size() != 0 {
 		return nil, errors.New("docker-archive doesn't support modifying existing images")
 	}
 
-	tarDest := tarfile.NewDestination(fh, ref.destinationRef)
-	if sys != nil && sys.DockerArchiveAdditionalTags != nil {
-		tarDest.AddRepoTags(sys.DockerArchiveAdditionalTags)
-	}
-	return &archiveImageDestination{
-		Destination: tarDest,
-		ref:         ref,
-		writer:      fh,
-	}, nil
+	succeeded = true
+	return fh, nil
 }
 
 // DesiredLayerCompression indicates if layers must be compressed, decompressed or preserved
@@ -60,6 +87,9 @@ func (d *archiveImageDestination) Reference() types.ImageReference {
 
 // Close removes resources associated with an initialized ImageDestination, if any.
 func (d *archiveImageDestination) Close() error {
+	if d.writer == nil {
+		return nil // The archive is closed by the owner of ref.writer.
+	}
 	return d.writer.Close()
 }
 
@@ -0,0 +1,57 @@
+package archive
+
+import (
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/docker/tarfile"
+	"github.com/containers/image/types"
+	"github.com/pkg/errors"
+)
+
+// ListResult describes a single image in a docker-archive, as returned by List.
+type ListResult struct {
+	// Reference refers to the image, using its index within manifest.json.
+	Reference types.ImageReference
+	// RepoTags contains the tags of the image recorded in the archive, if any.
+	RepoTags []reference.NamedTagged
+	// ManifestItem is the manifest.json entry for the image.
+	ManifestItem tarfile.ManifestItem
+}
+
+// List returns the images in the docker-archive at path, in the order of their manifest.json entries.
+func List(path string) ([]ListResult, error) {
+	src, err := tarfile.NewSourceFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	items, err := src.LoadTarManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	res := []ListResult{}
+	for i, item := range items {
+		tags := []reference.NamedTagged{}
+		for _, tag := range item.RepoTags {
+			parsed, err := reference.ParseNormalizedNamed(tag)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid tag %q in manifest.json", tag)
+			}
+			tagged, ok := parsed.(reference.NamedTagged)
+			if !ok {
+				return nil, errors.Errorf("Invalid tag %q in manifest.json: not a tagged reference", tag)
+			}
+			tags = append(tags, tagged)
+		}
+		ref, err := newReference(path, nil, i, nil)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ListResult{
+			Reference:    ref,
+			RepoTags:     tags,
+			ManifestItem: item,
+		})
+	}
+	return res, nil
+}
@@ -2,9 +2,9 @@ package archive
 
 import (
 	"context"
+
 	"github.com/containers/image/docker/tarfile"
 	"github.com/containers/image/types"
-	"github.com/sirupsen/logrus"
 )
 
 type archiveImageSource struct {
@@ -15,10 +15,7 @@ type archiveImageSource struct {
 // newImageSource returns a types.ImageSource for the specified image reference.
 // The caller must call .Close() on the returned ImageSource.
 func newImageSource(ctx context.Context, ref archiveReference) (types.ImageSource, error) {
-	if ref.destinationRef != nil {
-		logrus.Warnf("docker-archive: references are not supported for sources (ignoring)")
-	}
-	src, err := tarfile.NewSourceFromFile(ref.path)
+	src, err := tarfile.NewSourceFromFileWithImage(ref.path, ref.ref, ref.sourceIndex)
 	if err != nil {
 		return nil, err
 	}
@@ -47,16 +47,24 @@ func TestParseReference(t *testing.T) {
 
 // testParseReference is a test shared for Transport.ParseReference and ParseReference.
 func testParseReference(t *testing.T, fn func(string) (types.ImageReference, error)) {
-	for _, c := range []struct{ input, expectedPath, expectedRef string }{
-		{"", "", ""}, // Empty input is explicitly rejected
-		{"/path", "/path", ""},
-		{"/path:busybox:notlatest", "/path", "docker.io/library/busybox:notlatest"}, // Explicit tag
-		{"/path:busybox" + sha256digest, "", ""},                                    // Digest references are forbidden
-		{"/path:busybox", "/path", "docker.io/library/busybox:latest"},              // Default tag
+	for _, c := range []struct {
+		input, expectedPath, expectedRef string
+		expectedSourceIndex              int
+	}{
+		{"", "", "", -1}, // Empty input is explicitly rejected
+		{"/path", "/path", "", -1},
+		{"/path:busybox:notlatest", "/path", "docker.io/library/busybox:notlatest", -1}, // Explicit tag
+		{"/path:busybox" + sha256digest, "", "", -1},                                    // Digest references are forbidden
+		{"/path:busybox", "/path", "docker.io/library/busybox:latest", -1},              // Default tag
 		// A github.com/distribution/reference value can have a tag and a digest at the same time!
-		{"/path:busybox:latest" + sha256digest, "", ""},                                         // Both tag and digest is rejected
-		{"/path:docker.io/library/busybox:latest", "/path", "docker.io/library/busybox:latest"}, // All implied values explicitly specified
-		{"/path:UPPERCASEISINVALID", "", ""},                                                    // Invalid input
+		{"/path:busybox:latest" + sha256digest, "", "", -1},                                         // Both tag and digest is rejected
+		{"/path:docker.io/library/busybox:latest", "/path", "docker.io/library/busybox:latest", -1}, // All implied values explicitly specified
+		{"/path:UPPERCASEISINVALID", "", "", -1},                                                    // Invalid input
+		{"/path:@0", "/path", "", 0},                                                                // Source index
+		{"/path:@12", "/path", "", 12},                                                              // Multi-digit source index
+		{"/path:@-1", "", "", -1},                                                                   // Negative source index
+		{"/path:@", "", "", -1},                                                                     // Missing source index
+		{"/path:@notanumber", "", "", -1},                                                           // Invalid source index
 	} {
 		ref, err := fn(c.input)
 		if c.expectedPath == "" {
@@ -67,15 +75,50 @@ func testParseReference(t *testing.T, fn func(string) (types.ImageReference, err
 			require.True(t, ok, c.input)
 			assert.Equal(t, c.expectedPath, archiveRef.path, c.input)
 			if c.expectedRef == "" {
-				assert.Nil(t, archiveRef.destinationRef, c.input)
+				assert.Nil(t, archiveRef.ref, c.input)
 			} else {
-				require.NotNil(t, archiveRef.destinationRef, c.input)
-				assert.Equal(t, c.expectedRef, archiveRef.destinationRef.String(), c.input)
+				require.NotNil(t, archiveRef.ref, c.input)
+				assert.Equal(t, c.expectedRef, archiveRef.ref.String(), c.input)
 			}
+			assert.Equal(t, c.expectedSourceIndex, archiveRef.sourceIndex, c.input)
 		}
 	}
 }
 
+func TestNewReference(t *testing.T) {
+	ref, err := NewReference("/path", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "/path", ref.StringWithinTransport())
+
+	named, err := reference.ParseNormalizedNamed("busybox:notlatest")
+	require.NoError(t, err)
+	ref, err = NewReference("/path", named.(reference.NamedTagged))
+	require.NoError(t, err)
+	assert.Equal(t, "/path:docker.io/library/busybox:notlatest", ref.StringWithinTransport())
+
+	// Colons in the path are rejected because they can not be represented in StringWithinTransport
+	_, err = NewReference("/path:with:colons", nil)
+	assert.Error(t, err)
+
+	// Digest references are rejected
+	digested, err := reference.ParseNormalizedNamed("busybox" + sha256digest)
+	require.NoError(t, err)
+	_, err = NewReference("/path", refWithTagAndDigest{digested.(reference.Canonical)})
+	assert.Error(t, err)
+}
+
+func TestNewIndexReference(t *testing.T) {
+	ref, err := NewIndexReference("/path", 2)
+	require.NoError(t, err)
+	assert.Equal(t, "/path:@2", ref.StringWithinTransport())
+	assert.Nil(t, ref.DockerReference())
+
+	_, err = NewIndexReference("/path", -2)
+	assert.Error(t, err)
+	_, err = NewIndexReference("/path:with:colons", 0)
+	assert.Error(t, err)
+}
+
 // refWithTagAndDigest is a reference.NamedTagged and reference.Canonical at the same time.
 type refWithTagAndDigest struct{ reference.Canonical }
 
@@ -89,6 +132,7 @@ var validReferenceTestCases = []struct{ input, dockerRef, stringWithinTransport
 	{"/path:busybox:notlatest", "docker.io/library/busybox:notlatest", "/path:docker.io/library/busybox:notlatest"},          // Explicit tag
 	{"/path:docker.io/library/busybox:latest", "docker.io/library/busybox:latest", "/path:docker.io/library/busybox:latest"}, // All implied values explicitly specified
 	{"/path:example.com/ns/foo:bar", "example.com/ns/foo:bar", "/path:example.com/ns/foo:bar"},                               // All values explicitly specified
+	{"/path:@0", "", "/path:@0"}, // Source index
 }
 
 func TestReferenceTransport(t *testing.T) {
@@ -142,21 +186,21 @@ func TestReferencePolicyConfigurationNamespaces(t *testing.T) {
 }
 
 func TestReferenceNewImage(t *testing.T) {
-	for _, suffix := range []string{"", ":thisisignoredbutaccepted"} {
+	for _, suffix := range []string{"", ":emptyimage:latest", ":@0"} {
 		ref, err := ParseReference(tarFixture + suffix)
 		require.NoError(t, err, suffix)
 		img, err := ref.NewImage(context.Background(), nil)
-		assert.NoError(t, err, suffix)
+		require.NoError(t, err, suffix)
 		defer img.Close()
 	}
 }
 
 func TestReferenceNewImageSource(t *testing.T) {
-	for _, suffix := range []string{"", ":thisisignoredbutaccepted"} {
+	for _, suffix := range []string{"", ":emptyimage:latest", ":@0"} {
 		ref, err := ParseReference(tarFixture + suffix)
 		require.NoError(t, err, suffix)
 		src, err := ref.NewImageSource(context.Background(), nil)
-		assert.NoError(t, err, suffix)
+		require.NoError(t, err, suffix)
 		defer src.Close()
 	}
 }
@@ -177,6 +221,12 @@ func TestReferenceNewImageDestination(t *testing.T) {
 	dest, err = ref.NewImageDestination(context.Background(), nil)
 	assert.NoError(t, err)
 	defer dest.Close()
+
+	// Source indices are not valid for destinations
+	ref, err = ParseReference(filepath.Join(tmpDir, "with-index") + ":@0")
+	require.NoError(t, err)
+	_, err = ref.NewImageDestination(context.Background(), nil)
+	assert.Error(t, err)
 }
 
 func TestReferenceDeleteImage(t *testing.T) {
@@ -198,3 +248,28 @@ func TestReferenceDeleteImage(t *testing.T) {
 		assert.NoError(t, err, suffix)
 	}
 }
+
+func TestList(t *testing.T) {
+	res, err := List(tarFixture)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.Equal(t, tarFixture+":@0", res[0].Reference.StringWithinTransport())
+	require.Len(t, res[0].RepoTags, 1)
+	assert.Equal(t, "docker.io/library/emptyimage:latest", res[0].RepoTags[0].String())
+	assert.Equal(t, []string{"c7b98db321d22702b8dd264fa7d58936951867854969a873d3dd20520eadca8f/layer.tar"}, res[0].ManifestItem.Layers)
+	src, err := res[0].Reference.NewImageSource(context.Background(), nil)
+	require.NoError(t, err)
+	defer src.Close()
+
+	// Not an archive
+	tmpDir, err := ioutil.TempDir("", "docker-archive-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	testFile := filepath.Join(tmpDir, "file.tar")
+	err = ioutil.WriteFile(testFile, []byte("nonempty"), 0644)
+	require.NoError(t, err)
+	_, err = List(testFile)
+	assert.Error(t, err)
+	_, err = List(filepath.Join(tmpDir, "this-does-not-exist"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,48 @@
+package archive
+
+import (
+	"os"
+
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/docker/tarfile"
+	"github.com/containers/image/types"
+)
+
+// Writer manages a single in-progress Docker archive and allows adding images to it.
+// Layers shared by several images are stored only once.
+type Writer struct {
+	path    string
+	archive *tarfile.Writer
+	file    *os.File
+}
+
+// NewWriter returns a Writer for path.
+// The caller should call .Close() on the returned object after adding all images.
+func NewWriter(sys *types.SystemContext, path string) (*Writer, error) {
+	fh, err := openArchiveForWriting(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		path:    path,
+		archive: tarfile.NewWriter(fh),
+		file:    fh,
+	}, nil
+}
+
+// Close writes all outstanding data about images to the archive, and releases state associated with the Writer, if any.
+// No more images can be added after this is called.
+func (w *Writer) Close() error {
+	err := w.archive.Close()
+	if err2 := w.file.Close(); err2 != nil && err == nil {
+		err = err2
+	}
+	return err
+}
+
+// NewReference returns an ImageReference that allows adding an image to Writer,
+// with an optional reference.
+// Images must be copied one at a time; the Writer is not safe for concurrent use.
+func (w *Writer) NewReference(destinationRef reference.NamedTagged) (types.ImageReference, error) {
+	return newReference(w.path, destinationRef, -1, w)
+}
@@ -0,0 +1,186 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/blobinfocache"
+	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestImage writes an image consisting of layers and a config containing cmd to ref.
+func writeTestImage(t *testing.T, ref types.ImageReference, cmd string, layers ...[]byte) digest.Digest {
+	ctx := context.Background()
+	dest, err := ref.NewImageDestination(ctx, nil)
+	require.NoError(t, err)
+	defer dest.Close()
+
+	diffIDs := []digest.Digest{}
+	layerDescriptors := []manifest.Schema2Descriptor{}
+	for _, layer := range layers {
+		info, err := dest.PutBlob(ctx, bytes.NewReader(layer), types.BlobInfo{Digest: digest.FromBytes(layer), Size: int64(len(layer))}, blobinfocache.NoCache, false)
+		require.NoError(t, err)
+		diffIDs = append(diffIDs, info.Digest)
+		layerDescriptors = append(layerDescriptors, manifest.Schema2Descriptor{MediaType: manifest.DockerV2Schema2LayerMediaType, Digest: info.Digest, Size: info.Size})
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]interface{}{"Cmd": []string{cmd}},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	require.NoError(t, err)
+	configInfo, err := dest.PutBlob(ctx, bytes.NewReader(config), types.BlobInfo{Digest: digest.FromBytes(config), Size: int64(len(config))}, blobinfocache.NoCache, true)
+	require.NoError(t, err)
+
+	m := manifest.Schema2FromComponents(manifest.Schema2Descriptor{MediaType: manifest.DockerV2Schema2ConfigMediaType, Digest: configInfo.Digest, Size: configInfo.Size},
+		layerDescriptors)
+	manifestBlob, err := m.Serialize()
+	require.NoError(t, err)
+	err = dest.PutManifest(ctx, manifestBlob, nil)
+	require.NoError(t, err)
+	err = dest.Commit(ctx)
+	require.NoError(t, err)
+	return configInfo.Digest
+}
+
+// readTestImage reads the image at ref and returns its config digest and the contents of its layers.
+func readTestImage(t *testing.T, ref types.ImageReference) (digest.Digest, [][]byte) {
+	ctx := context.Background()
+	src, err := ref.NewImageSource(ctx, nil)
+	require.NoError(t, err)
+	defer src.Close()
+	manifestBlob, _, err := src.GetManifest(ctx, nil)
+	require.NoError(t, err)
+	m, err := manifest.Schema2FromManifest(manifestBlob)
+	require.NoError(t, err)
+	layers := [][]byte{}
+	for _, l := range m.LayerInfos() {
+		stream, _, err := src.GetBlob(ctx, l.BlobInfo, blobinfocache.NoCache)
+		require.NoError(t, err)
+		contents, err := ioutil.ReadAll(stream)
+		stream.Close()
+		require.NoError(t, err)
+		layers = append(layers, contents)
+	}
+	return m.ConfigInfo().Digest, layers
+}
+
+func TestWriter(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "docker-archive-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "archive.tar")
+
+	base := bytes.Repeat([]byte("base layer"), 100)
+	app1 := []byte("first application")
+	app2 := []byte("second application")
+	tags := []reference.NamedTagged{}
+	for _, s := range []string{"example.com/app1:latest", "example.com/app2:v2", "example.com/base:latest"} {
+		named, err := reference.ParseNormalizedNamed(s)
+		require.NoError(t, err)
+		tags = append(tags, named.(reference.NamedTagged))
+	}
+
+	writer, err := NewWriter(nil, path)
+	require.NoError(t, err)
+	configs := []digest.Digest{}
+	for _, c := range []struct {
+		tag    reference.NamedTagged
+		cmd    string
+		layers [][]byte
+	}{
+		{tags[0], "app1", [][]byte{base, app1}},
+		{tags[1], "app2", [][]byte{base, app2}},
+		{tags[2], "base", [][]byte{base}},
+		{nil, "app1-untagged", [][]byte{base, app1}}, // Same layers as tags[0], different config
+	} {
+		ref, err := writer.NewReference(c.tag)
+		require.NoError(t, err)
+		configs = append(configs, writeTestImage(t, ref, c.cmd, c.layers...))
+	}
+	err = writer.Close()
+	require.NoError(t, err)
+
+	// Shared layers are stored only once, and legacy layer directories are unique
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	seen := map[string]int{}
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		seen[h.Name]++
+	}
+	for name, count := range seen {
+		assert.Equal(t, 1, count, name)
+	}
+	assert.Equal(t, 1, seen[digest.FromBytes(base).Hex()+".tar"])
+	assert.Equal(t, 1, seen[digest.FromBytes(app1).Hex()+".tar"])
+
+	// The images can be listed and read by index
+	listed, err := List(path)
+	require.NoError(t, err)
+	require.Len(t, listed, 4)
+	expectedLayers := [][][]byte{{base, app1}, {base, app2}, {base}, {base, app1}}
+	for i, res := range listed {
+		assert.Equal(t, fmt.Sprintf("%s:@%d", path, i), res.Reference.StringWithinTransport())
+		config, layers := readTestImage(t, res.Reference)
+		assert.Equal(t, configs[i], config)
+		assert.Equal(t, expectedLayers[i], layers)
+	}
+	assert.Equal(t, []string{"example.com/app2:v2"}, listed[1].ManifestItem.RepoTags)
+	assert.Empty(t, listed[3].ManifestItem.RepoTags)
+
+	// The images can be read by tag
+	for i, tag := range []string{"example.com/app1:latest", "example.com/app2:v2", "example.com/base"} {
+		ref, err := ParseReference(path + ":" + tag)
+		require.NoError(t, err)
+		config, layers := readTestImage(t, ref)
+		assert.Equal(t, configs[i], config, tag)
+		assert.Equal(t, expectedLayers[i], layers, tag)
+	}
+
+	// Tags which are not present, and archives with more than one image without a selection, are rejected
+	for _, suffix := range []string{":example.com/app1:notlatest", ":@4", ""} {
+		ref, err := ParseReference(path + suffix)
+		require.NoError(t, err, suffix)
+		src, err := ref.NewImageSource(context.Background(), nil)
+		require.NoError(t, err, suffix)
+		_, _, err = src.GetManifest(context.Background(), nil)
+		assert.Error(t, err, suffix)
+		src.Close()
+	}
+
+	// An existing archive can not be appended to
+	_, err = NewWriter(nil, path)
+	assert.Error(t, err)
+
+	// A single-image archive written without a Writer can be read without selecting an image
+	singlePath := filepath.Join(tmpDir, "single.tar")
+	ref, err := NewReference(singlePath, tags[0])
+	require.NoError(t, err)
+	config := writeTestImage(t, ref, "app1", base, app1)
+	ref, err = ParseReference(singlePath)
+	require.NoError(t, err)
+	readConfig, layers := readTestImage(t, ref)
+	assert.Equal(t, config, readConfig)
+	assert.Equal(t, [][]byte{base, app1}, layers)
+}
@@ -0,0 +1,184 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// bodyReaderMaxRetries is the maximum number of consecutive attempts to resume a download
+// without receiving any data in between.
+const bodyReaderMaxRetries = 5
+
+// These are variables only to allow tests to run faster.
+var (
+	// bodyReaderInitialBackoff is the delay before the first attempt to resume a download; it doubles after every failed attempt.
+	bodyReaderInitialBackoff = 1 * time.Second
+	// bodyReaderMaxBackoff is the maximum delay between attempts to resume a download.
+	bodyReaderMaxBackoff = 30 * time.Second
+)
+
+// bodyReader is an io.ReadCloser returned by dockerImageSource.GetBlob,
+// which transparently resumes an interrupted download using HTTP Range requests.
+// It does not verify the contents; callers are expected to verify the digest of the whole stream, as copy.Image does.
+type bodyReader struct {
+	ctx  context.Context
+	c    *dockerClient
+	path string // path to pass to makeRequest to resume the download
+
+	body    io.ReadCloser // The currently open connection, or nil if it needs to be reopened.
+	offset  int64         // Number of bytes returned to the caller so far.
+	size    int64         // Total size of the blob, or -1 if unknown.
+	retries int           // Number of consecutive resume attempts without receiving any data.
+	lastErr error         // The error which caused the most recent resume attempt.
+	closed  bool
+}
+
+// newBodyReader returns a bodyReader for the blob at path, with res a successful (http.StatusOK) response to the initial request.
+func newBodyReader(ctx context.Context, c *dockerClient, path string, res *http.Response) *bodyReader {
+	return &bodyReader{
+		ctx:  ctx,
+		c:    c,
+		path: path,
+		body: res.Body,
+		size: getBlobSize(res),
+	}
+}
+
+// Read implements io.Reader.
+func (br *bodyReader) Read(p []byte) (int, error) {
+	if br.closed {
+		return 0, errors.Errorf("Internal error: Read called on a closed bodyReader for %s", br.path)
+	}
+	for {
+		if br.body == nil {
+			if err := br.resume(); err != nil {
+				return 0, err
+			}
+			if br.body == nil {
+				continue // The attempt failed; resume decides whether to try again.
+			}
+		}
+		n, err := br.body.Read(p)
+		br.offset += int64(n)
+		if n > 0 {
+			br.retries = 0
+		}
+		if err == nil || err == io.EOF || !br.canResume(err) {
+			return n, err
+		}
+		logrus.Debugf("Reading blob %s failed after %d bytes: %v", br.path, br.offset, err)
+		br.body.Close()
+		br.body = nil
+		br.lastErr = err
+		if n > 0 {
+			return n, nil // The next Read call will resume the download.
+		}
+	}
+}
+
+// canResume returns true if it makes sense to try resuming the download after err.
+func (br *bodyReader) canResume(err error) bool {
+	if br.ctx.Err() != nil {
+		return false // Canceled or timed out, don't try any further.
+	}
+	if br.size != -1 && br.offset >= br.size {
+		return false // We already have all data, and something else went wrong.
+	}
+	return true
+}
+
+// resume waits for a while, and then reopens br.body, starting at br.offset.
+func (br *bodyReader) resume() error {
+	if br.retries >= bodyReaderMaxRetries {
+		return errors.Wrapf(br.lastErr, "Error reading blob %s, giving up after %d attempts to resume the download", br.path, br.retries)
+	}
+	delay := bodyReaderInitialBackoff << uint(br.retries)
+	if delay > bodyReaderMaxBackoff {
+		delay = bodyReaderMaxBackoff
+	}
+	br.retries++
+	logrus.Debugf("Resuming download of %s at offset %d in %s (attempt %d of %d)", br.path, br.offset, delay, br.retries, bodyReaderMaxRetries)
+	select {
+	case <-br.ctx.Done():
+		return br.ctx.Err()
+	case <-time.After(delay):
+	}
+
+	// Use makeRequestOnce, not makeRequest: the attempts to resume are already retried here, with their own limit and backoff.
+	headers := map[string][]string{"Range": {fmt.Sprintf("bytes=%d-", br.offset)}}
+	res, err := br.c.makeRequestOnce(br.ctx, "GET", br.path, headers, nil, v2Auth, nil)
+	if err != nil {
+		if br.ctx.Err() != nil || !isRetryableError(err) {
+			return errors.Wrapf(err, "Error resuming download of blob %s", br.path)
+		}
+		logrus.Debugf("... Failed: %v", err)
+		br.lastErr = err
+		return nil // Try again on the next loop iteration in Read, or give up there.
+	}
+	if isRetryableStatus(res.StatusCode) {
+		res.Body.Close()
+		logrus.Debugf("... Failed: status %d (%s)", res.StatusCode, http.StatusText(res.StatusCode))
+		br.lastErr = errors.Errorf("Invalid status code returned when resuming download of blob %s: %d (%s)", br.path, res.StatusCode, http.StatusText(res.StatusCode))
+		return nil
+	}
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		start, err := parseContentRangeStart(res.Header.Get("Content-Range"))
+		if err != nil || start != br.offset {
+			res.Body.Close()
+			return errors.Errorf("Error resuming download of blob %s: requested offset %d, got Content-Range %q", br.path, br.offset, res.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		// The server does not support ranges, skip the data we have already returned.
+		logrus.Debugf("... Range request ignored, skipping %d bytes", br.offset)
+		if _, err := io.CopyN(ioutil.Discard, res.Body, br.offset); err != nil {
+			res.Body.Close()
+			logrus.Debugf("... Failed: %v", err)
+			br.lastErr = err
+			return nil
+		}
+	default:
+		res.Body.Close()
+		return errors.Errorf("Invalid status code returned when resuming download of blob %s: %d (%s)", br.path, res.StatusCode, http.StatusText(res.StatusCode))
+	}
+	br.body = res.Body
+	return nil
+}
+
+// Close implements io.Closer.
+func (br *bodyReader) Close() error {
+	br.closed = true
+	if br.body == nil {
+		return nil
+	}
+	err := br.body.Close()
+	br.body = nil
+	return err
+}
+
+// parseContentRangeStart returns the first byte position from a Content-Range header value, e.g. "bytes 100-199/200".
+func parseContentRangeStart(value string) (int64, error) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(value, prefix) {
+		return -1, errors.Errorf("unsupported Content-Range %q", value)
+	}
+	rangeSpec := strings.TrimPrefix(value, prefix)
+	dash := strings.IndexByte(rangeSpec, '-')
+	if dash == -1 {
+		return -1, errors.Errorf("invalid Content-Range %q", value)
+	}
+	start, err := strconv.ParseInt(rangeSpec[:dash], 10, 64)
+	if err != nil {
+		return -1, errors.Wrapf(err, "invalid Content-Range %q", value)
+	}
+	return start, nil
+}
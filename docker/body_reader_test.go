@@ -0,0 +1,157 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseContentRangeStart(t *testing.T) {
+	for _, c := range []struct {
+		input    string
+		expected int64
+	}{
+		{"bytes 0-99/100", 0},
+		{"bytes 42-99/100", 42},
+		{"bytes 42-99/*", 42},
+	} {
+		res, err := parseContentRangeStart(c.input)
+		require.NoError(t, err, c.input)
+		assert.Equal(t, c.expected, res, c.input)
+	}
+
+	for _, input := range []string{
+		"",
+		"bytes */100",
+		"bytes x-99/100",
+		"items 0-99/100",
+	} {
+		_, err := parseContentRangeStart(input)
+		assert.Error(t, err, input)
+	}
+}
+
+// flakyBlobServer serves content, aborting the first interruptions responses after sending at most chunkSize bytes.
+type flakyBlobServer struct {
+	mutex         sync.Mutex
+	content       []byte
+	chunkSize     int
+	interruptions int
+	ignoreRange   bool
+	unavailable   bool     // Respond to all requests after the first one with http.StatusServiceUnavailable
+	requests      []string // Range headers of all requests
+}
+
+func (s *flakyBlobServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	s.requests = append(s.requests, req.Header.Get("Range"))
+	interrupt := s.interruptions > 0
+	if interrupt {
+		s.interruptions--
+	}
+	unavailable := s.unavailable && len(s.requests) > 1
+	s.mutex.Unlock()
+
+	if unavailable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	start := 0
+	if rangeHeader := req.Header.Get("Range"); rangeHeader != "" && !s.ignoreRange {
+		_, err := fmt.Sscanf(rangeHeader, "bytes=%d-", &start)
+		if err != nil || start >= len(s.content) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(s.content)-1, len(s.content)))
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(s.content)-start))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(s.content)))
+		w.WriteHeader(http.StatusOK)
+	}
+	data := s.content[start:]
+	if interrupt {
+		if len(data) > s.chunkSize {
+			data = data[:s.chunkSize]
+		}
+		w.Write(data)
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.Write(data)
+}
+
+func TestBodyReader(t *testing.T) {
+	defer func(initial, max time.Duration) {
+		bodyReaderInitialBackoff, bodyReaderMaxBackoff = initial, max
+	}(bodyReaderInitialBackoff, bodyReaderMaxBackoff)
+	bodyReaderInitialBackoff, bodyReaderMaxBackoff = 1*time.Millisecond, 10*time.Millisecond
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+	for _, c := range []struct {
+		name             string
+		interruptions    int
+		ignoreRange      bool
+		unavailable      bool
+		success          bool
+		expectedRequests int
+	}{
+		{"no interruptions", 0, false, false, true, 1},
+		{"resumed", 2, false, false, true, 3},
+		{"resumed without Range support", 2, true, false, true, 3},
+		{"too many failures", 100, false, false, false, 1 + bodyReaderMaxRetries},
+		// Resume attempts are not retried again by the client, so the number of requests is the same
+		{"too many failures with transient status", 1, false, true, false, 1 + bodyReaderMaxRetries},
+	} {
+		chunkSize := 10000
+		if !c.success {
+			chunkSize = 0 // No progress, so that the retry limit is reached
+		}
+		server := &flakyBlobServer{
+			content:       content,
+			chunkSize:     chunkSize,
+			interruptions: c.interruptions,
+			ignoreRange:   c.ignoreRange,
+			unavailable:   c.unavailable,
+		}
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+		u, err := url.Parse(ts.URL)
+		require.NoError(t, err)
+		client := &dockerClient{
+			registry: u.Host,
+			client:   ts.Client(),
+			scheme:   "http",
+		}
+
+		ctx := context.Background()
+		res, err := client.makeRequest(ctx, "GET", "/v2/repo/blobs/sha256:0", nil, nil, v2Auth, nil)
+		require.NoError(t, err, c.name)
+		require.Equal(t, http.StatusOK, res.StatusCode, c.name)
+		br := newBodyReader(ctx, client, "/v2/repo/blobs/sha256:0", res)
+		data, err := ioutil.ReadAll(br)
+		br.Close()
+		if c.success {
+			require.NoError(t, err, c.name)
+			assert.Equal(t, content, data, c.name)
+		} else {
+			assert.Error(t, err, c.name)
+			assert.True(t, strings.Contains(err.Error(), "giving up"), c.name)
+		}
+		assert.Len(t, server.requests, c.expectedRequests, c.name)
+	}
+}
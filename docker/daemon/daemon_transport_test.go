@@ -217,6 +217,7 @@ func TestReferencePolicyConfigurationNamespaces(t *testing.T) {
 		"docker.io/library/busybox",
 		"docker.io/library",
 		"docker.io",
+		"*.io",
 	}, ref.PolicyConfigurationNamespaces())
 }
 
@@ -12,11 +12,13 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/containers/image/docker/reference"
 	"github.com/containers/image/internal/iolimits"
 	"github.com/containers/image/pkg/docker/config"
+	"github.com/containers/image/pkg/sysregistriesv2"
 	"github.com/containers/image/pkg/tlsclientconfig"
 	"github.com/containers/image/types"
 	"github.com/docker/distribution/registry/client"
@@ -85,14 +87,22 @@ type dockerClient struct {
 	client        *http.Client
 	signatureBase signatureStorageBase
 	scope         authScope
+	// If true, TLS verification is skipped and HTTP (non-TLS) connections are allowed.
+	insecureSkipTLSVerify bool
 	// The following members are detected registry properties:
 	// They are set after a successful detectProperties(), and never change afterwards.
 	scheme             string // Empty value also used to indicate detectProperties() has not yet succeeded.
 	challenges         []challenge
 	supportsSignatures bool
-	// The following members are private state for setupRequestAuth, both are valid if token != nil.
-	token           *bearerToken
-	tokenExpiration time.Time
+	// Private state for setupRequestAuth, cached bearer tokens indexed by the extra scope
+	// (key: string, value: cachedBearerToken; "" is the key used when there is no extra scope).
+	tokenCache sync.Map
+}
+
+// cachedBearerToken is a bearer token obtained by setupRequestAuth, along with its expiration time.
+type cachedBearerToken struct {
+	token      *bearerToken
+	expiration time.Time
 }
 
 type authScope struct {
@@ -185,8 +195,54 @@ func dockerCertDir(sys *types.SystemContext, hostPort string) (string, error) {
 // newDockerClientFromRef returns a new dockerClient instance for refHostname (a host a specified in the Docker image reference, not canonicalized to dockerRegistry)
 // “write” specifies whether the client will be used for "write" access (in particular passed to lookaside.go:toplevelFromSection)
 func newDockerClientFromRef(sys *types.SystemContext, ref dockerReference, write bool, actions string) (*dockerClient, error) {
-	registry := reference.Domain(ref.ref)
-	username, password, err := config.GetAuthentication(sys, reference.Domain(ref.ref))
+	reg, err := registriesConfigurationFor(sys, ref.ref.Name())
+	if err != nil {
+		return nil, err
+	}
+	insecure := false
+	if reg != nil {
+		if reg.Blocked {
+			return nil, errors.Errorf("registry %s is blocked in the registries configuration", reg.Prefix)
+		}
+		insecure = reg.Insecure
+	}
+	return newDockerClientForLocation(sys, ref, ref.ref, insecure, write, actions)
+}
+
+// newDockerClientForPrimaryLocation returns a new dockerClient instance for accessing ref at its primary location,
+// i.e. rewritten by the registries configuration but not using any mirrors, and the rewritten reference.
+// “write” specifies whether the client will be used for "write" access (in particular passed to lookaside.go:toplevelFromSection)
+func newDockerClientForPrimaryLocation(sys *types.SystemContext, ref dockerReference, write bool, actions string) (*dockerClient, reference.Named, error) {
+	reg, err := registriesConfigurationFor(sys, ref.ref.Name())
+	if err != nil {
+		return nil, nil, err
+	}
+	primary := sysregistriesv2.PullSource{Reference: ref.ref}
+	if reg != nil {
+		if reg.Blocked {
+			return nil, nil, errors.Errorf("registry %s is blocked in the registries configuration", reg.Prefix)
+		}
+		pullSources, err := reg.PullSourcesFromReference(ref.ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		primary = pullSources[len(pullSources)-1] // PullSourcesFromReference returns the primary location last.
+	}
+	c, err := newDockerClientForLocation(sys, ref, primary.Reference, primary.Insecure, write, actions)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, primary.Reference, nil
+}
+
+// newDockerClientForLocation returns a new dockerClient instance for accessing the image ref at location,
+// which may differ from ref if it was rewritten by the registries configuration (e.g. to point to a mirror).
+// ref is used to look up the signature storage; the registry and repository are taken from location.
+// insecure specifies whether TLS verification is skipped and HTTP (non-TLS) connections are allowed for location.
+// “write” specifies whether the client will be used for "write" access (in particular passed to lookaside.go:toplevelFromSection)
+func newDockerClientForLocation(sys *types.SystemContext, ref dockerReference, location reference.Named, insecure, write bool, actions string) (*dockerClient, error) {
+	registry := reference.Domain(location)
+	username, password, err := config.GetAuthentication(sys, registry)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error getting username and password")
 	}
@@ -194,13 +250,32 @@ func newDockerClientFromRef(sys *types.SystemContext, ref dockerReference, write
 	if err != nil {
 		return nil, err
 	}
-	remoteName := reference.Path(ref.ref)
+	remoteName := reference.Path(location)
+
+	return newDockerClientWithDetails(sys, registry, username, password, actions, sigBase, remoteName, insecure)
+}
+
+// registriesConfigurationFor returns the registries configuration which applies to ref (a reference or a registry host[:port]),
+// or nil if there is none.
+func registriesConfigurationFor(sys *types.SystemContext, ref string) (*sysregistriesv2.Registry, error) {
+	reg, err := sysregistriesv2.FindRegistryForReference(sys, ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading registries configuration")
+	}
+	return reg, nil
+}
 
-	return newDockerClientWithDetails(sys, registry, username, password, actions, sigBase, remoteName)
+// registryIsInsecure returns true if the registries configuration allows insecure access to registry.
+func registryIsInsecure(sys *types.SystemContext, registry string) (bool, error) {
+	reg, err := registriesConfigurationFor(sys, registry)
+	if err != nil {
+		return false, err
+	}
+	return reg != nil && reg.Insecure, nil
 }
 
 // newDockerClientWithDetails returns a new dockerClient instance for the given parameters
-func newDockerClientWithDetails(sys *types.SystemContext, registry, username, password, actions string, sigBase signatureStorageBase, remoteName string) (*dockerClient, error) {
+func newDockerClientWithDetails(sys *types.SystemContext, registry, username, password, actions string, sigBase signatureStorageBase, remoteName string, insecure bool) (*dockerClient, error) {
 	hostName := registry
 	if registry == dockerHostname {
 		registry = dockerRegistry
@@ -222,16 +297,20 @@ func newDockerClientWithDetails(sys *types.SystemContext, registry, username, pa
 	}
 
 	if sys != nil && sys.DockerInsecureSkipTLSVerify {
+		insecure = true
+	}
+	if insecure {
 		tr.TLSClientConfig.InsecureSkipVerify = true
 	}
 
 	return &dockerClient{
-		sys:           sys,
-		registry:      registry,
-		username:      username,
-		password:      password,
-		client:        &http.Client{Transport: tr},
-		signatureBase: sigBase,
+		sys:                   sys,
+		registry:              registry,
+		username:              username,
+		password:              password,
+		client:                &http.Client{Transport: tr},
+		signatureBase:         sigBase,
+		insecureSkipTLSVerify: insecure,
 		scope: authScope{
 			actions:    actions,
 			remoteName: remoteName,
@@ -242,12 +321,16 @@ func newDockerClientWithDetails(sys *types.SystemContext, registry, username, pa
 // CheckAuth validates the credentials by attempting to log into the registry
 // returns an error if an error occcured while making the http request or the status code received was 401
 func CheckAuth(ctx context.Context, sys *types.SystemContext, username, password, registry string) error {
-	newLoginClient, err := newDockerClientWithDetails(sys, registry, username, password, "", nil, "")
+	insecure, err := registryIsInsecure(sys, registry)
+	if err != nil {
+		return err
+	}
+	newLoginClient, err := newDockerClientWithDetails(sys, registry, username, password, "", nil, "", insecure)
 	if err != nil {
 		return errors.Wrapf(err, "error creating new docker client")
 	}
 
-	resp, err := newLoginClient.makeRequest(ctx, "GET", "/v2/", nil, nil, v2Auth)
+	resp, err := newLoginClient.makeRequest(ctx, "GET", "/v2/", nil, nil, v2Auth, nil)
 	if err != nil {
 		return err
 	}
@@ -299,13 +382,18 @@ func SearchRegistry(ctx context.Context, sys *types.SystemContext, registry, ima
 		return nil, errors.Wrapf(err, "error getting username and password")
 	}
 
+	insecure, err := registryIsInsecure(sys, registry)
+	if err != nil {
+		return nil, err
+	}
+
 	// The /v2/_catalog endpoint has been disabled for docker.io therefore the call made to that endpoint will fail
 	// So using the v1 hostname for docker.io for simplicity of implementation and the fact that it returns search results
 	if registry == dockerHostname {
 		registry = dockerV1Hostname
 	}
 
-	client, err := newDockerClientWithDetails(sys, registry, username, password, "", nil, "")
+	client, err := newDockerClientWithDetails(sys, registry, username, password, "", nil, "", insecure)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error creating new docker client")
 	}
@@ -323,7 +411,7 @@ func SearchRegistry(ctx context.Context, sys *types.SystemContext, registry, ima
 		u.RawQuery = q.Encode()
 
 		logrus.Debugf("trying to talk to v1 search endpoint\n")
-		resp, err := client.makeRequest(ctx, "GET", u.String(), nil, nil, noAuth)
+		resp, err := client.makeRequest(ctx, "GET", u.String(), nil, nil, noAuth, nil)
 		if err != nil {
 			logrus.Debugf("error getting search results from v1 endpoint %q: %v", registry, err)
 		} else {
@@ -340,7 +428,7 @@ func SearchRegistry(ctx context.Context, sys *types.SystemContext, registry, ima
 	}
 
 	logrus.Debugf("trying to talk to v2 search endpoint\n")
-	resp, err := client.makeRequest(ctx, "GET", "/v2/_catalog", nil, nil, v2Auth)
+	resp, err := client.makeRequest(ctx, "GET", "/v2/_catalog", nil, nil, v2Auth, nil)
 	if err != nil {
 		logrus.Debugf("error getting search results from v2 endpoint %q: %v", registry, err)
 	} else {
@@ -369,20 +457,64 @@ func SearchRegistry(ctx context.Context, sys *types.SystemContext, registry, ima
 
 // makeRequest creates and executes a http.Request with the specified parameters, adding authentication and TLS options for the Docker client.
 // The host name and schema is taken from the client or autodetected, and the path is relative to it, i.e. the path usually starts with /v2/.
-func (c *dockerClient) makeRequest(ctx context.Context, method, path string, headers map[string][]string, stream io.Reader, auth sendAuth) (*http.Response, error) {
+// extraScope, if not nil, is an additional scope requested in the bearer token, e.g. to allow reading from another repository.
+func (c *dockerClient) makeRequest(ctx context.Context, method, path string, headers map[string][]string, stream io.Reader, auth sendAuth, extraScope *authScope) (*http.Response, error) {
 	if err := c.detectProperties(ctx); err != nil {
 		return nil, err
 	}
 
 	url := fmt.Sprintf("%s://%s%s", c.scheme, c.registry, path)
-	return c.makeRequestToResolvedURL(ctx, method, url, headers, stream, -1, auth)
+	return c.makeRequestToResolvedURL(ctx, method, url, headers, stream, -1, auth, extraScope)
+}
+
+// makeRequestOnce is makeRequest, without any retries; it is intended for callers which handle transient failures themselves.
+func (c *dockerClient) makeRequestOnce(ctx context.Context, method, path string, headers map[string][]string, stream io.Reader, auth sendAuth, extraScope *authScope) (*http.Response, error) {
+	if err := c.detectProperties(ctx); err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s://%s%s", c.scheme, c.registry, path)
+	return c.makeRequestToResolvedURLOnce(ctx, method, url, headers, stream, -1, auth, extraScope)
 }
 
 // makeRequestToResolvedURL creates and executes a http.Request with the specified parameters, adding authentication and TLS options for the Docker client.
 // streamLen, if not -1, specifies the length of the data expected on stream.
+// extraScope, if not nil, is an additional scope requested in the bearer token.
+// Idempotent requests are retried on transient failures, see doWithRetries.
 // makeRequest should generally be preferred.
 // TODO(runcom): too many arguments here, use a struct
-func (c *dockerClient) makeRequestToResolvedURL(ctx context.Context, method, url string, headers map[string][]string, stream io.Reader, streamLen int64, auth sendAuth) (*http.Response, error) {
+func (c *dockerClient) makeRequestToResolvedURL(ctx context.Context, method, url string, headers map[string][]string, stream io.Reader, streamLen int64, auth sendAuth, extraScope *authScope) (*http.Response, error) {
+	if !isIdempotentRequest(method, stream) {
+		return c.makeRequestToResolvedURLOnce(ctx, method, url, headers, stream, streamLen, auth, extraScope)
+	}
+	// The request, including the authentication, is only set up once: getBearerToken retries obtaining a token on its own,
+	// and retrying it again here would multiply the number of attempts.
+	req, err := c.newRequestToResolvedURL(ctx, method, url, headers, stream, streamLen, auth, extraScope)
+	if err != nil {
+		return nil, err
+	}
+	return c.doWithRetries(ctx, method, url, func() (*http.Response, error) {
+		logrus.Debugf("%s %s", method, url)
+		return c.client.Do(req)
+	})
+}
+
+// makeRequestToResolvedURLOnce is makeRequestToResolvedURL, without any retries of the request itself.
+func (c *dockerClient) makeRequestToResolvedURLOnce(ctx context.Context, method, url string, headers map[string][]string, stream io.Reader, streamLen int64, auth sendAuth, extraScope *authScope) (*http.Response, error) {
+	req, err := c.newRequestToResolvedURL(ctx, method, url, headers, stream, streamLen, auth, extraScope)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("%s %s", method, url)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// newRequestToResolvedURL creates a request for makeRequestToResolvedURL and makeRequestToResolvedURLOnce, including any authentication.
+func (c *dockerClient) newRequestToResolvedURL(ctx context.Context, method, url string, headers map[string][]string, stream io.Reader, streamLen int64, auth sendAuth, extraScope *authScope) (*http.Request, error) {
 	req, err := http.NewRequest(method, url, stream)
 	if err != nil {
 		return nil, err
@@ -401,16 +533,11 @@ func (c *dockerClient) makeRequestToResolvedURL(ctx context.Context, method, url
 		req.Header.Add("User-Agent", c.sys.DockerRegistryUserAgent)
 	}
 	if auth == v2Auth {
-		if err := c.setupRequestAuth(req); err != nil {
+		if err := c.setupRequestAuth(req, extraScope); err != nil {
 			return nil, err
 		}
 	}
-	logrus.Debugf("%s %s", method, url)
-	res, err := c.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	return res, nil
+	return req, nil
 }
 
 // we're using the challenges from the /v2/ ping response and not the one from the destination
@@ -420,7 +547,7 @@ func (c *dockerClient) makeRequestToResolvedURL(ctx context.Context, method, url
 // 2) gcr.io is sending 401 without a WWW-Authenticate header in the real request
 //
 // debugging: https://github.com/containers/image/pull/211#issuecomment-273426236 and follows up
-func (c *dockerClient) setupRequestAuth(req *http.Request) error {
+func (c *dockerClient) setupRequestAuth(req *http.Request, extraScope *authScope) error {
 	if len(c.challenges) == 0 {
 		return nil
 	}
@@ -432,24 +559,34 @@ func (c *dockerClient) setupRequestAuth(req *http.Request) error {
 			req.SetBasicAuth(c.username, c.password)
 			return nil
 		case "bearer":
-			if c.token == nil || time.Now().After(c.tokenExpiration) {
+			scopes := []authScope{c.scope}
+			cacheKey := ""
+			if extraScope != nil {
+				scopes = append(scopes, *extraScope)
+				// Repository names can't contain ':', so this is unambiguous.
+				cacheKey = fmt.Sprintf("%s:%s", extraScope.remoteName, extraScope.actions)
+			}
+			var cached cachedBearerToken
+			if v, ok := c.tokenCache.Load(cacheKey); ok {
+				cached = v.(cachedBearerToken)
+			}
+			if cached.token == nil || time.Now().After(cached.expiration) {
 				realm, ok := challenge.Parameters["realm"]
 				if !ok {
 					return errors.Errorf("missing realm in bearer auth challenge")
 				}
 				service, _ := challenge.Parameters["service"] // Will be "" if not present
-				var scope string
-				if c.scope.remoteName != "" && c.scope.actions != "" {
-					scope = fmt.Sprintf("repository:%s:%s", c.scope.remoteName, c.scope.actions)
-				}
-				token, err := c.getBearerToken(req.Context(), realm, service, scope)
+				token, err := c.getBearerToken(req.Context(), realm, service, scopes)
 				if err != nil {
 					return err
 				}
-				c.token = token
-				c.tokenExpiration = token.IssuedAt.Add(time.Duration(token.ExpiresIn) * time.Second)
+				cached = cachedBearerToken{
+					token:      token,
+					expiration: token.IssuedAt.Add(time.Duration(token.ExpiresIn) * time.Second),
+				}
+				c.tokenCache.Store(cacheKey, cached)
 			}
-			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token.Token))
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", cached.token.Token))
 			return nil
 		default:
 			logrus.Debugf("no handler for %s authentication", challenge.Scheme)
@@ -459,7 +596,8 @@ func (c *dockerClient) setupRequestAuth(req *http.Request) error {
 	return nil
 }
 
-func (c *dockerClient) getBearerToken(ctx context.Context, realm, service, scope string) (*bearerToken, error) {
+// getBearerToken obtains a token from realm for service, valid for all of scopes (ignoring incomplete ones).
+func (c *dockerClient) getBearerToken(ctx context.Context, realm, service string, scopes []authScope) (*bearerToken, error) {
 	authReq, err := http.NewRequest("GET", realm, nil)
 	if err != nil {
 		return nil, err
@@ -472,8 +610,10 @@ func (c *dockerClient) getBearerToken(ctx context.Context, realm, service, scope
 	if service != "" {
 		getParams.Add("service", service)
 	}
-	if scope != "" {
-		getParams.Add("scope", scope)
+	for _, scope := range scopes {
+		if scope.remoteName != "" && scope.actions != "" {
+			getParams.Add("scope", fmt.Sprintf("repository:%s:%s", scope.remoteName, scope.actions))
+		}
 	}
 	authReq.URL.RawQuery = getParams.Encode()
 	if c.username != "" && c.password != "" {
@@ -484,7 +624,9 @@ func (c *dockerClient) getBearerToken(ctx context.Context, realm, service, scope
 	// TODO(runcom): insecure for now to contact the external token service
 	tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	client := &http.Client{Transport: tr}
-	res, err := client.Do(authReq)
+	res, err := c.doWithRetries(ctx, authReq.Method, authReq.URL.String(), func() (*http.Response, error) {
+		return client.Do(authReq)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -514,7 +656,8 @@ func (c *dockerClient) detectProperties(ctx context.Context) error {
 
 	ping := func(scheme string) error {
 		url := fmt.Sprintf(resolvedPingV2URL, scheme, c.registry)
-		resp, err := c.makeRequestToResolvedURL(ctx, "GET", url, nil, nil, -1, noAuth)
+		// Don't retry pings, an error only means that we should try another scheme or report it.
+		resp, err := c.makeRequestToResolvedURLOnce(ctx, "GET", url, nil, nil, -1, noAuth, nil)
 		if err != nil {
 			logrus.Debugf("Ping %s err %s (%#v)", url, err.Error(), err)
 			return err
@@ -530,7 +673,7 @@ func (c *dockerClient) detectProperties(ctx context.Context) error {
 		return nil
 	}
 	err := ping("https")
-	if err != nil && c.sys != nil && c.sys.DockerInsecureSkipTLSVerify {
+	if err != nil && c.insecureSkipTLSVerify {
 		err = ping("http")
 	}
 	if err != nil {
@@ -541,7 +684,7 @@ func (c *dockerClient) detectProperties(ctx context.Context) error {
 		// best effort to understand if we're talking to a V1 registry
 		pingV1 := func(scheme string) bool {
 			url := fmt.Sprintf(resolvedPingV1URL, scheme, c.registry)
-			resp, err := c.makeRequestToResolvedURL(ctx, "GET", url, nil, nil, -1, noAuth)
+			resp, err := c.makeRequestToResolvedURLOnce(ctx, "GET", url, nil, nil, -1, noAuth, nil)
 			if err != nil {
 				logrus.Debugf("Ping %s err %s (%#v)", url, err.Error(), err)
 				return false
@@ -554,7 +697,7 @@ func (c *dockerClient) detectProperties(ctx context.Context) error {
 			return true
 		}
 		isV1 := pingV1("https")
-		if !isV1 && c.sys != nil && c.sys.DockerInsecureSkipTLSVerify {
+		if !isV1 && c.insecureSkipTLSVerify {
 			isV1 = pingV1("http")
 		}
 		if isV1 {
@@ -568,7 +711,7 @@ func (c *dockerClient) detectProperties(ctx context.Context) error {
 // using the original data structures.
 func (c *dockerClient) getExtensionsSignatures(ctx context.Context, ref dockerReference, manifestDigest digest.Digest) (*extensionSignatureList, error) {
 	path := fmt.Sprintf(extensionsSignaturePath, reference.Path(ref.ref), manifestDigest)
-	res, err := c.makeRequest(ctx, "GET", path, nil, nil, v2Auth)
+	res, err := c.makeRequest(ctx, "GET", path, nil, nil, v2Auth, nil)
 	if err != nil {
 		return nil, err
 	}
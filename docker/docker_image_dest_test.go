@@ -0,0 +1,144 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/pkg/blobinfocache"
+	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mountTestRegistry is a minimal fake registry implementing bearer token authentication and cross-repository blob mounts.
+type mountTestRegistry struct {
+	mutex       sync.Mutex
+	allowMount  bool
+	blobs       map[string]bool // "repo@digest"
+	tokenScopes [][]string      // Scopes requested in each token request
+	deleted     []string        // Paths of canceled uploads
+}
+
+func (r *mountTestRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	switch {
+	case req.URL.Path == "/token":
+		r.tokenScopes = append(r.tokenScopes, req.URL.Query()["scope"])
+		fmt.Fprintf(w, `{"token":"token%d"}`, len(r.tokenScopes))
+	case req.Method == "HEAD" && strings.Contains(req.URL.Path, "/blobs/"):
+		i := strings.Index(req.URL.Path, "/blobs/")
+		key := req.URL.Path[len("/v2/"):i] + "@" + req.URL.Path[i+len("/blobs/"):]
+		if !r.blobs[key] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", "1234")
+		w.WriteHeader(http.StatusOK)
+	case req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/blobs/uploads/"):
+		repo := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/v2/"), "/blobs/uploads/")
+		mount, from := req.URL.Query().Get("mount"), req.URL.Query().Get("from")
+		if r.allowMount && mount != "" && r.blobs[from+"@"+mount] {
+			r.blobs[repo+"@"+mount] = true
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/upload-id")
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == "DELETE" && strings.Contains(req.URL.Path, "/blobs/uploads/"):
+		r.deleted = append(r.deleted, req.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestDockerImageDestinationTryReusingBlobMount(t *testing.T) {
+	blobDigest := digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000000")
+
+	for _, allowMount := range []bool{true, false} {
+		registry := &mountTestRegistry{
+			allowMount: allowMount,
+			blobs:      map[string]bool{"dev/foo@" + blobDigest.String(): true},
+		}
+		server := httptest.NewServer(registry)
+		defer server.Close()
+		serverURL, err := url.Parse(server.URL)
+		require.NoError(t, err)
+
+		named, err := reference.ParseNormalizedNamed(serverURL.Host + "/prod/foo:latest")
+		require.NoError(t, err)
+		ref, err := newReference(named)
+		require.NoError(t, err)
+		srcNamed, err := reference.ParseNormalizedNamed(serverURL.Host + "/dev/foo")
+		require.NoError(t, err)
+		dest := &dockerImageDestination{
+			ref: ref,
+			c: &dockerClient{
+				registry:   serverURL.Host,
+				client:     server.Client(),
+				scope:      authScope{remoteName: "prod/foo", actions: "pull,push"},
+				scheme:     "http",
+				challenges: []challenge{{Scheme: "bearer", Parameters: map[string]string{"realm": server.URL + "/token"}}},
+			},
+		}
+
+		cache := blobinfocache.NewMemoryCache()
+		cache.RecordKnownLocation(ref.Transport(), bicTransportScope(ref), blobDigest, types.BICLocationReference{Opaque: srcNamed.Name()})
+		reused, info, err := dest.TryReusingBlob(context.Background(), types.BlobInfo{Digest: blobDigest, Size: -1}, cache, false)
+		require.NoError(t, err)
+		if allowMount {
+			assert.True(t, reused)
+			assert.Equal(t, types.BlobInfo{Digest: blobDigest, Size: 1234}, info)
+			assert.Empty(t, registry.deleted)
+			candidates := cache.CandidateLocations(ref.Transport(), bicTransportScope(ref), blobDigest, false)
+			assert.Contains(t, candidates, types.BICReplacementCandidate{Digest: blobDigest, Location: newBICLocationReference(ref)})
+		} else {
+			assert.False(t, reused)
+			assert.Equal(t, []string{"/v2/prod/foo/blobs/uploads/upload-id"}, registry.deleted)
+		}
+		// The mount request asks for a token which also allows pulling from the source repository.
+		assert.Contains(t, registry.tokenScopes, []string{"repository:prod/foo:pull,push", "repository:dev/foo:pull"})
+	}
+}
+
+func TestDockerClientTokenCacheExtraScope(t *testing.T) {
+	registry := &mountTestRegistry{}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	c := &dockerClient{
+		client:     server.Client(),
+		scope:      authScope{remoteName: "prod/foo", actions: "pull,push"},
+		challenges: []challenge{{Scheme: "bearer", Parameters: map[string]string{"realm": server.URL + "/token"}}},
+	}
+
+	for _, e := range []struct {
+		extraScope    *authScope
+		expectedToken string
+	}{
+		{nil, "Bearer token1"},
+		{&authScope{remoteName: "dev/foo", actions: "pull"}, "Bearer token2"},
+		{nil, "Bearer token1"}, // Cached
+		{&authScope{remoteName: "dev/foo", actions: "pull"}, "Bearer token2"}, // Cached
+		{&authScope{remoteName: "dev/bar", actions: "pull"}, "Bearer token3"},
+	} {
+		req, err := http.NewRequest("GET", server.URL+"/v2/", nil)
+		require.NoError(t, err)
+		err = c.setupRequestAuth(req, e.extraScope)
+		require.NoError(t, err)
+		assert.Equal(t, e.expectedToken, req.Header.Get("Authorization"))
+	}
+	assert.Equal(t, [][]string{
+		{"repository:prod/foo:pull,push"},
+		{"repository:prod/foo:pull,push", "repository:dev/foo:pull"},
+		{"repository:prod/foo:pull,push", "repository:dev/bar:pull"},
+	}, registry.tokenScopes)
+}
@@ -1,9 +1,23 @@
 package docker
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSimplifyContentType(t *testing.T) {
@@ -22,3 +36,119 @@ func TestSimplifyContentType(t *testing.T) {
 		assert.Equal(t, c.expected, out, c.input)
 	}
 }
+
+// mirrorTestRegistry is a minimal fake registry serving a single manifest from repo, and recording all requests.
+type mirrorTestRegistry struct {
+	repo     string // Empty if the registry does not contain any images
+	manifest []byte
+	mutex    sync.Mutex
+	requests []string // "METHOD path" of each request
+}
+
+func (r *mirrorTestRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	r.mutex.Unlock()
+
+	manifestDigest := digest.FromBytes(r.manifest)
+	switch {
+	case req.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case r.repo == "":
+		http.Error(w, `{"errors":[{"code":"NAME_UNKNOWN","message":"repository name not known to registry"}]}`, http.StatusNotFound)
+	case req.Method == "GET" && req.URL.Path == "/v2/"+r.repo+"/manifests/latest":
+		w.Header().Set("Content-Type", manifest.DockerV2Schema2MediaType)
+		w.Header().Set("Docker-Content-Digest", manifestDigest.String())
+		w.Write(r.manifest)
+	case req.Method == "GET" && req.URL.Path == "/v2/"+r.repo+"/tags/list":
+		fmt.Fprintf(w, `{"name":%q,"tags":["latest"]}`, r.repo)
+	case req.Method == "DELETE" && req.URL.Path == "/v2/"+r.repo+"/manifests/"+manifestDigest.String():
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "unexpected request", http.StatusNotFound)
+	}
+}
+
+func TestImageSourceMirrorFallback(t *testing.T) {
+	manifestBlob := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json",` +
+		`"config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":2,"digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"},"layers":[]}`)
+	mirror := &mirrorTestRegistry{}
+	mirrorServer := httptest.NewServer(mirror)
+	defer mirrorServer.Close()
+	mirrorURL, err := url.Parse(mirrorServer.URL)
+	require.NoError(t, err)
+	mirrorHost := "localhost:" + mirrorURL.Port() // registries.conf does not accept IP addresses with a port.
+	primary := &mirrorTestRegistry{repo: "primary/app", manifest: manifestBlob}
+	primaryServer := httptest.NewServer(primary)
+	defer primaryServer.Close()
+	primaryURL, err := url.Parse(primaryServer.URL)
+	require.NoError(t, err)
+	primaryHost := "localhost:" + primaryURL.Port()
+
+	tmpDir, err := ioutil.TempDir("", "docker-mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	confPath := filepath.Join(tmpDir, "registries.conf")
+	err = ioutil.WriteFile(confPath, []byte(fmt.Sprintf(`
+[[registry]]
+prefix = "example.com/app"
+url = "%s/primary/app"
+insecure = true
+
+[[registry.mirror]]
+url = "%s/mirror/app"
+insecure = true
+
+[[registry]]
+url = "blocked.example.com"
+blocked = true
+`, primaryHost, mirrorHost)), 0600)
+	require.NoError(t, err)
+	sys := &types.SystemContext{
+		SystemRegistriesConfPath: confPath,
+		RegistriesDirPath:        tmpDir,
+		DockerPerHostCertDirPath: tmpDir,
+		DockerAuthConfig:         &types.DockerAuthConfig{},
+	}
+	ctx := context.Background()
+
+	named, err := reference.ParseNormalizedNamed("example.com/app:latest")
+	require.NoError(t, err)
+	ref, err := newReference(named)
+	require.NoError(t, err)
+
+	// The image is pulled from the primary location after the mirror fails
+	src, err := newImageSource(ctx, sys, ref)
+	require.NoError(t, err)
+	defer src.Close()
+	assert.Equal(t, primaryHost+"/primary/app:latest", src.physicalRef.ref.String())
+	assert.Equal(t, "example.com/app:latest", src.Reference().DockerReference().String())
+	m, mimeType, err := src.GetManifest(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, manifestBlob, m)
+	assert.Equal(t, manifest.DockerV2Schema2MediaType, mimeType)
+	assert.Contains(t, mirror.requests, "GET /v2/mirror/app/manifests/latest")
+
+	// Tags are listed, and images deleted, at the primary location, never using the mirror
+	mirror.requests = nil
+	tags, err := GetRepositoryTags(ctx, sys, ref)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"latest"}, tags)
+	err = deleteImage(ctx, sys, ref)
+	require.NoError(t, err)
+	assert.Contains(t, primary.requests, "GET /v2/primary/app/tags/list")
+	assert.Contains(t, primary.requests, "DELETE /v2/primary/app/manifests/"+digest.FromBytes(manifestBlob).String())
+	assert.Empty(t, mirror.requests)
+
+	// Blocked registries are not accessed at all
+	named, err = reference.ParseNormalizedNamed("blocked.example.com/app:latest")
+	require.NoError(t, err)
+	ref, err = newReference(named)
+	require.NoError(t, err)
+	_, err = newImageSource(ctx, sys, ref)
+	assert.Error(t, err)
+	_, err = GetRepositoryTags(ctx, sys, ref)
+	assert.Error(t, err)
+	err = deleteImage(ctx, sys, ref)
+	assert.Error(t, err)
+}
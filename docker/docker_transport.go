@@ -3,6 +3,7 @@ package docker
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"strings"
 
 	"github.com/containers/image/docker/policyconfiguration"
@@ -35,12 +36,20 @@ func (t dockerTransport) ParseReference(reference string) (types.ImageReference,
 // It is acceptable to allow an invalid value which will never be matched, it can "only" cause user confusion.
 // scope passed to this function will not be "", that value is always allowed.
 func (t dockerTransport) ValidatePolicyConfigurationScope(scope string) error {
+	// Wildcards are only accepted in the form returned by policyconfiguration.DockerReferenceNamespaces,
+	// i.e. "*." followed by a host name without a port.
+	if strings.Contains(scope, "*") && !wildcardScopeRegexp.MatchString(scope) {
+		return errors.Errorf("Invalid scope %s: wildcards are only supported in the form *.domain.name", scope)
+	}
 	// FIXME? We could be verifying the various character set and length restrictions
 	// from docker/distribution/reference.regexp.go, but other than that there
 	// are few semantically invalid strings.
 	return nil
 }
 
+// wildcardScopeRegexp matches a scope which applies to all subdomains of a host name, e.g. "*.example.com".
+var wildcardScopeRegexp = regexp.MustCompile(`^\*(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)+$`)
+
 // dockerReference is an ImageReference for Docker images.
 type dockerReference struct {
 	ref reference.Named // By construction we know that !reference.IsNameOnly(ref)
@@ -61,8 +70,13 @@ func ParseReference(refString string) (types.ImageReference, error) {
 
 // NewReference returns a Docker reference for a named reference. The reference must satisfy !reference.IsNameOnly().
 func NewReference(ref reference.Named) (types.ImageReference, error) {
+	return newReference(ref)
+}
+
+// newReference returns a dockerReference for a named reference.
+func newReference(ref reference.Named) (dockerReference, error) {
 	if reference.IsNameOnly(ref) {
-		return nil, errors.Errorf("Docker reference %s has neither a tag nor a digest", reference.FamiliarString(ref))
+		return dockerReference{}, errors.Errorf("Docker reference %s has neither a tag nor a digest", reference.FamiliarString(ref))
 	}
 	// A github.com/distribution/reference value can have a tag and a digest at the same time!
 	// The docker/distribution API does not really support that (we can’t ask for an image with a specific
@@ -72,7 +86,7 @@ func NewReference(ref reference.Named) (types.ImageReference, error) {
 	_, isTagged := ref.(reference.NamedTagged)
 	_, isDigested := ref.(reference.Canonical)
 	if isTagged && isDigested {
-		return nil, errors.Errorf("Docker references with both a tag and digest are currently not supported")
+		return dockerReference{}, errors.Errorf("Docker references with both a tag and digest are currently not supported")
 	}
 	return dockerReference{
 		ref: ref,
@@ -135,7 +149,7 @@ func (ref dockerReference) NewImage(ctx context.Context, sys *types.SystemContex
 // NewImageSource returns a types.ImageSource for this reference.
 // The caller must call .Close() on the returned ImageSource.
 func (ref dockerReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
-	return newImageSource(sys, ref)
+	return newImageSource(ctx, sys, ref)
 }
 
 // NewImageDestination returns a types.ImageDestination for this reference.
@@ -30,10 +30,28 @@ func TestTransportValidatePolicyConfigurationScope(t *testing.T) {
 		"docker.io/library/busybox",
 		"docker.io/library",
 		"docker.io",
+		"*.io",
+		"*.registry.corp.example",
+		"*.Example-1.com",
 	} {
 		err := Transport.ValidatePolicyConfigurationScope(scope)
 		assert.NoError(t, err, scope)
 	}
+
+	for _, scope := range []string{
+		"*",
+		"*.",
+		"*example.com",
+		"*.*.example.com",
+		"a.*.example.com",
+		"*.example.com:5000",
+		"*.example.com/ns",
+		"*.-example.com",
+		"docker.io/library/*",
+	} {
+		err := Transport.ValidatePolicyConfigurationScope(scope)
+		assert.Error(t, err, scope)
+	}
 }
 
 func TestParseReference(t *testing.T) {
@@ -147,6 +165,7 @@ func TestReferencePolicyConfigurationNamespaces(t *testing.T) {
 		"docker.io/library/busybox",
 		"docker.io/library",
 		"docker.io",
+		"*.io",
 	}, ref.PolicyConfigurationNamespaces())
 }
 
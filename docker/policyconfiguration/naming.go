@@ -52,5 +52,21 @@ func DockerReferenceNamespaces(ref reference.Named) []string {
 		}
 		name = name[:lastSlash]
 	}
+
+	// Finally, look for wildcard matches of the parent domains of the host name,
+	// most specific first: "a.b.example.com" is looked up as "*.b.example.com",
+	// "*.example.com", and "*.com". The wildcards do not match the port number, if any,
+	// and a wildcard does not match the parent domain itself ("*.example.com" does not match "example.com").
+	if portColon := strings.Index(name, ":"); portColon != -1 {
+		name = name[:portColon]
+	}
+	for {
+		firstDot := strings.Index(name, ".")
+		if firstDot == -1 {
+			break
+		}
+		name = name[firstDot+1:]
+		res = append(res, "*."+name)
+	}
 	return res
 }
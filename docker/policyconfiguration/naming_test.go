@@ -18,18 +18,21 @@ func TestDockerReference(t *testing.T) {
 	// and that DockerReferenceNamespaces starts with the expected value (fullName), i.e. that the two functions are
 	// consistent.
 	for inputName, expectedNS := range map[string][]string{
-		"example.com/ns/repo": {"example.com/ns/repo", "example.com/ns", "example.com"},
-		"example.com/repo":    {"example.com/repo", "example.com"},
+		"example.com/ns/repo": {"example.com/ns/repo", "example.com/ns", "example.com", "*.com"},
+		"example.com/repo":    {"example.com/repo", "example.com", "*.com"},
 		"localhost/ns/repo":   {"localhost/ns/repo", "localhost/ns", "localhost"},
 		// Note that "localhost" is special here: notlocalhost/repo is parsed as docker.io/notlocalhost.repo:
 		"localhost/repo":         {"localhost/repo", "localhost"},
-		"notlocalhost/repo":      {"docker.io/notlocalhost/repo", "docker.io/notlocalhost", "docker.io"},
-		"docker.io/ns/repo":      {"docker.io/ns/repo", "docker.io/ns", "docker.io"},
-		"docker.io/library/repo": {"docker.io/library/repo", "docker.io/library", "docker.io"},
-		"docker.io/repo":         {"docker.io/library/repo", "docker.io/library", "docker.io"},
-		"ns/repo":                {"docker.io/ns/repo", "docker.io/ns", "docker.io"},
-		"library/repo":           {"docker.io/library/repo", "docker.io/library", "docker.io"},
-		"repo":                   {"docker.io/library/repo", "docker.io/library", "docker.io"},
+		"localhost:5000/repo":    {"localhost:5000/repo", "localhost:5000"},
+		"notlocalhost/repo":      {"docker.io/notlocalhost/repo", "docker.io/notlocalhost", "docker.io", "*.io"},
+		"docker.io/ns/repo":      {"docker.io/ns/repo", "docker.io/ns", "docker.io", "*.io"},
+		"docker.io/library/repo": {"docker.io/library/repo", "docker.io/library", "docker.io", "*.io"},
+		"docker.io/repo":         {"docker.io/library/repo", "docker.io/library", "docker.io", "*.io"},
+		"ns/repo":                {"docker.io/ns/repo", "docker.io/ns", "docker.io", "*.io"},
+		"library/repo":           {"docker.io/library/repo", "docker.io/library", "docker.io", "*.io"},
+		"repo":                   {"docker.io/library/repo", "docker.io/library", "docker.io", "*.io"},
+		"a.b.example.com:5000/ns/repo": {"a.b.example.com:5000/ns/repo", "a.b.example.com:5000/ns", "a.b.example.com:5000",
+			"*.b.example.com", "*.example.com", "*.com"},
 	} {
 		for inputSuffix, mappedSuffix := range map[string]string{
 			":tag":       ":tag",
@@ -49,8 +52,15 @@ func TestDockerReference(t *testing.T) {
 			moreSpecific := identity
 			for i := range expectedNS {
 				assert.Equal(t, ns[i], expectedNS[i], fmt.Sprintf("%s item %d", fullInput, i))
-				assert.True(t, strings.HasPrefix(moreSpecific, ns[i]))
-				moreSpecific = ns[i]
+				if strings.HasPrefix(ns[i], "*.") {
+					// Wildcards match suffixes of the host name (without a port) instead of prefixes.
+					moreSpecific = strings.SplitN(moreSpecific, ":", 2)[0]
+					assert.True(t, strings.HasSuffix(moreSpecific, ns[i][1:]))
+					moreSpecific = ns[i][2:]
+				} else {
+					assert.True(t, strings.HasPrefix(moreSpecific, ns[i]))
+					moreSpecific = ns[i]
+				}
 			}
 		}
 	}
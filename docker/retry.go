@@ -0,0 +1,140 @@
+package docker
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/docker/distribution/registry/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultMaxAttempts is the default maximum number of attempts for idempotent requests, including the first one.
+	defaultMaxAttempts = 3
+	// defaultRetryDelay is the default delay before the first retry; it doubles after every attempt.
+	defaultRetryDelay = 1 * time.Second
+	// maxRetryDelay is the maximum delay between attempts, even if the registry asks for a longer one using Retry-After.
+	maxRetryDelay = 1 * time.Minute
+)
+
+// retryPolicy returns the maximum number of attempts and the initial delay between them for idempotent requests.
+func (c *dockerClient) retryPolicy() (int, time.Duration) {
+	maxAttempts := defaultMaxAttempts
+	delay := defaultRetryDelay
+	if c.sys != nil {
+		if c.sys.DockerRegistryMaxAttempts > 0 {
+			maxAttempts = c.sys.DockerRegistryMaxAttempts
+		}
+		if c.sys.DockerRegistryRetryDelay > 0 {
+			delay = c.sys.DockerRegistryRetryDelay
+		}
+	}
+	return maxAttempts, delay
+}
+
+// isIdempotentRequest returns true if a request with method and stream can be safely repeated.
+func isIdempotentRequest(method string, stream io.Reader) bool {
+	return (method == "GET" || method == "HEAD") && stream == nil
+}
+
+// doWithRetries calls send, which must perform an idempotent request to url, and repeats it
+// on transient failures according to c.retryPolicy().
+// If all attempts fail, the returned error reports how many attempts were made.
+func (c *dockerClient) doWithRetries(ctx context.Context, method, url string, send func() (*http.Response, error)) (*http.Response, error) {
+	maxAttempts, delay := c.retryPolicy()
+	for attempt := 1; ; attempt++ {
+		res, err := send()
+		var retryAfter time.Duration
+		retryable := false
+		if err != nil {
+			retryable = ctx.Err() == nil && isRetryableError(err)
+		} else if isRetryableStatus(res.StatusCode) {
+			retryable = true
+			retryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+		}
+		if !retryable {
+			return res, err
+		}
+		if attempt >= maxAttempts {
+			if attempt == 1 { // Retries are disabled, let the caller handle the failure as usual.
+				return res, err
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s %s failed after %d attempts", method, url, attempt)
+			}
+			defer res.Body.Close()
+			return nil, errors.Wrapf(client.HandleErrorResponse(res), "%s %s failed after %d attempts", method, url, attempt)
+		}
+
+		wait := delay
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if wait > maxRetryDelay {
+			wait = maxRetryDelay
+		}
+		if err != nil {
+			logrus.Debugf("%s %s failed (attempt %d of %d), retrying in %s: %v", method, url, attempt, maxAttempts, wait, err)
+		} else {
+			logrus.Debugf("%s %s failed (attempt %d of %d), retrying in %s: status %d (%s)", method, url, attempt, maxAttempts, wait, res.StatusCode, http.StatusText(res.StatusCode))
+			res.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// isRetryableStatus returns true if an HTTP response with statusCode indicates a transient failure.
+func isRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// isRetryableError returns true if err, returned by http.Client.Do, indicates a transient failure,
+// e.g. a refused or reset connection, or a timeout.
+func isRetryableError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	switch e := err.(type) {
+	case *net.OpError:
+		if dnsErr, ok := e.Err.(*net.DNSError); ok {
+			return dnsErr.Temporary() || dnsErr.Timeout()
+		}
+		return true
+	case net.Error:
+		return e.Timeout()
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// parseRetryAfter returns the delay requested by a Retry-After header value, relative to now, or 0 if there is none or it is invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
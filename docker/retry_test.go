@@ -0,0 +1,215 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/image/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	c := &dockerClient{}
+	maxAttempts, delay := c.retryPolicy()
+	assert.Equal(t, defaultMaxAttempts, maxAttempts)
+	assert.Equal(t, defaultRetryDelay, delay)
+
+	c = &dockerClient{sys: &types.SystemContext{}}
+	maxAttempts, delay = c.retryPolicy()
+	assert.Equal(t, defaultMaxAttempts, maxAttempts)
+	assert.Equal(t, defaultRetryDelay, delay)
+
+	c = &dockerClient{sys: &types.SystemContext{DockerRegistryMaxAttempts: 7, DockerRegistryRetryDelay: 3 * time.Second}}
+	maxAttempts, delay = c.retryPolicy()
+	assert.Equal(t, 7, maxAttempts)
+	assert.Equal(t, 3*time.Second, delay)
+}
+
+func TestIsIdempotentRequest(t *testing.T) {
+	assert.True(t, isIdempotentRequest("GET", nil))
+	assert.True(t, isIdempotentRequest("HEAD", nil))
+	assert.False(t, isIdempotentRequest("GET", strings.NewReader("")))
+	assert.False(t, isIdempotentRequest("POST", nil))
+	assert.False(t, isIdempotentRequest("PUT", nil))
+	assert.False(t, isIdempotentRequest("PATCH", nil))
+	assert.False(t, isIdempotentRequest("DELETE", nil))
+}
+
+func TestIsRetryableStatus(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		assert.True(t, isRetryableStatus(status), "%d", status)
+	}
+	for _, status := range []int{http.StatusOK, http.StatusNotFound, http.StatusUnauthorized, http.StatusInternalServerError} {
+		assert.False(t, isRetryableStatus(status), "%d", status)
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	for _, c := range []struct {
+		err      error
+		expected bool
+	}{
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, true},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}}, true},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: io.ErrUnexpectedEOF}, true},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: io.EOF}, true},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "example.com"}}}, false},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "timeout", Name: "example.com", IsTimeout: true}}}, true},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: errors.New("x509: certificate signed by unknown authority")}, false},
+		{errors.New("something else"), false},
+	} {
+		assert.Equal(t, c.expected, isRetryableError(c.err), c.err.Error())
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		input    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{"Tue, 01 Jan 2019 12:00:30 GMT", 30 * time.Second},
+		{"Tue, 01 Jan 2019 11:59:00 GMT", 0},
+		{"invalid", 0},
+	} {
+		assert.Equal(t, c.expected, parseRetryAfter(c.input, now), c.input)
+	}
+}
+
+// failingServer responds with failureStatus to the first failures requests, and with http.StatusOK and body afterwards.
+type failingServer struct {
+	mutex         sync.Mutex
+	failures      int
+	failureStatus int
+	body          string
+	requests      int
+}
+
+func (s *failingServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests++
+	if s.requests <= s.failures {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(s.failureStatus)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(s.body))
+}
+
+func TestMakeRequestRetries(t *testing.T) {
+	for _, c := range []struct {
+		method           string
+		failures         int
+		maxAttempts      int
+		expectedRequests int
+		success          bool
+	}{
+		{"GET", 0, 0, 1, true},
+		{"GET", 2, 0, 3, true},
+		{"HEAD", 2, 0, 3, true},
+		{"GET", 3, 0, 3, false},
+		{"GET", 3, 4, 4, true},
+		{"GET", 1, 1, 1, false},
+		{"POST", 1, 0, 1, false},
+	} {
+		server := &failingServer{failures: c.failures, failureStatus: http.StatusServiceUnavailable}
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+		client := &dockerClient{
+			sys:    &types.SystemContext{DockerRegistryMaxAttempts: c.maxAttempts, DockerRegistryRetryDelay: time.Millisecond},
+			client: ts.Client(),
+		}
+
+		res, err := client.makeRequestToResolvedURL(context.Background(), c.method, ts.URL+"/v2/", nil, nil, -1, noAuth, nil)
+		assert.Equal(t, c.expectedRequests, server.requests, "%#v", c)
+		switch {
+		case c.success:
+			require.NoError(t, err, "%#v", c)
+			assert.Equal(t, http.StatusOK, res.StatusCode, "%#v", c)
+			res.Body.Close()
+		case c.expectedRequests > 1:
+			require.Error(t, err, "%#v", c)
+			assert.Contains(t, err.Error(), "after 3 attempts", "%#v", c)
+		default: // A single failed attempt, the response is returned to the caller
+			require.NoError(t, err, "%#v", c)
+			assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode, "%#v", c)
+			res.Body.Close()
+		}
+	}
+
+	// Retries stop when the context is canceled
+	server := &failingServer{failures: 100, failureStatus: http.StatusTooManyRequests}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	client := &dockerClient{
+		sys:    &types.SystemContext{DockerRegistryMaxAttempts: 100, DockerRegistryRetryDelay: time.Hour},
+		client: ts.Client(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := client.makeRequestToResolvedURL(ctx, "GET", ts.URL+"/v2/", nil, nil, -1, noAuth, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 1, server.requests)
+}
+
+func TestBearerTokenRetries(t *testing.T) {
+	for _, c := range []struct {
+		method           string
+		maxAttempts      int
+		tokenFailures    int
+		registryFailures int
+		tokenRequests    int
+		registryRequests int
+		success          bool
+	}{
+		{"GET", 0, 100, 0, defaultMaxAttempts, 0, false},
+		{"GET", 4, 100, 0, 4, 0, false},
+		{"GET", 1, 100, 0, 1, 0, false},
+		{"PUT", 0, 100, 0, defaultMaxAttempts, 0, false},
+		{"GET", 0, 2, 2, 3, 3, true},
+	} {
+		tokenServer := &failingServer{failures: c.tokenFailures, failureStatus: http.StatusServiceUnavailable, body: `{"token":"t"}`}
+		tokenTS := httptest.NewServer(tokenServer)
+		defer tokenTS.Close()
+		registry := &failingServer{failures: c.registryFailures, failureStatus: http.StatusServiceUnavailable}
+		registryTS := httptest.NewServer(registry)
+		defer registryTS.Close()
+		client := &dockerClient{
+			sys:        &types.SystemContext{DockerRegistryMaxAttempts: c.maxAttempts, DockerRegistryRetryDelay: time.Millisecond},
+			client:     registryTS.Client(),
+			challenges: []challenge{{Scheme: "bearer", Parameters: map[string]string{"realm": tokenTS.URL + "/token"}}},
+		}
+
+		res, err := client.makeRequestToResolvedURL(context.Background(), c.method, registryTS.URL+"/v2/", nil, nil, -1, v2Auth, nil)
+		// Obtaining the token and the request itself are each retried up to the limit, without multiplying the attempts.
+		assert.Equal(t, c.tokenRequests, tokenServer.requests, "%#v", c)
+		assert.Equal(t, c.registryRequests, registry.requests, "%#v", c)
+		if !c.success {
+			require.Error(t, err, "%#v", c)
+			if c.tokenRequests > 1 {
+				assert.Contains(t, err.Error(), fmt.Sprintf("after %d attempts", c.tokenRequests), "%#v", c)
+			}
+			continue
+		}
+		require.NoError(t, err, "%#v", c)
+		assert.Equal(t, http.StatusOK, res.StatusCode, "%#v", c)
+		res.Body.Close()
+	}
+}
@@ -10,8 +10,9 @@ import (
 	"os"
 	"path"
 
-	"github.com/containers/image/internal/tmpdir"
+	"github.com/containers/image/docker/reference"
 	"github.com/containers/image/internal/iolimits"
+	"github.com/containers/image/internal/tmpdir"
 	"github.com/containers/image/manifest"
 	"github.com/containers/image/pkg/compression"
 	"github.com/containers/image/types"
@@ -22,7 +23,9 @@ import (
 // Source is a partial implementation of types.ImageSource for reading from tarPath.
 type Source struct {
 	tarPath              string
-	removeTarPathOnClose bool // Remove temp file on close if true
+	removeTarPathOnClose bool                  // Remove temp file on close if true
+	ref                  reference.NamedTagged // If not nil, selects the image with this RepoTag
+	sourceIndex          int                   // If not -1, selects the image at this index of manifest.json
 	// The following data is only available after ensureCachedDataIsPresent() succeeds
 	tarManifest       *ManifestItem // nil if not available yet.
 	configBytes       []byte
@@ -38,13 +41,19 @@ type layerInfo struct {
 	size int64
 }
 
-// TODO: We could add support for multiple images in a single archive, so
-//       that people could use docker-archive:opensuse.tar:opensuse:leap as
-//       the source of an image.
-// 	To do for both the NewSourceFromFile and NewSourceFromStream functions
-
 // NewSourceFromFile returns a tarfile.Source for the specified path.
+// The archive must contain exactly one image; use NewSourceFromFileWithImage to read archives with more images.
 func NewSourceFromFile(path string) (*Source, error) {
+	return NewSourceFromFileWithImage(path, nil, -1)
+}
+
+// NewSourceFromFileWithImage returns a tarfile.Source for an image in the archive at the specified path.
+// If ref is not nil, the image with that tag in RepoTags is used; otherwise, if sourceIndex is not -1,
+// the image at that index of manifest.json is used; otherwise, the archive must contain exactly one image.
+func NewSourceFromFileWithImage(path string, ref reference.NamedTagged, sourceIndex int) (*Source, error) {
+	if ref != nil && sourceIndex != -1 {
+		return nil, errors.Errorf("Internal error: both a tag and a source index specified")
+	}
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error opening file %q", path)
@@ -60,10 +69,18 @@ func NewSourceFromFile(path string) (*Source, error) {
 	defer stream.Close()
 	if !isCompressed {
 		return &Source{
-			tarPath: path,
+			tarPath:     path,
+			ref:         ref,
+			sourceIndex: sourceIndex,
 		}, nil
 	}
-	return NewSourceFromStream(stream)
+	src, err := NewSourceFromStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	src.ref = ref
+	src.sourceIndex = sourceIndex
+	return src, nil
 }
 
 // NewSourceFromStream returns a tarfile.Source for the specified inputStream,
@@ -106,6 +123,7 @@ func NewSourceFromStream(inputStream io.Reader) (*Source, error) {
 	return &Source{
 		tarPath:              tarCopyFile.Name(),
 		removeTarPathOnClose: true,
+		sourceIndex:          -1,
 	}, nil
 }
 
@@ -210,27 +228,27 @@ func (s *Source) ensureCachedDataIsPresent() error {
 		return err
 	}
 
-	// Check to make sure length is 1
-	if len(tarManifest) != 1 {
-		return errors.Errorf("Unexpected tar manifest.json: expected 1 item, got %d", len(tarManifest))
+	item, err := s.chooseManifestItem(tarManifest)
+	if err != nil {
+		return err
 	}
 	// Read and parse config.
-	configBytes, err := s.readTarComponent(tarManifest[0].Config, iolimits.MaxConfigBodySize)
+	configBytes, err := s.readTarComponent(item.Config, iolimits.MaxConfigBodySize)
 	if err != nil {
 		return err
 	}
 	var parsedConfig manifest.Schema2Image // There's a lot of info there, but we only really care about layer DiffIDs.
 	if err := json.Unmarshal(configBytes, &parsedConfig); err != nil {
-		return errors.Wrapf(err, "Error decoding tar config %s", tarManifest[0].Config)
+		return errors.Wrapf(err, "Error decoding tar config %s", item.Config)
 	}
 
-	knownLayers, err := s.prepareLayerData(&tarManifest[0], &parsedConfig)
+	knownLayers, err := s.prepareLayerData(item, &parsedConfig)
 	if err != nil {
 		return err
 	}
 
 	// Success; commit.
-	s.tarManifest = &tarManifest[0]
+	s.tarManifest = item
 	s.configBytes = configBytes
 	s.configDigest = digest.FromBytes(configBytes)
 	s.orderedDiffIDList = parsedConfig.RootFS.DiffIDs
@@ -238,6 +256,35 @@ func (s *Source) ensureCachedDataIsPresent() error {
 	return nil
 }
 
+// chooseManifestItem returns the element of tarManifest selected by s.ref or s.sourceIndex.
+func (s *Source) chooseManifestItem(tarManifest []ManifestItem) (*ManifestItem, error) {
+	switch {
+	case s.ref != nil:
+		for i := range tarManifest {
+			for _, tag := range tarManifest[i].RepoTags {
+				parsedTag, err := reference.ParseNormalizedNamed(tag)
+				if err != nil {
+					return nil, errors.Wrapf(err, "Invalid tag %q in manifest.json item %d", tag, i)
+				}
+				if parsedTag.String() == s.ref.String() {
+					return &tarManifest[i], nil
+				}
+			}
+		}
+		return nil, errors.Errorf("Tag %q not found in the archive", s.ref.String())
+	case s.sourceIndex != -1:
+		if s.sourceIndex < 0 || s.sourceIndex >= len(tarManifest) {
+			return nil, errors.Errorf("Invalid source index @%d, only %d manifest items available", s.sourceIndex, len(tarManifest))
+		}
+		return &tarManifest[s.sourceIndex], nil
+	default:
+		if len(tarManifest) != 1 {
+			return nil, errors.Errorf("Unexpected tar manifest.json: expected 1 item, got %d", len(tarManifest))
+		}
+		return &tarManifest[0], nil
+	}
+}
+
 // loadTarManifest loads and decodes the manifest.json.
 func (s *Source) loadTarManifest() ([]ManifestItem, error) {
 	// FIXME? Do we need to deal with the legacy format?
@@ -398,7 +445,9 @@ func (r uncompressedReadCloser) Close() error {
 }
 
 // GetBlob returns a stream for the specified blob, and the blob’s size (or -1 if unknown).
-func (s *Source) GetBlob(ctx context.Context, info types.BlobInfo) (io.ReadCloser, int64, error) {
+// The Digest field in BlobInfo is guaranteed to be provided, Size may be -1 and MediaType may be optionally provided.
+// May update BlobInfoCache, preferably after it knows for certain that a blob truly exists at a specific location.
+func (s *Source) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
 	if err := s.ensureCachedDataIsPresent(); err != nil {
 		return nil, 0, err
 	}
@@ -0,0 +1,239 @@
+package tarfile
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Writer writes a docker tar archive containing one or more images to an io.Writer.
+// Images are added using Destination objects created by NewDestinationForArchive;
+// blobs shared by several images are only stored once.
+// A Writer is not safe for concurrent use; images must be added one at a time.
+type Writer struct {
+	writer io.Writer
+	tar    *tar.Writer
+	// Other state.
+	blobs        map[digest.Digest]types.BlobInfo // list of already-sent blobs
+	legacyLayers map[string]struct{}              // IDs of already-sent legacy layer directories
+	repositories map[string]map[string]string     // Contents of the legacy repositories file; nil if no image with layers was added
+	manifest     []ManifestItem                   // Contents of manifest.json
+	closed       bool
+}
+
+// NewWriter returns a tarfile.Writer for the specified io.Writer.
+// The caller must call .Close() on the returned Writer to finish writing the archive.
+func NewWriter(dest io.Writer) *Writer {
+	return &Writer{
+		writer:       dest,
+		tar:          tar.NewWriter(dest),
+		blobs:        make(map[digest.Digest]types.BlobInfo),
+		legacyLayers: make(map[string]struct{}),
+	}
+}
+
+// addManifestItem records item, and the legacy repositories data for repoTags pointing at lastLayerID, for writing in Close.
+func (w *Writer) addManifestItem(item ManifestItem, repoTags []reference.NamedTagged, lastLayerID string) error {
+	if w.closed {
+		return errors.New("Internal error: adding an image to a closed docker tar archive")
+	}
+	if lastLayerID != "" {
+		if w.repositories == nil {
+			w.repositories = map[string]map[string]string{}
+		}
+		for _, repoTag := range repoTags {
+			if val, ok := w.repositories[repoTag.Name()]; ok {
+				val[repoTag.Tag()] = lastLayerID
+			} else {
+				w.repositories[repoTag.Name()] = map[string]string{repoTag.Tag(): lastLayerID}
+			}
+		}
+	}
+	w.manifest = append(w.manifest, item)
+	return nil
+}
+
+// Close writes manifest.json and the other metadata of all added images, and finishes writing the tar stream.
+// It is the caller's responsibility to close the underlying io.Writer, if necessary.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if w.repositories != nil {
+		b, err := json.Marshal(w.repositories)
+		if err != nil {
+			return errors.Wrap(err, "Error marshaling repositories")
+		}
+		if err := w.sendBytes(legacyRepositoriesFileName, b); err != nil {
+			return errors.Wrap(err, "Error writing config json file")
+		}
+	}
+
+	items := w.manifest
+	if items == nil {
+		items = []ManifestItem{}
+	}
+	itemsBytes, err := json.Marshal(&items)
+	if err != nil {
+		return err
+	}
+	// FIXME? Do we also need to support the legacy format?
+	if err := w.sendBytes(manifestFileName, itemsBytes); err != nil {
+		return err
+	}
+	return w.tar.Close()
+}
+
+// writeLegacyLayerMetadata writes legacy VERSION and configuration files for all layers of an image with the specified config,
+// skipping layers which have already been written for another image.
+func (w *Writer) writeLegacyLayerMetadata(layerDescriptors []manifest.Schema2Descriptor, config []byte) (layerPaths []string, lastLayerID string, err error) {
+	var chainID digest.Digest
+	lastLayerID = ""
+	for i, l := range layerDescriptors {
+		// This chainID value matches the computation in docker/docker/layer.CreateChainID.
+		if chainID == "" {
+			chainID = l.Digest
+		} else {
+			chainID = digest.Canonical.FromString(chainID.String() + " " + l.Digest.String())
+		}
+
+		physicalLayerPath := l.Digest.Hex() + ".tar"
+		// The layer itself has been stored into physicalLayerPath in PutManifest.
+		// So, use that path for layerPaths used in the non-legacy manifest
+		layerPaths = append(layerPaths, physicalLayerPath)
+
+		// The legacy format requires a config file per layer
+		layerConfig := make(map[string]interface{})
+		// The root layer doesn't have any parent
+		if lastLayerID != "" {
+			layerConfig["parent"] = lastLayerID
+		}
+		// The root layer configuration file is generated by using subpart of the image configuration
+		if i == len(layerDescriptors)-1 {
+			var imageConfig map[string]*json.RawMessage
+			if err := json.Unmarshal(config, &imageConfig); err != nil {
+				return nil, "", errors.Wrap(err, "Error unmarshaling config")
+			}
+			for _, attr := range [7]string{"architecture", "config", "container", "container_config", "created", "docker_version", "os"} {
+				layerConfig[attr] = imageConfig[attr]
+			}
+		}
+
+		// Note that this image ID does not match docker/docker/image/v1.CreateID. At least recent
+		// versions allocate new IDs on load, as long as the IDs we use are unique / cannot loop.
+		//
+		// Overall, the goal of computing a digest dependent on the full history is to avoid reusing an image ID
+		// (and possibly creating a loop in the "parent" links) if a layer with the same DiffID appears two or more
+		// times in layersDescriptors.  The ChainID values are sufficient for this within a single image, but
+		// the configuration of the top layer differs between images with the same layers, so the ID is computed
+		// from the layer configuration, with the ChainID mixed in; identical legacy layers are then written only once.
+		layerConfig["layer_id"] = chainID
+		b, err := json.Marshal(layerConfig)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "Error marshaling layer config")
+		}
+		delete(layerConfig, "layer_id")
+		layerID := digest.Canonical.FromBytes(b).Hex()
+		layerConfig["id"] = layerID
+
+		// Create a symlink and metadata for the legacy format, unless an identical legacy layer has already been written for another image.
+		if _, ok := w.legacyLayers[layerID]; !ok {
+			if err := w.sendSymlink(filepath.Join(layerID, legacyLayerFileName), filepath.Join("..", physicalLayerPath)); err != nil {
+				return nil, "", errors.Wrap(err, "Error creating layer symbolic link")
+			}
+
+			if err := w.sendBytes(filepath.Join(layerID, legacyVersionFileName), []byte("1.0")); err != nil {
+				return nil, "", errors.Wrap(err, "Error writing VERSION file")
+			}
+
+			b, err := json.Marshal(layerConfig)
+			if err != nil {
+				return nil, "", errors.Wrap(err, "Error marshaling layer config")
+			}
+			if err := w.sendBytes(filepath.Join(layerID, legacyConfigFileName), b); err != nil {
+				return nil, "", errors.Wrap(err, "Error writing config json file")
+			}
+			w.legacyLayers[layerID] = struct{}{}
+		}
+
+		lastLayerID = layerID
+	}
+	return layerPaths, lastLayerID, nil
+}
+
+type tarFI struct {
+	path      string
+	size      int64
+	isSymlink bool
+}
+
+func (t *tarFI) Name() string {
+	return t.path
+}
+func (t *tarFI) Size() int64 {
+	return t.size
+}
+func (t *tarFI) Mode() os.FileMode {
+	if t.isSymlink {
+		return os.ModeSymlink
+	}
+	return 0444
+}
+func (t *tarFI) ModTime() time.Time {
+	return time.Unix(0, 0)
+}
+func (t *tarFI) IsDir() bool {
+	return false
+}
+func (t *tarFI) Sys() interface{} {
+	return nil
+}
+
+// sendSymlink sends a symlink into the tar stream.
+func (w *Writer) sendSymlink(path string, target string) error {
+	hdr, err := tar.FileInfoHeader(&tarFI{path: path, size: 0, isSymlink: true}, target)
+	if err != nil {
+		return nil
+	}
+	logrus.Debugf("Sending as tar link %s -> %s", path, target)
+	return w.tar.WriteHeader(hdr)
+}
+
+// sendBytes sends a path into the tar stream.
+func (w *Writer) sendBytes(path string, b []byte) error {
+	return w.sendFile(path, int64(len(b)), bytes.NewReader(b))
+}
+
+// sendFile sends a file into the tar stream.
+func (w *Writer) sendFile(path string, expectedSize int64, stream io.Reader) error {
+	hdr, err := tar.FileInfoHeader(&tarFI{path: path, size: expectedSize}, "")
+	if err != nil {
+		return nil
+	}
+	logrus.Debugf("Sending as tar file %s", path)
+	if err := w.tar.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// TODO: This can take quite some time, and should ideally be cancellable using a context.Context.
+	size, err := io.Copy(w.tar, stream)
+	if err != nil {
+		return err
+	}
+	if size != expectedSize {
+		return errors.Errorf("Size mismatch when copying %s, expected %d, got %d", path, expectedSize, size)
+	}
+	return nil
+}
@@ -6,14 +6,16 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/containers/image/manifest"
 	"github.com/containers/image/types"
 	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestChooseDigestFromManifestList(t *testing.T) {
-	manifest, err := ioutil.ReadFile(filepath.Join("fixtures", "schema2list.json"))
+	blob, err := ioutil.ReadFile(filepath.Join("fixtures", "schema2list.json"))
 	require.NoError(t, err)
 
 	// Match found
@@ -27,18 +29,72 @@ func TestChooseDigestFromManifestList(t *testing.T) {
 		digest, err := chooseDigestFromManifestList(&types.SystemContext{
 			ArchitectureChoice: arch,
 			OSChoice:           "linux",
-		}, manifest)
+		}, blob, manifest.DockerV2ListMediaType)
 		require.NoError(t, err, arch)
 		assert.Equal(t, expected, digest)
 	}
 
+	// Variants
+	for _, c := range []struct {
+		arch, variant string
+		expected      digest.Digest
+	}{
+		{"arm", "v7", "sha256:a8fe0549cac196f439de3bf2b57af14f7cd4e59915ccd524428f588628a4ef31"},
+		{"arm", "v6", "sha256:b5dbad4bdb4444d919294afe49a095c23e86782f98cdf0aa286198ddb814b50b"},
+		{"arm", "armv5", "sha256:9142d97ef280a7953cf1a85716de49a24cc1dd62776352afad67e635331ff77a"},
+		// The most recent compatible variant is used if there is no exact match.
+		{"arm", "v8", "sha256:a8fe0549cac196f439de3bf2b57af14f7cd4e59915ccd524428f588628a4ef31"},
+		{"arm64", "", "sha256:dc472a59fb006797aa2a6bfb54cc9c57959bb0a6d11fadaa608df8c16dea39cf"},
+		{"aarch64", "v8", "sha256:dc472a59fb006797aa2a6bfb54cc9c57959bb0a6d11fadaa608df8c16dea39cf"},
+	} {
+		digest, err := chooseDigestFromManifestList(&types.SystemContext{
+			ArchitectureChoice: c.arch,
+			VariantChoice:      c.variant,
+			OSChoice:           "linux",
+		}, blob, manifest.DockerV2ListMediaType)
+		require.NoError(t, err, "%s/%s", c.arch, c.variant)
+		assert.Equal(t, c.expected, digest, "%s/%s", c.arch, c.variant)
+	}
+	_, err = chooseDigestFromManifestList(&types.SystemContext{
+		ArchitectureChoice: "arm", VariantChoice: "unknown", OSChoice: "linux",
+	}, blob, manifest.DockerV2ListMediaType)
+	assert.Error(t, err)
+
 	// Invalid manifest list
 	_, err = chooseDigestFromManifestList(&types.SystemContext{
 		ArchitectureChoice: "amd64", OSChoice: "linux",
-	}, bytes.Join([][]byte{manifest, []byte("!INVALID")}, nil))
+	}, bytes.Join([][]byte{blob, []byte("!INVALID")}, nil), manifest.DockerV2ListMediaType)
+	assert.Error(t, err)
+
+	// Not found
+	_, err = chooseDigestFromManifestList(&types.SystemContext{OSChoice: "Unmatched"}, blob, manifest.DockerV2ListMediaType)
+	assert.Error(t, err)
+
+	// Not a manifest list
+	_, err = chooseDigestFromManifestList(&types.SystemContext{
+		ArchitectureChoice: "amd64", OSChoice: "linux",
+	}, blob, manifest.DockerV2Schema2MediaType)
 	assert.Error(t, err)
+}
+
+func TestChooseDigestFromOCI1Index(t *testing.T) {
+	blob, err := ioutil.ReadFile(filepath.Join("fixtures", "oci1index.json"))
+	require.NoError(t, err)
+
+	// Match found
+	for arch, expected := range map[string]digest.Digest{
+		"amd64":   "sha256:5b0bcabd1ed22e9fb1310cf6c2dec7cdef19f0ad69efa1f392e94a4333501270",
+		"ppc64le": "sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f",
+	} {
+		digest, err := chooseDigestFromManifestList(&types.SystemContext{
+			ArchitectureChoice: arch,
+			OSChoice:           "linux",
+		}, blob, imgspecv1.MediaTypeImageIndex)
+		require.NoError(t, err, arch)
+		assert.Equal(t, expected, digest)
+	}
 
 	// Not found
-	_, err = chooseDigestFromManifestList(&types.SystemContext{OSChoice: "Unmatched"}, manifest)
+	_, err = chooseDigestFromManifestList(&types.SystemContext{OSChoice: "Unmatched"}, blob, imgspecv1.MediaTypeImageIndex)
 	assert.Error(t, err)
 }
@@ -0,0 +1,43 @@
+// Package blobinfocache contains extensions of types.BlobInfoCache which are not a part of the public API.
+package blobinfocache
+
+import (
+	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// Uncompressed is the compressor name recorded for blobs which are known not to be compressed.
+	Uncompressed = "uncompressed"
+	// UnknownCompression is the compressor name returned if nothing is known about the compression of a blob.
+	UnknownCompression = ""
+)
+
+// BlobInfoCache2 is a types.BlobInfoCache which can also record the compression of blobs.
+type BlobInfoCache2 interface {
+	types.BlobInfoCache
+	// RecordDigestCompressorName records that the blob with anyDigest is compressed using compressorName
+	// (a compression.Algorithm.Name() value), or is Uncompressed.
+	// WARNING: Only call this for LOCALLY VERIFIED data; don’t record a compressor name just because some remote author claims so
+	// (e.g. because a manifest lists a MIME type), otherwise the cache could be poisoned and cause incorrect MIME types to be used.
+	RecordDigestCompressorName(anyDigest digest.Digest, compressorName string)
+	// DigestCompressorName returns the compressor name recorded for anyDigest, or UnknownCompression.
+	DigestCompressorName(anyDigest digest.Digest) string
+}
+
+// RecordDigestCompressorName records compressorName for anyDigest in cache, if cache supports recording compression data.
+// See BlobInfoCache2.RecordDigestCompressorName.
+func RecordDigestCompressorName(cache types.BlobInfoCache, anyDigest digest.Digest, compressorName string) {
+	if cache2, ok := cache.(BlobInfoCache2); ok {
+		cache2.RecordDigestCompressorName(anyDigest, compressorName)
+	}
+}
+
+// DigestCompressorName returns the compressor name recorded for anyDigest in cache, or UnknownCompression
+// if nothing is known, or cache does not support recording compression data.
+func DigestCompressorName(cache types.BlobInfoCache, anyDigest digest.Digest) string {
+	if cache2, ok := cache.(BlobInfoCache2); ok {
+		return cache2.DigestCompressorName(anyDigest)
+	}
+	return UnknownCompression
+}
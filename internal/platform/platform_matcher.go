@@ -0,0 +1,227 @@
+package platform
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/containers/image/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// compatibility lists, for architectures whose variants are backwards compatible,
+// the known variants from the newest to the oldest; a machine implementing one of the
+// variants can also run images built for any of the variants following it.
+var compatibility = map[string][]string{
+	"arm":   {"v8", "v7", "v6", "v5"},
+	"arm64": {"v8"},
+	"amd64": {"v4", "v3", "v2", "v1"},
+}
+
+// architectureAliases maps architecture names used by other tools to the GOARCH values used in manifests,
+// along with the variant which the alias implies, if any.
+var architectureAliases = map[string]struct{ architecture, variant string }{
+	"aarch64": {"arm64", ""},
+	"armhf":   {"arm", "v7"},
+	"armel":   {"arm", "v6"},
+	"i386":    {"386", ""},
+	"x86_64":  {"amd64", ""},
+	"x86-64":  {"amd64", ""},
+}
+
+// Normalize returns p with architecture aliases and variant spellings (e.g. "armv7" or "7")
+// converted to the canonical form used in manifests (e.g. "v7").
+func Normalize(p imgspecv1.Platform) imgspecv1.Platform {
+	p.OS = strings.ToLower(p.OS)
+	p.Architecture = strings.ToLower(p.Architecture)
+	p.Variant = strings.ToLower(p.Variant)
+	if alias, ok := architectureAliases[p.Architecture]; ok {
+		p.Architecture = alias.architecture
+		if p.Variant == "" {
+			p.Variant = alias.variant
+		}
+	}
+	if p.Architecture == "arm" || p.Architecture == "arm64" {
+		p.Variant = strings.TrimPrefix(p.Variant, "arm")
+	}
+	if p.Variant != "" && p.Variant[0] >= '0' && p.Variant[0] <= '9' {
+		p.Variant = "v" + p.Variant
+	}
+	return p
+}
+
+// WantedPlatform returns the platform described by sys, using values of the current platform for
+// everything sys does not specify.
+func WantedPlatform(sys *types.SystemContext) imgspecv1.Platform {
+	wanted := imgspecv1.Platform{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+	}
+	if sys != nil && sys.ArchitectureChoice != "" {
+		wanted.Architecture = sys.ArchitectureChoice
+	} else {
+		// The variant of the current CPU is only relevant if we are choosing an image for it.
+		wanted.Variant = cpuVariant()
+	}
+	if sys != nil && sys.VariantChoice != "" {
+		wanted.Variant = sys.VariantChoice
+	}
+	if sys != nil && sys.OSChoice != "" {
+		wanted.OS = sys.OSChoice
+	}
+	if sys != nil && sys.OSVersionChoice != "" {
+		wanted.OSVersion = sys.OSVersionChoice
+	}
+	return Normalize(wanted)
+}
+
+// cpuVariant returns the variant of the CPU we are running on, or "" if it is not known.
+func cpuVariant() string {
+	switch runtime.GOARCH {
+	case "arm64":
+		return "v8"
+	case "arm":
+		if runtime.GOOS != "linux" {
+			return ""
+		}
+		f, err := os.Open("/proc/cpuinfo")
+		if err != nil {
+			return ""
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.SplitN(scanner.Text(), ":", 2)
+			if len(fields) == 2 && strings.TrimSpace(fields[0]) == "CPU architecture" {
+				switch strings.TrimSpace(fields[1]) {
+				case "5", "5T", "5TE", "5TEJ":
+					return "v5"
+				case "6", "6TEJ":
+					return "v6"
+				case "7":
+					return "v7"
+				case "8", "AArch64":
+					return "v8"
+				}
+				return ""
+			}
+		}
+	}
+	return ""
+}
+
+// variantRanks is larger than any value returned by Matcher.variantRank.
+const variantRanks = 100
+
+// Matcher decides whether, and how well, images built for a platform can be used on a wanted platform.
+type Matcher struct {
+	wanted imgspecv1.Platform
+	// variants lists the acceptable variants of wanted.Architecture, most preferred first, if wanted.Variant is known to be
+	// backwards compatible with other variants; nil otherwise.
+	variants []string
+}
+
+// NewMatcher returns a Matcher for images which can be used on wanted.
+func NewMatcher(wanted imgspecv1.Platform) *Matcher {
+	m := &Matcher{wanted: Normalize(wanted)}
+	if m.wanted.Variant != "" {
+		known := compatibility[m.wanted.Architecture]
+		for i, v := range known {
+			if v == m.wanted.Variant {
+				m.variants = known[i:]
+				break
+			}
+		}
+	}
+	return m
+}
+
+// Rank returns how well an image built for candidate suits the wanted platform; 0 is a perfect match, and larger values are
+// less preferred.  ok is false if the image can't be used on the wanted platform at all.
+//
+// The OS and architecture must always match.  If the wanted variant is known to be backwards compatible, images built for
+// older variants are accepted, and images which don't specify a variant are accepted last; unknown variants must match exactly.
+// If the wanted platform does not specify a variant, images for any variant are accepted, preferring those which don't specify one.
+// If the wanted platform specifies an OS version, images built for the same build (the first three components) are accepted,
+// preferring an exact match, and images which don't specify an OS version are accepted last.
+// If the wanted platform specifies OS features, all OS features the candidate requires must be among them.
+func (m *Matcher) Rank(candidate imgspecv1.Platform) (rank int, ok bool) {
+	candidate = Normalize(candidate)
+	if candidate.OS != m.wanted.OS || candidate.Architecture != m.wanted.Architecture {
+		return 0, false
+	}
+	variantRank, ok := m.variantRank(candidate.Variant)
+	if !ok {
+		return 0, false
+	}
+	osVersionRank, ok := m.osVersionRank(candidate.OSVersion)
+	if !ok {
+		return 0, false
+	}
+	if m.wanted.OSFeatures != nil {
+		for _, feature := range candidate.OSFeatures {
+			if !containsString(m.wanted.OSFeatures, feature) {
+				return 0, false
+			}
+		}
+	}
+	// The variant is more important than the OS version: an image for an older variant is likely to
+	// work only with a performance penalty, but a different OS build may not work at all.
+	return osVersionRank*variantRanks + variantRank, true
+}
+
+// variantRank returns the Rank component for the candidate variant.
+func (m *Matcher) variantRank(variant string) (int, bool) {
+	switch {
+	case m.wanted.Variant == "":
+		if variant == "" {
+			return 0, true
+		}
+		return 1, true
+	case variant == m.wanted.Variant:
+		return 0, true
+	case m.variants != nil:
+		if variant == "" {
+			return len(m.variants), true
+		}
+		for i, v := range m.variants {
+			if v == variant {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// osVersionRank returns the Rank component for the candidate OS version.
+func (m *Matcher) osVersionRank(osVersion string) (int, bool) {
+	switch {
+	case m.wanted.OSVersion == "" || osVersion == m.wanted.OSVersion:
+		return 0, true
+	case osVersion == "":
+		return 2, true
+	case osBuild(osVersion) == osBuild(m.wanted.OSVersion):
+		return 1, true
+	}
+	return 0, false
+}
+
+// osBuild returns the build of osVersion, i.e. the version without the revision, e.g. "10.0.17763" for "10.0.17763.1039".
+func osBuild(osVersion string) string {
+	components := strings.SplitN(osVersion, ".", 4)
+	if len(components) > 3 {
+		components = components[:3]
+	}
+	return strings.Join(components, ".")
+}
+
+// containsString returns true if list contains s.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package platform
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/containers/image/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalize(t *testing.T) {
+	for _, c := range []struct{ input, expected imgspecv1.Platform }{
+		{imgspecv1.Platform{Architecture: "amd64", OS: "linux"}, imgspecv1.Platform{Architecture: "amd64", OS: "linux"}},
+		{imgspecv1.Platform{Architecture: "x86_64", OS: "Linux"}, imgspecv1.Platform{Architecture: "amd64", OS: "linux"}},
+		{imgspecv1.Platform{Architecture: "aarch64", OS: "linux"}, imgspecv1.Platform{Architecture: "arm64", OS: "linux"}},
+		{imgspecv1.Platform{Architecture: "arm64", OS: "linux", Variant: "armv8"}, imgspecv1.Platform{Architecture: "arm64", OS: "linux", Variant: "v8"}},
+		{imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "armv7"}, imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "v7"}},
+		{imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "6"}, imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "v6"}},
+		{imgspecv1.Platform{Architecture: "armhf", OS: "linux"}, imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "v7"}},
+		{imgspecv1.Platform{Architecture: "armel", OS: "linux", Variant: "v5"}, imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "v5"}},
+	} {
+		assert.Equal(t, c.expected, Normalize(c.input), c.input)
+	}
+}
+
+func TestWantedPlatform(t *testing.T) {
+	// Defaults to the current platform
+	wanted := WantedPlatform(nil)
+	assert.Equal(t, runtime.GOOS, wanted.OS)
+	assert.Equal(t, runtime.GOARCH, wanted.Architecture)
+
+	// Overrides
+	wanted = WantedPlatform(&types.SystemContext{
+		ArchitectureChoice: "arm",
+		VariantChoice:      "armv7",
+		OSChoice:           "windows",
+		OSVersionChoice:    "10.0.17763",
+	})
+	assert.Equal(t, imgspecv1.Platform{Architecture: "arm", Variant: "v7", OS: "windows", OSVersion: "10.0.17763"}, wanted)
+
+	// The variant of the current CPU is not used for other architectures
+	wanted = WantedPlatform(&types.SystemContext{ArchitectureChoice: "arm", OSChoice: "linux"})
+	assert.Equal(t, imgspecv1.Platform{Architecture: "arm", OS: "linux"}, wanted)
+}
+
+func TestMatcherRank(t *testing.T) {
+	type candidate struct {
+		platform imgspecv1.Platform
+		rank     int // -1 if not acceptable
+	}
+	for _, c := range []struct {
+		wanted     imgspecv1.Platform
+		candidates []candidate
+	}{
+		{ // OS and architecture must match
+			imgspecv1.Platform{Architecture: "amd64", OS: "linux"},
+			[]candidate{
+				{imgspecv1.Platform{Architecture: "amd64", OS: "linux"}, 0},
+				{imgspecv1.Platform{Architecture: "x86_64", OS: "linux"}, 0},
+				{imgspecv1.Platform{Architecture: "amd64", OS: "windows"}, -1},
+				{imgspecv1.Platform{Architecture: "arm64", OS: "linux"}, -1},
+			},
+		},
+		{ // With no wanted variant, any variant is accepted
+			imgspecv1.Platform{Architecture: "amd64", OS: "linux"},
+			[]candidate{
+				{imgspecv1.Platform{Architecture: "amd64", OS: "linux", Variant: "v3"}, 1},
+				{imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "v3"}, -1},
+			},
+		},
+		{ // Older compatible variants are accepted, newer ones are not
+			imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "v7"},
+			[]candidate{
+				{imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "v7"}, 0},
+				{imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "armv7"}, 0},
+				{imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "v6"}, 1},
+				{imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "v5"}, 2},
+				{imgspecv1.Platform{Architecture: "arm", OS: "linux"}, 3},
+				{imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "v8"}, -1},
+				{imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "unknown"}, -1},
+			},
+		},
+		{
+			imgspecv1.Platform{Architecture: "arm64", OS: "linux", Variant: "v8"},
+			[]candidate{
+				{imgspecv1.Platform{Architecture: "arm64", OS: "linux", Variant: "v8"}, 0},
+				{imgspecv1.Platform{Architecture: "arm64", OS: "linux"}, 1},
+			},
+		},
+		{ // Unknown variants must match exactly
+			imgspecv1.Platform{Architecture: "amd64", OS: "linux", Variant: "unknown"},
+			[]candidate{
+				{imgspecv1.Platform{Architecture: "amd64", OS: "linux", Variant: "unknown"}, 0},
+				{imgspecv1.Platform{Architecture: "amd64", OS: "linux"}, -1},
+				{imgspecv1.Platform{Architecture: "amd64", OS: "linux", Variant: "v1"}, -1},
+			},
+		},
+		{ // OS versions must be the same build
+			imgspecv1.Platform{Architecture: "amd64", OS: "windows", OSVersion: "10.0.17763.1039"},
+			[]candidate{
+				{imgspecv1.Platform{Architecture: "amd64", OS: "windows", OSVersion: "10.0.17763.1039"}, 0},
+				{imgspecv1.Platform{Architecture: "amd64", OS: "windows", OSVersion: "10.0.17763.1098"}, variantRanks},
+				{imgspecv1.Platform{Architecture: "amd64", OS: "windows"}, 2 * variantRanks},
+				{imgspecv1.Platform{Architecture: "amd64", OS: "windows", OSVersion: "10.0.14393.3504"}, -1},
+			},
+		},
+		{ // With no wanted OS version, any version is accepted
+			imgspecv1.Platform{Architecture: "amd64", OS: "windows"},
+			[]candidate{
+				{imgspecv1.Platform{Architecture: "amd64", OS: "windows", OSVersion: "10.0.14393.3504"}, 0},
+			},
+		},
+		{ // Required OS features must be available, if the wanted features are known
+			imgspecv1.Platform{Architecture: "amd64", OS: "windows", OSFeatures: []string{"win32k"}},
+			[]candidate{
+				{imgspecv1.Platform{Architecture: "amd64", OS: "windows", OSFeatures: []string{"win32k"}}, 0},
+				{imgspecv1.Platform{Architecture: "amd64", OS: "windows"}, 0},
+				{imgspecv1.Platform{Architecture: "amd64", OS: "windows", OSFeatures: []string{"other"}}, -1},
+			},
+		},
+		{
+			imgspecv1.Platform{Architecture: "amd64", OS: "windows"},
+			[]candidate{
+				{imgspecv1.Platform{Architecture: "amd64", OS: "windows", OSFeatures: []string{"win32k"}}, 0},
+			},
+		},
+	} {
+		m := NewMatcher(c.wanted)
+		for _, cand := range c.candidates {
+			rank, ok := m.Rank(cand.platform)
+			if cand.rank == -1 {
+				assert.False(t, ok, "%#v on %#v", cand.platform, c.wanted)
+			} else {
+				assert.True(t, ok, "%#v on %#v", cand.platform, c.wanted)
+				assert.Equal(t, cand.rank, rank, "%#v on %#v", cand.platform, c.wanted)
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package manifest
+
+import (
+	"fmt"
+
+	"github.com/containers/image/types"
+	"github.com/pkg/errors"
+)
+
+// ManifestLayerCompressionIncompatibilityError indicates that a manifest format can not describe a layer
+// after it has been compressed or decompressed in the requested way, e.g. a zstd-compressed layer in a Docker schema2 manifest.
+type ManifestLayerCompressionIncompatibilityError struct {
+	text string
+}
+
+func (m ManifestLayerCompressionIncompatibilityError) Error() string {
+	return m.text
+}
+
+// compressionMIMETypeSet describes a set of MIME types of a single kind of layer, differing only in compression.
+// It maps compression algorithm names to MIME types; the "" key is used for the uncompressed variant.
+type compressionMIMETypeSet map[string]string
+
+const mtsUncompressed = "" // A key in compressionMIMETypeSet for the uncompressed variant
+
+// updatedMIMEType returns the MIME type to use for a layer with mimeType after copying it as described by updated,
+// using sets to find the variants of mimeType.
+func updatedMIMEType(sets []compressionMIMETypeSet, mimeType string, updated types.BlobInfo) (string, error) {
+	if updated.CompressionOperation == types.PreserveOriginal {
+		return mimeType, nil
+	}
+	for _, set := range sets {
+		if !compressionMIMETypeSetContains(set, mimeType) {
+			continue
+		}
+		switch updated.CompressionOperation {
+		case types.Decompress:
+			if mt, ok := set[mtsUncompressed]; ok {
+				return mt, nil
+			}
+			return "", ManifestLayerCompressionIncompatibilityError{fmt.Sprintf("uncompressed variant of MIME type %s is not known", mimeType)}
+		case types.Compress:
+			if updated.CompressionAlgorithm == nil {
+				return "", errors.Errorf("Internal error: layer %s is compressed, but the compression algorithm is not known", updated.Digest)
+			}
+			if mt, ok := set[updated.CompressionAlgorithm.Name()]; ok {
+				return mt, nil
+			}
+			return "", ManifestLayerCompressionIncompatibilityError{fmt.Sprintf("%s compression is not supported for MIME type %s", updated.CompressionAlgorithm.Name(), mimeType)}
+		default:
+			return "", errors.Errorf("unknown compression operation (%d)", updated.CompressionOperation)
+		}
+	}
+	return "", ManifestLayerCompressionIncompatibilityError{fmt.Sprintf("compressing or decompressing layers with MIME type %s is not supported", mimeType)}
+}
+
+// compressionMIMETypeSetContains returns true if set contains mimeType.
+func compressionMIMETypeSetContains(set compressionMIMETypeSet, mimeType string) bool {
+	for _, mt := range set {
+		if mt == mimeType {
+			return true
+		}
+	}
+	return false
+}
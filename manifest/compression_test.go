@@ -0,0 +1,81 @@
+package manifest
+
+import (
+	"testing"
+
+	"github.com/containers/image/pkg/compression"
+	"github.com/containers/image/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOCI1UpdateLayerInfosCompression(t *testing.T) {
+	for _, c := range []struct {
+		mimeType  string
+		operation types.LayerCompression
+		algorithm *compression.Algorithm
+		expected  string // "" if an error is expected
+	}{
+		{imgspecv1.MediaTypeImageLayerGzip, types.PreserveOriginal, nil, imgspecv1.MediaTypeImageLayerGzip},
+		{imgspecv1.MediaTypeImageLayerGzip, types.Decompress, nil, imgspecv1.MediaTypeImageLayer},
+		{imgspecv1.MediaTypeImageLayer, types.Compress, &compression.Gzip, imgspecv1.MediaTypeImageLayerGzip},
+		{imgspecv1.MediaTypeImageLayer, types.Compress, &compression.Zstd, OCI1LayerZstdMediaType},
+		{imgspecv1.MediaTypeImageLayerGzip, types.Compress, &compression.Zstd, OCI1LayerZstdMediaType},
+		{OCI1LayerZstdMediaType, types.Decompress, nil, imgspecv1.MediaTypeImageLayer},
+		{imgspecv1.MediaTypeImageLayerNonDistributable, types.Compress, &compression.Zstd, OCI1LayerNonDistributableZstdMediaType},
+		{imgspecv1.MediaTypeImageLayerNonDistributableGzip, types.Decompress, nil, imgspecv1.MediaTypeImageLayerNonDistributable},
+		{imgspecv1.MediaTypeImageLayer, types.Compress, nil, ""},
+		{imgspecv1.MediaTypeImageLayer, types.Compress, &compression.Bzip2, ""},
+		{"application/x-unknown", types.Compress, &compression.Gzip, ""},
+	} {
+		m := OCI1FromComponents(imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageConfig}, []imgspecv1.Descriptor{
+			{MediaType: c.mimeType, Digest: "sha256:1111111111111111111111111111111111111111111111111111111111111111"},
+		})
+		err := m.UpdateLayerInfos([]types.BlobInfo{{
+			Digest:               "sha256:2222222222222222222222222222222222222222222222222222222222222222",
+			CompressionOperation: c.operation,
+			CompressionAlgorithm: c.algorithm,
+		}})
+		if c.expected == "" {
+			assert.Error(t, err, "%#v", c)
+			assert.Equal(t, c.mimeType, m.Layers[0].MediaType, "%#v", c)
+		} else {
+			require.NoError(t, err, "%#v", c)
+			assert.Equal(t, c.expected, m.Layers[0].MediaType, "%#v", c)
+		}
+	}
+}
+
+func TestSchema2UpdateLayerInfosCompression(t *testing.T) {
+	for _, c := range []struct {
+		mimeType  string
+		operation types.LayerCompression
+		algorithm *compression.Algorithm
+		expected  string // "" if an error is expected
+	}{
+		{DockerV2Schema2LayerMediaType, types.PreserveOriginal, nil, DockerV2Schema2LayerMediaType},
+		{DockerV2Schema2LayerMediaType, types.Decompress, nil, DockerV2SchemaLayerMediaTypeUncompressed},
+		{DockerV2SchemaLayerMediaTypeUncompressed, types.Compress, &compression.Gzip, DockerV2Schema2LayerMediaType},
+		{DockerV2Schema2ForeignLayerMediaType, types.Decompress, nil, DockerV2Schema2ForeignLayerMediaTypeUncompressed},
+		{DockerV2SchemaLayerMediaTypeUncompressed, types.Compress, &compression.Zstd, ""},
+		{DockerV2Schema2LayerMediaType, types.Compress, &compression.Zstd, ""},
+	} {
+		m := Schema2FromComponents(Schema2Descriptor{MediaType: DockerV2Schema2ConfigMediaType}, []Schema2Descriptor{
+			{MediaType: c.mimeType, Digest: "sha256:1111111111111111111111111111111111111111111111111111111111111111"},
+		})
+		err := m.UpdateLayerInfos([]types.BlobInfo{{
+			Digest:               "sha256:2222222222222222222222222222222222222222222222222222222222222222",
+			CompressionOperation: c.operation,
+			CompressionAlgorithm: c.algorithm,
+		}})
+		if c.expected == "" {
+			assert.Error(t, err, "%#v", c)
+			assert.IsType(t, ManifestLayerCompressionIncompatibilityError{}, errors.Cause(err), "%#v", c)
+		} else {
+			require.NoError(t, err, "%#v", c)
+			assert.Equal(t, c.expected, m.LayersDescriptors[0].MediaType, "%#v", c)
+		}
+	}
+}
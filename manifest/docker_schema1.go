@@ -2,11 +2,13 @@ package manifest
 
 import (
 	"encoding/json"
+	"fmt"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/pkg/compression"
 	"github.com/containers/image/types"
 	"github.com/docker/docker/api/types/versions"
 	"github.com/opencontainers/go-digest"
@@ -140,6 +142,12 @@ func (m *Schema1) UpdateLayerInfos(layerInfos []types.BlobInfo) error {
 	if len(m.FSLayers) != len(layerInfos) {
 		return errors.Errorf("Error preparing updated manifest: layer count changed from %d to %d", len(m.FSLayers), len(layerInfos))
 	}
+	for _, info := range layerInfos {
+		// Schema1 can only describe gzip-compressed (or, in practice, uncompressed) layers.
+		if info.CompressionOperation == types.Compress && info.CompressionAlgorithm != nil && info.CompressionAlgorithm.Name() != compression.Gzip.Name() {
+			return ManifestLayerCompressionIncompatibilityError{fmt.Sprintf("%s compression is not supported by Docker schema1 manifests, layer %q", info.CompressionAlgorithm.Name(), info.Digest)}
+		}
+	}
 	m.FSLayers = make([]Schema1FSLayers, len(layerInfos))
 	for i, info := range layerInfos {
 		// (docker push) sets up m.ExtractedV1Compatibility[].{Id,Parent} based on values of info.Digest,
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"time"
 
+	"github.com/containers/image/pkg/compression"
 	"github.com/containers/image/pkg/strslice"
 	"github.com/containers/image/types"
 	"github.com/opencontainers/go-digest"
@@ -28,6 +29,19 @@ func BlobInfoFromSchema2Descriptor(desc Schema2Descriptor) types.BlobInfo {
 	}
 }
 
+// schema2CompressionMIMETypeSets lists the variants of schema2 layer MIME types using various compression algorithms.
+// Only gzip is supported by schema2.
+var schema2CompressionMIMETypeSets = []compressionMIMETypeSet{
+	{
+		mtsUncompressed:         DockerV2SchemaLayerMediaTypeUncompressed,
+		compression.Gzip.Name(): DockerV2Schema2LayerMediaType,
+	},
+	{
+		mtsUncompressed:         DockerV2Schema2ForeignLayerMediaTypeUncompressed,
+		compression.Gzip.Name(): DockerV2Schema2ForeignLayerMediaType,
+	},
+}
+
 // Schema2 is a manifest in docker/distribution schema 2.
 type Schema2 struct {
 	SchemaVersion     int                 `json:"schemaVersion"`
@@ -207,7 +221,12 @@ func (m *Schema2) UpdateLayerInfos(layerInfos []types.BlobInfo) error {
 	original := m.LayersDescriptors
 	m.LayersDescriptors = make([]Schema2Descriptor, len(layerInfos))
 	for i, info := range layerInfos {
-		m.LayersDescriptors[i].MediaType = original[i].MediaType
+		mimeType, err := updatedMIMEType(schema2CompressionMIMETypeSets, original[i].MediaType, info)
+		if err != nil {
+			m.LayersDescriptors = original
+			return errors.Wrapf(err, "Error preparing updated manifest, layer %q", info.Digest)
+		}
+		m.LayersDescriptors[i].MediaType = mimeType
 		m.LayersDescriptors[i].Digest = info.Digest
 		m.LayersDescriptors[i].Size = info.Size
 		m.LayersDescriptors[i].URLs = info.URLs
@@ -0,0 +1,262 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/containers/image/internal/platform"
+	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Schema2PlatformSpec describes the platform which a particular manifest is
+// specialized for.
+type Schema2PlatformSpec struct {
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+	Features     []string `json:"features,omitempty"` // removed in OCI
+}
+
+// Schema2ManifestDescriptor references a platform-specific manifest.
+type Schema2ManifestDescriptor struct {
+	Schema2Descriptor
+	Platform Schema2PlatformSpec `json:"platform"`
+}
+
+// Schema2List is a list of platform-specific manifests.
+type Schema2List struct {
+	SchemaVersion int                         `json:"schemaVersion"`
+	MediaType     string                      `json:"mediaType"`
+	Manifests     []Schema2ManifestDescriptor `json:"manifests"`
+}
+
+// Schema2ListFromComponents creates a Schema2 manifest list instance from the
+// supplied data.
+func Schema2ListFromComponents(components []Schema2ManifestDescriptor) *Schema2List {
+	list := Schema2List{
+		SchemaVersion: 2,
+		MediaType:     DockerV2ListMediaType,
+		Manifests:     make([]Schema2ManifestDescriptor, len(components)),
+	}
+	for i, component := range components {
+		list.Manifests[i] = schema2ManifestDescriptorClone(component)
+	}
+	return &list
+}
+
+// Schema2ListFromManifest creates a Schema2List manifest list instance from a manifest list blob.
+func Schema2ListFromManifest(manifest []byte) (*Schema2List, error) {
+	list := Schema2List{}
+	if err := json.Unmarshal(manifest, &list); err != nil {
+		return nil, errors.Wrap(err, "Error unmarshaling Schema2List")
+	}
+	return &list, nil
+}
+
+// Schema2ListClone creates a deep copy of the supplied Schema2List manifest list.
+func Schema2ListClone(list *Schema2List) *Schema2List {
+	copy := *list
+	copy.Manifests = make([]Schema2ManifestDescriptor, len(list.Manifests))
+	for i, m := range list.Manifests {
+		copy.Manifests[i] = schema2ManifestDescriptorClone(m)
+	}
+	return &copy
+}
+
+// schema2ManifestDescriptorClone returns a deep copy of m.
+func schema2ManifestDescriptorClone(m Schema2ManifestDescriptor) Schema2ManifestDescriptor {
+	m.URLs = dupStringSlice(m.URLs)
+	m.Platform.OSFeatures = dupStringSlice(m.Platform.OSFeatures)
+	m.Platform.Features = dupStringSlice(m.Platform.Features)
+	return m
+}
+
+// Clone returns a deep copy of this list and its contents.
+func (list *Schema2List) Clone() List {
+	return Schema2ListClone(list)
+}
+
+// MIMEType returns the MIME type of this particular manifest list.
+func (list *Schema2List) MIMEType() string {
+	return DockerV2ListMediaType
+}
+
+// Instances returns a slice of digests of the manifests that this list knows of.
+func (list *Schema2List) Instances() []digest.Digest {
+	results := make([]digest.Digest, len(list.Manifests))
+	for i, m := range list.Manifests {
+		results[i] = m.Digest
+	}
+	return results
+}
+
+// Instance returns the ListUpdate of a particular instance in the list.
+func (list *Schema2List) Instance(instanceDigest digest.Digest) (ListUpdate, error) {
+	for _, manifest := range list.Manifests {
+		if manifest.Digest == instanceDigest {
+			return ListUpdate{
+				Digest:    manifest.Digest,
+				Size:      manifest.Size,
+				MediaType: manifest.MediaType,
+			}, nil
+		}
+	}
+	return ListUpdate{}, errors.Errorf("unable to find instance %s passed to Schema2List.Instance", instanceDigest)
+}
+
+// UpdateInstances updates the sizes, digests, and media types of the manifests
+// which the list catalogs.
+func (list *Schema2List) UpdateInstances(updates []ListUpdate) error {
+	if len(updates) != len(list.Manifests) {
+		return errors.Errorf("incorrect number of update entries passed to Schema2List.UpdateInstances: expected %d, got %d", len(list.Manifests), len(updates))
+	}
+	for i := range updates {
+		if err := updates[i].Digest.Validate(); err != nil {
+			return errors.Wrapf(err, "update %d of %d passed to Schema2List.UpdateInstances contained an invalid digest", i+1, len(updates))
+		}
+		list.Manifests[i].Digest = updates[i].Digest
+		if updates[i].Size < 0 {
+			return errors.Errorf("update %d of %d passed to Schema2List.UpdateInstances had an invalid size (%d)", i+1, len(updates), updates[i].Size)
+		}
+		list.Manifests[i].Size = updates[i].Size
+		if updates[i].MediaType == "" {
+			return errors.Errorf("update %d of %d passed to Schema2List.UpdateInstances had no media type (was %q)", i+1, len(updates), list.Manifests[i].MediaType)
+		}
+		list.Manifests[i].MediaType = updates[i].MediaType
+	}
+	return nil
+}
+
+// AddInstance adds an instance, with its digest, size, media type, and the platform it is built for,
+// at the end of the list.
+func (list *Schema2List) AddInstance(update ListUpdate, platform *imgspecv1.Platform) error {
+	if err := update.Digest.Validate(); err != nil {
+		return errors.Wrap(err, "instance passed to Schema2List.AddInstance contained an invalid digest")
+	}
+	if update.Size < 0 {
+		return errors.Errorf("instance passed to Schema2List.AddInstance had an invalid size (%d)", update.Size)
+	}
+	if update.MediaType == "" {
+		return errors.New("instance passed to Schema2List.AddInstance had no media type")
+	}
+	if platform == nil {
+		return errors.New("instance passed to Schema2List.AddInstance had no platform, which is required for Docker manifest lists")
+	}
+	list.Manifests = append(list.Manifests, Schema2ManifestDescriptor{
+		Schema2Descriptor: Schema2Descriptor{
+			MediaType: update.MediaType,
+			Size:      update.Size,
+			Digest:    update.Digest,
+		},
+		Platform: schema2PlatformSpecFromOCIPlatform(*platform),
+	})
+	return nil
+}
+
+// RemoveInstance removes the instance with the specified digest from the list.
+func (list *Schema2List) RemoveInstance(instanceDigest digest.Digest) error {
+	for i, manifest := range list.Manifests {
+		if manifest.Digest == instanceDigest {
+			list.Manifests = append(list.Manifests[:i], list.Manifests[i+1:]...)
+			return nil
+		}
+	}
+	return errors.Errorf("unable to find instance %s passed to Schema2List.RemoveInstance", instanceDigest)
+}
+
+// InstanceForPlatform returns the digest of the instance in the list which is most appropriate for use on
+// the wanted platform, preferring instances listed first if several are equally appropriate.
+func (list *Schema2List) InstanceForPlatform(wanted imgspecv1.Platform) (digest.Digest, error) {
+	matcher := platform.NewMatcher(wanted)
+	best, bestRank := -1, 0
+	for i, d := range list.Manifests {
+		if rank, ok := matcher.Rank(ociPlatformFromSchema2PlatformSpec(d.Platform)); ok && (best == -1 || rank < bestRank) {
+			best, bestRank = i, rank
+		}
+	}
+	if best == -1 {
+		return "", fmt.Errorf("no image found in manifest list for architecture %s, variant %q, OS %s", wanted.Architecture, wanted.Variant, wanted.OS)
+	}
+	return list.Manifests[best].Digest, nil
+}
+
+// ChooseInstance returns the digest of the image in the list which is appropriate for the platform
+// described by sys, or for the current platform if sys doesn't specify any details.
+func (list *Schema2List) ChooseInstance(sys *types.SystemContext) (digest.Digest, error) {
+	return list.InstanceForPlatform(platform.WantedPlatform(sys))
+}
+
+// Serialize returns the list in a blob format.
+// NOTE: Serialize() does not in general reproduce the original blob if this object was loaded from one, even if no modifications were made!
+func (list *Schema2List) Serialize() ([]byte, error) {
+	buf, err := json.Marshal(list)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error marshaling Schema2List")
+	}
+	return buf, nil
+}
+
+// ToOCI1Index returns the list encoded as an OCI1 index.
+// The Features field of instance platforms, which was removed in OCI, is dropped.
+func (list *Schema2List) ToOCI1Index() (*OCI1Index, error) {
+	components := make([]imgspecv1.Descriptor, 0, len(list.Manifests))
+	for _, manifest := range list.Manifests {
+		platform := ociPlatformFromSchema2PlatformSpec(manifest.Platform)
+		components = append(components, imgspecv1.Descriptor{
+			MediaType: manifest.MediaType,
+			Size:      manifest.Size,
+			Digest:    manifest.Digest,
+			URLs:      dupStringSlice(manifest.URLs),
+			Platform:  &platform,
+		})
+	}
+	return OCI1IndexFromComponents(components, nil), nil
+}
+
+// ToSchema2List returns the list encoded as a Schema2 list.
+func (list *Schema2List) ToSchema2List() (*Schema2List, error) {
+	return Schema2ListClone(list), nil
+}
+
+// ConvertToMIMEType converts the passed-in manifest list to a manifest
+// list of the specified type.
+func (list *Schema2List) ConvertToMIMEType(manifestMIMEType string) (List, error) {
+	switch normalized := NormalizedMIMEType(manifestMIMEType); normalized {
+	case DockerV2ListMediaType:
+		return list.Clone(), nil
+	case imgspecv1.MediaTypeImageIndex:
+		return list.ToOCI1Index()
+	case DockerV2Schema1MediaType, DockerV2Schema1SignedMediaType, imgspecv1.MediaTypeImageManifest, DockerV2Schema2MediaType:
+		return nil, fmt.Errorf("Can not convert manifest list to MIME type %q, which is not a list type", manifestMIMEType)
+	default:
+		// Note that this may not be reachable, NormalizedMIMEType has a default for unknown values.
+		return nil, fmt.Errorf("Unimplemented manifest list MIME type %s", manifestMIMEType)
+	}
+}
+
+// ociPlatformFromSchema2PlatformSpec returns p as an OCI platform.
+func ociPlatformFromSchema2PlatformSpec(p Schema2PlatformSpec) imgspecv1.Platform {
+	return imgspecv1.Platform{
+		Architecture: p.Architecture,
+		OS:           p.OS,
+		OSVersion:    p.OSVersion,
+		OSFeatures:   dupStringSlice(p.OSFeatures),
+		Variant:      p.Variant,
+	}
+}
+
+// schema2PlatformSpecFromOCIPlatform returns p as a Schema2PlatformSpec.
+func schema2PlatformSpecFromOCIPlatform(p imgspecv1.Platform) Schema2PlatformSpec {
+	return Schema2PlatformSpec{
+		Architecture: p.Architecture,
+		OS:           p.OS,
+		OSVersion:    p.OSVersion,
+		OSFeatures:   dupStringSlice(p.OSFeatures),
+		Variant:      p.Variant,
+	}
+}
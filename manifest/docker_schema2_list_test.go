@@ -0,0 +1,199 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchema2ListFromManifest(t *testing.T) {
+	manifest, err := ioutil.ReadFile(filepath.Join("fixtures", "v2list.manifest.json"))
+	require.NoError(t, err)
+
+	list, err := Schema2ListFromManifest(manifest)
+	require.NoError(t, err)
+	assert.Equal(t, DockerV2ListMediaType, list.MediaType)
+	assert.Equal(t, []digest.Digest{
+		"sha256:7820f9a86d4ad15a2c4f0c0e5479298df2aa7c2f6871288e2ef8546f3e7b6783",
+		"sha256:ae1b0e06e8ade3a11267564a26e750585ba2259c0ecab59ab165ad1af41d1bdd",
+		"sha256:e4c0df75810b953d6717b8f8f28298d73870e8aa2a0d5e77b8391f16fdfbbbe2",
+		"sha256:07ebe243465ef4a667b78154ae6c3ea46fdb1582936aac3ac899ea311a701b40",
+		"sha256:fb2fc0707b86dafa9959fe3d29e66af8787aee4d9a23581714be65db4265ad8a",
+	}, list.Instances())
+	assert.Equal(t, "armv7", list.Manifests[3].Platform.Variant)
+
+	_, err = Schema2ListFromManifest([]byte("}this is invalid JSON"))
+	assert.Error(t, err)
+}
+
+func TestSchema2ListUpdateInstances(t *testing.T) {
+	manifest, err := ioutil.ReadFile(filepath.Join("fixtures", "v2list.manifest.json"))
+	require.NoError(t, err)
+	list, err := Schema2ListFromManifest(manifest)
+	require.NoError(t, err)
+
+	updates := []ListUpdate{}
+	for _, instance := range list.Manifests {
+		updates = append(updates, ListUpdate{
+			Digest:    instance.Digest,
+			Size:      instance.Size,
+			MediaType: instance.MediaType,
+		})
+	}
+	updates[1] = ListUpdate{
+		Digest:    "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		Size:      1234,
+		MediaType: DockerV2Schema2MediaType,
+	}
+
+	clone := Schema2ListClone(list)
+	err = clone.UpdateInstances(updates)
+	require.NoError(t, err)
+	assert.Equal(t, updates[1].Digest, clone.Manifests[1].Digest)
+	assert.Equal(t, int64(1234), clone.Manifests[1].Size)
+	assert.Equal(t, DockerV2Schema2MediaType, clone.Manifests[1].MediaType)
+	assert.Equal(t, list.Manifests[1].Platform, clone.Manifests[1].Platform)
+	// The original is not modified
+	assert.Equal(t, digest.Digest("sha256:ae1b0e06e8ade3a11267564a26e750585ba2259c0ecab59ab165ad1af41d1bdd"), list.Manifests[1].Digest)
+
+	serialized, err := clone.Serialize()
+	require.NoError(t, err)
+	reparsed, err := Schema2ListFromManifest(serialized)
+	require.NoError(t, err)
+	assert.Equal(t, clone, reparsed)
+
+	// Invalid updates
+	err = clone.UpdateInstances(updates[:2])
+	assert.Error(t, err)
+	for _, invalid := range []ListUpdate{
+		{Digest: "invalid", Size: 1, MediaType: DockerV2Schema2MediaType},
+		{Digest: updates[1].Digest, Size: -1, MediaType: DockerV2Schema2MediaType},
+		{Digest: updates[1].Digest, Size: 1, MediaType: ""},
+	} {
+		u := append([]ListUpdate{}, updates...)
+		u[1] = invalid
+		err = Schema2ListClone(list).UpdateInstances(u)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestSchema2ListAddRemoveInstance(t *testing.T) {
+	manifest, err := ioutil.ReadFile(filepath.Join("fixtures", "v2list.manifest.json"))
+	require.NoError(t, err)
+	list, err := Schema2ListFromManifest(manifest)
+	require.NoError(t, err)
+
+	added := ListUpdate{
+		Digest:    "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		Size:      1234,
+		MediaType: DockerV2Schema2MediaType,
+	}
+	err = list.AddInstance(added, &imgspecv1.Platform{Architecture: "arm64", OS: "linux", Variant: "v8"})
+	require.NoError(t, err)
+	require.Len(t, list.Manifests, 6)
+	assert.Equal(t, added.Digest, list.Manifests[5].Digest)
+	assert.Equal(t, Schema2PlatformSpec{Architecture: "arm64", OS: "linux", Variant: "v8"}, list.Manifests[5].Platform)
+	instance, err := list.Instance(added.Digest)
+	require.NoError(t, err)
+	assert.Equal(t, added, instance)
+
+	// Invalid instances
+	for _, invalid := range []ListUpdate{
+		{Digest: "invalid", Size: 1, MediaType: DockerV2Schema2MediaType},
+		{Digest: added.Digest, Size: -1, MediaType: DockerV2Schema2MediaType},
+		{Digest: added.Digest, Size: 1, MediaType: ""},
+	} {
+		err = list.AddInstance(invalid, &imgspecv1.Platform{Architecture: "amd64", OS: "linux"})
+		assert.Error(t, err, invalid)
+	}
+	// A platform is mandatory
+	err = list.AddInstance(added, nil)
+	assert.Error(t, err)
+
+	err = list.RemoveInstance("sha256:ae1b0e06e8ade3a11267564a26e750585ba2259c0ecab59ab165ad1af41d1bdd")
+	require.NoError(t, err)
+	assert.Len(t, list.Manifests, 5)
+	_, err = list.Instance("sha256:ae1b0e06e8ade3a11267564a26e750585ba2259c0ecab59ab165ad1af41d1bdd")
+	assert.Error(t, err)
+	err = list.RemoveInstance("sha256:ae1b0e06e8ade3a11267564a26e750585ba2259c0ecab59ab165ad1af41d1bdd")
+	assert.Error(t, err)
+}
+
+func TestSchema2ListChooseInstance(t *testing.T) {
+	manifest, err := ioutil.ReadFile(filepath.Join("fixtures", "v2list.manifest.json"))
+	require.NoError(t, err)
+	list, err := Schema2ListFromManifest(manifest)
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		platform imgspecv1.Platform
+		expected digest.Digest
+	}{
+		{imgspecv1.Platform{Architecture: "amd64", OS: "linux"}, "sha256:ae1b0e06e8ade3a11267564a26e750585ba2259c0ecab59ab165ad1af41d1bdd"},
+		{imgspecv1.Platform{Architecture: "s390x", OS: "linux"}, "sha256:e4c0df75810b953d6717b8f8f28298d73870e8aa2a0d5e77b8391f16fdfbbbe2"},
+		{imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "armv7"}, "sha256:07ebe243465ef4a667b78154ae6c3ea46fdb1582936aac3ac899ea311a701b40"},
+		// Older compatible variants are accepted
+		{imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "v8"}, "sha256:07ebe243465ef4a667b78154ae6c3ea46fdb1582936aac3ac899ea311a701b40"},
+	} {
+		d, err := list.InstanceForPlatform(c.platform)
+		require.NoError(t, err, c.platform)
+		assert.Equal(t, c.expected, d, c.platform)
+
+		d, err = list.ChooseInstance(&types.SystemContext{ArchitectureChoice: c.platform.Architecture, OSChoice: c.platform.OS})
+		require.NoError(t, err, c.platform)
+		if c.platform.Variant == "" {
+			assert.Equal(t, c.expected, d, c.platform)
+		}
+	}
+
+	_, err = list.InstanceForPlatform(imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "unmatched"})
+	assert.Error(t, err)
+	_, err = list.InstanceForPlatform(imgspecv1.Platform{Architecture: "arm", OS: "linux", Variant: "v6"})
+	assert.Error(t, err)
+	_, err = list.ChooseInstance(&types.SystemContext{OSChoice: "Unmatched"})
+	assert.Error(t, err)
+}
+
+func TestSchema2ListToOCI1Index(t *testing.T) {
+	manifest, err := ioutil.ReadFile(filepath.Join("fixtures", "v2list.manifest.json"))
+	require.NoError(t, err)
+	list, err := Schema2ListFromManifest(manifest)
+	require.NoError(t, err)
+
+	index, err := list.ToOCI1Index()
+	require.NoError(t, err)
+	assert.Equal(t, imgspecv1.MediaTypeImageIndex, index.MIMEType())
+	assert.Equal(t, list.Instances(), index.Instances())
+	for i, m := range list.Manifests {
+		require.NotNil(t, index.Manifests[i].Platform)
+		assert.Equal(t, m.MediaType, index.Manifests[i].MediaType)
+		assert.Equal(t, m.Size, index.Manifests[i].Size)
+		assert.Equal(t, m.Platform.Architecture, index.Manifests[i].Platform.Architecture)
+		assert.Equal(t, m.Platform.OS, index.Manifests[i].Platform.OS)
+		assert.Equal(t, m.Platform.Variant, index.Manifests[i].Platform.Variant)
+	}
+
+	// Converting back loses only the OCI-removed Features field.
+	roundTrip, err := index.ToSchema2List()
+	require.NoError(t, err)
+	expected := Schema2ListClone(list)
+	for i := range expected.Manifests {
+		expected.Manifests[i].Platform.Features = nil
+	}
+	assert.Equal(t, expected, roundTrip)
+
+	converted, err := list.ConvertToMIMEType(imgspecv1.MediaTypeImageIndex)
+	require.NoError(t, err)
+	assert.Equal(t, index, converted)
+	converted, err = list.ConvertToMIMEType(DockerV2ListMediaType)
+	require.NoError(t, err)
+	assert.Equal(t, list, converted)
+	_, err = list.ConvertToMIMEType(DockerV2Schema2MediaType)
+	assert.Error(t, err)
+}
@@ -0,0 +1,43 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListFromBlob(t *testing.T) {
+	for _, c := range []struct {
+		path     string
+		mimeType string
+	}{
+		{"v2list.manifest.json", DockerV2ListMediaType},
+		{"ociv1.image.index.json", imgspecv1.MediaTypeImageIndex},
+	} {
+		manifest, err := ioutil.ReadFile(filepath.Join("fixtures", c.path))
+		require.NoError(t, err, c.path)
+		list, err := ListFromBlob(manifest, c.mimeType)
+		require.NoError(t, err, c.path)
+		assert.Equal(t, c.mimeType, list.MIMEType(), c.path)
+		assert.NotEmpty(t, list.Instances(), c.path)
+	}
+
+	// Single images are not lists
+	for _, c := range []struct {
+		path     string
+		mimeType string
+	}{
+		{"v2s2.manifest.json", DockerV2Schema2MediaType},
+		{"v2s1.manifest.json", DockerV2Schema1SignedMediaType},
+		{"ociv1.manifest.json", imgspecv1.MediaTypeImageManifest},
+	} {
+		manifest, err := ioutil.ReadFile(filepath.Join("fixtures", c.path))
+		require.NoError(t, err, c.path)
+		_, err = ListFromBlob(manifest, c.mimeType)
+		assert.Error(t, err, c.path)
+	}
+}
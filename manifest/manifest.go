@@ -28,6 +28,14 @@ const (
 	DockerV2ListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
 	// DockerV2Schema2ForeignLayerMediaType is the MIME type used for schema 2 foreign layers.
 	DockerV2Schema2ForeignLayerMediaType = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+	// DockerV2SchemaLayerMediaTypeUncompressed is the MIME type used for uncompressed schema 2 layers.
+	DockerV2SchemaLayerMediaTypeUncompressed = "application/vnd.docker.image.rootfs.diff.tar"
+	// DockerV2Schema2ForeignLayerMediaTypeUncompressed is the MIME type used for uncompressed schema 2 foreign layers.
+	DockerV2Schema2ForeignLayerMediaTypeUncompressed = "application/vnd.docker.image.rootfs.foreign.diff.tar"
+	// OCI1LayerZstdMediaType is the MIME type used for zstd-compressed OCI layers (not defined by image-spec v1.0.0).
+	OCI1LayerZstdMediaType = "application/vnd.oci.image.layer.v1.tar+zstd"
+	// OCI1LayerNonDistributableZstdMediaType is the MIME type used for zstd-compressed non-distributable OCI layers.
+	OCI1LayerNonDistributableZstdMediaType = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
 )
 
 // DefaultRequestedManifestMIMETypes is a list of MIME types a types.ImageSource
@@ -38,6 +46,7 @@ var DefaultRequestedManifestMIMETypes = []string{
 	DockerV2Schema1SignedMediaType,
 	DockerV2Schema1MediaType,
 	DockerV2ListMediaType,
+	imgspecv1.MediaTypeImageIndex,
 }
 
 // Manifest is an interface for parsing, modifying image manifests in isolation.
@@ -95,7 +104,8 @@ func GuessMIMEType(manifest []byte) string {
 	}
 
 	switch meta.MediaType {
-	case DockerV2Schema2MediaType, DockerV2ListMediaType: // A recognized type.
+	case DockerV2Schema2MediaType, DockerV2ListMediaType,
+		imgspecv1.MediaTypeImageManifest, imgspecv1.MediaTypeImageIndex: // A recognized type.
 		return meta.MediaType
 	}
 	// this is the only way the function can return DockerV2Schema1MediaType, and recognizing that is essential for stripping the JWS signatures = computing the correct manifest digest.
@@ -127,7 +137,8 @@ func GuessMIMEType(manifest []byte) string {
 		if err := json.Unmarshal(manifest, &ociIndex); err != nil {
 			return ""
 		}
-		if len(ociIndex.Manifests) != 0 && ociIndex.Manifests[0].MediaType == imgspecv1.MediaTypeImageManifest {
+		// An index may also list instances of other manifest types, but it never has a config.
+		if len(ociIndex.Manifests) != 0 && (ociIndex.Manifests[0].MediaType == imgspecv1.MediaTypeImageManifest || ociMan.Config.MediaType == "") {
 			return imgspecv1.MediaTypeImageIndex
 		}
 		return DockerV2Schema2MediaType
@@ -186,7 +197,7 @@ func AddDummyV2S1Signature(manifest []byte) ([]byte, error) {
 
 // MIMETypeIsMultiImage returns true if mimeType is a list of images
 func MIMETypeIsMultiImage(mimeType string) bool {
-	return mimeType == DockerV2ListMediaType
+	return mimeType == DockerV2ListMediaType || mimeType == imgspecv1.MediaTypeImageIndex
 }
 
 // NormalizedMIMEType returns the effective MIME type of a manifest MIME type returned by a server,
@@ -200,6 +211,7 @@ func NormalizedMIMEType(input string) string {
 		return DockerV2Schema1SignedMediaType
 	case DockerV2Schema1MediaType, DockerV2Schema1SignedMediaType,
 		imgspecv1.MediaTypeImageManifest,
+		imgspecv1.MediaTypeImageIndex,
 		DockerV2Schema2MediaType,
 		DockerV2ListMediaType:
 		return input
@@ -226,7 +238,7 @@ func FromBlob(manblob []byte, mt string) (Manifest, error) {
 		return OCI1FromManifest(manblob)
 	case DockerV2Schema2MediaType:
 		return Schema2FromManifest(manblob)
-	case DockerV2ListMediaType:
+	case DockerV2ListMediaType, imgspecv1.MediaTypeImageIndex:
 		return nil, fmt.Errorf("Treating manifest lists as individual manifests is not implemented")
 	default: // Note that this may not be reachable, NormalizedMIMEType has a default for unknown values.
 		return nil, fmt.Errorf("Unimplemented manifest MIME type %s", mt)
@@ -0,0 +1,227 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/containers/image/internal/platform"
+	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// OCI1Index is just an alias for the OCI index type, but one which we can
+// provide methods for.
+type OCI1Index struct {
+	imgspecv1.Index
+}
+
+// OCI1IndexFromComponents creates an OCI1 image index instance from the
+// supplied data.
+func OCI1IndexFromComponents(components []imgspecv1.Descriptor, annotations map[string]string) *OCI1Index {
+	index := OCI1Index{
+		imgspecv1.Index{
+			Versioned:   specs.Versioned{SchemaVersion: 2},
+			Manifests:   make([]imgspecv1.Descriptor, len(components)),
+			Annotations: dupStringStringMap(annotations),
+		},
+	}
+	for i, component := range components {
+		index.Manifests[i] = ociDescriptorClone(component)
+	}
+	return &index
+}
+
+// OCI1IndexFromManifest creates an OCI1 index instance from an index blob.
+func OCI1IndexFromManifest(manifest []byte) (*OCI1Index, error) {
+	index := OCI1Index{}
+	if err := json.Unmarshal(manifest, &index); err != nil {
+		return nil, errors.Wrap(err, "Error unmarshaling OCI1Index")
+	}
+	return &index, nil
+}
+
+// OCI1IndexClone creates a deep copy of the passed-in index.
+func OCI1IndexClone(index *OCI1Index) *OCI1Index {
+	return OCI1IndexFromComponents(index.Manifests, index.Annotations)
+}
+
+// ociDescriptorClone returns a deep copy of d.
+func ociDescriptorClone(d imgspecv1.Descriptor) imgspecv1.Descriptor {
+	d.URLs = dupStringSlice(d.URLs)
+	d.Annotations = dupStringStringMap(d.Annotations)
+	if d.Platform != nil {
+		platform := *d.Platform
+		platform.OSFeatures = dupStringSlice(d.Platform.OSFeatures)
+		d.Platform = &platform
+	}
+	return d
+}
+
+// Clone returns a deep copy of this index and its contents.
+func (index *OCI1Index) Clone() List {
+	return OCI1IndexClone(index)
+}
+
+// MIMEType returns the MIME type of this particular manifest index.
+func (index *OCI1Index) MIMEType() string {
+	return imgspecv1.MediaTypeImageIndex
+}
+
+// Instances returns a slice of digests of the manifests that this index knows of.
+func (index *OCI1Index) Instances() []digest.Digest {
+	results := make([]digest.Digest, len(index.Manifests))
+	for i, m := range index.Manifests {
+		results[i] = m.Digest
+	}
+	return results
+}
+
+// Instance returns the ListUpdate of a particular instance in the index.
+func (index *OCI1Index) Instance(instanceDigest digest.Digest) (ListUpdate, error) {
+	for _, manifest := range index.Manifests {
+		if manifest.Digest == instanceDigest {
+			return ListUpdate{
+				Digest:    manifest.Digest,
+				Size:      manifest.Size,
+				MediaType: manifest.MediaType,
+			}, nil
+		}
+	}
+	return ListUpdate{}, errors.Errorf("unable to find instance %s in OCI1Index", instanceDigest)
+}
+
+// UpdateInstances updates the sizes, digests, and media types of the manifests
+// which the list catalogs.
+func (index *OCI1Index) UpdateInstances(updates []ListUpdate) error {
+	if len(updates) != len(index.Manifests) {
+		return errors.Errorf("incorrect number of update entries passed to OCI1Index.UpdateInstances: expected %d, got %d", len(index.Manifests), len(updates))
+	}
+	for i := range updates {
+		if err := updates[i].Digest.Validate(); err != nil {
+			return errors.Wrapf(err, "update %d of %d passed to OCI1Index.UpdateInstances contained an invalid digest", i+1, len(updates))
+		}
+		index.Manifests[i].Digest = updates[i].Digest
+		if updates[i].Size < 0 {
+			return errors.Errorf("update %d of %d passed to OCI1Index.UpdateInstances had an invalid size (%d)", i+1, len(updates), updates[i].Size)
+		}
+		index.Manifests[i].Size = updates[i].Size
+		if updates[i].MediaType == "" {
+			return errors.Errorf("update %d of %d passed to OCI1Index.UpdateInstances had no media type (was %q)", i+1, len(updates), index.Manifests[i].MediaType)
+		}
+		index.Manifests[i].MediaType = updates[i].MediaType
+	}
+	return nil
+}
+
+// AddInstance adds an instance, with its digest, size, media type, and the platform it is built for,
+// at the end of the index.  platform may be nil.
+func (index *OCI1Index) AddInstance(update ListUpdate, platform *imgspecv1.Platform) error {
+	if err := update.Digest.Validate(); err != nil {
+		return errors.Wrap(err, "instance passed to OCI1Index.AddInstance contained an invalid digest")
+	}
+	if update.Size < 0 {
+		return errors.Errorf("instance passed to OCI1Index.AddInstance had an invalid size (%d)", update.Size)
+	}
+	if update.MediaType == "" {
+		return errors.New("instance passed to OCI1Index.AddInstance had no media type")
+	}
+	index.Manifests = append(index.Manifests, ociDescriptorClone(imgspecv1.Descriptor{
+		MediaType: update.MediaType,
+		Size:      update.Size,
+		Digest:    update.Digest,
+		Platform:  platform,
+	}))
+	return nil
+}
+
+// RemoveInstance removes the instance with the specified digest from the index.
+func (index *OCI1Index) RemoveInstance(instanceDigest digest.Digest) error {
+	for i, manifest := range index.Manifests {
+		if manifest.Digest == instanceDigest {
+			index.Manifests = append(index.Manifests[:i], index.Manifests[i+1:]...)
+			return nil
+		}
+	}
+	return errors.Errorf("unable to find instance %s passed to OCI1Index.RemoveInstance", instanceDigest)
+}
+
+// InstanceForPlatform returns the digest of the instance in the index which is most appropriate for use on
+// the wanted platform, preferring instances listed first if several are equally appropriate.
+// Instances which do not specify a platform are ignored.
+func (index *OCI1Index) InstanceForPlatform(wanted imgspecv1.Platform) (digest.Digest, error) {
+	matcher := platform.NewMatcher(wanted)
+	best, bestRank := -1, 0
+	for i, d := range index.Manifests {
+		if d.Platform == nil {
+			continue
+		}
+		if rank, ok := matcher.Rank(*d.Platform); ok && (best == -1 || rank < bestRank) {
+			best, bestRank = i, rank
+		}
+	}
+	if best == -1 {
+		return "", fmt.Errorf("no image found in image index for architecture %s, variant %q, OS %s", wanted.Architecture, wanted.Variant, wanted.OS)
+	}
+	return index.Manifests[best].Digest, nil
+}
+
+// ChooseInstance returns the digest of the image in the index which is appropriate for the platform
+// described by sys, or for the current platform if sys doesn't specify any details.
+func (index *OCI1Index) ChooseInstance(sys *types.SystemContext) (digest.Digest, error) {
+	return index.InstanceForPlatform(platform.WantedPlatform(sys))
+}
+
+// Serialize returns the index in a blob format.
+// NOTE: Serialize() does not in general reproduce the original blob if this object was loaded from one, even if no modifications were made!
+func (index *OCI1Index) Serialize() ([]byte, error) {
+	buf, err := json.Marshal(index)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error marshaling OCI1Index")
+	}
+	return buf, nil
+}
+
+// ToOCI1Index returns the index encoded as an OCI1 index.
+func (index *OCI1Index) ToOCI1Index() (*OCI1Index, error) {
+	return OCI1IndexClone(index), nil
+}
+
+// ToSchema2List returns the index encoded as a Schema2 list.
+// Annotations of the index and of its instances can not be represented, and are dropped.
+func (index *OCI1Index) ToSchema2List() (*Schema2List, error) {
+	components := make([]Schema2ManifestDescriptor, 0, len(index.Manifests))
+	for _, manifest := range index.Manifests {
+		if manifest.Platform == nil {
+			return nil, errors.Errorf("instance %s in OCI1Index has no platform, which is required for Docker manifest lists", manifest.Digest)
+		}
+		components = append(components, Schema2ManifestDescriptor{
+			Schema2Descriptor: Schema2Descriptor{
+				MediaType: manifest.MediaType,
+				Size:      manifest.Size,
+				Digest:    manifest.Digest,
+				URLs:      manifest.URLs,
+			},
+			Platform: schema2PlatformSpecFromOCIPlatform(*manifest.Platform),
+		})
+	}
+	return Schema2ListFromComponents(components), nil
+}
+
+// ConvertToMIMEType converts the passed-in image index to a manifest list of
+// the specified type.
+func (index *OCI1Index) ConvertToMIMEType(manifestMIMEType string) (List, error) {
+	switch normalized := NormalizedMIMEType(manifestMIMEType); normalized {
+	case DockerV2ListMediaType:
+		return index.ToSchema2List()
+	case imgspecv1.MediaTypeImageIndex:
+		return index.Clone(), nil
+	case DockerV2Schema1MediaType, DockerV2Schema1SignedMediaType, imgspecv1.MediaTypeImageManifest, DockerV2Schema2MediaType:
+		return nil, fmt.Errorf("Can not convert image index to MIME type %q, which is not a list type", manifestMIMEType)
+	default:
+		// Note that this may not be reachable, NormalizedMIMEType has a default for unknown values.
+		return nil, fmt.Errorf("Unimplemented manifest MIME type %s", manifestMIMEType)
+	}
+}
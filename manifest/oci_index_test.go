@@ -0,0 +1,194 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOCI1IndexFromManifest(t *testing.T) {
+	manifest, err := ioutil.ReadFile(filepath.Join("fixtures", "ociv1.image.index.json"))
+	require.NoError(t, err)
+
+	index, err := OCI1IndexFromManifest(manifest)
+	require.NoError(t, err)
+	assert.Equal(t, imgspecv1.MediaTypeImageIndex, index.MIMEType())
+	assert.Equal(t, []digest.Digest{
+		"sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f",
+		"sha256:5b0bcabd1ed22e9fb1310cf6c2dec7cdef19f0ad69efa1f392e94a4333501270",
+	}, index.Instances())
+	assert.Equal(t, map[string]string{"com.example.key1": "value1", "com.example.key2": "value2"}, index.Annotations)
+	require.NotNil(t, index.Manifests[1].Platform)
+	assert.Equal(t, []string{"sse4"}, index.Manifests[1].Platform.OSFeatures)
+
+	_, err = OCI1IndexFromManifest([]byte("}this is invalid JSON"))
+	assert.Error(t, err)
+}
+
+func TestOCI1IndexClone(t *testing.T) {
+	manifest, err := ioutil.ReadFile(filepath.Join("fixtures", "ociv1.image.index.json"))
+	require.NoError(t, err)
+	index, err := OCI1IndexFromManifest(manifest)
+	require.NoError(t, err)
+
+	clone := OCI1IndexClone(index)
+	assert.Equal(t, index, clone)
+	clone.Annotations["com.example.key1"] = "modified"
+	clone.Manifests[1].Platform.OSFeatures[0] = "modified"
+	assert.Equal(t, "value1", index.Annotations["com.example.key1"])
+	assert.Equal(t, "sse4", index.Manifests[1].Platform.OSFeatures[0])
+}
+
+func TestOCI1IndexUpdateInstances(t *testing.T) {
+	manifest, err := ioutil.ReadFile(filepath.Join("fixtures", "ociv1.image.index.json"))
+	require.NoError(t, err)
+	index, err := OCI1IndexFromManifest(manifest)
+	require.NoError(t, err)
+
+	updates := []ListUpdate{}
+	for _, instance := range index.Manifests {
+		updates = append(updates, ListUpdate{
+			Digest:    instance.Digest,
+			Size:      instance.Size,
+			MediaType: instance.MediaType,
+		})
+	}
+	updates[1] = ListUpdate{
+		Digest:    "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		Size:      1234,
+		MediaType: DockerV2Schema2MediaType,
+	}
+
+	clone := OCI1IndexClone(index)
+	err = clone.UpdateInstances(updates)
+	require.NoError(t, err)
+	instance, err := clone.Instance(updates[1].Digest)
+	require.NoError(t, err)
+	assert.Equal(t, updates[1], instance)
+	assert.Equal(t, index.Manifests[1].Platform, clone.Manifests[1].Platform)
+	_, err = index.Instance(updates[1].Digest)
+	assert.Error(t, err)
+
+	serialized, err := clone.Serialize()
+	require.NoError(t, err)
+	reparsed, err := OCI1IndexFromManifest(serialized)
+	require.NoError(t, err)
+	assert.Equal(t, clone, reparsed)
+
+	// Invalid updates
+	err = clone.UpdateInstances(updates[:1])
+	assert.Error(t, err)
+	for _, invalid := range []ListUpdate{
+		{Digest: "invalid", Size: 1, MediaType: DockerV2Schema2MediaType},
+		{Digest: updates[1].Digest, Size: -1, MediaType: DockerV2Schema2MediaType},
+		{Digest: updates[1].Digest, Size: 1, MediaType: ""},
+	} {
+		u := append([]ListUpdate{}, updates...)
+		u[1] = invalid
+		err = OCI1IndexClone(index).UpdateInstances(u)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestOCI1IndexAddRemoveInstance(t *testing.T) {
+	manifest, err := ioutil.ReadFile(filepath.Join("fixtures", "ociv1.image.index.json"))
+	require.NoError(t, err)
+	index, err := OCI1IndexFromManifest(manifest)
+	require.NoError(t, err)
+
+	added := ListUpdate{
+		Digest:    "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		Size:      1234,
+		MediaType: imgspecv1.MediaTypeImageManifest,
+	}
+	// A platform is optional in OCI indexes.
+	err = index.AddInstance(added, nil)
+	require.NoError(t, err)
+	require.Len(t, index.Manifests, 3)
+	assert.Nil(t, index.Manifests[2].Platform)
+	instance, err := index.Instance(added.Digest)
+	require.NoError(t, err)
+	assert.Equal(t, added, instance)
+
+	for _, invalid := range []ListUpdate{
+		{Digest: "invalid", Size: 1, MediaType: imgspecv1.MediaTypeImageManifest},
+		{Digest: added.Digest, Size: -1, MediaType: imgspecv1.MediaTypeImageManifest},
+		{Digest: added.Digest, Size: 1, MediaType: ""},
+	} {
+		err = index.AddInstance(invalid, nil)
+		assert.Error(t, err, invalid)
+	}
+
+	err = index.RemoveInstance(added.Digest)
+	require.NoError(t, err)
+	assert.Len(t, index.Manifests, 2)
+	err = index.RemoveInstance(added.Digest)
+	assert.Error(t, err)
+}
+
+func TestOCI1IndexChooseInstance(t *testing.T) {
+	manifest, err := ioutil.ReadFile(filepath.Join("fixtures", "ociv1.image.index.json"))
+	require.NoError(t, err)
+	index, err := OCI1IndexFromManifest(manifest)
+	require.NoError(t, err)
+	// Instances without a platform are never chosen.
+	err = index.AddInstance(ListUpdate{
+		Digest:    "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		Size:      1234,
+		MediaType: imgspecv1.MediaTypeImageManifest,
+	}, nil)
+	require.NoError(t, err)
+
+	for arch, expected := range map[string]digest.Digest{
+		"ppc64le": "sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f",
+		"amd64":   "sha256:5b0bcabd1ed22e9fb1310cf6c2dec7cdef19f0ad69efa1f392e94a4333501270",
+	} {
+		d, err := index.ChooseInstance(&types.SystemContext{ArchitectureChoice: arch, OSChoice: "linux"})
+		require.NoError(t, err, arch)
+		assert.Equal(t, expected, d, arch)
+	}
+
+	_, err = index.ChooseInstance(&types.SystemContext{ArchitectureChoice: "s390x", OSChoice: "linux"})
+	assert.Error(t, err)
+	_, err = index.InstanceForPlatform(imgspecv1.Platform{Architecture: "amd64", OS: "linux", Variant: "unmatched"})
+	assert.Error(t, err)
+}
+
+func TestOCI1IndexToSchema2List(t *testing.T) {
+	manifest, err := ioutil.ReadFile(filepath.Join("fixtures", "ociv1.image.index.json"))
+	require.NoError(t, err)
+	index, err := OCI1IndexFromManifest(manifest)
+	require.NoError(t, err)
+
+	list, err := index.ToSchema2List()
+	require.NoError(t, err)
+	assert.Equal(t, DockerV2ListMediaType, list.MIMEType())
+	assert.Equal(t, DockerV2ListMediaType, list.MediaType)
+	assert.Equal(t, index.Instances(), list.Instances())
+	assert.Equal(t, Schema2PlatformSpec{Architecture: "amd64", OS: "linux", OSFeatures: []string{"sse4"}}, list.Manifests[1].Platform)
+
+	converted, err := index.ConvertToMIMEType(DockerV2ListMediaType)
+	require.NoError(t, err)
+	assert.Equal(t, list, converted)
+	converted, err = index.ConvertToMIMEType(imgspecv1.MediaTypeImageIndex)
+	require.NoError(t, err)
+	assert.Equal(t, index, converted)
+	_, err = index.ConvertToMIMEType(imgspecv1.MediaTypeImageManifest)
+	assert.Error(t, err)
+
+	// Instances without a platform can't be represented in a schema2 list.
+	err = index.AddInstance(ListUpdate{
+		Digest:    "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		Size:      1234,
+		MediaType: imgspecv1.MediaTypeImageManifest,
+	}, nil)
+	require.NoError(t, err)
+	_, err = index.ToSchema2List()
+	assert.Error(t, err)
+}
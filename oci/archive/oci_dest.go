@@ -1,19 +1,39 @@
 package archive
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"time"
 
+	"github.com/containers/image/internal/tmpdir"
+	"github.com/containers/image/oci/internal"
 	"github.com/containers/image/types"
 	"github.com/containers/storage/pkg/archive"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
+// ociArchiveImageDestination writes an image into an oci-archive.
+// Blobs are streamed directly into the output tar file; manifests and signatures are handled by unpackedDest,
+// which writes into a temporary OCI layout, and copied into the tar file, along with index.json and oci-layout, in Commit.
 type ociArchiveImageDestination struct {
 	ref          ociArchiveReference
 	unpackedDest types.ImageDestination
 	tempDirRef   tempDirOCIRef
+	outputFile   *os.File                // The file the archive is being written to
+	replaceFile  bool                    // Whether outputFile is a temporary file which should replace ref.resolvedFile in Commit
+	tar          *tar.Writer             // Writes to outputFile
+	blobs        map[digest.Digest]int64 // Sizes of blobs already written to tar
+	directories  map[string]struct{}     // Directories already written to tar
+	failed       bool                    // Set if tar may contain incomplete or invalid data
+	committed    bool
 }
 
 // newImageDestination returns an ImageDestination for writing to an existing directory.
@@ -29,9 +49,50 @@ func newImageDestination(ctx context.Context, sys *types.SystemContext, ref ociA
 		}
 		return nil, err
 	}
+	outputFile, replaceFile, err := createOutputFile(ref.resolvedFile)
+	if err != nil {
+		unpackedDest.Close()
+		tempDirRef.deleteTempDir()
+		return nil, err
+	}
 	return &ociArchiveImageDestination{ref: ref,
 		unpackedDest: unpackedDest,
-		tempDirRef:   tempDirRef}, nil
+		tempDirRef:   tempDirRef,
+		outputFile:   outputFile,
+		replaceFile:  replaceFile,
+		tar:          tar.NewWriter(outputFile),
+		blobs:        map[digest.Digest]int64{},
+		directories:  map[string]struct{}{},
+	}, nil
+}
+
+// createOutputFile returns a file to write an archive to be stored at path.
+// If path is a regular file, or does not exist, the returned file is a temporary file in the same directory,
+// to replace path only after the archive is complete (and replaceFile is true); if path is a special file (e.g. /dev/stdout),
+// the returned file is path itself.
+func createOutputFile(path string) (file *os.File, replaceFile bool, err error) {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		if !fi.Mode().IsRegular() && !fi.IsDir() {
+			file, err := os.OpenFile(path, os.O_WRONLY, 0)
+			if err != nil {
+				return nil, false, errors.Wrapf(err, "error opening %q", path)
+			}
+			return file, false, nil
+		}
+		mode = fi.Mode().Perm()
+	}
+	file, err = ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "error creating tar file %q", path)
+	}
+	// ioutil.TempFile uses mode 0600; keep the mode of the file being replaced instead, or use the usual mode of new files.
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, false, errors.Wrapf(err, "error creating tar file %q", path)
+	}
+	return file, true, nil
 }
 
 // Reference returns the reference used to set up this destination.
@@ -40,9 +101,15 @@ func (d *ociArchiveImageDestination) Reference() types.ImageReference {
 }
 
 // Close removes resources associated with an initialized ImageDestination, if any
-// Close deletes the temp directory of the oci-archive image
+// Close deletes the temp directory of the oci-archive image, and the incomplete archive if Commit was not called.
 func (d *ociArchiveImageDestination) Close() error {
 	defer d.tempDirRef.deleteTempDir()
+	if !d.committed {
+		d.outputFile.Close()
+		if d.replaceFile {
+			os.Remove(d.outputFile.Name())
+		}
+	}
 	return d.unpackedDest.Close()
 }
 
@@ -77,63 +144,246 @@ func (d *ociArchiveImageDestination) IgnoresEmbeddedDockerReference() bool {
 	return d.unpackedDest.IgnoresEmbeddedDockerReference()
 }
 
+// HasThreadSafePutBlob indicates whether PutBlob can be executed concurrently.
+func (d *ociArchiveImageDestination) HasThreadSafePutBlob() bool {
+	return false // All blobs are written to a single tar stream.
+}
+
 // PutBlob writes contents of stream and returns data representing the result (with all data filled in).
 // inputInfo.Digest can be optionally provided if known; it is not mandatory for the implementation to verify it.
 // inputInfo.Size is the expected length of stream, if known.
-func (d *ociArchiveImageDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, isConfig bool) (types.BlobInfo, error) {
-	return d.unpackedDest.PutBlob(ctx, stream, inputInfo, isConfig)
-}
+// May update cache.
+// The blob is streamed directly into the archive if both inputInfo.Digest and inputInfo.Size are known.
+// If stream.Read() fails, or the data does not match inputInfo.Digest, the archive can't be completed, and Commit will fail.
+func (d *ociArchiveImageDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	if d.failed {
+		return types.BlobInfo{}, errors.New("Internal error: writing to an oci-archive which failed previously")
+	}
+	// We need to know the digest and size before writing the tar header, so stream the blob into a temporary file if necessary.
+	if inputInfo.Size == -1 || inputInfo.Digest == "" {
+		logrus.Debugf("oci-archive: input with unknown size or digest, streaming to disk first ...")
+		streamCopy, err := ioutil.TempFile(tmpdir.TemporaryDirectoryForBigFiles(), "oci-archive-blob")
+		if err != nil {
+			return types.BlobInfo{}, err
+		}
+		defer os.Remove(streamCopy.Name())
+		defer streamCopy.Close()
+
+		digester := digest.Canonical.Digester()
+		tee := io.TeeReader(stream, digester.Hash())
+		// TODO: This can take quite some time, and should ideally be cancellable using ctx.Done().
+		size, err := io.Copy(streamCopy, tee)
+		if err != nil {
+			return types.BlobInfo{}, err
+		}
+		if _, err := streamCopy.Seek(0, io.SeekStart); err != nil {
+			return types.BlobInfo{}, err
+		}
+		inputInfo.Size = size // inputInfo is a struct, so we are only modifying our copy.
+		inputInfo.Digest = digester.Digest()
+		stream = streamCopy
+		logrus.Debugf("... streaming done")
+	}
+	if err := inputInfo.Digest.Validate(); err != nil {
+		return types.BlobInfo{}, errors.Wrapf(err, "unexpected digest reference %s", inputInfo.Digest)
+	}
+
+	// Maybe the blob has been already sent
+	ok, reusedInfo, err := d.TryReusingBlob(ctx, inputInfo, cache, false)
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	if ok {
+		return reusedInfo, nil
+	}
 
-// HasBlob returns true iff the image destination already contains a blob with the matching digest which can be reapplied using ReapplyBlob
-func (d *ociArchiveImageDestination) HasBlob(ctx context.Context, info types.BlobInfo) (bool, int64, error) {
-	return d.unpackedDest.HasBlob(ctx, info)
+	verifier := inputInfo.Digest.Verifier()
+	if err := d.sendFile(blobTarPath(inputInfo.Digest), inputInfo.Size, io.TeeReader(stream, verifier)); err != nil {
+		return types.BlobInfo{}, err
+	}
+	if !verifier.Verified() {
+		d.failed = true
+		return types.BlobInfo{}, errors.Errorf("Digest mismatch when copying %s", inputInfo.Digest)
+	}
+	d.blobs[inputInfo.Digest] = inputInfo.Size
+	return types.BlobInfo{Digest: inputInfo.Digest, Size: inputInfo.Size}, nil
 }
 
-func (d *ociArchiveImageDestination) ReapplyBlob(ctx context.Context, info types.BlobInfo) (types.BlobInfo, error) {
-	return d.unpackedDest.ReapplyBlob(ctx, info)
+// TryReusingBlob checks whether the transport already contains, or can efficiently reuse, a blob, and if so, applies it to the current destination.
+// May use and/or update cache.
+func (d *ociArchiveImageDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	if info.Digest == "" {
+		return false, types.BlobInfo{}, errors.Errorf("Can not check for a blob with unknown digest")
+	}
+	if size, ok := d.blobs[info.Digest]; ok {
+		return true, types.BlobInfo{Digest: info.Digest, Size: size}, nil
+	}
+	return false, types.BlobInfo{}, nil
 }
 
 // PutManifest writes manifest to the destination
-func (d *ociArchiveImageDestination) PutManifest(ctx context.Context, m []byte) error {
-	return d.unpackedDest.PutManifest(ctx, m)
+// If instanceDigest is not nil, it contains a digest of the specific manifest instance to write the manifest for
+// (when the primary manifest is a manifest list); this should always be nil if the primary manifest is not a manifest list.
+func (d *ociArchiveImageDestination) PutManifest(ctx context.Context, m []byte, instanceDigest *digest.Digest) error {
+	return d.unpackedDest.PutManifest(ctx, m, instanceDigest)
 }
 
-func (d *ociArchiveImageDestination) PutSignatures(ctx context.Context, signatures [][]byte) error {
-	return d.unpackedDest.PutSignatures(ctx, signatures)
+// PutSignatures writes signatures to the destination.
+// If instanceDigest is not nil, it contains a digest of the specific manifest instance to write or overwrite the signatures for
+// (when the primary manifest is a manifest list); this should always be nil if the primary manifest is not a manifest list.
+func (d *ociArchiveImageDestination) PutSignatures(ctx context.Context, signatures [][]byte, instanceDigest *digest.Digest) error {
+	return d.unpackedDest.PutSignatures(ctx, signatures, instanceDigest)
 }
 
 // Commit marks the process of storing the image as successful and asks for the image to be persisted
-// after the directory is made, it is tarred up into a file and the directory is deleted
+// the manifests, signatures and metadata are added to the archive, after all blobs, and the archive is then moved into place
 func (d *ociArchiveImageDestination) Commit(ctx context.Context) error {
+	if d.failed {
+		return errors.Errorf("error storing image %q: writing the archive failed previously", d.ref.image)
+	}
 	if err := d.unpackedDest.Commit(ctx); err != nil {
 		return errors.Wrapf(err, "error storing image %q", d.ref.image)
 	}
 
-	// path of directory to tar up
-	src := d.tempDirRef.tempDirectory
-	// path to save tarred up file
-	dst := d.ref.resolvedFile
-	return tarDirectory(src, dst)
+	// The temporary layout only contains manifests and signatures as blobs.
+	blobDir := filepath.Join(d.tempDirRef.tempDirectory, "blobs")
+	algorithms, err := ioutil.ReadDir(blobDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, algorithm := range algorithms {
+		blobs, err := ioutil.ReadDir(filepath.Join(blobDir, algorithm.Name()))
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			blobDigest := digest.NewDigestFromHex(algorithm.Name(), blob.Name())
+			if _, ok := d.blobs[blobDigest]; ok || blobDigest.Validate() != nil {
+				continue
+			}
+			if err := d.sendLayoutFile(path.Join("blobs", algorithm.Name(), blob.Name())); err != nil {
+				return err
+			}
+			d.blobs[blobDigest] = blob.Size()
+		}
+	}
+	// index.json is written last, so that readers of an incomplete archive don't find any image.
+	for _, name := range []string{"oci-layout", "index.json"} {
+		if err := d.sendLayoutFile(name); err != nil {
+			return err
+		}
+	}
+
+	if err := d.tar.Close(); err != nil {
+		return err
+	}
+	if err := d.outputFile.Close(); err != nil {
+		return err
+	}
+	d.committed = true
+	if d.replaceFile {
+		if err := os.Rename(d.outputFile.Name(), d.ref.resolvedFile); err != nil {
+			os.Remove(d.outputFile.Name())
+			return err
+		}
+	}
+	return nil
+}
+
+// sendLayoutFile copies the file at name within the temporary OCI layout into the tar stream.
+func (d *ociArchiveImageDestination) sendLayoutFile(name string) error {
+	contents, err := ioutil.ReadFile(filepath.Join(d.tempDirRef.tempDirectory, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	return d.sendFile(name, int64(len(contents)), bytes.NewReader(contents))
+}
+
+// sendFile sends a file into the tar stream, preceded by its parent directories if necessary.
+// If this fails, the tar stream may be left in an inconsistent state, so d.failed is set.
+func (d *ociArchiveImageDestination) sendFile(name string, expectedSize int64, stream io.Reader) error {
+	d.failed = true // Until we succeed.
+	var parents []string
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		parents = append([]string{dir}, parents...)
+	}
+	for _, dir := range parents {
+		if _, ok := d.directories[dir]; ok {
+			continue
+		}
+		if err := d.tar.WriteHeader(&tar.Header{
+			Name:     dir + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+			ModTime:  time.Now(),
+		}); err != nil {
+			return err
+		}
+		d.directories[dir] = struct{}{}
+	}
+
+	logrus.Debugf("Sending as tar file %s", name)
+	if err := d.tar.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     expectedSize,
+		ModTime:  time.Now(),
+	}); err != nil {
+		return err
+	}
+	// TODO: This can take quite some time, and should ideally be cancellable using a context.Context.
+	size, err := io.Copy(d.tar, stream)
+	if err != nil {
+		return err
+	}
+	if size != expectedSize {
+		return errors.Errorf("Size mismatch when copying %s, expected %d, got %d", name, expectedSize, size)
+	}
+	d.failed = false
+	return nil
 }
 
-// tar converts the directory at src and saves it to dst
+// tar converts the directory at src and saves it to dst.
+// Lock files of the OCI layout at src are not included in the archive.
+// Unless dst is a special file, the archive is written to a temporary file which replaces dst only when it is complete.
 func tarDirectory(src, dst string) error {
 	// input is a stream of bytes from the archive of the directory at path
-	input, err := archive.Tar(src, archive.Uncompressed)
+	input, err := archive.TarWithOptions(src, &archive.TarOptions{
+		Compression:     archive.Uncompressed,
+		ExcludePatterns: internal.LayoutLockFiles(),
+	})
 	if err != nil {
 		return errors.Wrapf(err, "error retrieving stream of bytes from %q", src)
 	}
+	defer input.Close()
 
-	// creates the tar file
-	outFile, err := os.Create(dst)
+	// creates the tar file, replacing dst only after the archive is complete
+	outFile, replaceFile, err := createOutputFile(dst)
 	if err != nil {
-		return errors.Wrapf(err, "error creating tar file %q", dst)
+		return err
 	}
-	defer outFile.Close()
+	succeeded := false
+	defer func() {
+		if !succeeded && replaceFile {
+			os.Remove(outFile.Name())
+		}
+	}()
 
 	// copies the contents of the directory to the tar file
 	// TODO: This can take quite some time, and should ideally be cancellable using a context.Context.
-	_, err = io.Copy(outFile, input)
-
-	return err
+	if _, err := io.Copy(outFile, input); err != nil {
+		outFile.Close()
+		return errors.Wrapf(err, "error writing tar file %q", dst)
+	}
+	if err := outFile.Close(); err != nil {
+		return errors.Wrapf(err, "error writing tar file %q", dst)
+	}
+	if replaceFile {
+		if err := os.Rename(outFile.Name(), dst); err != nil {
+			return err
+		}
+	}
+	succeeded = true
+	return nil
 }
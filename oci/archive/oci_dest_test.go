@@ -0,0 +1,211 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/blobinfocache"
+	"github.com/containers/image/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tarEntryNames returns the names of entries in the tar file at path.
+func tarEntryNames(t *testing.T, path string) []string {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	names := []string{}
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	return names
+}
+
+// putTestArchive writes an image with a config, one layer and a signature into the archive at path.
+func putTestArchive(t *testing.T, path string, config, layer []byte) (manifestBlob []byte) {
+	ref, err := NewReference(path, "img")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer dest.Close()
+	assert.False(t, dest.HasThreadSafePutBlob())
+
+	cache := blobinfocache.NewMemoryCache()
+	// A blob with a known digest and size is streamed directly
+	configInfo, err := dest.PutBlob(context.Background(), bytes.NewReader(config), types.BlobInfo{Digest: digest.FromBytes(config), Size: int64(len(config))}, cache, true)
+	require.NoError(t, err)
+	// A blob with an unknown digest and size is buffered first
+	layerInfo, err := dest.PutBlob(context.Background(), bytes.NewReader(layer), types.BlobInfo{Size: -1}, cache, false)
+	require.NoError(t, err)
+	assert.Equal(t, types.BlobInfo{Digest: digest.FromBytes(layer), Size: int64(len(layer))}, layerInfo)
+	// Blobs are only written once
+	reused, reusedInfo, err := dest.TryReusingBlob(context.Background(), types.BlobInfo{Digest: layerInfo.Digest}, cache, false)
+	require.NoError(t, err)
+	assert.True(t, reused)
+	assert.Equal(t, layerInfo, reusedInfo)
+	_, err = dest.PutBlob(context.Background(), bytes.NewReader(layer), layerInfo, cache, false)
+	require.NoError(t, err)
+
+	manifestBlob, err = manifest.OCI1FromComponents(imgspecv1.Descriptor{
+		MediaType: imgspecv1.MediaTypeImageConfig,
+		Digest:    configInfo.Digest,
+		Size:      configInfo.Size,
+	}, []imgspecv1.Descriptor{{
+		MediaType: imgspecv1.MediaTypeImageLayer,
+		Digest:    layerInfo.Digest,
+		Size:      layerInfo.Size,
+	}}).Serialize()
+	require.NoError(t, err)
+	err = dest.PutManifest(context.Background(), manifestBlob, nil)
+	require.NoError(t, err)
+	err = dest.PutSignatures(context.Background(), [][]byte{[]byte("signature")}, nil)
+	require.NoError(t, err)
+	err = dest.Commit(context.Background())
+	require.NoError(t, err)
+	return manifestBlob
+}
+
+func TestDestinationStreaming(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-archive-dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	archivePath := filepath.Join(tmpDir, "archive.tar")
+	config := []byte("{}")
+	layer := []byte("layer contents")
+
+	manifestBlob := putTestArchive(t, archivePath, config, layer)
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(tmpDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "archive.tar", files[0].Name())
+	// Blobs are written first, and index.json last
+	names := tarEntryNames(t, archivePath)
+	require.Len(t, names, 9)
+	assert.Equal(t, []string{"blobs/", "blobs/sha256/", blobTarPath(digest.FromBytes(config)), blobTarPath(digest.FromBytes(layer))}, names[:4])
+	// The remaining blobs are the manifest, the signature, and the signature index
+	assert.Subset(t, names[4:7], []string{blobTarPath(digest.FromBytes(manifestBlob)), blobTarPath(digest.FromBytes([]byte("signature")))})
+	assert.Equal(t, []string{"oci-layout", "index.json"}, names[7:])
+
+	// The image can be read back
+	ref, err := NewReference(archivePath, "img")
+	require.NoError(t, err)
+	src, err := ref.NewImageSource(context.Background(), nil)
+	require.NoError(t, err)
+	defer src.Close()
+	assert.NotNil(t, src.(*ociArchiveImageSource).archive)
+	m, mt, err := src.GetManifest(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, manifestBlob, m)
+	assert.Equal(t, imgspecv1.MediaTypeImageManifest, mt)
+	for _, blob := range [][]byte{config, layer} {
+		rc, size, err := src.GetBlob(context.Background(), types.BlobInfo{Digest: digest.FromBytes(blob), Size: -1}, blobinfocache.NewMemoryCache())
+		require.NoError(t, err)
+		contents, err := ioutil.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		assert.Equal(t, blob, contents)
+		assert.Equal(t, int64(len(blob)), size)
+	}
+	sigs, err := src.GetSignatures(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("signature")}, sigs)
+	_, _, err = src.GetBlob(context.Background(), types.BlobInfo{Digest: digest.FromBytes([]byte("missing")), Size: -1}, blobinfocache.NewMemoryCache())
+	assert.Error(t, err)
+
+	// Overwriting an existing archive
+	putTestArchive(t, archivePath, []byte(`{"architecture":"amd64"}`), layer)
+	desc, err := LoadManifestDescriptor(ref)
+	require.NoError(t, err)
+	assert.NotEqual(t, digest.FromBytes(manifestBlob), desc.Digest)
+}
+
+func TestDestinationFailure(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-archive-dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	archivePath := filepath.Join(tmpDir, "archive.tar")
+	ref, err := NewReference(archivePath, "img")
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		contents string
+		info     types.BlobInfo
+	}{
+		{"contents", types.BlobInfo{Digest: digest.FromBytes([]byte("other contents")), Size: 8}}, // Digest mismatch
+		{"contents", types.BlobInfo{Digest: digest.FromBytes([]byte("contents")), Size: 7}},       // Size mismatch
+		{"contents", types.BlobInfo{Digest: digest.FromBytes([]byte("contents")), Size: 9}},       // Size mismatch
+		{"contents", types.BlobInfo{Digest: "this is not a digest", Size: 8}},                     // Invalid digest
+	} {
+		dest, err := ref.NewImageDestination(context.Background(), nil)
+		require.NoError(t, err)
+		_, err = dest.PutBlob(context.Background(), bytes.NewReader([]byte(c.contents)), c.info, blobinfocache.NewMemoryCache(), false)
+		assert.Error(t, err, c.info)
+		err = dest.PutManifest(context.Background(), []byte("{}"), nil)
+		require.NoError(t, err)
+		err = dest.Commit(context.Background())
+		if c.info.Digest.Validate() == nil {
+			assert.Error(t, err, c.info)
+		} else {
+			assert.NoError(t, err, c.info) // Nothing has been written to the archive
+		}
+		err = dest.Close()
+		assert.NoError(t, err)
+	}
+	// A failed destination is not visible
+	files, err := ioutil.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestSourceCompressedArchive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-archive-src")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	archivePath := filepath.Join(tmpDir, "archive.tar")
+	layer := []byte("layer contents")
+	putTestArchive(t, archivePath, []byte("{}"), layer)
+
+	// Compressed archives are extracted instead of being read directly.
+	uncompressed, err := ioutil.ReadFile(archivePath)
+	require.NoError(t, err)
+	compressedPath := filepath.Join(tmpDir, "archive.tar.gz")
+	compressed := bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(&compressed)
+	_, err = gzipWriter.Write(uncompressed)
+	require.NoError(t, err)
+	err = gzipWriter.Close()
+	require.NoError(t, err)
+	err = ioutil.WriteFile(compressedPath, compressed.Bytes(), 0644)
+	require.NoError(t, err)
+
+	ref, err := NewReference(compressedPath, "img")
+	require.NoError(t, err)
+	src, err := ref.NewImageSource(context.Background(), nil)
+	require.NoError(t, err)
+	defer src.Close()
+	assert.Nil(t, src.(*ociArchiveImageSource).archive)
+	rc, _, err := src.GetBlob(context.Background(), types.BlobInfo{Digest: digest.FromBytes(layer), Size: -1}, blobinfocache.NewMemoryCache())
+	require.NoError(t, err)
+	defer rc.Close()
+	contents, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, layer, contents)
+}
@@ -15,18 +15,23 @@ type ociArchiveImageSource struct {
 	ref         ociArchiveReference
 	unpackedSrc types.ImageSource
 	tempDirRef  tempDirOCIRef
+	archive     *tarArchive // nil if the archive has been fully extracted into tempDirRef
 }
 
 // newImageSource returns an ImageSource for reading from an existing directory.
-// newImageSource untars the file and saves it in a temp directory
+// newImageSource extracts the metadata of the archive into a temp directory, and reads other blobs directly from the archive;
+// if the archive does not allow that (e.g. because it is not a regular file), it untars the whole file into the temp directory.
 func newImageSource(ctx context.Context, sys *types.SystemContext, ref ociArchiveReference) (types.ImageSource, error) {
-	tempDirRef, err := createUntarTempDir(ref)
+	archive, tempDirRef, err := openArchive(ref)
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating temp directory")
+		return nil, err
 	}
 
 	unpackedSrc, err := tempDirRef.ociRefExtracted.NewImageSource(ctx, sys)
 	if err != nil {
+		if archive != nil {
+			archive.Close()
+		}
 		if err := tempDirRef.deleteTempDir(); err != nil {
 			return nil, errors.Wrapf(err, "error deleting temp directory %q", tempDirRef.tempDirectory)
 		}
@@ -34,7 +39,8 @@ func newImageSource(ctx context.Context, sys *types.SystemContext, ref ociArchiv
 	}
 	return &ociArchiveImageSource{ref: ref,
 		unpackedSrc: unpackedSrc,
-		tempDirRef:  tempDirRef}, nil
+		tempDirRef:  tempDirRef,
+		archive:     archive}, nil
 }
 
 // LoadManifestDescriptor loads the manifest
@@ -43,11 +49,14 @@ func LoadManifestDescriptor(imgRef types.ImageReference) (imgspecv1.Descriptor,
 	if !ok {
 		return imgspecv1.Descriptor{}, errors.Errorf("error typecasting, need type ociArchiveReference")
 	}
-	tempDirRef, err := createUntarTempDir(ociArchRef)
+	archive, tempDirRef, err := openArchive(ociArchRef)
 	if err != nil {
-		return imgspecv1.Descriptor{}, errors.Wrap(err, "error creating temp directory")
+		return imgspecv1.Descriptor{}, err
 	}
 	defer tempDirRef.deleteTempDir()
+	if archive != nil {
+		defer archive.Close()
+	}
 
 	descriptor, err := ocilayout.LoadManifestDescriptor(tempDirRef.ociRefExtracted)
 	if err != nil {
@@ -65,6 +74,9 @@ func (s *ociArchiveImageSource) Reference() types.ImageReference {
 // Close deletes the temporary directory at dst
 func (s *ociArchiveImageSource) Close() error {
 	defer s.tempDirRef.deleteTempDir()
+	if s.archive != nil {
+		defer s.archive.Close()
+	}
 	return s.unpackedSrc.Close()
 }
 
@@ -77,8 +89,15 @@ func (s *ociArchiveImageSource) GetManifest(ctx context.Context, instanceDigest
 }
 
 // GetBlob returns a stream for the specified blob, and the blob's size.
-func (s *ociArchiveImageSource) GetBlob(ctx context.Context, info types.BlobInfo) (io.ReadCloser, int64, error) {
-	return s.unpackedSrc.GetBlob(ctx, info)
+// May update BlobInfoCache, preferably after it knows for certain that a blob truly exists at a specific location.
+func (s *ociArchiveImageSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	// Blobs with URLs are read from the URLs by unpackedSrc, see ociImageSource.GetBlob.
+	if s.archive != nil && len(info.URLs) == 0 {
+		if rc, size, ok := s.archive.openBlob(info.Digest); ok {
+			return rc, size, nil
+		}
+	}
+	return s.unpackedSrc.GetBlob(ctx, info, cache)
 }
 
 // GetSignatures returns the image's signatures.  It may use a remote (= slow) service.
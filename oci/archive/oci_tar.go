@@ -0,0 +1,252 @@
+package archive
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/internal/iolimits"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/compression"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// signatureIndexAnnotation is the index.json annotation referencing the signature index of an OCI layout;
+// this must match the value used by oci/layout.
+const signatureIndexAnnotation = "io.containers.image.signatures"
+
+// tarArchive provides random access to files within an uncompressed tar archive.
+type tarArchive struct {
+	file    *os.File
+	entries map[string]tarEntry // Indexed by cleaned relative paths, see cleanTarPath
+}
+
+// tarEntry records the location of a regular file within a tar archive.
+type tarEntry struct {
+	offset int64
+	size   int64
+}
+
+// openTarArchive opens the tar archive at path for random access.
+// It returns nil, and no error, if the archive can't be accessed that way (e.g. because it is not a regular file, or it is compressed);
+// the caller should then fall back to extracting the archive.
+func openTarArchive(path string) (*tarArchive, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening file %q", path)
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			file.Close()
+		}
+	}()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, nil
+	}
+	decompressor, _, err := compression.DetectCompression(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error detecting compression for file %q", path)
+	}
+	if decompressor != nil {
+		return nil, nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	entries := map[string]tarEntry{}
+	// tar.Reader does not read ahead, and skips over file contents by seeking,
+	// so the current offset of file after reading a header is the offset of the file contents.
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading tar archive %q", path)
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		entries[cleanTarPath(hdr.Name)] = tarEntry{offset: offset, size: hdr.Size}
+	}
+	succeeded = true
+	return &tarArchive{file: file, entries: entries}, nil
+}
+
+// Close releases resources associated with the archive.
+func (ta *tarArchive) Close() error {
+	return ta.file.Close()
+}
+
+// cleanTarPath returns a canonical form of a path within a tar archive, e.g. turning "./blobs/sha256/…" into "blobs/sha256/…".
+func cleanTarPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// blobTarPath returns the path of a blob within an archive, using OCI image-layout conventions.
+func blobTarPath(blobDigest digest.Digest) string {
+	return path.Join("blobs", blobDigest.Algorithm().String(), blobDigest.Hex())
+}
+
+// open returns a reader for the file at name within the archive, and its size, or ok == false if the archive does not contain such a file.
+func (ta *tarArchive) open(name string) (rc io.ReadCloser, size int64, ok bool) {
+	e, ok := ta.entries[name]
+	if !ok {
+		return nil, 0, false
+	}
+	return ioutil.NopCloser(io.NewSectionReader(ta.file, e.offset, e.size)), e.size, true
+}
+
+// openBlob returns a reader for the blob with blobDigest, and its size, or ok == false if the archive does not contain the blob.
+func (ta *tarArchive) openBlob(blobDigest digest.Digest) (rc io.ReadCloser, size int64, ok bool) {
+	if err := blobDigest.Validate(); err != nil {
+		return nil, 0, false
+	}
+	return ta.open(blobTarPath(blobDigest))
+}
+
+// extractFile copies the file at name within the archive into dir, and returns true if it exists.
+func (ta *tarArchive) extractFile(dir, name string) (bool, error) {
+	src, _, ok := ta.open(name)
+	if !ok {
+		return false, nil
+	}
+	defer src.Close()
+	dest := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return false, err
+	}
+	destFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer destFile.Close()
+	if _, err := io.Copy(destFile, src); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// extractMetadata extracts the metadata of the archive into the OCI layout at dir:
+// index.json, oci-layout, the blobs directly referenced from index.json (i.e. manifests and the signature index),
+// and the instances of image indexes (including signatures listed in the signature index).  Other blobs, notably layers, are not extracted.
+func (ta *tarArchive) extractMetadata(dir string) error {
+	if _, err := ta.extractFile(dir, "oci-layout"); err != nil {
+		return err
+	}
+	ok, err := ta.extractFile(dir, "index.json")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("index.json not found in the archive")
+	}
+	indexBlob, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return err
+	}
+	index := imgspecv1.Index{}
+	if err := json.Unmarshal(indexBlob, &index); err != nil {
+		return errors.Wrap(err, "error parsing index.json")
+	}
+	for _, desc := range index.Manifests {
+		if err := ta.extractMetadataBlob(dir, desc); err != nil {
+			return err
+		}
+	}
+	if value, ok := index.Annotations[signatureIndexAnnotation]; ok {
+		if err := ta.extractMetadataBlob(dir, imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageIndex, Digest: digest.Digest(value)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractMetadataBlob extracts the blob referenced by desc into the OCI layout at dir, and if it is an image index, also its instances.
+// Blobs missing in the archive are ignored; they will be reported as missing when (and if) they are used.
+func (ta *tarArchive) extractMetadataBlob(dir string, desc imgspecv1.Descriptor) error {
+	if err := desc.Digest.Validate(); err != nil {
+		return errors.Wrapf(err, "unexpected digest reference %s", desc.Digest)
+	}
+	ok, err := ta.extractFile(dir, blobTarPath(desc.Digest))
+	if err != nil || !ok {
+		return err
+	}
+	if !manifest.MIMETypeIsMultiImage(desc.MediaType) {
+		return nil
+	}
+
+	file, err := os.Open(filepath.Join(dir, filepath.FromSlash(blobTarPath(desc.Digest))))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	blob, err := iolimits.ReadAtMost(file, iolimits.MaxManifestBodySize)
+	if err != nil {
+		return err
+	}
+	list, err := manifest.ListFromBlob(blob, desc.MediaType)
+	if err != nil {
+		return errors.Wrapf(err, "error parsing manifest list %s", desc.Digest)
+	}
+	for _, instanceDigest := range list.Instances() {
+		instance, err := list.Instance(instanceDigest)
+		if err != nil {
+			return err
+		}
+		if err := ta.extractMetadataBlob(dir, imgspecv1.Descriptor{MediaType: instance.MediaType, Digest: instanceDigest}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openArchive prepares the archive referenced by ref for reading.
+// If possible, only the metadata of the archive is extracted into the returned temporary directory,
+// and other blobs should be read using the returned *tarArchive; otherwise, the archive is fully extracted,
+// and the returned *tarArchive is nil.
+// The caller must delete the temporary directory, and close the *tarArchive if it is not nil.
+func openArchive(ref ociArchiveReference) (*tarArchive, tempDirOCIRef, error) {
+	archive, err := openTarArchive(ref.resolvedFile)
+	if err != nil {
+		return nil, tempDirOCIRef{}, err
+	}
+	if archive == nil {
+		tempDirRef, err := createUntarTempDir(ref)
+		if err != nil {
+			return nil, tempDirOCIRef{}, errors.Wrap(err, "error creating temp directory")
+		}
+		return nil, tempDirRef, nil
+	}
+
+	tempDirRef, err := createOCIRef(ref.image)
+	if err != nil {
+		archive.Close()
+		return nil, tempDirOCIRef{}, errors.Wrap(err, "error creating oci reference")
+	}
+	if err := archive.extractMetadata(tempDirRef.tempDirectory); err != nil {
+		archive.Close()
+		tempDirRef.deleteTempDir()
+		return nil, tempDirOCIRef{}, errors.Wrapf(err, "error reading archive %q", ref.resolvedFile)
+	}
+	return archive, tempDirRef, nil
+}
@@ -0,0 +1,79 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanTarPath(t *testing.T) {
+	for _, c := range []struct{ input, expected string }{
+		{"index.json", "index.json"},
+		{"./index.json", "index.json"},
+		{"/blobs/sha256/abc", "blobs/sha256/abc"},
+		{"blobs//sha256/../sha256/abc", "blobs/sha256/abc"},
+		{"../../index.json", "index.json"},
+	} {
+		assert.Equal(t, c.expected, cleanTarPath(c.input), c.input)
+	}
+}
+
+func TestOpenTarArchive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-archive-tar")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct{ name, contents string }{
+		{"./index.json", "{}"},
+		{"blobs/sha256/abc", "blob contents"},
+	} {
+		err := tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.contents))})
+		require.NoError(t, err)
+		_, err = tw.Write([]byte(f.contents))
+		require.NoError(t, err)
+	}
+	err = tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "index.json"})
+	require.NoError(t, err)
+	err = tw.Close()
+	require.NoError(t, err)
+	archivePath := filepath.Join(tmpDir, "archive.tar")
+	err = ioutil.WriteFile(archivePath, buf.Bytes(), 0644)
+	require.NoError(t, err)
+
+	archive, err := openTarArchive(archivePath)
+	require.NoError(t, err)
+	require.NotNil(t, archive)
+	defer archive.Close()
+	assert.Len(t, archive.entries, 2)
+	for name, expected := range map[string]string{"index.json": "{}", "blobs/sha256/abc": "blob contents"} {
+		rc, size, ok := archive.open(name)
+		require.True(t, ok, name)
+		contents, err := ioutil.ReadAll(rc)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(contents))
+		assert.Equal(t, int64(len(expected)), size)
+	}
+	_, _, ok := archive.open("link")
+	assert.False(t, ok)
+
+	// Failures
+	_, err = openTarArchive(filepath.Join(tmpDir, "this-does-not-exist"))
+	assert.Error(t, err)
+	invalidPath := filepath.Join(tmpDir, "invalid.tar")
+	err = ioutil.WriteFile(invalidPath, bytes.Repeat([]byte("invalid"), 200), 0644)
+	require.NoError(t, err)
+	_, err = openTarArchive(invalidPath)
+	assert.Error(t, err)
+	// Directories can't be read directly
+	archive, err = openTarArchive(tmpDir)
+	assert.NoError(t, err)
+	assert.Nil(t, archive)
+}
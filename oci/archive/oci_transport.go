@@ -143,8 +143,18 @@ func (ref ociArchiveReference) NewImageDestination(ctx context.Context, sys *typ
 }
 
 // DeleteImage deletes the named image from the registry, if supported.
+// The archive is extracted, the image is deleted from the extracted layout, and the archive is then recreated.
 func (ref ociArchiveReference) DeleteImage(ctx context.Context, sys *types.SystemContext) error {
-	return errors.Errorf("Deleting images not implemented for oci: images")
+	tempDirRef, err := createUntarTempDir(ref)
+	if err != nil {
+		return errors.Wrap(err, "error extracting the archive")
+	}
+	defer tempDirRef.deleteTempDir()
+
+	if err := tempDirRef.ociRefExtracted.DeleteImage(ctx, sys); err != nil {
+		return errors.Wrapf(err, "error deleting image %q", ref.image)
+	}
+	return tarDirectory(tempDirRef.tempDirectory, ref.resolvedFile)
 }
 
 // struct to store the ociReference and temporary directory returned by createOCIRef
@@ -190,3 +200,44 @@ func createUntarTempDir(ref ociArchiveReference) (tempDirOCIRef, error) {
 	}
 	return tempDirRef, nil
 }
+
+// List returns the images in the oci-archive at path, in the order of their index.json entries.
+// The returned references refer to images in the archive.
+func List(sys *types.SystemContext, path string) ([]ocilayout.ListResult, error) {
+	ref, err := NewReference(path, "")
+	if err != nil {
+		return nil, err
+	}
+	archive, tempDirRef, err := openArchive(ref.(ociArchiveReference))
+	if err != nil {
+		return nil, err
+	}
+	defer tempDirRef.deleteTempDir()
+	if archive != nil {
+		defer archive.Close()
+	}
+
+	res, err := ocilayout.List(sys, tempDirRef.tempDirectory)
+	if err != nil {
+		return nil, err
+	}
+	for i := range res {
+		if res[i].Reference == nil {
+			continue
+		}
+		// The layout reference either uses the image name, or refers to the only image in the layout;
+		// create an equivalent reference to the archive.
+		image := ""
+		if res[i].Name != "" {
+			if namedRef, err := ocilayout.NewReference(tempDirRef.tempDirectory, res[i].Name); err == nil &&
+				namedRef.StringWithinTransport() == res[i].Reference.StringWithinTransport() {
+				image = res[i].Name
+			}
+		}
+		res[i].Reference, err = NewReference(path, image)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -5,10 +5,13 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	_ "github.com/containers/image/internal/testing/explicitfilepath-tmpdir"
+	ocilayout "github.com/containers/image/oci/layout"
 	"github.com/containers/image/types"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -285,4 +288,40 @@ func TestReferenceDeleteImage(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 	err := ref.DeleteImage(context.Background(), nil)
 	assert.Error(t, err)
+
+	ref, tmpTarFile := refToTempOCIArchive(t)
+	defer os.RemoveAll(tmpTarFile)
+	err = os.Chmod(tmpTarFile, 0640)
+	require.NoError(t, err)
+	err = ref.DeleteImage(context.Background(), nil)
+	require.NoError(t, err)
+	// The archive has been replaced, keeping its mode, and no temporary files are left behind
+	fi, err := os.Stat(tmpTarFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+	// Lock files used while modifying the layout are not included in the archive
+	for _, name := range tarEntryNames(t, tmpTarFile) {
+		assert.False(t, strings.HasSuffix(name, ".lock"), name)
+	}
+	tmpFiles, err := filepath.Glob(filepath.Join(filepath.Dir(tmpTarFile), "."+filepath.Base(tmpTarFile)+".tmp*"))
+	require.NoError(t, err)
+	assert.Empty(t, tmpFiles)
+	// The archive now contains no images
+	err = ref.DeleteImage(context.Background(), nil)
+	assert.Equal(t, ocilayout.ErrMoreThanOneImage, errors.Cause(err))
+}
+
+func TestList(t *testing.T) {
+	_, tmpTarFile := refToTempOCIArchive(t)
+	defer os.RemoveAll(tmpTarFile)
+
+	res, err := List(nil, tmpTarFile)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.Equal(t, "imageValue", res[0].Name)
+	assert.Equal(t, tmpTarFile+":imageValue", res[0].Reference.StringWithinTransport())
+	assert.Equal(t, "sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f", res[0].ManifestDescriptor.Digest.String())
+
+	_, err = List(nil, tmpTarFile+"-does-not-exist")
+	assert.Error(t, err)
 }
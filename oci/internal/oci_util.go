@@ -15,6 +15,18 @@ const (
 	component = `(?:` + alphanum + `(?:` + separator + alphanum + `)*)`
 )
 
+// Lock files which the oci: transport creates in an OCI layout directory.
+// They are not a part of the image layout, and should not be copied along with it, e.g. into an archive.
+const (
+	IndexLockFile = "index.json.lock" // Serializes updates of index.json
+	BlobsLockFile = "blobs.lock"      // Protects blobs not referenced from index.json yet against garbage collection
+)
+
+// LayoutLockFiles returns the names of all lock files which may exist in an OCI layout directory.
+func LayoutLockFiles() []string {
+	return []string{IndexLockFile, BlobsLockFile}
+}
+
 var refRegexp = regexp.MustCompile(`^` + component + `(?:/` + component + `)*$`)
 var windowsRefRegexp = regexp.MustCompile(`^([a-zA-Z]:\\.+?):(.*)$`)
 
@@ -0,0 +1,181 @@
+package layout
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// DeleteImage deletes the named image from the registry, if supported.
+// The image's descriptor is removed from index.json, and its signatures from the signature index,
+// and all blobs which are no longer referenced from any remaining index.json entry are deleted.
+// Image destinations which have written blobs into the layout, but have not been committed or closed yet, may be using
+// blobs not referenced from index.json; so, this waits until all such destinations, in any process, are committed or closed.
+// The wait can be interrupted by cancelling ctx; note that it never ends if the caller itself holds such a destination.
+func (ref ociReference) DeleteImage(ctx context.Context, sys *types.SystemContext) error {
+	if sys != nil && sys.OCISharedBlobDirPath != "" {
+		// We have no way to find all the other layouts using the shared directory, and blobs they refer to.
+		return errors.Errorf("Deleting images from oci: layouts using a shared blob directory (%s) is not supported", sys.OCISharedBlobDirPath)
+	}
+
+	unlockBlobs, err := ref.lockBlobsExclusively(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlockBlobs()
+	unlock, err := ref.lockIndex()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var reachable map[digest.Digest]struct{}
+	if err := ref.updateIndex(func(index *imgspecv1.Index) error {
+		i, err := ref.findManifestDescriptor(index)
+		if err != nil {
+			return err
+		}
+		index.Manifests = append(index.Manifests[:i], index.Manifests[i+1:]...)
+		// Compute the set of referenced blobs before modifying anything, so that failures to read
+		// the remaining manifests don't cause us to delete blobs which are still in use.
+		reachable, err = ref.reachableBlobs(index)
+		return err
+	}); err != nil {
+		return err
+	}
+	return ref.deleteUnreachableBlobs(reachable)
+}
+
+// reachableBlobs returns the set of digests of blobs referenced, directly or indirectly, from index.
+// It also removes from the signature index referenced by index the signatures of manifests which are no longer referenced.
+func (ref ociReference) reachableBlobs(index *imgspecv1.Index) (map[digest.Digest]struct{}, error) {
+	reachable := map[digest.Digest]struct{}{}
+	for _, desc := range index.Manifests {
+		if err := ref.markReachable(reachable, desc.Digest, desc.MediaType); err != nil {
+			return nil, err
+		}
+	}
+
+	sigIndex, err := ref.getSignatureIndex(index, "")
+	if err != nil {
+		return nil, err
+	}
+	signatures := []imgspecv1.Descriptor{}
+	for _, desc := range sigIndex.Manifests {
+		if _, ok := reachable[digest.Digest(desc.Annotations[signatureManifestDigestAnnotation])]; !ok {
+			continue
+		}
+		reachable[desc.Digest] = struct{}{}
+		signatures = append(signatures, desc)
+	}
+	if len(signatures) != len(sigIndex.Manifests) {
+		sigIndex.Manifests = signatures
+		if err := ref.putSignatureIndex(index, sigIndex, ""); err != nil {
+			return nil, err
+		}
+	}
+	if value, ok := index.Annotations[signatureIndexAnnotation]; ok {
+		reachable[digest.Digest(value)] = struct{}{}
+	}
+	return reachable, nil
+}
+
+// markReachable adds blobDigest, and the blobs referenced by it if it is a manifest or a manifest list of type mimeType, to reachable.
+// It fails if mimeType is not recognized, because the blobs referenced by blobDigest can't be determined.
+func (ref ociReference) markReachable(reachable map[digest.Digest]struct{}, blobDigest digest.Digest, mimeType string) error {
+	if _, ok := reachable[blobDigest]; ok {
+		return nil
+	}
+	reachable[blobDigest] = struct{}{}
+
+	switch mimeType {
+	case imgspecv1.MediaTypeImageIndex, manifest.DockerV2ListMediaType:
+		blob, err := ref.readBlob(blobDigest, "")
+		if err != nil {
+			return err
+		}
+		list, err := manifest.ListFromBlob(blob, mimeType)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing manifest list %s", blobDigest)
+		}
+		for _, instanceDigest := range list.Instances() {
+			instance, err := list.Instance(instanceDigest)
+			if err != nil {
+				return err
+			}
+			if err := ref.markReachable(reachable, instanceDigest, instance.MediaType); err != nil {
+				return err
+			}
+		}
+	case imgspecv1.MediaTypeImageManifest, manifest.DockerV2Schema2MediaType, manifest.DockerV2Schema1MediaType, manifest.DockerV2Schema1SignedMediaType:
+		blob, err := ref.readBlob(blobDigest, "")
+		if err != nil {
+			return err
+		}
+		m, err := manifest.FromBlob(blob, mimeType)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing manifest %s", blobDigest)
+		}
+		if config := m.ConfigInfo(); config.Digest != "" {
+			reachable[config.Digest] = struct{}{}
+		}
+		for _, layer := range m.LayerInfos() {
+			reachable[layer.Digest] = struct{}{}
+		}
+	default:
+		// We can't tell which blobs this refers to, so deleting any blob could break it.
+		return errors.Errorf("Refusing to delete unreferenced blobs: %s is referenced with an unrecognized media type %q", blobDigest, mimeType)
+	}
+	return nil
+}
+
+// readBlob returns the contents of the blob with blobDigest.
+func (ref ociReference) readBlob(blobDigest digest.Digest, sharedBlobDir string) ([]byte, error) {
+	path, err := ref.blobPath(blobDigest, sharedBlobDir)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+// deleteUnreachableBlobs deletes all blobs in the layout which are not in reachable.
+// Files which don't look like blobs are left alone.
+func (ref ociReference) deleteUnreachableBlobs(reachable map[digest.Digest]struct{}) error {
+	blobDir := filepath.Join(ref.dir, "blobs")
+	algorithms, err := ioutil.ReadDir(blobDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, algorithm := range algorithms {
+		if !algorithm.IsDir() {
+			continue
+		}
+		blobs, err := ioutil.ReadDir(filepath.Join(blobDir, algorithm.Name()))
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			blobDigest := digest.NewDigestFromHex(algorithm.Name(), blob.Name())
+			if blob.IsDir() || blobDigest.Validate() != nil {
+				continue
+			}
+			if _, ok := reachable[blobDigest]; ok {
+				continue
+			}
+			if err := os.Remove(filepath.Join(blobDir, algorithm.Name(), blob.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
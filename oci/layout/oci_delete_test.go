@@ -0,0 +1,314 @@
+package layout
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/blobinfocache"
+	"github.com/containers/image/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// putTestImage writes an image with the specified config and layer contents, and a signature, to ref,
+// and returns the digest of its manifest.
+func putTestImage(t *testing.T, ref types.ImageReference, config string, layers ...string) digest.Digest {
+	manifestDigest, err := writeTestImage(ref, config, layers...)
+	require.NoError(t, err)
+	return manifestDigest
+}
+
+// writeTestImage is putTestImage, reporting errors to the caller; it can be used outside of the test goroutine.
+func writeTestImage(ref types.ImageReference, config string, layers ...string) (digest.Digest, error) {
+	dest, err := ref.NewImageDestination(context.Background(), nil)
+	if err != nil {
+		return "", err
+	}
+	defer dest.Close()
+
+	putBlob := func(contents string, isConfig bool) (imgspecv1.Descriptor, error) {
+		info, err := dest.PutBlob(context.Background(), bytes.NewReader([]byte(contents)), types.BlobInfo{Size: -1}, blobinfocache.NewMemoryCache(), isConfig)
+		if err != nil {
+			return imgspecv1.Descriptor{}, err
+		}
+		return imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageLayer, Digest: info.Digest, Size: info.Size}, nil
+	}
+	configDesc, err := putBlob(config, true)
+	if err != nil {
+		return "", err
+	}
+	configDesc.MediaType = imgspecv1.MediaTypeImageConfig
+	layerDescs := []imgspecv1.Descriptor{}
+	for _, layer := range layers {
+		layerDesc, err := putBlob(layer, false)
+		if err != nil {
+			return "", err
+		}
+		layerDescs = append(layerDescs, layerDesc)
+	}
+	manifestBlob, err := manifest.OCI1FromComponents(configDesc, layerDescs).Serialize()
+	if err != nil {
+		return "", err
+	}
+	if err := dest.PutManifest(context.Background(), manifestBlob, nil); err != nil {
+		return "", err
+	}
+	if err := dest.PutSignatures(context.Background(), [][]byte{[]byte("signature of " + config)}, nil); err != nil {
+		return "", err
+	}
+	if err := dest.Commit(context.Background()); err != nil {
+		return "", err
+	}
+	return digest.FromBytes(manifestBlob), nil
+}
+
+// assertBlobExists asserts whether the blob with contents exists in ref.
+func assertBlobExists(t *testing.T, ref ociReference, contents string, expected bool) {
+	path, err := ref.blobPath(digest.FromBytes([]byte(contents)), "")
+	require.NoError(t, err)
+	_, err = os.Stat(path)
+	if expected {
+		assert.NoError(t, err, contents)
+	} else {
+		assert.True(t, os.IsNotExist(err), contents)
+	}
+}
+
+func TestDeleteImageGarbageCollection(t *testing.T) {
+	_, tmpDir := refToTempOCI(t)
+	defer os.RemoveAll(tmpDir)
+	ref1, err := NewReference(tmpDir, "image1")
+	require.NoError(t, err)
+	ref2, err := NewReference(tmpDir, "image2")
+	require.NoError(t, err)
+	imageValueRef, err := NewReference(tmpDir, "imageValue")
+	require.NoError(t, err)
+
+	manifest1 := putTestImage(t, ref1, "config1", "shared", "layer1")
+	manifest2 := putTestImage(t, ref2, "config2", "shared", "layer2")
+	// The index.json created by refToTempOCI refers to a manifest which does not exist in the layout.
+	err = imageValueRef.DeleteImage(context.Background(), nil)
+	require.NoError(t, err)
+
+	err = ref1.DeleteImage(context.Background(), nil)
+	require.NoError(t, err)
+
+	ociRef := ref2.(ociReference)
+	index, err := ociRef.getIndex()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(index.Manifests), "Unexpected number of manifests")
+	assert.Equal(t, manifest2, index.Manifests[0].Digest)
+	sigIndex, err := ociRef.getSignatureIndex(index, "")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(sigIndex.Manifests), "Unexpected number of signatures")
+	assert.Equal(t, manifest2.String(), sigIndex.Manifests[0].Annotations[signatureManifestDigestAnnotation])
+	for _, c := range []struct {
+		contents string
+		exists   bool
+	}{
+		{"config1", false},
+		{"layer1", false},
+		{"signature of config1", false},
+		{"config2", true},
+		{"layer2", true},
+		{"shared", true},
+		{"signature of config2", true},
+	} {
+		assertBlobExists(t, ociRef, c.contents, c.exists)
+	}
+	manifestPath, err := ociRef.blobPath(manifest1, "")
+	require.NoError(t, err)
+	_, err = os.Stat(manifestPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// The remaining image can still be read.
+	src, err := ref2.NewImageSource(context.Background(), nil)
+	require.NoError(t, err)
+	defer src.Close()
+	sigs, err := src.GetSignatures(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("signature of config2")}, sigs)
+
+	// Deleting the last image removes all blobs
+	err = ref2.DeleteImage(context.Background(), nil)
+	require.NoError(t, err)
+	for _, contents := range []string{"config2", "layer2", "shared", "signature of config2"} {
+		assertBlobExists(t, ociRef, contents, false)
+	}
+	index, err = ociRef.getIndex()
+	require.NoError(t, err)
+	assert.Empty(t, index.Manifests)
+	assert.NotContains(t, index.Annotations, signatureIndexAnnotation)
+	blobs, err := ioutil.ReadDir(filepath.Join(tmpDir, "blobs", "sha256"))
+	require.NoError(t, err)
+	assert.Empty(t, blobs)
+}
+
+func TestDeleteImageManifestList(t *testing.T) {
+	ref, tmpDir := refToTempOCI(t)
+	defer os.RemoveAll(tmpDir)
+	ociRef := ref.(ociReference)
+	listRef, err := NewReference(tmpDir, "list")
+	require.NoError(t, err)
+
+	instanceDigest := putTestImage(t, ref, "instance-config", "instance-layer")
+	index := manifest.OCI1IndexFromComponents([]imgspecv1.Descriptor{{
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Digest:    instanceDigest,
+		Size:      -1,
+	}}, nil)
+	indexBlob, err := index.Serialize()
+	require.NoError(t, err)
+	dest, err := listRef.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer dest.Close()
+	err = dest.PutManifest(context.Background(), indexBlob, nil)
+	require.NoError(t, err)
+	err = dest.Commit(context.Background())
+	require.NoError(t, err)
+
+	// The instance, and its signature, are still referenced from the list.
+	err = ref.DeleteImage(context.Background(), nil)
+	require.NoError(t, err)
+	for _, contents := range []string{"instance-config", "instance-layer", "signature of instance-config", string(indexBlob)} {
+		assertBlobExists(t, ociRef, contents, true)
+	}
+	src, err := listRef.NewImageSource(context.Background(), nil)
+	require.NoError(t, err)
+	defer src.Close()
+	sigs, err := src.GetSignatures(context.Background(), &instanceDigest)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("signature of instance-config")}, sigs)
+
+	err = listRef.DeleteImage(context.Background(), nil)
+	require.NoError(t, err)
+	for _, contents := range []string{"instance-config", "instance-layer", "signature of instance-config", string(indexBlob)} {
+		assertBlobExists(t, ociRef, contents, false)
+	}
+}
+
+func TestDeleteImageUnknownMediaType(t *testing.T) {
+	_, tmpDir := refToTempOCI(t)
+	defer os.RemoveAll(tmpDir)
+	ref, err := NewReference(tmpDir, "image")
+	require.NoError(t, err)
+	ociRef := ref.(ociReference)
+	putTestImage(t, ref, "config", "layer")
+
+	// An index.json entry with a media type we don't understand may refer to any of the blobs, so nothing is deleted.
+	unknownBlob := []byte("unknown")
+	blobPath, err := ociRef.blobPath(digest.FromBytes(unknownBlob), "")
+	require.NoError(t, err)
+	err = ioutil.WriteFile(blobPath, unknownBlob, 0644)
+	require.NoError(t, err)
+	err = ociRef.updateIndex(func(index *imgspecv1.Index) error {
+		index.Manifests = append(index.Manifests, imgspecv1.Descriptor{
+			MediaType: "application/vnd.example.unknown",
+			Digest:    digest.FromBytes(unknownBlob),
+			Size:      int64(len(unknownBlob)),
+		})
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = ref.DeleteImage(context.Background(), nil)
+	assert.Error(t, err)
+	index, err := ociRef.getIndex()
+	require.NoError(t, err)
+	assert.Len(t, index.Manifests, 3)
+	for _, contents := range []string{"config", "layer", "signature of config", string(unknownBlob)} {
+		assertBlobExists(t, ociRef, contents, true)
+	}
+}
+
+func TestDeleteImageWaitsForWriters(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-delete-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	ref1, err := NewReference(tmpDir, "image1")
+	require.NoError(t, err)
+	ref2, err := NewReference(tmpDir, "image2")
+	require.NoError(t, err)
+	ref3, err := NewReference(tmpDir, "image3")
+	require.NoError(t, err)
+	putTestImage(t, ref1, "config1", "layer1")
+	putTestImage(t, ref3, "config3", "layer3")
+	// Don't wait forever if DeleteImage is broken.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A destination which has not written anything yet does not block DeleteImage.
+	dest, err := ref2.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer dest.Close()
+	err = ref3.DeleteImage(ctx, nil)
+	require.NoError(t, err)
+	assertBlobExists(t, ref2.(ociReference), "layer3", false)
+
+	// A blob written by a destination which has not been committed yet is not referenced from index.json.
+	_, err = dest.PutBlob(context.Background(), bytes.NewReader([]byte("pending")), types.BlobInfo{Size: -1}, blobinfocache.NewMemoryCache(), false)
+	require.NoError(t, err)
+	deleted := make(chan error, 1)
+	go func() {
+		deleted <- ref1.DeleteImage(ctx, nil)
+	}()
+	select {
+	case err := <-deleted:
+		t.Fatalf("DeleteImage did not wait for the destination to be committed or closed, err = %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assertBlobExists(t, ref2.(ociReference), "pending", true)
+
+	err = dest.Close()
+	require.NoError(t, err)
+	err = <-deleted
+	require.NoError(t, err)
+	// Nothing refers to the blob after the destination was closed without committing.
+	assertBlobExists(t, ref2.(ociReference), "pending", false)
+	assertBlobExists(t, ref2.(ociReference), "layer1", false)
+}
+
+func TestDeleteImageCancelledWhileWaiting(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-delete-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	ref1, err := NewReference(tmpDir, "image1")
+	require.NoError(t, err)
+	ref2, err := NewReference(tmpDir, "image2")
+	require.NoError(t, err)
+	putTestImage(t, ref1, "config1", "layer1")
+
+	dest, err := ref2.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer dest.Close()
+	_, err = dest.PutBlob(context.Background(), bytes.NewReader([]byte("pending")), types.BlobInfo{Size: -1}, blobinfocache.NewMemoryCache(), false)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = ref1.DeleteImage(ctx, nil)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	// Nothing has been deleted.
+	index, err := ref1.(ociReference).getIndex()
+	require.NoError(t, err)
+	assert.Len(t, index.Manifests, 1)
+	for _, contents := range []string{"config1", "layer1", "pending"} {
+		assertBlobExists(t, ref1.(ociReference), contents, true)
+	}
+
+	// The lock is not held after the destination is closed, even though the cancelled DeleteImage has been waiting for it.
+	err = dest.Close()
+	require.NoError(t, err)
+	err = ref1.DeleteImage(context.Background(), nil)
+	require.NoError(t, err)
+	assertBlobExists(t, ref1.(ociReference), "pending", false)
+}
@@ -2,46 +2,43 @@ package layout
 
 import (
 	"context"
-	"encoding/json"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
 
 	"github.com/containers/image/manifest"
 	"github.com/containers/image/types"
 	digest "github.com/opencontainers/go-digest"
-	imgspec "github.com/opencontainers/image-spec/specs-go"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
 
+// ociImageDestination writes an image into an OCI layout.
+// index.json is only modified in Commit, which merges the changes made through this destination
+// into the current contents of index.json, so that concurrent writers into the same layout don't lose each other's images.
+// Until then, from the first blob written, the destination holds the lock returned by blobsLock, so that DeleteImage doesn't delete the blobs.
 type ociImageDestination struct {
 	ref                      ociReference
-	index                    imgspecv1.Index
 	sharedBlobDir            string
 	acceptUncompressedLayers bool
+	blobsLockMutex           sync.Mutex            // Protects unlockBlobs
+	unlockBlobs              func()                // Releases the lock returned by blobsLock; nil if it is not held
+	manifest                 *imgspecv1.Descriptor // The descriptor of the primary manifest written by PutManifest, or nil if none
+	signatures               []signatureUpdate     // Signatures written by PutSignatures, in order
+}
+
+// signatureUpdate records a PutSignatures call, to be applied to the signature index in Commit.
+type signatureUpdate struct {
+	manifestDigest digest.Digest
+	descriptors    []imgspecv1.Descriptor
 }
 
 // newImageDestination returns an ImageDestination for writing to an existing directory.
 func newImageDestination(sys *types.SystemContext, ref ociReference) (types.ImageDestination, error) {
-	var index *imgspecv1.Index
-	if indexExists(ref) {
-		var err error
-		index, err = ref.getIndex()
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		index = &imgspecv1.Index{
-			Versioned: imgspec.Versioned{
-				SchemaVersion: 2,
-			},
-		}
-	}
-
-	d := &ociImageDestination{ref: ref, index: *index}
+	d := &ociImageDestination{ref: ref}
 	if sys != nil {
 		d.sharedBlobDir = sys.OCISharedBlobDirPath
 		d.acceptUncompressedLayers = sys.OCIAcceptUncompressedLayers
@@ -67,19 +64,48 @@ func (d *ociImageDestination) Reference() types.ImageReference {
 
 // Close removes resources associated with an initialized ImageDestination, if any.
 func (d *ociImageDestination) Close() error {
+	d.releaseBlobsLock()
+	return nil
+}
+
+// holdBlobsLock acquires the lock returned by blobsLock shared, unless d already holds it.
+// It must be called before d writes or reuses blobs which index.json may not reference until Commit.
+func (d *ociImageDestination) holdBlobsLock() error {
+	d.blobsLockMutex.Lock()
+	defer d.blobsLockMutex.Unlock()
+	if d.unlockBlobs != nil {
+		return nil
+	}
+	lock, err := d.ref.blobsLock()
+	if err != nil {
+		return err
+	}
+	lock.RLock()
+	d.unlockBlobs = lock.Unlock
 	return nil
 }
 
+// releaseBlobsLock releases the lock acquired by holdBlobsLock, if it is held.
+func (d *ociImageDestination) releaseBlobsLock() {
+	d.blobsLockMutex.Lock()
+	defer d.blobsLockMutex.Unlock()
+	if d.unlockBlobs != nil {
+		d.unlockBlobs()
+		d.unlockBlobs = nil
+	}
+}
+
 func (d *ociImageDestination) SupportedManifestMIMETypes() []string {
 	return []string{
 		imgspecv1.MediaTypeImageManifest,
+		imgspecv1.MediaTypeImageIndex,
 	}
 }
 
 // SupportsSignatures returns an error (to be displayed to the user) if the destination certainly can't store signatures.
 // Note: It is still possible for PutSignatures to fail if SupportsSignatures returns nil.
 func (d *ociImageDestination) SupportsSignatures(ctx context.Context) error {
-	return errors.Errorf("Pushing signatures for OCI images is not supported")
+	return nil
 }
 
 func (d *ociImageDestination) DesiredLayerCompression() types.LayerCompression {
@@ -107,13 +133,22 @@ func (d *ociImageDestination) IgnoresEmbeddedDockerReference() bool {
 	return false // N/A, DockerReference() returns nil.
 }
 
+// HasThreadSafePutBlob indicates whether PutBlob can be executed concurrently.
+func (d *ociImageDestination) HasThreadSafePutBlob() bool {
+	return true // Each blob is written to a separate temporary file, and renamed into place.
+}
+
 // PutBlob writes contents of stream and returns data representing the result (with all data filled in).
 // inputInfo.Digest can be optionally provided if known; it is not mandatory for the implementation to verify it.
 // inputInfo.Size is the expected length of stream, if known.
 // WARNING: The contents of stream are being verified on the fly.  Until stream.Read() returns io.EOF, the contents of the data SHOULD NOT be available
 // to any other readers for download using the supplied digest.
+// May update cache.
 // If stream.Read() at any time, ESPECIALLY at end of input, returns an error, PutBlob MUST 1) fail, and 2) delete any data stored so far.
-func (d *ociImageDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, isConfig bool) (types.BlobInfo, error) {
+func (d *ociImageDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	if err := d.holdBlobsLock(); err != nil {
+		return types.BlobInfo{}, err
+	}
 	blobFile, err := ioutil.TempFile(d.ref.dir, "oci-put-blob")
 	if err != nil {
 		return types.BlobInfo{}, err
@@ -173,45 +208,57 @@ func (d *ociImageDestination) PutBlob(ctx context.Context, stream io.Reader, inp
 	return types.BlobInfo{Digest: computedDigest, Size: size}, nil
 }
 
-// HasBlob returns true iff the image destination already contains a blob with the matching digest which can be reapplied using ReapplyBlob.
-// Unlike PutBlob, the digest can not be empty.  If HasBlob returns true, the size of the blob must also be returned.
-// If the destination does not contain the blob, or it is unknown, HasBlob ordinarily returns (false, -1, nil);
-// it returns a non-nil error only on an unexpected failure.
-func (d *ociImageDestination) HasBlob(ctx context.Context, info types.BlobInfo) (bool, int64, error) {
+// TryReusingBlob checks whether the transport already contains, or can efficiently reuse, a blob, and if so, applies it to the current destination
+// (e.g. if the blob is a filesystem layer, this signifies that the changes it describes need to be applied again when composing a filesystem tree).
+// info.Digest must not be empty.
+// If canSubstitute, TryReusingBlob can use an equivalent of the desired blob; in that case the returned info may not match the input.
+// If the blob has been successfully reused, returns (true, info, nil); info must contain at least a digest and size.
+// If the transport can not reuse the requested blob, TryReusingBlob returns (false, {}, nil); it returns a non-nil error only on an unexpected failure.
+// May use and/or update cache.
+func (d *ociImageDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
 	if info.Digest == "" {
-		return false, -1, errors.Errorf(`"Can not check for a blob with unknown digest`)
+		return false, types.BlobInfo{}, errors.Errorf(`"Can not check for a blob with unknown digest`)
+	}
+	// The blob may be in the layout without being referenced from index.json.
+	if err := d.holdBlobsLock(); err != nil {
+		return false, types.BlobInfo{}, err
 	}
 	blobPath, err := d.ref.blobPath(info.Digest, d.sharedBlobDir)
 	if err != nil {
-		return false, -1, err
+		return false, types.BlobInfo{}, err
 	}
 	finfo, err := os.Stat(blobPath)
 	if err != nil && os.IsNotExist(err) {
-		return false, -1, nil
+		return false, types.BlobInfo{}, nil
 	}
 	if err != nil {
-		return false, -1, err
+		return false, types.BlobInfo{}, err
 	}
-	return true, finfo.Size(), nil
-}
-
-func (d *ociImageDestination) ReapplyBlob(ctx context.Context, info types.BlobInfo) (types.BlobInfo, error) {
-	return info, nil
+	return true, types.BlobInfo{Digest: info.Digest, Size: finfo.Size()}, nil
 }
 
 // PutManifest writes manifest to the destination.
+// If instanceDigest is not nil, it contains a digest of the specific manifest instance to write the manifest for
+// (when the primary manifest is a manifest list); this should always be nil if the primary manifest is not a manifest list.
+// Instances are only stored as blobs; only the primary manifest is recorded in index.json.
 // FIXME? This should also receive a MIME type if known, to differentiate between schema versions.
 // If the destination is in principle available, refuses this manifest type (e.g. it does not recognize the schema),
 // but may accept a different manifest type, the returned error must be an ManifestTypeRejectedError.
-func (d *ociImageDestination) PutManifest(ctx context.Context, m []byte) error {
+func (d *ociImageDestination) PutManifest(ctx context.Context, m []byte, instanceDigest *digest.Digest) error {
+	if err := d.holdBlobsLock(); err != nil {
+		return err
+	}
 	digest, err := manifest.Digest(m)
 	if err != nil {
 		return err
 	}
 	desc := imgspecv1.Descriptor{}
 	desc.Digest = digest
-	// TODO(runcom): beaware and add support for OCI manifest list
 	desc.MediaType = imgspecv1.MediaTypeImageManifest
+	isIndex := manifest.GuessMIMEType(m) == imgspecv1.MediaTypeImageIndex
+	if isIndex {
+		desc.MediaType = imgspecv1.MediaTypeImageIndex
+	}
 	desc.Size = int64(len(m))
 
 	blobPath, err := d.ref.blobPath(digest, d.sharedBlobDir)
@@ -221,55 +268,138 @@ func (d *ociImageDestination) PutManifest(ctx context.Context, m []byte) error {
 	if err := ensureParentDirectoryExists(blobPath); err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(blobPath, m, 0644); err != nil {
+	if err := writeFileAtomically(blobPath, m); err != nil {
 		return err
 	}
 
+	if instanceDigest != nil {
+		// The instance is referenced from the manifest list blob, not from index.json.
+		return nil
+	}
+
 	if d.ref.image != "" {
 		annotations := make(map[string]string)
 		annotations["org.opencontainers.image.ref.name"] = d.ref.image
 		desc.Annotations = annotations
 	}
-	desc.Platform = &imgspecv1.Platform{
-		Architecture: runtime.GOARCH,
-		OS:           runtime.GOOS,
+	if !isIndex { // The platforms of an index are recorded in the index itself.
+		desc.Platform = &imgspecv1.Platform{
+			Architecture: runtime.GOARCH,
+			OS:           runtime.GOOS,
+		}
 	}
-	d.addManifest(&desc)
+	d.manifest = &desc
 
 	return nil
 }
 
-func (d *ociImageDestination) addManifest(desc *imgspecv1.Descriptor) {
-	for i, manifest := range d.index.Manifests {
+// addManifest adds desc to index, replacing an existing descriptor with the same name.
+func addManifest(index *imgspecv1.Index, desc *imgspecv1.Descriptor) {
+	for i, manifest := range index.Manifests {
 		if manifest.Annotations["org.opencontainers.image.ref.name"] == desc.Annotations["org.opencontainers.image.ref.name"] {
 			// TODO Should there first be a cleanup based on the descriptor we are going to replace?
-			d.index.Manifests[i] = *desc
+			index.Manifests[i] = *desc
 			return
 		}
 	}
-	d.index.Manifests = append(d.index.Manifests, *desc)
+	index.Manifests = append(index.Manifests, *desc)
 }
 
-func (d *ociImageDestination) PutSignatures(ctx context.Context, signatures [][]byte) error {
-	if len(signatures) != 0 {
-		return errors.Errorf("Pushing signatures for OCI images is not supported")
+// PutSignatures writes a set of signatures to the destination.
+// The signatures are stored as blobs, referenced from the signature index (see signatureIndexAnnotation)
+// using descriptors with signatureMediaType, and replace any signatures previously stored in the layout for the same manifest.
+// If instanceDigest is not nil, it contains a digest of the specific manifest instance to write or overwrite the signatures for
+// (when the primary manifest is a manifest list); this should always be nil if the primary manifest is not a manifest list.
+func (d *ociImageDestination) PutSignatures(ctx context.Context, signatures [][]byte, instanceDigest *digest.Digest) error {
+	var manifestDigest digest.Digest
+	if d.manifest != nil {
+		manifestDigest = d.manifest.Digest
+	}
+	if instanceDigest != nil {
+		manifestDigest = *instanceDigest
+	}
+	if manifestDigest == "" {
+		if len(signatures) == 0 {
+			return nil
+		}
+		return errors.Errorf("Unknown manifest digest, can't add signatures")
+	}
+	if err := d.holdBlobsLock(); err != nil {
+		return err
 	}
+
+	sigDescs := make([]imgspecv1.Descriptor, 0, len(signatures))
+	for _, sig := range signatures {
+		sigDigest := digest.FromBytes(sig)
+		blobPath, err := d.ref.blobPath(sigDigest, d.sharedBlobDir)
+		if err != nil {
+			return err
+		}
+		if err := ensureParentDirectoryExists(blobPath); err != nil {
+			return err
+		}
+		if err := writeFileAtomically(blobPath, sig); err != nil {
+			return err
+		}
+		sigDescs = append(sigDescs, imgspecv1.Descriptor{
+			MediaType:   signatureMediaType,
+			Digest:      sigDigest,
+			Size:        int64(len(sig)),
+			Annotations: map[string]string{signatureManifestDigestAnnotation: manifestDigest.String()},
+		})
+	}
+
+	d.signatures = append(d.signatures, signatureUpdate{manifestDigest: manifestDigest, descriptors: sigDescs})
 	return nil
 }
 
+// replaceSignatures replaces all signature descriptors for manifestDigest in sigIndex with sigDescs.
+func replaceSignatures(sigIndex *imgspecv1.Index, manifestDigest digest.Digest, sigDescs []imgspecv1.Descriptor) {
+	manifests := []imgspecv1.Descriptor{}
+	for _, desc := range sigIndex.Manifests {
+		if desc.Annotations[signatureManifestDigestAnnotation] == manifestDigest.String() {
+			continue
+		}
+		manifests = append(manifests, desc)
+	}
+	sigIndex.Manifests = append(manifests, sigDescs...)
+}
+
 // Commit marks the process of storing the image as successful and asks for the image to be persisted.
 // WARNING: This does not have any transactional semantics:
 // - Uploaded data MAY be visible to others before Commit() is called
 // - Uploaded data MAY be removed or MAY remain around if Close() is called without Commit() (i.e. rollback is allowed but not guaranteed)
 func (d *ociImageDestination) Commit(ctx context.Context) error {
-	if err := ioutil.WriteFile(d.ref.ociLayoutPath(), []byte(`{"imageLayoutVersion": "1.0.0"}`), 0644); err != nil {
+	if err := writeFileAtomically(d.ref.ociLayoutPath(), []byte(`{"imageLayoutVersion": "1.0.0"}`)); err != nil {
 		return err
 	}
-	indexJSON, err := json.Marshal(d.index)
+
+	unlock, err := d.ref.lockIndex()
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(d.ref.indexPath(), indexJSON, 0644)
+	defer unlock()
+	if err := d.ref.updateIndex(func(index *imgspecv1.Index) error {
+		if d.manifest != nil {
+			addManifest(index, d.manifest)
+		}
+		if len(d.signatures) == 0 {
+			return nil
+		}
+		sigIndex, err := d.ref.getSignatureIndex(index, d.sharedBlobDir)
+		if err != nil {
+			return err
+		}
+		for _, u := range d.signatures {
+			replaceSignatures(sigIndex, u.manifestDigest, u.descriptors)
+		}
+		return d.ref.putSignatureIndex(index, sigIndex, d.sharedBlobDir)
+	}); err != nil {
+		return err
+	}
+	// All blobs written by this destination are now referenced from index.json, and safe from garbage collection.
+	d.releaseBlobsLock()
+	return nil
 }
 
 func ensureDirectoryExists(path string) error {
@@ -286,15 +416,37 @@ func ensureParentDirectoryExists(path string) error {
 	return ensureDirectoryExists(filepath.Dir(path))
 }
 
-// indexExists checks whether the index location specified in the OCI reference exists.
-// The implementation is opinionated, since in case of unexpected errors false is returned
-func indexExists(ref ociReference) bool {
-	_, err := os.Stat(ref.indexPath())
-	if err == nil {
-		return true
+// writeFileAtomically writes data to path, replacing any previous contents of the file,
+// so that concurrent readers see either the previous or the new contents of the file, but nothing in between.
+func writeFileAtomically(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
 	}
-	if os.IsNotExist(err) {
-		return false
+	tmpPath := tmp.Name()
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			os.Remove(tmpPath)
+		}
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
 	}
-	return true
+	// See the comment in PutBlob.
+	if runtime.GOOS != "windows" {
+		if err := tmp.Chmod(0644); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	succeeded = true
+	return nil
 }
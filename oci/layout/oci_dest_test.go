@@ -1,13 +1,22 @@
 package layout
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"strings"
 	"testing"
 
 	"path/filepath"
 
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/blobinfocache"
 	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -52,7 +61,7 @@ func TestPutBlobDigestFailure(t *testing.T) {
 	dest, err := ref.NewImageDestination(context.Background(), nil)
 	require.NoError(t, err)
 	defer dest.Close()
-	_, err = dest.PutBlob(context.Background(), reader, types.BlobInfo{Digest: blobDigest, Size: -1}, false)
+	_, err = dest.PutBlob(context.Background(), reader, types.BlobInfo{Digest: blobDigest, Size: -1}, blobinfocache.NewMemoryCache(), false)
 	assert.Error(t, err)
 	assert.Contains(t, digestErrorString, err.Error())
 	err = dest.Commit(context.Background())
@@ -108,7 +117,7 @@ func putTestManifest(t *testing.T, ociRef ociReference, tmpDir string) {
 	assert.NoError(t, err)
 
 	data := []byte("abc")
-	err = imageDest.PutManifest(context.Background(), data)
+	err = imageDest.PutManifest(context.Background(), data, nil)
 	assert.NoError(t, err)
 
 	err = imageDest.Commit(context.Background())
@@ -123,3 +132,335 @@ func putTestManifest(t *testing.T, ociRef ociReference, tmpDir string) {
 	digest := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
 	assert.Contains(t, paths, filepath.Join(tmpDir, "blobs", "sha256", digest), "The OCI directory does not contain the new manifest data")
 }
+
+// TestPutManifestIndex tests that an index and its instances can be stored, and read back.
+func TestPutManifestIndex(t *testing.T) {
+	ref, tmpDir := refToTempOCI(t)
+	defer os.RemoveAll(tmpDir)
+
+	ociRef, err := NewReference(tmpDir, "list")
+	require.NoError(t, err)
+	instance, err := ioutil.ReadFile("../../manifest/fixtures/ociv1.manifest.json")
+	require.NoError(t, err)
+	instanceDigest, err := manifest.Digest(instance)
+	require.NoError(t, err)
+	index := manifest.OCI1IndexFromComponents([]imgspecv1.Descriptor{{
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Digest:    instanceDigest,
+		Size:      int64(len(instance)),
+		Platform:  &imgspecv1.Platform{Architecture: "amd64", OS: "linux"},
+	}}, nil)
+	indexBlob, err := index.Serialize()
+	require.NoError(t, err)
+
+	dest, err := ociRef.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer dest.Close()
+	err = dest.PutManifest(context.Background(), instance, &instanceDigest)
+	require.NoError(t, err)
+	err = dest.PutManifest(context.Background(), indexBlob, nil)
+	require.NoError(t, err)
+	err = dest.Commit(context.Background())
+	require.NoError(t, err)
+
+	// Only the index is recorded in index.json.
+	idx, err := ref.(ociReference).getIndex()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(idx.Manifests), "Unexpected number of manifests")
+	assert.Equal(t, imgspecv1.MediaTypeImageIndex, idx.Manifests[1].MediaType)
+	assert.Nil(t, idx.Manifests[1].Platform)
+
+	src, err := ociRef.NewImageSource(context.Background(), nil)
+	require.NoError(t, err)
+	defer src.Close()
+	m, mt, err := src.GetManifest(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, indexBlob, m)
+	assert.Equal(t, imgspecv1.MediaTypeImageIndex, mt)
+	m, mt, err = src.GetManifest(context.Background(), &instanceDigest)
+	require.NoError(t, err)
+	assert.Equal(t, instance, m)
+	assert.Equal(t, imgspecv1.MediaTypeImageManifest, mt)
+}
+
+// TestPutSignatures tests that signatures can be stored, replaced and read back.
+func TestPutSignatures(t *testing.T) {
+	ref, tmpDir := refToTempOCI(t)
+	defer os.RemoveAll(tmpDir)
+	ociRef, ok := ref.(ociReference)
+	require.True(t, ok)
+
+	manifestBlob := []byte("abc")
+	manifestDigest := digest.FromBytes(manifestBlob)
+	putSignatures := func(signatures [][]byte) {
+		dest, err := ociRef.NewImageDestination(context.Background(), nil)
+		require.NoError(t, err)
+		defer dest.Close()
+		err = dest.SupportsSignatures(context.Background())
+		assert.NoError(t, err)
+		err = dest.PutManifest(context.Background(), manifestBlob, nil)
+		require.NoError(t, err)
+		err = dest.PutSignatures(context.Background(), signatures, nil)
+		require.NoError(t, err)
+		err = dest.Commit(context.Background())
+		require.NoError(t, err)
+	}
+	getSignatures := func() [][]byte {
+		src, err := ociRef.NewImageSource(context.Background(), nil)
+		require.NoError(t, err)
+		defer src.Close()
+		sigs, err := src.GetSignatures(context.Background(), nil)
+		require.NoError(t, err)
+		return sigs
+	}
+
+	// No signatures yet
+	assert.Equal(t, [][]byte{}, getSignatures())
+
+	signatures := [][]byte{[]byte("sig1"), []byte("sig2")}
+	putSignatures(signatures)
+	assert.Equal(t, signatures, getSignatures())
+	index, err := ociRef.getIndex()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(index.Manifests), "Unexpected number of manifests")
+	assert.Equal(t, manifestDigest, index.Manifests[0].Digest)
+	sigIndex, err := ociRef.getSignatureIndex(index, "")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(sigIndex.Manifests), "Unexpected number of signatures")
+	for i, sig := range signatures {
+		desc := sigIndex.Manifests[i]
+		assert.Equal(t, signatureMediaType, desc.MediaType)
+		assert.Equal(t, digest.FromBytes(sig), desc.Digest)
+		assert.Equal(t, int64(len(sig)), desc.Size)
+		assert.Equal(t, manifestDigest.String(), desc.Annotations[signatureManifestDigestAnnotation])
+	}
+
+	// Signatures are replaced, not appended
+	putSignatures([][]byte{[]byte("sig3")})
+	assert.Equal(t, [][]byte{[]byte("sig3")}, getSignatures())
+	putSignatures([][]byte{})
+	assert.Equal(t, [][]byte{}, getSignatures())
+	index, err = ociRef.getIndex()
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(index.Manifests), "Unexpected number of manifests")
+	assert.NotContains(t, index.Annotations, signatureIndexAnnotation)
+
+	// A reference without an image name still finds the only image.
+	putSignatures(signatures)
+	noImageRef, err := NewReference(tmpDir, "")
+	require.NoError(t, err)
+	src, err := noImageRef.NewImageSource(context.Background(), nil)
+	require.NoError(t, err)
+	defer src.Close()
+	sigs, err := src.GetSignatures(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, signatures, sigs)
+
+	// A corrupted signature blob is rejected
+	blobPath, err := ociRef.blobPath(digest.FromBytes(signatures[0]), "")
+	require.NoError(t, err)
+	err = ioutil.WriteFile(blobPath, []byte("corrupted"), 0644)
+	require.NoError(t, err)
+	_, err = src.GetSignatures(context.Background(), nil)
+	assert.Error(t, err)
+}
+
+// TestPutSignaturesInstance tests that signatures of manifest list instances are stored separately.
+func TestPutSignaturesInstance(t *testing.T) {
+	ref, tmpDir := refToTempOCI(t)
+	defer os.RemoveAll(tmpDir)
+	ociRef, ok := ref.(ociReference)
+	require.True(t, ok)
+
+	dest, err := ociRef.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer dest.Close()
+	// Signatures can't be stored without knowing the manifest digest
+	err = dest.PutSignatures(context.Background(), [][]byte{[]byte("sig")}, nil)
+	assert.Error(t, err)
+	err = dest.PutSignatures(context.Background(), [][]byte{}, nil)
+	assert.NoError(t, err)
+
+	instanceDigest := digest.FromBytes([]byte("instance"))
+	err = dest.PutManifest(context.Background(), []byte("list"), nil)
+	require.NoError(t, err)
+	err = dest.PutSignatures(context.Background(), [][]byte{[]byte("list-sig")}, nil)
+	require.NoError(t, err)
+	err = dest.PutSignatures(context.Background(), [][]byte{[]byte("instance-sig")}, &instanceDigest)
+	require.NoError(t, err)
+	err = dest.Commit(context.Background())
+	require.NoError(t, err)
+
+	src, err := ociRef.NewImageSource(context.Background(), nil)
+	require.NoError(t, err)
+	defer src.Close()
+	sigs, err := src.GetSignatures(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("list-sig")}, sigs)
+	sigs, err = src.GetSignatures(context.Background(), &instanceDigest)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("instance-sig")}, sigs)
+}
+
+// TestCommitMergesConcurrentChanges tests that Commit does not lose images committed by other destinations after it was created.
+func TestCommitMergesConcurrentChanges(t *testing.T) {
+	_, tmpDir := refToTempOCI(t)
+	defer os.RemoveAll(tmpDir)
+
+	dests := []types.ImageDestination{}
+	for _, name := range []string{"first", "second"} {
+		ref, err := NewReference(tmpDir, name)
+		require.NoError(t, err)
+		dest, err := ref.NewImageDestination(context.Background(), nil)
+		require.NoError(t, err)
+		defer dest.Close()
+		dests = append(dests, dest)
+	}
+	for i, dest := range dests {
+		err := dest.PutManifest(context.Background(), []byte(fmt.Sprintf("manifest %d", i)), nil)
+		require.NoError(t, err)
+	}
+	for _, dest := range dests {
+		err := dest.Commit(context.Background())
+		require.NoError(t, err)
+	}
+
+	index, err := dests[0].Reference().(ociReference).getIndex()
+	require.NoError(t, err)
+	names := []string{}
+	for _, desc := range index.Manifests {
+		names = append(names, desc.Annotations["org.opencontainers.image.ref.name"])
+	}
+	assert.Equal(t, []string{"imageValue", "first", "second"}, names)
+}
+
+// concurrentWriterEnv, if set, contains the layout path and an image name prefix for TestConcurrentWritersHelperProcess.
+const concurrentWriterEnv = "OCI_LAYOUT_TEST_CONCURRENT_WRITER"
+
+// writeConcurrently writes writers images, named prefix-0 and so on, into the layout at dir from separate goroutines,
+// and returns their manifest digests.
+func writeConcurrently(dir, prefix string, writers int) ([]digest.Digest, error) {
+	type result struct {
+		i              int
+		manifestDigest digest.Digest
+		err            error
+	}
+	results := make(chan result, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			name := fmt.Sprintf("%s-%d", prefix, i)
+			ref, err := NewReference(dir, name)
+			if err != nil {
+				results <- result{i: i, err: err}
+				return
+			}
+			manifestDigest, err := writeTestImage(ref, "config of "+name, "shared", "layer of "+name)
+			results <- result{i: i, manifestDigest: manifestDigest, err: errors.Wrapf(err, "error writing %s", name)}
+		}(i)
+	}
+	manifestDigests := make([]digest.Digest, writers)
+	var firstErr error
+	for i := 0; i < writers; i++ {
+		res := <-results
+		if res.err != nil && firstErr == nil {
+			firstErr = res.err
+		}
+		manifestDigests[res.i] = res.manifestDigest
+	}
+	return manifestDigests, firstErr
+}
+
+// TestConcurrentWritersHelperProcess is not a real test; TestConcurrentWriters runs it in separate processes.
+// It writes images into a layout using writeConcurrently, and prints their manifest digests, one per line.
+func TestConcurrentWritersHelperProcess(t *testing.T) {
+	env := os.Getenv(concurrentWriterEnv)
+	if env == "" {
+		return
+	}
+	parts := strings.SplitN(env, ":", 2)
+	require.Len(t, parts, 2)
+	manifestDigests, err := writeConcurrently(parts[1], parts[0], concurrentWritersPerProcess)
+	require.NoError(t, err)
+	for _, manifestDigest := range manifestDigests {
+		fmt.Println(manifestDigest.String())
+	}
+}
+
+const (
+	concurrentWriterProcesses   = 4
+	concurrentWritersPerProcess = 16
+)
+
+// TestConcurrentWriters tests that many writers, in this and other processes, can store images into a single layout in parallel.
+func TestConcurrentWriters(t *testing.T) {
+	_, tmpDir := refToTempOCI(t)
+	defer os.RemoveAll(tmpDir)
+
+	type process struct {
+		cmd    *exec.Cmd
+		stdout bytes.Buffer
+		stderr bytes.Buffer
+	}
+	processes := []*process{}
+	for p := 0; p < concurrentWriterProcesses; p++ {
+		proc := &process{cmd: exec.Command(os.Args[0], "-test.run=^TestConcurrentWritersHelperProcess$")}
+		proc.cmd.Env = append(os.Environ(), fmt.Sprintf("%s=process%d:%s", concurrentWriterEnv, p, tmpDir))
+		proc.cmd.Stdout = &proc.stdout
+		proc.cmd.Stderr = &proc.stderr
+		err := proc.cmd.Start()
+		require.NoError(t, err)
+		processes = append(processes, proc)
+	}
+	// Write from this process as well, while the other processes are running.
+	manifestDigests := map[string]digest.Digest{}
+	localDigests, err := writeConcurrently(tmpDir, "local", concurrentWritersPerProcess)
+	assert.NoError(t, err)
+	for i, manifestDigest := range localDigests {
+		manifestDigests[fmt.Sprintf("local-%d", i)] = manifestDigest
+	}
+	for p, proc := range processes {
+		err := proc.cmd.Wait()
+		require.NoError(t, err, "stdout:\n%s\nstderr:\n%s", proc.stdout.String(), proc.stderr.String())
+		// The output also contains the test binary's own status messages.
+		printed := []digest.Digest{}
+		for _, line := range strings.Split(proc.stdout.String(), "\n") {
+			if manifestDigest, err := digest.Parse(line); err == nil {
+				printed = append(printed, manifestDigest)
+			}
+		}
+		require.Len(t, printed, concurrentWritersPerProcess, proc.stdout.String())
+		for i, manifestDigest := range printed {
+			manifestDigests[fmt.Sprintf("process%d-%d", p, i)] = manifestDigest
+		}
+	}
+	require.Len(t, manifestDigests, (1+concurrentWriterProcesses)*concurrentWritersPerProcess)
+
+	ref, err := NewReference(tmpDir, "")
+	require.NoError(t, err)
+	index, err := ref.(ociReference).getIndex()
+	require.NoError(t, err)
+	assert.Equal(t, 1+len(manifestDigests), len(index.Manifests), "Unexpected number of manifests")
+	for name, manifestDigest := range manifestDigests {
+		ref, err := NewReference(tmpDir, name)
+		require.NoError(t, err)
+		src, err := ref.NewImageSource(context.Background(), nil)
+		require.NoError(t, err)
+		defer src.Close()
+		m, _, err := src.GetManifest(context.Background(), nil)
+		require.NoError(t, err)
+		assert.Equal(t, manifestDigest, digest.FromBytes(m), name)
+		sigs, err := src.GetSignatures(context.Background(), nil)
+		require.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("signature of config of " + name)}, sigs, name)
+	}
+	// No temporary files are left behind
+	paths := []string{}
+	err = filepath.Walk(tmpDir, func(path string, info os.FileInfo, err error) error {
+		if strings.Contains(filepath.Base(path), ".tmp") {
+			paths = append(paths, path)
+		}
+		return err
+	})
+	require.NoError(t, err)
+	assert.Empty(t, paths)
+}
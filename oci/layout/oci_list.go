@@ -0,0 +1,72 @@
+package layout
+
+import (
+	"encoding/json"
+
+	"github.com/containers/image/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ListResult describes a single image in an OCI layout, as returned by List.
+type ListResult struct {
+	// Name is the value of the org.opencontainers.image.ref.name annotation of the image, or "" if the image is not named.
+	Name string
+	// Reference refers to the image, or is nil if the image can't be unambiguously referenced
+	// (e.g. if it is not named and the layout contains more than one image).
+	Reference types.ImageReference
+	// ManifestDescriptor is the index.json entry for the image, including its platform if known.
+	ManifestDescriptor imgspecv1.Descriptor
+	// Instances contains the entries of the image index, if ManifestDescriptor refers to an image index; nil otherwise.
+	Instances []imgspecv1.Descriptor
+}
+
+// List returns the images in the OCI layout at dir, in the order of their index.json entries.
+func List(sys *types.SystemContext, dir string) ([]ListResult, error) {
+	ref, err := NewReference(dir, "")
+	if err != nil {
+		return nil, err
+	}
+	ociRef := ref.(ociReference)
+	sharedBlobDir := ""
+	if sys != nil {
+		sharedBlobDir = sys.OCISharedBlobDirPath
+	}
+	index, err := ociRef.getIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	res := []ListResult{}
+	seenNames := map[string]struct{}{}
+	for _, desc := range index.Manifests {
+		r := ListResult{
+			Name:               desc.Annotations["org.opencontainers.image.ref.name"],
+			ManifestDescriptor: desc,
+		}
+		isIndex := desc.MediaType == imgspecv1.MediaTypeImageIndex
+		if _, seen := seenNames[r.Name]; r.Name != "" && !seen && (isIndex || desc.MediaType == imgspecv1.MediaTypeImageManifest) {
+			// Only the first entry with a name can be referenced by that name, see findManifestDescriptor.
+			seenNames[r.Name] = struct{}{}
+			if nameRef, err := NewReference(dir, r.Name); err == nil {
+				r.Reference = nameRef
+			}
+		}
+		if r.Reference == nil && len(index.Manifests) == 1 {
+			r.Reference = ref
+		}
+		if isIndex {
+			blob, err := ociRef.readBlob(desc.Digest, sharedBlobDir)
+			if err != nil {
+				return nil, err
+			}
+			var nested imgspecv1.Index
+			if err := json.Unmarshal(blob, &nested); err != nil {
+				return nil, errors.Wrapf(err, "error parsing image index %s", desc.Digest)
+			}
+			r.Instances = nested.Manifests
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
@@ -0,0 +1,94 @@
+package layout
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestList(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-list-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// A single unnamed image
+	unnamedRef, err := NewReference(tmpDir, "")
+	require.NoError(t, err)
+	unnamedDigest := putTestImage(t, unnamedRef, "unnamed-config", "layer")
+	res, err := List(nil, tmpDir)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.Equal(t, "", res[0].Name)
+	assert.Equal(t, unnamedRef.StringWithinTransport(), res[0].Reference.StringWithinTransport())
+	assert.Equal(t, unnamedDigest, res[0].ManifestDescriptor.Digest)
+	assert.Nil(t, res[0].Instances)
+
+	// A named image, and an index
+	namedRef, err := NewReference(tmpDir, "named")
+	require.NoError(t, err)
+	namedDigest := putTestImage(t, namedRef, "named-config", "layer")
+	listRef, err := NewReference(tmpDir, "list")
+	require.NoError(t, err)
+	instances := []imgspecv1.Descriptor{{
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Digest:    namedDigest,
+		Size:      1,
+		Platform:  &imgspecv1.Platform{Architecture: "amd64", OS: "linux"},
+	}}
+	indexBlob, err := manifest.OCI1IndexFromComponents(instances, nil).Serialize()
+	require.NoError(t, err)
+	dest, err := listRef.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer dest.Close()
+	err = dest.PutManifest(context.Background(), indexBlob, nil)
+	require.NoError(t, err)
+	err = dest.Commit(context.Background())
+	require.NoError(t, err)
+
+	res, err = List(nil, tmpDir)
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+	assert.Equal(t, "", res[0].Name)
+	assert.Nil(t, res[0].Reference)
+	assert.Equal(t, "named", res[1].Name)
+	assert.Equal(t, namedRef.StringWithinTransport(), res[1].Reference.StringWithinTransport())
+	assert.Equal(t, namedDigest, res[1].ManifestDescriptor.Digest)
+	assert.NotNil(t, res[1].ManifestDescriptor.Platform)
+	assert.Nil(t, res[1].Instances)
+	assert.Equal(t, "list", res[2].Name)
+	assert.Equal(t, listRef.StringWithinTransport(), res[2].Reference.StringWithinTransport())
+	assert.Equal(t, imgspecv1.MediaTypeImageIndex, res[2].ManifestDescriptor.MediaType)
+	assert.Equal(t, instances, res[2].Instances)
+
+	// The references can be used to read the images
+	for _, r := range res[1:] {
+		src, err := r.Reference.NewImageSource(context.Background(), nil)
+		require.NoError(t, err)
+		m, _, err := src.GetManifest(context.Background(), nil)
+		require.NoError(t, err)
+		assert.Equal(t, r.ManifestDescriptor.Digest.String(), manifestDigestString(t, m))
+		src.Close()
+	}
+
+	// The index blob is read from the shared blob directory, if any
+	_, err = List(&types.SystemContext{OCISharedBlobDirPath: filepath.Join(tmpDir, "this-does-not-exist")}, tmpDir)
+	assert.Error(t, err)
+	// Missing index.json
+	_, err = List(nil, filepath.Join(tmpDir, "this-does-not-exist"))
+	assert.Error(t, err)
+}
+
+// manifestDigestString returns the digest of m, as a string.
+func manifestDigestString(t *testing.T, m []byte) string {
+	d, err := manifest.Digest(m)
+	require.NoError(t, err)
+	return d.String()
+}
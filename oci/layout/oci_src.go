@@ -8,6 +8,7 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/containers/image/manifest"
 	"github.com/containers/image/pkg/tlsclientconfig"
 	"github.com/containers/image/types"
 	"github.com/docker/go-connections/tlsconfig"
@@ -71,13 +72,16 @@ func (s *ociImageSource) GetManifest(ctx context.Context, instanceDigest *digest
 		mimeType = s.descriptor.MediaType
 	} else {
 		dig = *instanceDigest
-		// XXX: instanceDigest means that we don't immediately have the context of what
-		//      mediaType the manifest has. In OCI this means that we don't know
-		//      what reference it came from, so we just *assume* that its
-		//      MediaTypeImageManifest.
-		// FIXME: We should actually be able to look up the manifest in the index,
-		// and see the MIME type there.
 		mimeType = imgspecv1.MediaTypeImageManifest
+		// instanceDigest means that the top-level manifest is an index; look up the MIME type of the instance there.
+		// If the index can't be read, we just *assume* that the instance is a MediaTypeImageManifest.
+		if indexBlob, _, err := s.GetManifest(ctx, nil); err == nil {
+			if index, err := manifest.OCI1IndexFromManifest(indexBlob); err == nil {
+				if instance, err := index.Instance(dig); err == nil {
+					mimeType = instance.MediaType
+				}
+			}
+		}
 	}
 
 	manifestPath, err := s.ref.blobPath(dig, s.sharedBlobDir)
@@ -93,7 +97,8 @@ func (s *ociImageSource) GetManifest(ctx context.Context, instanceDigest *digest
 }
 
 // GetBlob returns a stream for the specified blob, and the blob's size.
-func (s *ociImageSource) GetBlob(ctx context.Context, info types.BlobInfo) (io.ReadCloser, int64, error) {
+// May update BlobInfoCache, preferably after it knows for certain that a blob truly exists at a specific location.
+func (s *ociImageSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
 	if len(info.URLs) != 0 {
 		return s.getExternalBlob(ctx, info.URLs)
 	}
@@ -119,7 +124,38 @@ func (s *ociImageSource) GetBlob(ctx context.Context, info types.BlobInfo) (io.R
 // (when the primary manifest is a manifest list); this never happens if the primary manifest is not a manifest list
 // (e.g. if the source never returns manifest lists).
 func (s *ociImageSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
-	return [][]byte{}, nil
+	manifestDigest := s.descriptor.Digest
+	if instanceDigest != nil {
+		manifestDigest = *instanceDigest
+	}
+	index, err := s.ref.getIndex()
+	if err != nil {
+		return nil, err
+	}
+	sigIndex, err := s.ref.getSignatureIndex(index, s.sharedBlobDir)
+	if err != nil {
+		return nil, err
+	}
+
+	signatures := [][]byte{}
+	for _, desc := range sigIndex.Manifests {
+		if desc.MediaType != signatureMediaType || desc.Annotations[signatureManifestDigestAnnotation] != manifestDigest.String() {
+			continue
+		}
+		path, err := s.ref.blobPath(desc.Digest, s.sharedBlobDir)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if desc.Digest.Algorithm().FromBytes(signature) != desc.Digest {
+			return nil, errors.Errorf("Signature blob %s does not match its digest", desc.Digest)
+		}
+		signatures = append(signatures, signature)
+	}
+	return signatures, nil
 }
 
 func (s *ociImageSource) getExternalBlob(ctx context.Context, urls []string) (io.ReadCloser, int64, error) {
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/containers/image/pkg/blobinfocache"
 	"github.com/containers/image/types"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
@@ -51,7 +52,7 @@ func TestGetBlobForRemoteLayers(t *testing.T) {
 		},
 	}
 
-	reader, _, err := imageSource.GetBlob(context.Background(), layerInfo)
+	reader, _, err := imageSource.GetBlob(context.Background(), layerInfo, blobinfocache.NewMemoryCache())
 	require.NoError(t, err)
 	defer reader.Close()
 
@@ -67,7 +68,7 @@ func TestGetBlobForRemoteLayersWithTLS(t *testing.T) {
 
 	layer, size, err := imageSource.GetBlob(context.Background(), types.BlobInfo{
 		URLs: []string{httpServerAddr},
-	})
+	}, blobinfocache.NewMemoryCache())
 	require.NoError(t, err)
 
 	layerContent, _ := ioutil.ReadAll(layer)
@@ -81,7 +82,7 @@ func TestGetBlobForRemoteLayersOnTLSFailure(t *testing.T) {
 	})
 	layer, size, err := imageSource.GetBlob(context.Background(), types.BlobInfo{
 		URLs: []string{httpServerAddr},
-	})
+	}, blobinfocache.NewMemoryCache())
 
 	require.Error(t, err)
 	assert.Nil(t, layer)
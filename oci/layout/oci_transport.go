@@ -14,7 +14,9 @@ import (
 	"github.com/containers/image/oci/internal"
 	"github.com/containers/image/transports"
 	"github.com/containers/image/types"
+	"github.com/containers/storage/pkg/lockfile"
 	"github.com/opencontainers/go-digest"
+	imgspec "github.com/opencontainers/image-spec/specs-go"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
@@ -177,41 +179,185 @@ func (ref ociReference) getIndex() (*imgspecv1.Index, error) {
 	return index, nil
 }
 
+// lockIndex acquires the lock serializing updates of index.json, and returns a function which releases it.
+func (ref ociReference) lockIndex() (func(), error) {
+	lock, err := lockfile.GetLockfile(filepath.Join(ref.dir, internal.IndexLockFile))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating lock file for %s", ref.indexPath())
+	}
+	lock.Lock()
+	return lock.Unlock, nil
+}
+
+// blobsLock returns the lock which protects blobs not referenced from index.json yet against garbage collection.
+// Image destinations hold it shared while they have blobs in the layout which they have not committed yet;
+// DeleteImage holds it exclusively while deleting unreferenced blobs.
+func (ref ociReference) blobsLock() (lockfile.Locker, error) {
+	lock, err := lockfile.GetLockfile(filepath.Join(ref.dir, internal.BlobsLockFile))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating lock file for blobs of %s", ref.dir)
+	}
+	return lock, nil
+}
+
+// lockBlobsExclusively acquires the lock returned by blobsLock exclusively, and returns a function which releases it.
+// If ctx is cancelled before the lock is acquired, it fails; the lock is then released as soon as it is eventually acquired.
+func (ref ociReference) lockBlobsExclusively(ctx context.Context) (func(), error) {
+	lock, err := ref.blobsLock()
+	if err != nil {
+		return nil, err
+	}
+	acquired := make(chan struct{})
+	go func() {
+		lock.Lock()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return lock.Unlock, nil
+	case <-ctx.Done():
+		go func() {
+			<-acquired
+			lock.Unlock()
+		}()
+		return nil, errors.Wrapf(ctx.Err(), "error waiting for uncommitted writes into %s", ref.dir)
+	}
+}
+
+// updateIndex calls fn to modify the current contents of index.json, creating it if it does not exist,
+// and atomically writes the result back.
+// The caller must hold the lock obtained by lockIndex, so that concurrent updates are not lost.
+func (ref ociReference) updateIndex(fn func(index *imgspecv1.Index) error) error {
+	index, err := ref.getIndex()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		index = &imgspecv1.Index{
+			Versioned: imgspec.Versioned{
+				SchemaVersion: 2,
+			},
+		}
+	}
+	if err := fn(index); err != nil {
+		return err
+	}
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(ref.indexPath(), indexJSON)
+}
+
+const (
+	// signatureIndexAnnotation is the index.json annotation containing the digest of the signature index, an image index blob
+	// listing the signatures stored by PutSignatures.  Signatures are not listed in index.json itself,
+	// so that all index.json entries remain images, as other consumers of OCI layouts expect.
+	signatureIndexAnnotation = "io.containers.image.signatures"
+	// signatureMediaType is the media type of signature index descriptors referring to signature blobs.
+	// The digest of the signed manifest is recorded in the signatureManifestDigestAnnotation annotation of the descriptor.
+	signatureMediaType = "application/vnd.containers.image.signature.v1"
+	// signatureManifestDigestAnnotation is the annotation of a signature descriptor containing the digest of the signed manifest.
+	signatureManifestDigestAnnotation = "io.containers.image.signature.manifest-digest"
+)
+
+// getSignatureIndex returns the signature index referenced from index, or an empty index if there is none.
+func (ref ociReference) getSignatureIndex(index *imgspecv1.Index, sharedBlobDir string) (*imgspecv1.Index, error) {
+	sigIndex := &imgspecv1.Index{
+		Versioned: imgspec.Versioned{
+			SchemaVersion: 2,
+		},
+	}
+	value, ok := index.Annotations[signatureIndexAnnotation]
+	if !ok {
+		return sigIndex, nil
+	}
+	sigIndexDigest, err := digest.Parse(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid signature index digest %q", value)
+	}
+	blob, err := ref.readBlob(sigIndexDigest, sharedBlobDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading signature index")
+	}
+	if sigIndexDigest.Algorithm().FromBytes(blob) != sigIndexDigest {
+		return nil, errors.Errorf("Signature index %s does not match its digest", sigIndexDigest)
+	}
+	if err := json.Unmarshal(blob, sigIndex); err != nil {
+		return nil, errors.Wrapf(err, "error parsing signature index %s", sigIndexDigest)
+	}
+	return sigIndex, nil
+}
+
+// putSignatureIndex stores sigIndex as a blob, and references it from index.
+// If sigIndex is empty, the reference is removed from index instead.
+func (ref ociReference) putSignatureIndex(index, sigIndex *imgspecv1.Index, sharedBlobDir string) error {
+	if len(sigIndex.Manifests) == 0 {
+		delete(index.Annotations, signatureIndexAnnotation)
+		if len(index.Annotations) == 0 {
+			index.Annotations = nil
+		}
+		return nil
+	}
+	blob, err := json.Marshal(sigIndex)
+	if err != nil {
+		return err
+	}
+	sigIndexDigest := digest.FromBytes(blob)
+	blobPath, err := ref.blobPath(sigIndexDigest, sharedBlobDir)
+	if err != nil {
+		return err
+	}
+	if err := ensureParentDirectoryExists(blobPath); err != nil {
+		return err
+	}
+	if err := writeFileAtomically(blobPath, blob); err != nil {
+		return err
+	}
+	if index.Annotations == nil {
+		index.Annotations = map[string]string{}
+	}
+	index.Annotations[signatureIndexAnnotation] = sigIndexDigest.String()
+	return nil
+}
+
 func (ref ociReference) getManifestDescriptor() (imgspecv1.Descriptor, error) {
 	index, err := ref.getIndex()
 	if err != nil {
 		return imgspecv1.Descriptor{}, err
 	}
+	i, err := ref.findManifestDescriptor(index)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+	return index.Manifests[i], nil
+}
 
-	var d *imgspecv1.Descriptor
+// findManifestDescriptor returns the position of the descriptor of ref's image within index.Manifests.
+func (ref ociReference) findManifestDescriptor(index *imgspecv1.Index) (int, error) {
 	if ref.image == "" {
 		// return manifest if only one image is in the oci directory
-		if len(index.Manifests) == 1 {
-			d = &index.Manifests[0]
-		} else {
+		if len(index.Manifests) != 1 {
 			// ask user to choose image when more than one image in the oci directory
-			return imgspecv1.Descriptor{}, ErrMoreThanOneImage
-		}
-	} else {
-		// if image specified, look through all manifests for a match
-		for _, md := range index.Manifests {
-			if md.MediaType != imgspecv1.MediaTypeImageManifest {
-				continue
-			}
-			refName, ok := md.Annotations["org.opencontainers.image.ref.name"]
-			if !ok {
-				continue
-			}
-			if refName == ref.image {
-				d = &md
-				break
-			}
+			return -1, ErrMoreThanOneImage
 		}
+		return 0, nil
 	}
-	if d == nil {
-		return imgspecv1.Descriptor{}, fmt.Errorf("no descriptor found for reference %q", ref.image)
+
+	// if image specified, look through all manifests for a match
+	for i, md := range index.Manifests {
+		if md.MediaType != imgspecv1.MediaTypeImageManifest && md.MediaType != imgspecv1.MediaTypeImageIndex {
+			continue
+		}
+		refName, ok := md.Annotations["org.opencontainers.image.ref.name"]
+		if !ok {
+			continue
+		}
+		if refName == ref.image {
+			return i, nil
+		}
 	}
-	return *d, nil
+	return -1, fmt.Errorf("no descriptor found for reference %q", ref.image)
 }
 
 // LoadManifestDescriptor loads the manifest descriptor to be used to retrieve the image name
@@ -236,11 +382,6 @@ func (ref ociReference) NewImageDestination(ctx context.Context, sys *types.Syst
 	return newImageDestination(sys, ref)
 }
 
-// DeleteImage deletes the named image from the registry, if supported.
-func (ref ociReference) DeleteImage(ctx context.Context, sys *types.SystemContext) error {
-	return errors.Errorf("Deleting images not implemented for oci: images")
-}
-
 // ociLayoutPath returns a path for the oci-layout within a directory using OCI conventions.
 func (ref ociReference) ociLayoutPath() string {
 	return filepath.Join(ref.dir, "oci-layout")
@@ -263,7 +263,23 @@ func TestReferenceNewImageDestination(t *testing.T) {
 func TestReferenceDeleteImage(t *testing.T) {
 	ref, tmpDir := refToTempOCI(t)
 	defer os.RemoveAll(tmpDir)
-	err := ref.DeleteImage(context.Background(), nil)
+
+	// Shared blob directories are not supported
+	err := ref.DeleteImage(context.Background(), &types.SystemContext{OCISharedBlobDirPath: tmpDir})
+	assert.Error(t, err)
+	// Unknown image
+	missingRef, err := NewReference(tmpDir, "this-does-not-exist")
+	require.NoError(t, err)
+	err = missingRef.DeleteImage(context.Background(), nil)
+	assert.Error(t, err)
+
+	err = ref.DeleteImage(context.Background(), nil)
+	require.NoError(t, err)
+	index, err := ref.(ociReference).getIndex()
+	require.NoError(t, err)
+	assert.Empty(t, index.Manifests)
+	// The image no longer exists
+	err = ref.DeleteImage(context.Background(), nil)
 	assert.Error(t, err)
 }
 
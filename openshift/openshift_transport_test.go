@@ -112,6 +112,8 @@ func TestReferencePolicyConfigurationNamespaces(t *testing.T) {
 		"registry.example.com:8443/ns/stream",
 		"registry.example.com:8443/ns",
 		"registry.example.com:8443",
+		"*.example.com",
+		"*.com",
 	}, ref.PolicyConfigurationNamespaces())
 }
 
@@ -0,0 +1,369 @@
+package blobinfocache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containers/image/types"
+	"github.com/containers/storage/pkg/lockfile"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// fileFormatVersion is the version of the on-disk format written by fileCache.
+	fileFormatVersion = 1
+	// fileLocationMaxAge is the time after which a known location which has not been seen again is dropped.
+	fileLocationMaxAge = 30 * 24 * time.Hour
+	// fileLocationsPerBlobLimit is the maximum number of known locations kept for a single (transport, scope, digest);
+	// CandidateLocations never returns more than a few of them anyway.
+	fileLocationsPerBlobLimit = 10
+	// fileLocationsLimit is the maximum number of known locations kept in the file.
+	fileLocationsLimit = 10000
+	// fileLastSeenGranularity is the time within which a known location seen again is not recorded again,
+	// to avoid rewriting the file when the same blobs are used repeatedly.
+	fileLastSeenGranularity = time.Hour
+)
+
+// fileContents is the on-disk representation of the data recorded by fileCache.
+type fileContents struct {
+	Version             int                             `json:"version"`
+	UncompressedDigests map[digest.Digest]digest.Digest `json:"uncompressedDigests,omitempty"`
+	KnownLocations      []fileKnownLocation             `json:"knownLocations,omitempty"`
+	Compressors         map[digest.Digest]string        `json:"compressors,omitempty"`
+}
+
+// fileKnownLocation is the on-disk representation of a single known location of a blob.
+type fileKnownLocation struct {
+	Transport string        `json:"transport"`
+	Scope     string        `json:"scope"`
+	Digest    digest.Digest `json:"digest"`
+	Location  string        `json:"location"`
+	LastSeen  time.Time     `json:"lastSeen"`
+}
+
+// fileCache is a BlobInfoCache stored in a single JSON file.
+// The file may be shared by several processes; all accesses are serialized using a lock file next to it.
+// The parsed contents are kept in memory, and the file is only read again after it is replaced by another process;
+// updates are only written if they change the recorded data, and concurrent updates are written together.
+// Known locations are pruned by age and count whenever the file is written.
+type fileCache struct {
+	path string
+	lock lockfile.Locker // Serializes accesses to the file by different processes
+
+	pendingMutex sync.Mutex   // Protects pending
+	pending      []fileUpdate // Updates waiting to be written
+
+	mutex    sync.Mutex  // Serializes accesses to the file within this process, and protects the fields below
+	data     *cacheData  // Contents of the file, as of dataStat; nil if not loaded
+	dataStat os.FileInfo // The state of the file when data was loaded or written
+}
+
+// fileUpdate modifies data, and returns true if it was changed and the file needs to be written.
+type fileUpdate func(data *cacheData) bool
+
+// NewFileCache returns a BlobInfoCache implementation which uses a JSON file at path.
+//
+// Most users should call DefaultCache instead.
+func NewFileCache(path string) (types.BlobInfoCache, error) {
+	lock, err := lockfile.GetLockfile(path + ".lock")
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating lock file for blob info cache at %s", path)
+	}
+	return &fileCache{path: path, lock: lock}, nil
+}
+
+// load returns the data currently stored in the file.
+// The caller must hold fc.lock.
+func (fc *fileCache) load() (*cacheData, error) {
+	data := newCacheData()
+	blob, err := ioutil.ReadFile(fc.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return data, nil
+		}
+		return nil, err
+	}
+	var contents fileContents
+	if err := json.Unmarshal(blob, &contents); err != nil {
+		return nil, errors.Wrapf(err, "error parsing blob info cache %s", fc.path)
+	}
+	if contents.Version != fileFormatVersion {
+		// Don't fail hard; a different version of the code may have written the file, so just start anew.
+		logrus.Debugf("Ignoring blob info cache %s with unknown version %d", fc.path, contents.Version)
+		return data, nil
+	}
+	for anyDigest, uncompressed := range contents.UncompressedDigests {
+		data.recordDigestUncompressedPair(anyDigest, uncompressed)
+	}
+	for _, l := range contents.KnownLocations {
+		data.recordKnownLocation(l.Transport, types.BICTransportScope{Opaque: l.Scope}, l.Digest, types.BICLocationReference{Opaque: l.Location}, l.LastSeen)
+	}
+	for anyDigest, compressorName := range contents.Compressors {
+		data.recordDigestCompressorName(anyDigest, compressorName)
+	}
+	return data, nil
+}
+
+// save atomically replaces the file with data.
+// The caller must hold fc.lock.
+func (fc *fileCache) save(data *cacheData) error {
+	contents := fileContents{
+		Version:             fileFormatVersion,
+		UncompressedDigests: data.uncompressedDigests,
+		KnownLocations:      []fileKnownLocation{},
+		Compressors:         data.compressors,
+	}
+	for key, locations := range data.knownLocations {
+		for location, lastSeen := range locations {
+			contents.KnownLocations = append(contents.KnownLocations, fileKnownLocation{
+				Transport: key.transport,
+				Scope:     key.scope.Opaque,
+				Digest:    key.blobDigest,
+				Location:  location.Opaque,
+				LastSeen:  lastSeen,
+			})
+		}
+	}
+	blob, err := json.Marshal(contents)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fc.path), filepath.Base(fc.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			os.Remove(tmpPath)
+		}
+	}()
+	if _, err := tmp.Write(blob); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, fc.path); err != nil {
+		return err
+	}
+	succeeded = true
+	return nil
+}
+
+// current returns the current contents of the file, reusing fc.data if the file has not been modified since it was loaded.
+// The returned value may be modified only if the result is written back by the caller.
+// The caller must hold fc.mutex and fc.lock.
+func (fc *fileCache) current() (*cacheData, error) {
+	fi, err := os.Stat(fc.path)
+	if err != nil {
+		fc.data, fc.dataStat = nil, nil
+		if os.IsNotExist(err) {
+			return newCacheData(), nil
+		}
+		return nil, err
+	}
+	// save always replaces the file, so comparing the identity of the file is sufficient for our own writes; the modification time
+	// and size help to notice other kinds of modifications.
+	if fc.data != nil && os.SameFile(fi, fc.dataStat) && fi.ModTime().Equal(fc.dataStat.ModTime()) && fi.Size() == fc.dataStat.Size() {
+		return fc.data, nil
+	}
+	data, err := fc.load()
+	if err != nil {
+		fc.data, fc.dataStat = nil, nil
+		return nil, err
+	}
+	fc.data, fc.dataStat = data, fi
+	return data, nil
+}
+
+// view calls fn with the current contents of the cache.
+// fn must not modify data.
+func (fc *fileCache) view(fn func(data *cacheData)) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	data, err := fc.current()
+	if err != nil {
+		logrus.Debugf("Error reading blob info cache %s: %v", fc.path, err)
+		data = newCacheData()
+	}
+	fn(data)
+}
+
+// update applies fn to the current contents of the cache, and writes the result back if necessary.
+// Updates by concurrent callers are applied and written together.
+func (fc *fileCache) update(fn fileUpdate) {
+	fc.pendingMutex.Lock()
+	fc.pending = append(fc.pending, fn)
+	fc.pendingMutex.Unlock()
+
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.pendingMutex.Lock()
+	pending := fc.pending
+	fc.pending = nil
+	fc.pendingMutex.Unlock()
+	if len(pending) == 0 {
+		return // Another caller has already handled fn together with its own update.
+	}
+
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	data, err := fc.current()
+	if err != nil {
+		// Don't overwrite data we can't read; the cache is only an optimization, so just don't record anything.
+		logrus.Debugf("Error reading blob info cache %s: %v", fc.path, err)
+		return
+	}
+	changed := false
+	for _, fn := range pending {
+		if fn(data) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	pruneKnownLocations(data, time.Now())
+	if err := fc.save(data); err != nil {
+		logrus.Debugf("Error writing blob info cache %s: %v", fc.path, err)
+		fc.data, fc.dataStat = nil, nil // data no longer matches the file.
+		return
+	}
+	fi, err := os.Stat(fc.path)
+	if err != nil {
+		logrus.Debugf("Error reading blob info cache %s: %v", fc.path, err)
+		fc.data, fc.dataStat = nil, nil
+		return
+	}
+	fc.data, fc.dataStat = data, fi
+}
+
+// pruneKnownLocations removes known locations last seen more than fileLocationMaxAge before now from data,
+// and then the least recently seen ones beyond fileLocationsPerBlobLimit for each blob, and fileLocationsLimit in total.
+func pruneKnownLocations(data *cacheData, now time.Time) {
+	type knownLocation struct {
+		key      locationKey
+		location types.BICLocationReference
+		lastSeen time.Time
+	}
+	newestFirst := func(locations []knownLocation) {
+		sort.Slice(locations, func(i, j int) bool { return locations[i].lastSeen.After(locations[j].lastSeen) })
+	}
+	remove := func(l knownLocation) {
+		delete(data.knownLocations[l.key], l.location)
+		if len(data.knownLocations[l.key]) == 0 {
+			delete(data.knownLocations, l.key)
+		}
+	}
+
+	cutoff := now.Add(-fileLocationMaxAge)
+	all := []knownLocation{}
+	for key, locations := range data.knownLocations {
+		blobLocations := []knownLocation{}
+		for location, lastSeen := range locations {
+			blobLocations = append(blobLocations, knownLocation{key: key, location: location, lastSeen: lastSeen})
+		}
+		newestFirst(blobLocations)
+		for i, l := range blobLocations {
+			if i >= fileLocationsPerBlobLimit || l.lastSeen.Before(cutoff) {
+				remove(l)
+			} else {
+				all = append(all, l)
+			}
+		}
+	}
+	if len(all) > fileLocationsLimit {
+		newestFirst(all)
+		for _, l := range all[fileLocationsLimit:] {
+			remove(l)
+		}
+	}
+}
+
+// UncompressedDigest returns an uncompressed digest corresponding to anyDigest.
+// May return anyDigest if it is known to be uncompressed.
+// Returns "" if nothing is known about the digest (it may be compressed or uncompressed).
+func (fc *fileCache) UncompressedDigest(anyDigest digest.Digest) digest.Digest {
+	var res digest.Digest
+	fc.view(func(data *cacheData) {
+		res = data.uncompressedDigest(anyDigest)
+	})
+	return res
+}
+
+// RecordDigestUncompressedPair records that uncompressed is the uncompressed version of anyDigest.
+// It’s allowed for anyDigest == uncompressed.
+// WARNING: Only call this for LOCALLY VERIFIED data; don’t record a digest pair just because some remote author claims so (e.g.
+// because a manifest/config pair exists); otherwise the cache could be poisoned and allow substituting unexpected blobs.
+// (Eventually, the DiffIDs in image config could detect the substitution, but that may be too late, and not all image formats contain that data.)
+func (fc *fileCache) RecordDigestUncompressedPair(anyDigest digest.Digest, uncompressed digest.Digest) {
+	fc.update(func(data *cacheData) bool {
+		if data.uncompressedDigests[anyDigest] == uncompressed {
+			return false
+		}
+		data.recordDigestUncompressedPair(anyDigest, uncompressed)
+		return true
+	})
+}
+
+// RecordKnownLocation records that a blob with the specified digest exists within the specified (transport, scope) scope,
+// and can be reused given the opaque location data.
+func (fc *fileCache) RecordKnownLocation(transport types.ImageTransport, scope types.BICTransportScope, blobDigest digest.Digest, location types.BICLocationReference) {
+	now := time.Now()
+	fc.update(func(data *cacheData) bool {
+		lastSeen, ok := data.knownLocations[locationKey{transport: transport.Name(), scope: scope, blobDigest: blobDigest}][location]
+		if ok && now.Sub(lastSeen) < fileLastSeenGranularity {
+			return false
+		}
+		data.recordKnownLocation(transport.Name(), scope, blobDigest, location, now)
+		return true
+	})
+}
+
+// RecordDigestCompressorName records that the blob with anyDigest is compressed using compressorName, or is uncompressed.
+// WARNING: Only call this for LOCALLY VERIFIED data; see blobinfocache.BlobInfoCache2.
+func (fc *fileCache) RecordDigestCompressorName(anyDigest digest.Digest, compressorName string) {
+	fc.update(func(data *cacheData) bool {
+		if data.digestCompressorName(anyDigest) == compressorName {
+			return false
+		}
+		data.recordDigestCompressorName(anyDigest, compressorName)
+		return true
+	})
+}
+
+// DigestCompressorName returns the compressor name recorded for anyDigest, or "" if nothing is known.
+func (fc *fileCache) DigestCompressorName(anyDigest digest.Digest) string {
+	var res string
+	fc.view(func(data *cacheData) {
+		res = data.digestCompressorName(anyDigest)
+	})
+	return res
+}
+
+// CandidateLocations returns a prioritized, limited, number of blobs and their locations that could possibly be reused
+// within the specified (transport scope) (if they still exist, which is not guaranteed).
+//
+// If !canSubstitute, the returned candidates will match the submitted digest exactly; if canSubstitute,
+// data from previous RecordDigestUncompressedPair calls is used to also look up variants of the blob which have the same
+// uncompressed digest.
+func (fc *fileCache) CandidateLocations(transport types.ImageTransport, scope types.BICTransportScope, primaryDigest digest.Digest, canSubstitute bool) []types.BICReplacementCandidate {
+	var res []types.BICReplacementCandidate
+	fc.view(func(data *cacheData) {
+		res = data.candidateLocations(transport.Name(), scope, primaryDigest, canSubstitute)
+	})
+	return res
+}
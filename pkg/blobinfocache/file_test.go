@@ -0,0 +1,196 @@
+package blobinfocache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFileCache(t *testing.T) types.BlobInfoCache {
+	tmpDir, err := ioutil.TempDir("", "blobinfocache-file")
+	require.NoError(t, err)
+	// The directory is not removed; t.Run does not give us a convenient hook, and it is in the temporary directory anyway.
+	cache, err := NewFileCache(filepath.Join(tmpDir, "cache.json"))
+	require.NoError(t, err)
+	return cache
+}
+
+func TestNewFileCache(t *testing.T) {
+	testGenericCache(t, newTestFileCache)
+}
+
+func TestFileCachePersistence(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "blobinfocache-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "cache.json")
+	transport := mockTransport{"==BlobInfocache transport mock"}
+	scope := types.BICTransportScope{Opaque: "scope"}
+	location := types.BICLocationReference{Opaque: "location"}
+
+	// Data recorded through one instance is visible through another one.
+	cache1, err := NewFileCache(path)
+	require.NoError(t, err)
+	cache2, err := NewFileCache(path)
+	require.NoError(t, err)
+	cache1.RecordDigestUncompressedPair(digestCompressedA, digestUncompressed)
+	cache2.RecordKnownLocation(transport, scope, digestCompressedA, location)
+	for _, cache := range []types.BlobInfoCache{cache1, cache2} {
+		assert.Equal(t, digestUncompressed, cache.UncompressedDigest(digestCompressedA))
+		assert.Equal(t, []types.BICReplacementCandidate{{Digest: digestCompressedA, Location: location}},
+			cache.CandidateLocations(transport, scope, digestCompressedA, false))
+	}
+
+	// Unreadable or unknown data is ignored.
+	for _, contents := range []string{"}this is invalid JSON", `{"version":999}`} {
+		err = ioutil.WriteFile(path, []byte(contents), 0600)
+		require.NoError(t, err)
+		assert.Equal(t, []types.BICReplacementCandidate{}, cache1.CandidateLocations(transport, scope, digestCompressedA, false))
+	}
+}
+
+// readTestFileCache returns the contents of the cache file at path.
+func readTestFileCache(t *testing.T, path string) fileContents {
+	blob, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var contents fileContents
+	err = json.Unmarshal(blob, &contents)
+	require.NoError(t, err)
+	return contents
+}
+
+func TestFileCacheRedundantWrites(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "blobinfocache-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "cache.json")
+	transport := mockTransport{"==BlobInfocache transport mock"}
+	scope := types.BICTransportScope{Opaque: "scope"}
+
+	cache, err := NewFileCache(path)
+	require.NoError(t, err)
+	cache.RecordDigestUncompressedPair(digestCompressedA, digestUncompressed)
+	cache.RecordKnownLocation(transport, scope, digestCompressedA, types.BICLocationReference{Opaque: "location"})
+	fi1, err := os.Stat(path)
+	require.NoError(t, err)
+
+	// Recording the same data again does not rewrite the file
+	cache.RecordDigestUncompressedPair(digestCompressedA, digestUncompressed)
+	cache.RecordKnownLocation(transport, scope, digestCompressedA, types.BICLocationReference{Opaque: "location"})
+	fi2, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(fi1, fi2))
+
+	// New data does
+	cache.RecordKnownLocation(transport, scope, digestCompressedA, types.BICLocationReference{Opaque: "location2"})
+	fi3, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.False(t, os.SameFile(fi2, fi3))
+	assert.Len(t, readTestFileCache(t, path).KnownLocations, 2)
+}
+
+func TestFileCacheConcurrentUpdates(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "blobinfocache-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "cache.json")
+	transport := mockTransport{"==BlobInfocache transport mock"}
+	scope := types.BICTransportScope{Opaque: "scope"}
+
+	caches := []types.BlobInfoCache{}
+	for i := 0; i < 2; i++ {
+		cache, err := NewFileCache(path)
+		require.NoError(t, err)
+		caches = append(caches, cache)
+	}
+	const count = 50
+	wg := sync.WaitGroup{}
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			caches[i%len(caches)].RecordKnownLocation(transport, scope, digestCompressedA, types.BICLocationReference{Opaque: fmt.Sprintf("location%d", i)})
+		}(i)
+	}
+	wg.Wait()
+
+	// All updates were written; fileLocationsPerBlobLimit applies, so use a different digest for each location.
+	contents := readTestFileCache(t, path)
+	assert.Len(t, contents.KnownLocations, fileLocationsPerBlobLimit)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			caches[i%len(caches)].RecordKnownLocation(transport, scope, digest.FromString(fmt.Sprint(i)), types.BICLocationReference{Opaque: "location"})
+		}(i)
+	}
+	wg.Wait()
+	contents = readTestFileCache(t, path)
+	assert.Len(t, contents.KnownLocations, fileLocationsPerBlobLimit+count)
+}
+
+func TestFileCachePruning(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "blobinfocache-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "cache.json")
+	transport := mockTransport{"==BlobInfocache transport mock"}
+	now := time.Now()
+
+	contents := fileContents{
+		Version: fileFormatVersion,
+		KnownLocations: []fileKnownLocation{
+			{Transport: transport.Name(), Scope: "scope", Digest: digestCompressedA, Location: "expired", LastSeen: now.Add(-fileLocationMaxAge - time.Hour)},
+		},
+	}
+	// More than fileLocationsPerBlobLimit locations for digestCompressedB, B0 being the most recent one
+	for i := 0; i < fileLocationsPerBlobLimit+2; i++ {
+		contents.KnownLocations = append(contents.KnownLocations, fileKnownLocation{
+			Transport: transport.Name(), Scope: "scope", Digest: digestCompressedB, Location: fmt.Sprintf("B%d", i), LastSeen: now.Add(-time.Hour - time.Duration(i)*time.Minute),
+		})
+	}
+	// fileLocationsLimit older locations for other digests
+	for i := 0; i < fileLocationsLimit; i++ {
+		contents.KnownLocations = append(contents.KnownLocations, fileKnownLocation{
+			Transport: transport.Name(), Scope: "scope", Digest: digest.FromString(fmt.Sprint(i)), Location: "other", LastSeen: now.Add(-2*time.Hour - time.Duration(i)*time.Second),
+		})
+	}
+	blob, err := json.Marshal(contents)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(path, blob, 0600)
+	require.NoError(t, err)
+
+	cache, err := NewFileCache(path)
+	require.NoError(t, err)
+	cache.RecordKnownLocation(transport, types.BICTransportScope{Opaque: "scope"}, digestCompressedA, types.BICLocationReference{Opaque: "new"})
+
+	contents = readTestFileCache(t, path)
+	assert.Len(t, contents.KnownLocations, fileLocationsLimit)
+	locationsA, locationsB := []string{}, []string{}
+	others := 0
+	for _, l := range contents.KnownLocations {
+		switch l.Digest {
+		case digestCompressedA:
+			locationsA = append(locationsA, l.Location)
+		case digestCompressedB:
+			locationsB = append(locationsB, l.Location)
+		default:
+			others++
+		}
+	}
+	assert.Equal(t, []string{"new"}, locationsA)
+	sort.Strings(locationsB)
+	assert.Equal(t, []string{"B0", "B1", "B2", "B3", "B4", "B5", "B6", "B7", "B8", "B9"}, locationsB)
+	assert.Equal(t, fileLocationsLimit-1-fileLocationsPerBlobLimit, others)
+}
@@ -0,0 +1,195 @@
+package blobinfocache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// locationKey only exists to make lookup in knownLocations easier.
+type locationKey struct {
+	transport  string
+	scope      types.BICTransportScope
+	blobDigest digest.Digest
+}
+
+// cacheData is the data recorded by a BlobInfoCache, without any synchronization.
+type cacheData struct {
+	uncompressedDigests   map[digest.Digest]digest.Digest
+	digestsByUncompressed map[digest.Digest]map[digest.Digest]struct{}             // stores a set of digests for each uncompressed digest
+	knownLocations        map[locationKey]map[types.BICLocationReference]time.Time // stores last known existence time for each location reference
+	compressors           map[digest.Digest]string                                 // stores a compressor name, or blobinfocache.Uncompressed, for each digest
+}
+
+// newCacheData returns an empty cacheData.
+func newCacheData() *cacheData {
+	return &cacheData{
+		uncompressedDigests:   map[digest.Digest]digest.Digest{},
+		digestsByUncompressed: map[digest.Digest]map[digest.Digest]struct{}{},
+		knownLocations:        map[locationKey]map[types.BICLocationReference]time.Time{},
+		compressors:           map[digest.Digest]string{},
+	}
+}
+
+// uncompressedDigest implements types.BlobInfoCache.UncompressedDigest.
+func (d *cacheData) uncompressedDigest(anyDigest digest.Digest) digest.Digest {
+	if uncompressed, ok := d.uncompressedDigests[anyDigest]; ok {
+		return uncompressed
+	}
+	// Presence in digestsByUncompressed implies that anyDigest must already refer to an uncompressed digest.
+	// This way we don't have to waste storage space with trivial (uncompressed, uncompressed) mappings
+	// when we already record a (compressed, uncompressed) pair.
+	if m, ok := d.digestsByUncompressed[anyDigest]; ok && len(m) > 0 {
+		return anyDigest
+	}
+	return ""
+}
+
+// recordDigestUncompressedPair implements types.BlobInfoCache.RecordDigestUncompressedPair.
+func (d *cacheData) recordDigestUncompressedPair(anyDigest digest.Digest, uncompressed digest.Digest) {
+	if previous, ok := d.uncompressedDigests[anyDigest]; ok && previous != uncompressed {
+		logrus.Warnf("Uncompressed digest for blob %s previously recorded as %s, now %s", anyDigest, previous, uncompressed)
+	}
+	d.uncompressedDigests[anyDigest] = uncompressed
+
+	anyDigestSet, ok := d.digestsByUncompressed[uncompressed]
+	if !ok {
+		anyDigestSet = map[digest.Digest]struct{}{}
+		d.digestsByUncompressed[uncompressed] = anyDigestSet
+	}
+	anyDigestSet[anyDigest] = struct{}{} // Possibly writing the same struct{}{} presence marker again.
+}
+
+// recordKnownLocation implements types.BlobInfoCache.RecordKnownLocation, recording that the location was seen at when.
+func (d *cacheData) recordKnownLocation(transport string, scope types.BICTransportScope, blobDigest digest.Digest, location types.BICLocationReference, when time.Time) {
+	key := locationKey{transport: transport, scope: scope, blobDigest: blobDigest}
+	locationScope, ok := d.knownLocations[key]
+	if !ok {
+		locationScope = map[types.BICLocationReference]time.Time{}
+		d.knownLocations[key] = locationScope
+	}
+	if previous, ok := locationScope[location]; !ok || previous.Before(when) {
+		locationScope[location] = when
+	}
+}
+
+// recordDigestCompressorName implements blobinfocache.BlobInfoCache2.RecordDigestCompressorName.
+func (d *cacheData) recordDigestCompressorName(anyDigest digest.Digest, compressorName string) {
+	if previous, ok := d.compressors[anyDigest]; ok && previous != compressorName {
+		logrus.Warnf("Compressor for blob %s previously recorded as %s, now %s", anyDigest, previous, compressorName)
+	}
+	d.compressors[anyDigest] = compressorName
+}
+
+// digestCompressorName implements blobinfocache.BlobInfoCache2.DigestCompressorName.
+func (d *cacheData) digestCompressorName(anyDigest digest.Digest) string {
+	return d.compressors[anyDigest] // "" == blobinfocache.UnknownCompression if not present
+}
+
+// appendReplacementCandidates creates candidateWithTime values for (transport, scope, digest), and returns the result of appending them to candidates.
+func (d *cacheData) appendReplacementCandidates(candidates []candidateWithTime, transport string, scope types.BICTransportScope, blobDigest digest.Digest) []candidateWithTime {
+	locations := d.knownLocations[locationKey{transport: transport, scope: scope, blobDigest: blobDigest}] // nil if not present
+	for l, t := range locations {
+		candidates = append(candidates, candidateWithTime{
+			candidate: types.BICReplacementCandidate{
+				Digest:   blobDigest,
+				Location: l,
+			},
+			lastSeen: t,
+		})
+	}
+	return candidates
+}
+
+// candidateLocations implements types.BlobInfoCache.CandidateLocations.
+func (d *cacheData) candidateLocations(transport string, scope types.BICTransportScope, primaryDigest digest.Digest, canSubstitute bool) []types.BICReplacementCandidate {
+	res := []candidateWithTime{}
+	res = d.appendReplacementCandidates(res, transport, scope, primaryDigest)
+	var uncompressedDigest digest.Digest // = ""
+	if canSubstitute {
+		if uncompressedDigest = d.uncompressedDigest(primaryDigest); uncompressedDigest != "" {
+			otherDigests := d.digestsByUncompressed[uncompressedDigest] // nil if not present in the map
+			for d2 := range otherDigests {
+				if d2 != primaryDigest && d2 != uncompressedDigest {
+					res = d.appendReplacementCandidates(res, transport, scope, d2)
+				}
+			}
+			if uncompressedDigest != primaryDigest {
+				res = d.appendReplacementCandidates(res, transport, scope, uncompressedDigest)
+			}
+		}
+	}
+	return destructivelyPrioritizeReplacementCandidates(res, primaryDigest, uncompressedDigest)
+}
+
+// memoryCache implements an in-memory-only BlobInfoCache
+type memoryCache struct {
+	mutex sync.Mutex // synchronizes concurrent accesses
+	data  *cacheData
+}
+
+// NewMemoryCache returns a BlobInfoCache implementation which is in-memory only.
+// This is primarily intended for tests, but also used as a fallback if DefaultCache
+// can’t determine, or set up, the location for a persistent cache.
+// Manual users of types.{ImageSource,ImageDestination} might also use this instead of a persistent cache.
+func NewMemoryCache() types.BlobInfoCache {
+	return &memoryCache{data: newCacheData()}
+}
+
+// UncompressedDigest returns an uncompressed digest corresponding to anyDigest.
+// May return anyDigest if it is known to be uncompressed.
+// Returns "" if nothing is known about the digest (it may be compressed or uncompressed).
+func (mem *memoryCache) UncompressedDigest(anyDigest digest.Digest) digest.Digest {
+	mem.mutex.Lock()
+	defer mem.mutex.Unlock()
+	return mem.data.uncompressedDigest(anyDigest)
+}
+
+// RecordDigestUncompressedPair records that uncompressed is the uncompressed version of anyDigest.
+// It’s allowed for anyDigest == uncompressed.
+// WARNING: Only call this for LOCALLY VERIFIED data; don’t record a digest pair just because some remote author claims so (e.g.
+// because a manifest/config pair exists); otherwise the cache could be poisoned and allow substituting unexpected blobs.
+// (Eventually, the DiffIDs in image config could detect the substitution, but that may be too late, and not all image formats contain that data.)
+func (mem *memoryCache) RecordDigestUncompressedPair(anyDigest digest.Digest, uncompressed digest.Digest) {
+	mem.mutex.Lock()
+	defer mem.mutex.Unlock()
+	mem.data.recordDigestUncompressedPair(anyDigest, uncompressed)
+}
+
+// RecordKnownLocation records that a blob with the specified digest exists within the specified (transport, scope) scope,
+// and can be reused given the opaque location data.
+func (mem *memoryCache) RecordKnownLocation(transport types.ImageTransport, scope types.BICTransportScope, blobDigest digest.Digest, location types.BICLocationReference) {
+	mem.mutex.Lock()
+	defer mem.mutex.Unlock()
+	mem.data.recordKnownLocation(transport.Name(), scope, blobDigest, location, time.Now())
+}
+
+// RecordDigestCompressorName records that the blob with anyDigest is compressed using compressorName, or is uncompressed.
+// WARNING: Only call this for LOCALLY VERIFIED data; see blobinfocache.BlobInfoCache2.
+func (mem *memoryCache) RecordDigestCompressorName(anyDigest digest.Digest, compressorName string) {
+	mem.mutex.Lock()
+	defer mem.mutex.Unlock()
+	mem.data.recordDigestCompressorName(anyDigest, compressorName)
+}
+
+// DigestCompressorName returns the compressor name recorded for anyDigest, or "" if nothing is known.
+func (mem *memoryCache) DigestCompressorName(anyDigest digest.Digest) string {
+	mem.mutex.Lock()
+	defer mem.mutex.Unlock()
+	return mem.data.digestCompressorName(anyDigest)
+}
+
+// CandidateLocations returns a prioritized, limited, number of blobs and their locations that could possibly be reused
+// within the specified (transport scope) (if they still exist, which is not guaranteed).
+//
+// If !canSubstitute, the returned candidates will match the submitted digest exactly; if canSubstitute,
+// data from previous RecordDigestUncompressedPair calls is used to also look up variants of the blob which have the same
+// uncompressed digest.
+func (mem *memoryCache) CandidateLocations(transport types.ImageTransport, scope types.BICTransportScope, primaryDigest digest.Digest, canSubstitute bool) []types.BICReplacementCandidate {
+	mem.mutex.Lock()
+	defer mem.mutex.Unlock()
+	return mem.data.candidateLocations(transport.Name(), scope, primaryDigest, canSubstitute)
+}
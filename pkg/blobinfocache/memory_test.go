@@ -0,0 +1,15 @@
+package blobinfocache
+
+import (
+	"testing"
+
+	"github.com/containers/image/types"
+)
+
+func newTestMemoryCache(t *testing.T) types.BlobInfoCache {
+	return NewMemoryCache()
+}
+
+func TestNewMemoryCache(t *testing.T) {
+	testGenericCache(t, newTestMemoryCache)
+}
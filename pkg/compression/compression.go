@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/ulikunitz/xz"
@@ -35,32 +36,98 @@ func XzDecompressor(r io.Reader) (io.ReadCloser, error) {
 	return ioutil.NopCloser(r), nil
 }
 
-// compressionAlgos is an internal implementation detail of DetectCompression
-var compressionAlgos = map[string]struct {
+// ZstdDecompressor is a DecompressorFunc for the zstd compression algorithm.
+func ZstdDecompressor(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+// compressorFunc writes the compressed stream to the given writer.
+type compressorFunc func(io.Writer) (io.WriteCloser, error)
+
+// gzipCompressor is a compressorFunc for the gzip compression algorithm.
+func gzipCompressor(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+// xzCompressor is a compressorFunc for the xz compression algorithm.
+func xzCompressor(w io.Writer) (io.WriteCloser, error) {
+	return xz.NewWriter(w)
+}
+
+// zstdCompressor is a compressorFunc for the zstd compression algorithm.
+func zstdCompressor(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+// Algorithm is a compression algorithm that can be used for CompressStream.
+type Algorithm struct {
+	name         string
 	prefix       []byte
 	decompressor DecompressorFunc
-}{
-	"gzip":  {[]byte{0x1F, 0x8B, 0x08}, GzipDecompressor},                 // gzip (RFC 1952)
-	"bzip2": {[]byte{0x42, 0x5A, 0x68}, Bzip2Decompressor},                // bzip2 (decompress.c:BZ2_decompress)
-	"xz":    {[]byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}, XzDecompressor}, // xz (/usr/share/doc/xz/xz-file-format.txt)
+	compressor   compressorFunc // nil if compressing is not supported
 }
 
-// DetectCompression returns a DecompressorFunc if the input is recognized as a compressed format, nil otherwise.
+// Name returns the name for the compression algorithm.
+func (c Algorithm) Name() string {
+	return c.name
+}
+
+var (
+	// Gzip compression.
+	Gzip = Algorithm{"gzip", []byte{0x1F, 0x8B, 0x08}, GzipDecompressor, gzipCompressor} // gzip (RFC 1952)
+	// Bzip2 compression.  Only decompression is supported.
+	Bzip2 = Algorithm{"bzip2", []byte{0x42, 0x5A, 0x68}, Bzip2Decompressor, nil} // bzip2 (decompress.c:BZ2_decompress)
+	// Xz compression.
+	Xz = Algorithm{"xz", []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}, XzDecompressor, xzCompressor} // xz (/usr/share/doc/xz/xz-file-format.txt)
+	// Zstd compression.
+	Zstd = Algorithm{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}, ZstdDecompressor, zstdCompressor} // zstd (http://www.zstd.net)
+)
+
+// compressionAlgorithms is an internal implementation detail of DetectCompressionFormat and AlgorithmByName
+var compressionAlgorithms = []Algorithm{Gzip, Bzip2, Xz, Zstd}
+
+// AlgorithmByName returns the compression algorithm with name, or an error if it is not known.
+func AlgorithmByName(name string) (Algorithm, error) {
+	for _, algo := range compressionAlgorithms {
+		if algo.name == name {
+			return algo, nil
+		}
+	}
+	return Algorithm{}, errors.Errorf("cannot find compressor for %q", name)
+}
+
+// CompressStream returns a writer which compresses data written to it using algo, and writes the result to dest.
+// The caller must call Close() on the returned writer to flush all compressed data.
+func CompressStream(dest io.Writer, algo Algorithm) (io.WriteCloser, error) {
+	if algo.compressor == nil {
+		return nil, errors.Errorf("compressing with %s is not supported", algo.name)
+	}
+	return algo.compressor(dest)
+}
+
+// DetectCompressionFormat returns a DecompressorFunc if the input is recognized as a compressed format, nil otherwise,
+// along with the detected Algorithm (the zero value if the input is not compressed).
 // Because it consumes the start of input, other consumers must use the returned io.Reader instead to also read from the beginning.
-func DetectCompression(input io.Reader) (DecompressorFunc, io.Reader, error) {
+func DetectCompressionFormat(input io.Reader) (Algorithm, DecompressorFunc, io.Reader, error) {
 	buffer := [8]byte{}
 
 	n, err := io.ReadAtLeast(input, buffer[:], len(buffer))
 	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		// This is a “real” error. We could just ignore it this time, process the data we have, and hope that the source will report the same error again.
 		// Instead, fail immediately with the original error cause instead of a possibly secondary/misleading error returned later.
-		return nil, nil, err
+		return Algorithm{}, nil, nil, err
 	}
 
+	var retAlgo Algorithm
 	var decompressor DecompressorFunc
-	for name, algo := range compressionAlgos {
+	for _, algo := range compressionAlgorithms {
 		if bytes.HasPrefix(buffer[:n], algo.prefix) {
-			logrus.Debugf("Detected compression format %s", name)
+			logrus.Debugf("Detected compression format %s", algo.name)
+			retAlgo = algo
 			decompressor = algo.decompressor
 			break
 		}
@@ -69,7 +136,14 @@ func DetectCompression(input io.Reader) (DecompressorFunc, io.Reader, error) {
 		logrus.Debugf("No compression detected")
 	}
 
-	return decompressor, io.MultiReader(bytes.NewReader(buffer[:n]), input), nil
+	return retAlgo, decompressor, io.MultiReader(bytes.NewReader(buffer[:n]), input), nil
+}
+
+// DetectCompression returns a DecompressorFunc if the input is recognized as a compressed format, nil otherwise.
+// Because it consumes the start of input, other consumers must use the returned io.Reader instead to also read from the beginning.
+func DetectCompression(input io.Reader) (DecompressorFunc, io.Reader, error) {
+	_, d, r, e := DetectCompressionFormat(input)
+	return d, r, e
 }
 
 // AutoDecompress takes a stream and returns an uncompressed version of the
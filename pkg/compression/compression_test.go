@@ -19,6 +19,7 @@ func TestDetectCompression(t *testing.T) {
 		"fixtures/Hello.gz",
 		"fixtures/Hello.bz2",
 		"fixtures/Hello.xz",
+		"fixtures/Hello.zst",
 	}
 
 	// The original stream is preserved.
@@ -87,6 +88,7 @@ func TestAutoDecompress(t *testing.T) {
 		{"fixtures/Hello.gz", true},
 		{"fixtures/Hello.bz2", true},
 		{"fixtures/Hello.xz", true},
+		{"fixtures/Hello.zst", true},
 	}
 
 	// The correct decompressor is chosen, and the result is as expected.
@@ -125,3 +127,63 @@ func TestAutoDecompress(t *testing.T) {
 	_, _, err = AutoDecompress(reader)
 	assert.Error(t, err)
 }
+
+func TestDetectCompressionFormat(t *testing.T) {
+	for _, c := range []struct {
+		filename string
+		expected string
+	}{
+		{"fixtures/Hello.uncompressed", ""},
+		{"fixtures/Hello.gz", Gzip.Name()},
+		{"fixtures/Hello.bz2", Bzip2.Name()},
+		{"fixtures/Hello.xz", Xz.Name()},
+		{"fixtures/Hello.zst", Zstd.Name()},
+	} {
+		stream, err := os.Open(c.filename)
+		require.NoError(t, err, c.filename)
+		defer stream.Close()
+
+		algo, decompressor, _, err := DetectCompressionFormat(stream)
+		require.NoError(t, err, c.filename)
+		assert.Equal(t, c.expected, algo.Name(), c.filename)
+		assert.Equal(t, c.expected != "", decompressor != nil, c.filename)
+	}
+}
+
+func TestAlgorithmByName(t *testing.T) {
+	for _, algo := range []Algorithm{Gzip, Bzip2, Xz, Zstd} {
+		res, err := AlgorithmByName(algo.Name())
+		require.NoError(t, err, algo.Name())
+		assert.Equal(t, algo.Name(), res.Name())
+	}
+	_, err := AlgorithmByName("this does not exist")
+	assert.Error(t, err)
+}
+
+func TestCompressStream(t *testing.T) {
+	// Compressing and detecting the compression round-trips.
+	for _, algo := range []Algorithm{Gzip, Xz, Zstd} {
+		var compressed bytes.Buffer
+		writer, err := CompressStream(&compressed, algo)
+		require.NoError(t, err, algo.Name())
+		_, err = writer.Write([]byte("Hello"))
+		require.NoError(t, err, algo.Name())
+		err = writer.Close()
+		require.NoError(t, err, algo.Name())
+
+		detected, decompressor, stream, err := DetectCompressionFormat(&compressed)
+		require.NoError(t, err, algo.Name())
+		assert.Equal(t, algo.Name(), detected.Name())
+		require.NotNil(t, decompressor, algo.Name())
+		uncompressedStream, err := decompressor(stream)
+		require.NoError(t, err, algo.Name())
+		defer uncompressedStream.Close()
+		uncompressedContents, err := ioutil.ReadAll(uncompressedStream)
+		require.NoError(t, err, algo.Name())
+		assert.Equal(t, []byte("Hello"), uncompressedContents, algo.Name())
+	}
+
+	// Algorithms without compression support are rejected.
+	_, err := CompressStream(ioutil.Discard, Bzip2)
+	assert.Error(t, err)
+}
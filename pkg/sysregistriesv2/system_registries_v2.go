@@ -4,12 +4,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 
 	"github.com/BurntSushi/toml"
+	"github.com/containers/image/docker/reference"
 	"github.com/containers/image/types"
+	"github.com/pkg/errors"
 )
 
 // systemRegistriesConfPath is the path to the system-wide registry
@@ -38,7 +41,7 @@ type Registry struct {
 	URL string `toml:"url"`
 	// The registry's mirrors.
 	Mirrors []Mirror `toml:"mirror"`
-	// If true, pulling from the registry will be blocked.
+	// If true, pulling from (or pushing to) the registry will be blocked.
 	Blocked bool `toml:"blocked"`
 	// If true, certs verification will be skipped and HTTP (non-TLS)
 	// connections will be allowed.
@@ -223,8 +226,8 @@ func postProcessRegistries(regs []Registry) ([]Registry, error) {
 		}
 
 		// make sure mirrors are valid
-		for _, mir := range reg.Mirrors {
-			mir.URL, err = parseURL(mir.URL)
+		for i := range reg.Mirrors {
+			reg.Mirrors[i].URL, err = parseURL(reg.Mirrors[i].URL)
 			if err != nil {
 				return nil, err
 			}
@@ -333,13 +336,30 @@ func FindUnqualifiedSearchRegistries(registries []Registry) []Registry {
 	return unqualified
 }
 
+// refMatchesPrefix returns true if ref, a reference or a registry host[:port], is within the namespace
+// identified by prefix, i.e. if prefix is a prefix of ref which ends at a path component boundary.
+func refMatchesPrefix(ref, prefix string) bool {
+	if !strings.HasPrefix(ref, prefix) {
+		return false
+	}
+	if len(ref) == len(prefix) {
+		return true
+	}
+	switch ref[len(prefix)] {
+	case '/', ':', '@':
+		return true
+	default:
+		return false
+	}
+}
+
 // FindRegistry returns the Registry with the longest prefix for ref.  If no
 // Registry prefixes the image, nil is returned.
 func FindRegistry(ref string, registries []Registry) *Registry {
 	reg := Registry{}
 	prefixLen := 0
 	for _, r := range registries {
-		if strings.HasPrefix(ref, r.Prefix) {
+		if refMatchesPrefix(ref, r.Prefix) {
 			length := len(r.Prefix)
 			if length > prefixLen {
 				reg = r
@@ -353,6 +373,59 @@ func FindRegistry(ref string, registries []Registry) *Registry {
 	return nil
 }
 
+// FindRegistryForReference loads the registries configuration specified by ctx, and returns the Registry with
+// the longest prefix for ref (a reference or a registry host[:port]).  If no Registry prefixes ref, nil is returned.
+// A missing configuration file is treated as an empty configuration, i.e. nil is returned for any ref.
+func FindRegistryForReference(ctx *types.SystemContext, ref string) (*Registry, error) {
+	registries, err := GetRegistries(ctx)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return FindRegistry(ref, registries), nil
+}
+
+// PullSource is a location an image can be pulled from.
+type PullSource struct {
+	// Reference is the image reference, rewritten to point to this location.
+	Reference reference.Named
+	// If true, certs verification will be skipped and HTTP (non-TLS)
+	// connections will be allowed for this location.
+	Insecure bool
+}
+
+// PullSourcesFromReference returns the locations ref, which must be within the namespace of reg.Prefix,
+// can be pulled from, in the order they should be tried: the mirrors of reg, followed by reg.URL itself.
+func (reg *Registry) PullSourcesFromReference(ref reference.Named) ([]PullSource, error) {
+	refString := ref.String()
+	if !refMatchesPrefix(refString, reg.Prefix) {
+		return nil, fmt.Errorf("reference %s does not match registry prefix %s", refString, reg.Prefix)
+	}
+	rewrite := func(location string) (reference.Named, error) {
+		rewritten, err := reference.ParseNamed(location + refString[len(reg.Prefix):])
+		if err != nil {
+			return nil, errors.Wrapf(err, "error rewriting reference %s for location %s", refString, location)
+		}
+		return rewritten, nil
+	}
+
+	sources := []PullSource{}
+	for _, mirror := range reg.Mirrors {
+		mirrorRef, err := rewrite(mirror.URL)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, PullSource{Reference: mirrorRef, Insecure: mirror.Insecure})
+	}
+	primaryRef, err := rewrite(reg.URL)
+	if err != nil {
+		return nil, err
+	}
+	return append(sources, PullSource{Reference: primaryRef, Insecure: reg.Insecure}), nil
+}
+
 // Reads the global registry file from the filesystem. Returns a byte array.
 func readRegistryConf(configPath string) ([]byte, error) {
 	configBytes, err := ioutil.ReadFile(configPath)
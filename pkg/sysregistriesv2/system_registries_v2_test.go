@@ -1,10 +1,13 @@
 package sysregistriesv2
 
 import (
+	"os"
 	"testing"
 
+	"github.com/containers/image/docker/reference"
 	"github.com/containers/image/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var testConfig = []byte("")
@@ -167,6 +170,112 @@ prefix = ""`)
 	assert.NotNil(t, reg)
 	assert.Equal(t, "empty-prefix.com", reg.Prefix)
 	assert.Equal(t, "empty-prefix.com", reg.URL)
+
+	// Prefixes only match at path component boundaries
+	reg = FindRegistry("complex-prefix.com:4000/with/pathology:tag", registries)
+	assert.Nil(t, reg)
+	reg = FindRegistry("no-prefix.com.example/foo:tag", registries)
+	assert.Nil(t, reg)
+	reg = FindRegistry("no-prefix.com", registries)
+	assert.NotNil(t, reg)
+	assert.Equal(t, "no-prefix.com", reg.Prefix)
+}
+
+func TestRefMatchesPrefix(t *testing.T) {
+	for _, c := range []struct {
+		ref, prefix string
+		expected    bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com/foo", "example.com", true},
+		{"example.com:5000/foo", "example.com", true},
+		{"example.com/foo:tag", "example.com/foo", true},
+		{"example.com/foo@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", "example.com/foo", true},
+		{"example.com/foobar", "example.com/foo", false},
+		{"example.community/foo", "example.com", false},
+		{"other.com/foo", "example.com", false},
+	} {
+		assert.Equal(t, c.expected, refMatchesPrefix(c.ref, c.prefix), "%s vs. %s", c.ref, c.prefix)
+	}
+}
+
+func TestPullSourcesFromReference(t *testing.T) {
+	testConfig = []byte(`
+[[registry]]
+url = "registry.com/foo/bar"
+prefix = "example.com/bar"
+insecure = true
+
+[[registry.mirror]]
+url = "mirror-1.registry.com:5000/"
+
+[[registry.mirror]]
+url = "mirror-2.registry.com/with/path"
+insecure = true
+
+[[registry]]
+url = "unmirrored.com"`)
+
+	configCache = make(map[string][]Registry)
+	registries, err := GetRegistries(nil)
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		ref      string
+		expected []string
+	}{
+		{"example.com/bar/image:tag", []string{"mirror-1.registry.com:5000/image:tag", "mirror-2.registry.com/with/path/image:tag", "registry.com/foo/bar/image:tag"}},
+		{"example.com/bar/ns/image@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", []string{
+			"mirror-1.registry.com:5000/ns/image@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			"mirror-2.registry.com/with/path/ns/image@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			"registry.com/foo/bar/ns/image@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		}},
+	} {
+		ref, err := reference.ParseNamed(c.ref)
+		require.NoError(t, err, c.ref)
+		reg := FindRegistry(ref.Name(), registries)
+		require.NotNil(t, reg, c.ref)
+		sources, err := reg.PullSourcesFromReference(ref)
+		require.NoError(t, err, c.ref)
+		refs := []string{}
+		for _, source := range sources {
+			refs = append(refs, source.Reference.String())
+		}
+		assert.Equal(t, c.expected, refs, c.ref)
+		require.Len(t, sources, 3)
+		assert.False(t, sources[0].Insecure)
+		assert.True(t, sources[1].Insecure)
+		assert.True(t, sources[2].Insecure)
+	}
+
+	// Registries without mirrors are only pulled from the primary location
+	ref, err := reference.ParseNamed("unmirrored.com/image:tag")
+	require.NoError(t, err)
+	reg := FindRegistry(ref.Name(), registries)
+	require.NotNil(t, reg)
+	sources, err := reg.PullSourcesFromReference(ref)
+	require.NoError(t, err)
+	assert.Equal(t, []PullSource{{Reference: ref, Insecure: false}}, sources)
+
+	// References outside of the prefix are rejected
+	ref, err = reference.ParseNamed("other.com/image:tag")
+	require.NoError(t, err)
+	_, err = reg.PullSourcesFromReference(ref)
+	assert.Error(t, err)
+}
+
+func TestMissingConfigFile(t *testing.T) {
+	defer func() { readConf = func(_ string) ([]byte, error) { return testConfig, nil } }()
+	readConf = func(_ string) ([]byte, error) { return nil, os.ErrNotExist }
+
+	configCache = make(map[string][]Registry)
+	// GetRegistries reports the missing file
+	_, err := GetRegistries(&types.SystemContext{SystemRegistriesConfPath: "/this/does/not/exist"})
+	assert.True(t, os.IsNotExist(err))
+	// FindRegistryForReference treats it as an empty configuration
+	reg, err := FindRegistryForReference(&types.SystemContext{SystemRegistriesConfPath: "/this/does/not/exist"}, "registry.com/image:tag")
+	assert.Nil(t, err)
+	assert.Nil(t, reg)
 }
 
 func assertSearchRegistryURLsEqual(t *testing.T, expected []string, regs []Registry) {
@@ -11,4 +11,6 @@ const (
 	TestKeyFingerprint = "1D8230F6CDB6A06716E414C1DB72F2188BB46CC8"
 	// TestKeyShortID is the short ID of the private key in this directory.
 	TestKeyShortID = "DB72F2188BB46CC8"
+	// TestSignatureTimestamp is the timestamp in the signature in "dir-img-valid" (and in most other dir-img-* signatures).
+	TestSignatureTimestamp = 1464398954
 )
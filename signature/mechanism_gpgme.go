@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	"github.com/mtrmac/gpgme"
 )
@@ -35,33 +36,156 @@ func newGPGSigningMechanismInDirectory(optionalDir string) (SigningMechanism, er
 // of these keys.
 // The caller must call .Close() on the returned SigningMechanism.
 func newEphemeralGPGSigningMechanism(blob []byte) (SigningMechanism, []string, error) {
-	dir, err := ioutil.TempDir("", "containers-ephemeral-gpg-")
+	mech, err := newEphemeralGPGMESigningMechanism()
+	if err != nil {
+		return nil, nil, err
+	}
+	keyIdentities, err := mech.importKeysFromBytes(blob)
+	if err != nil {
+		mech.Close()
+		return nil, nil, err
+	}
+	return mech, keyIdentities, nil
+}
+
+// newEphemeralGPGSigningMechanismForCertifiedKeys returns a new GPG/OpenPGP signing mechanism which
+// recognizes _only_ public keys from the supplied trustedBlob and candidateBlob (if candidateBlob is nil,
+// the keys in trustedBlob are used as candidates), and returns the identities of those candidate keys
+// which are certified by a different key from trustedBlob.
+// Revoked or expired keys and certifications are ignored, and so are certifications by trusted keys
+// for which isCertifierAccepted (if not nil) returns false.
+// The caller must call .Close() on the returned SigningMechanism.
+func newEphemeralGPGSigningMechanismForCertifiedKeys(trustedBlob, candidateBlob []byte, isCertifierAccepted func(keyIdentity string) bool) (SigningMechanism, []string, error) {
+	blobs := [][]byte{trustedBlob}
+	if candidateBlob != nil {
+		blobs = append(blobs, candidateBlob)
+	}
+
+	mech, err := newEphemeralGPGMESigningMechanism()
 	if err != nil {
 		return nil, nil, err
 	}
-	removeDir := true
+	closeMech := true
 	defer func() {
-		if removeDir {
-			os.RemoveAll(dir)
+		if closeMech {
+			mech.Close()
 		}
 	}()
-	ctx, err := newGPGMEContext(dir)
+	trustedIdentities, err := mech.importKeysFromBytes(trustedBlob)
 	if err != nil {
 		return nil, nil, err
 	}
-	mech := &gpgmeSigningMechanism{
-		ctx:          ctx,
-		ephemeralDir: dir,
+	candidateIdentities := trustedIdentities
+	if candidateBlob != nil {
+		candidateIdentities, err = mech.importKeysFromBytes(candidateBlob)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
-	keyIdentities, err := mech.importKeysFromBytes(blob)
-	if err != nil {
-		return nil, nil, err
+
+	// GPGME does not expose key certifications, so let GnuPG compute the validity of the candidate keys
+	// instead, separately for each trusted key, so that the trusted keys do not make themselves valid.
+	certified := map[string]struct{}{}
+	for _, trustedIdentity := range trustedIdentities {
+		if isCertifierAccepted != nil && !isCertifierAccepted(trustedIdentity) {
+			continue
+		}
+		identities, err := gpgmeKeysCertifiedBy(trustedIdentity, candidateIdentities, blobs)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, identity := range identities {
+			certified[identity] = struct{}{}
+		}
+	}
+	keyIdentities := []string{}
+	for _, identity := range candidateIdentities {
+		if _, ok := certified[identity]; ok {
+			keyIdentities = append(keyIdentities, identity)
+			delete(certified, identity) // Don't return duplicates
+		}
 	}
 
-	removeDir = false
+	closeMech = false
 	return mech, keyIdentities, nil
 }
 
+// gpgmeKeysCertifiedBy imports blobs into a temporary GnuPG home directory, and returns those of candidateIdentities
+// which are valid, using the PGP trust model, when only trustedIdentity is trusted.
+// Because no other key is trusted to certify keys, this is the case exactly for keys with a valid certification by trustedIdentity.
+func gpgmeKeysCertifiedBy(trustedIdentity string, candidateIdentities []string, blobs [][]byte) ([]string, error) {
+	if len(trustedIdentity) < 16 {
+		// Coverage: importKeysFromBytes returns full fingerprints.
+		return nil, fmt.Errorf("Unexpected GPG key fingerprint %s", trustedIdentity)
+	}
+	mech, err := newEphemeralGPGMESigningMechanism()
+	if err != nil {
+		return nil, err
+	}
+	defer mech.Close()
+	for _, blob := range blobs {
+		if _, err := mech.importKeysFromBytes(blob); err != nil {
+			return nil, err
+		}
+	}
+	// trusted-key expects a long key ID, which is the suffix of a V4 fingerprint.
+	config := fmt.Sprintf("trust-model pgp\ntrusted-key %s\n", trustedIdentity[len(trustedIdentity)-16:])
+	if err := ioutil.WriteFile(filepath.Join(mech.ephemeralDir, "gpg.conf"), []byte(config), 0600); err != nil {
+		return nil, err
+	}
+
+	trustedKey, err := mech.ctx.GetKey(trustedIdentity, false)
+	if err != nil {
+		return nil, err
+	}
+	if !gpgmeKeyIsUsable(trustedKey) {
+		return nil, nil
+	}
+	res := []string{}
+	for _, identity := range candidateIdentities {
+		if identity == trustedIdentity {
+			continue
+		}
+		key, err := mech.ctx.GetKey(identity, false)
+		if err != nil {
+			return nil, err
+		}
+		if !gpgmeKeyIsUsable(key) {
+			continue
+		}
+		for uid := key.UserIDs(); uid != nil; uid = uid.Next() {
+			if !uid.Revoked() && !uid.Invalid() && (uid.Validity() == gpgme.ValidityFull || uid.Validity() == gpgme.ValidityUltimate) {
+				res = append(res, identity)
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+// gpgmeKeyIsUsable returns true if key has not been revoked, has not expired, and is not otherwise disabled or invalid.
+func gpgmeKeyIsUsable(key *gpgme.Key) bool {
+	return !key.Revoked() && !key.Expired() && !key.Disabled() && !key.Invalid()
+}
+
+// newEphemeralGPGMESigningMechanism returns a new gpgmeSigningMechanism using a new, empty, temporary directory.
+// The caller must call .Close() on the returned mechanism.
+func newEphemeralGPGMESigningMechanism() (*gpgmeSigningMechanism, error) {
+	dir, err := ioutil.TempDir("", "containers-ephemeral-gpg-")
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := newGPGMEContext(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &gpgmeSigningMechanism{
+		ctx:          ctx,
+		ephemeralDir: dir,
+	}, nil
+}
+
 // newGPGMEContext returns a new *gpgme.Context, using optionalDir if not empty.
 func newGPGMEContext(optionalDir string) (*gpgme.Context, error) {
 	ctx, err := gpgme.New()
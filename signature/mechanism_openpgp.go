@@ -4,7 +4,6 @@ package signature
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -14,6 +13,7 @@ import (
 
 	"github.com/containers/storage/pkg/homedir"
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 // A GPG/OpenPGP signing mechanism, implemented using x/crypto/openpgp.
@@ -65,6 +65,126 @@ func newEphemeralGPGSigningMechanism(blob []byte) (SigningMechanism, []string, e
 	return m, keyIdentities, nil
 }
 
+// newEphemeralGPGSigningMechanismForCertifiedKeys returns a new GPG/OpenPGP signing mechanism which
+// recognizes _only_ public keys from the supplied trustedBlob and candidateBlob (if candidateBlob is nil,
+// the keys in trustedBlob are used as candidates), and returns the identities of those candidate keys
+// which are certified by a different key from trustedBlob.
+// Revoked or expired keys and certifications are ignored, and so are certifications by trusted keys
+// for which isCertifierAccepted (if not nil) returns false.
+// The caller must call .Close() on the returned SigningMechanism.
+func newEphemeralGPGSigningMechanismForCertifiedKeys(trustedBlob, candidateBlob []byte, isCertifierAccepted func(keyIdentity string) bool) (SigningMechanism, []string, error) {
+	m := &openpgpSigningMechanism{
+		keyring: openpgp.EntityList{},
+	}
+	if _, err := m.importKeysFromBytes(trustedBlob); err != nil {
+		return nil, nil, err
+	}
+	trusted := m.keyring[:len(m.keyring):len(m.keyring)]
+	candidates := trusted
+	if candidateBlob != nil {
+		if _, err := m.importKeysFromBytes(candidateBlob); err != nil {
+			return nil, nil, err
+		}
+		candidates = m.keyring[len(trusted):]
+	}
+
+	now := time.Now()
+	keyIdentities := []string{}
+	for _, candidate := range candidates {
+		if !openpgpEntityIsValid(candidate, now) {
+			continue
+		}
+		for _, certifier := range trusted {
+			if certifier.PrimaryKey.Fingerprint == candidate.PrimaryKey.Fingerprint || !openpgpEntityIsValid(certifier, now) {
+				continue
+			}
+			if isCertifierAccepted != nil && !isCertifierAccepted(strings.ToUpper(fmt.Sprintf("%x", certifier.PrimaryKey.Fingerprint))) {
+				continue
+			}
+			if openpgpEntityIsCertifiedBy(candidate, certifier, now) {
+				// Uppercase the fingerprint to be compatible with gpgme
+				keyIdentities = append(keyIdentities, strings.ToUpper(fmt.Sprintf("%x", candidate.PrimaryKey.Fingerprint)))
+				break
+			}
+		}
+	}
+	return m, keyIdentities, nil
+}
+
+// openpgpEntityIsValid returns true if e has not been revoked, and has not expired at now.
+func openpgpEntityIsValid(e *openpgp.Entity, now time.Time) bool {
+	// openpgp.ReadEntity only records revocations which it has verified.
+	if len(e.Revocations) != 0 {
+		return false
+	}
+	// The most recent self-signature determines the key expiration time.
+	var selfSignature *packet.Signature
+	for _, identity := range e.Identities {
+		if identity.SelfSignature != nil && (selfSignature == nil || identity.SelfSignature.CreationTime.After(selfSignature.CreationTime)) {
+			selfSignature = identity.SelfSignature
+		}
+	}
+	return selfSignature != nil && !selfSignature.KeyExpired(now)
+}
+
+// openpgpEntityIsCertifiedBy returns true if certifier has made a valid certification of a user ID of e
+// which has neither expired at now, nor been revoked.
+func openpgpEntityIsCertifiedBy(e, certifier *openpgp.Entity, now time.Time) bool {
+	for name, identity := range e.Identities {
+		for _, sig := range identity.Signatures {
+			switch sig.SigType {
+			case packet.SigTypeGenericCert, packet.SigTypePersonaCert, packet.SigTypeCasualCert, packet.SigTypePositiveCert:
+			default:
+				continue
+			}
+			if sig.IssuerKeyId == nil || *sig.IssuerKeyId != certifier.PrimaryKey.KeyId ||
+				sig.CreationTime.After(now) || openpgpSignatureExpired(sig, now) {
+				continue
+			}
+			if err := certifier.PrimaryKey.VerifyUserIdSignature(name, e.PrimaryKey, sig); err != nil {
+				continue
+			}
+			if openpgpCertificationIsRevoked(e, certifier, name, identity, sig) {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// openpgpCertificationIsRevoked returns true if certification of identity (with the user ID name) of e, made by certifier,
+// has been revoked by certifier, or if the user ID has been revoked by e itself.
+func openpgpCertificationIsRevoked(e, certifier *openpgp.Entity, name string, identity *openpgp.Identity, certification *packet.Signature) bool {
+	for _, sig := range identity.Signatures {
+		if sig.SigType != sigTypeCertificationRevocation || sig.IssuerKeyId == nil || sig.CreationTime.Before(certification.CreationTime) {
+			continue
+		}
+		var issuer *packet.PublicKey
+		switch *sig.IssuerKeyId {
+		case certifier.PrimaryKey.KeyId:
+			issuer = certifier.PrimaryKey
+		case e.PrimaryKey.KeyId:
+			issuer = e.PrimaryKey
+		default:
+			continue
+		}
+		if err := issuer.VerifyUserIdSignature(name, e.PrimaryKey, sig); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// openpgpSignatureExpired returns true if sig has expired at now.
+func openpgpSignatureExpired(sig *packet.Signature, now time.Time) bool {
+	if sig.SigLifetimeSecs == nil || *sig.SigLifetimeSecs == 0 {
+		return false
+	}
+	expiry := sig.CreationTime.Add(time.Duration(*sig.SigLifetimeSecs) * time.Second)
+	return now.After(expiry)
+}
+
 func (m *openpgpSigningMechanism) Close() error {
 	return nil
 }
@@ -109,44 +229,7 @@ func (m *openpgpSigningMechanism) Sign(input []byte, keyIdentity string) ([]byte
 
 // Verify parses unverifiedSignature and returns the content and the signer's identity
 func (m *openpgpSigningMechanism) Verify(unverifiedSignature []byte) (contents []byte, keyIdentity string, err error) {
-	md, err := openpgp.ReadMessage(bytes.NewReader(unverifiedSignature), m.keyring, nil, nil)
-	if err != nil {
-		return nil, "", err
-	}
-	if !md.IsSigned {
-		return nil, "", errors.New("not signed")
-	}
-	content, err := ioutil.ReadAll(md.UnverifiedBody)
-	if err != nil {
-		// Coverage: md.UnverifiedBody.Read only fails if the body is encrypted
-		// (and possibly also signed, but it _must_ be encrypted) and the signing
-		// “modification detection code” detects a mismatch. But in that case,
-		// we would expect the signature verification to fail as well, and that is checked
-		// first.  Besides, we are not supplying any decryption keys, so we really
-		// can never reach this “encrypted data MDC mismatch” path.
-		return nil, "", err
-	}
-	if md.SignatureError != nil {
-		return nil, "", fmt.Errorf("signature error: %v", md.SignatureError)
-	}
-	if md.SignedBy == nil {
-		return nil, "", InvalidSignatureError{msg: fmt.Sprintf("Invalid GPG signature: %#v", md.Signature)}
-	}
-	if md.Signature != nil {
-		if md.Signature.SigLifetimeSecs != nil {
-			expiry := md.Signature.CreationTime.Add(time.Duration(*md.Signature.SigLifetimeSecs) * time.Second)
-			if time.Now().After(expiry) {
-				return nil, "", InvalidSignatureError{msg: fmt.Sprintf("Signature expired on %s", expiry)}
-			}
-		}
-	} else if md.SignatureV3 == nil {
-		// Coverage: If md.SignedBy != nil, the final md.UnverifiedBody.Read() either sets one of md.Signature or md.SignatureV3,
-		// or sets md.SignatureError.
-		return nil, "", InvalidSignatureError{msg: "Unexpected openpgp.MessageDetails: neither Signature nor SignatureV3 is set"}
-	}
-
-	// Uppercase the fingerprint to be compatible with gpgme
-	return content, strings.ToUpper(fmt.Sprintf("%x", md.SignedBy.PublicKey.Fingerprint)), nil
+	return openpgpVerify(m.keyring, unverifiedSignature)
 }
 
 // UntrustedSignatureContents returns UNTRUSTED contents of the signature WITHOUT ANY VERIFICATION,
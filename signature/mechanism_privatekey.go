@@ -0,0 +1,116 @@
+package signature
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// A GPG/OpenPGP signing mechanism using in-memory private keys, implemented using x/crypto/openpgp.
+// Unlike the mechanisms returned by NewGPGSigningMechanism and NewEphemeralGPGSigningMechanism,
+// this does not depend on the build tags, nor on any GPG home directory or agent.
+type openpgpPrivateKeySigningMechanism struct {
+	keyring openpgp.EntityList
+}
+
+// NewEphemeralGPGSigningMechanismWithPrivateKey returns a new GPG/OpenPGP signing mechanism which
+// recognizes _only_ the private keys (and their public parts) from the supplied blob, which may be ASCII-armored,
+// and returns the identities of these keys; they can be used as keyIdentity values for Sign.
+// If any of the private keys are encrypted, they are decrypted using passphrase.
+// The caller must call .Close() on the returned SigningMechanism.
+func NewEphemeralGPGSigningMechanismWithPrivateKey(blob []byte, passphrase []byte) (SigningMechanism, []string, error) {
+	keyring, err := openpgp.ReadKeyRing(bytes.NewReader(blob))
+	if err != nil {
+		k, e2 := openpgp.ReadArmoredKeyRing(bytes.NewReader(blob))
+		if e2 != nil {
+			return nil, nil, err // The original error
+		}
+		keyring = k
+	}
+
+	m := &openpgpPrivateKeySigningMechanism{
+		keyring: openpgp.EntityList{},
+	}
+	keyIdentities := []string{}
+	for _, entity := range keyring {
+		if entity.PrivateKey == nil {
+			return nil, nil, fmt.Errorf("Key %s does not contain a private key", openpgpKeyIdentity(entity.PrimaryKey))
+		}
+		privateKeys := []*packet.PrivateKey{entity.PrivateKey}
+		for _, subkey := range entity.Subkeys {
+			if subkey.PrivateKey != nil {
+				privateKeys = append(privateKeys, subkey.PrivateKey)
+			}
+		}
+		for _, k := range privateKeys {
+			if k.Encrypted {
+				if err := k.Decrypt(passphrase); err != nil {
+					return nil, nil, fmt.Errorf("Error decrypting private key %s: %v", openpgpKeyIdentity(entity.PrimaryKey), err)
+				}
+			}
+		}
+		keyIdentities = append(keyIdentities, openpgpKeyIdentity(entity.PrimaryKey))
+		m.keyring = append(m.keyring, entity)
+	}
+	return m, keyIdentities, nil
+}
+
+// openpgpKeyIdentity returns the key identity of k, in the format used by gpgme.
+func openpgpKeyIdentity(k *packet.PublicKey) string {
+	return strings.ToUpper(fmt.Sprintf("%x", k.Fingerprint))
+}
+
+func (m *openpgpPrivateKeySigningMechanism) Close() error {
+	return nil
+}
+
+// SupportsSigning returns nil if the mechanism supports signing, or a SigningNotSupportedError.
+func (m *openpgpPrivateKeySigningMechanism) SupportsSigning() error {
+	return nil
+}
+
+// Sign creates a (non-detached) signature of input using keyIdentity.
+// Fails with a SigningNotSupportedError if the mechanism does not support signing.
+func (m *openpgpPrivateKeySigningMechanism) Sign(input []byte, keyIdentity string) ([]byte, error) {
+	var signer *openpgp.Entity
+	for _, entity := range m.keyring {
+		if strings.EqualFold(openpgpKeyIdentity(entity.PrimaryKey), keyIdentity) {
+			signer = entity
+			break
+		}
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("Unknown key %s", keyIdentity)
+	}
+
+	var sigBuffer bytes.Buffer
+	w, err := openpgp.Sign(&sigBuffer, signer, nil, &packet.Config{DefaultHash: crypto.SHA256})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(input); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return sigBuffer.Bytes(), nil
+}
+
+// Verify parses unverifiedSignature and returns the content and the signer's identity
+func (m *openpgpPrivateKeySigningMechanism) Verify(unverifiedSignature []byte) (contents []byte, keyIdentity string, err error) {
+	return openpgpVerify(m.keyring, unverifiedSignature)
+}
+
+// UntrustedSignatureContents returns UNTRUSTED contents of the signature WITHOUT ANY VERIFICATION,
+// along with a short identifier of the key used for signing.
+// WARNING: The short key identifier (which correponds to "Key ID" for OpenPGP keys)
+// is NOT the same as a "key identity" used in other calls ot this interface, and
+// the values may have no recognizable relationship if the public key is not available.
+func (m *openpgpPrivateKeySigningMechanism) UntrustedSignatureContents(untrustedSignature []byte) (untrustedContents []byte, shortKeyIdentifier string, err error) {
+	return gpgUntrustedSignatureContents(untrustedSignature)
+}
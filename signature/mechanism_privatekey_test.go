@@ -0,0 +1,78 @@
+package signature
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func TestNewEphemeralGPGSigningMechanismWithPrivateKey(t *testing.T) {
+	input := []byte("This is not JSON\n")
+
+	// Successful import of a binary keyring
+	secring, err := ioutil.ReadFile("./fixtures/secring.gpg")
+	require.NoError(t, err)
+	mech, keyIdentities, err := NewEphemeralGPGSigningMechanismWithPrivateKey(secring, nil)
+	require.NoError(t, err)
+	defer mech.Close()
+	assert.Equal(t, []string{TestKeyFingerprint}, keyIdentities)
+	err = mech.SupportsSigning()
+	assert.NoError(t, err)
+	// The created signatures are accepted by the other mechanisms
+	sig, err := mech.Sign(input, TestKeyFingerprint)
+	require.NoError(t, err)
+	content, signingFingerprint, err := mech.Verify(sig)
+	require.NoError(t, err)
+	assert.Equal(t, input, content)
+	assert.Equal(t, TestKeyFingerprint, signingFingerprint)
+	publicKey, err := ioutil.ReadFile("./fixtures/public-key.gpg")
+	require.NoError(t, err)
+	publicMech, _, err := NewEphemeralGPGSigningMechanism(publicKey)
+	require.NoError(t, err)
+	defer publicMech.Close()
+	content, signingFingerprint, err = publicMech.Verify(sig)
+	require.NoError(t, err)
+	assert.Equal(t, input, content)
+	assert.Equal(t, TestKeyFingerprint, signingFingerprint)
+	// The key identity is not case-sensitive
+	_, err = mech.Sign(input, strings.ToLower(TestKeyFingerprint))
+	assert.NoError(t, err)
+	// Unknown key
+	_, err = mech.Sign(input, "this key does not exist")
+	assert.Error(t, err)
+
+	// Successful import of an ASCII-armored keyring
+	e := newOpenPGPTestEntity(t, "armored", time.Now())
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PrivateKeyType, nil)
+	require.NoError(t, err)
+	err = e.SerializePrivate(w, nil)
+	require.NoError(t, err)
+	err = w.Close()
+	require.NoError(t, err)
+	mech, keyIdentities, err = NewEphemeralGPGSigningMechanismWithPrivateKey(armored.Bytes(), nil)
+	require.NoError(t, err)
+	defer mech.Close()
+	assert.Equal(t, []string{openpgpTestFingerprint(e)}, keyIdentities)
+	sig, err = mech.Sign(input, openpgpTestFingerprint(e))
+	require.NoError(t, err)
+	content, signingFingerprint, err = mech.Verify(sig)
+	require.NoError(t, err)
+	assert.Equal(t, input, content)
+	assert.Equal(t, openpgpTestFingerprint(e), signingFingerprint)
+
+	// Public keys only
+	_, _, err = NewEphemeralGPGSigningMechanismWithPrivateKey(publicKey, nil)
+	assert.Error(t, err)
+
+	// Invalid input
+	_, _, err = NewEphemeralGPGSigningMechanismWithPrivateKey([]byte("This is invalid"), nil)
+	assert.Error(t, err)
+}
@@ -4,13 +4,19 @@ package signature
 
 import (
 	"bytes"
+	"crypto"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 const (
@@ -163,6 +169,210 @@ func TestNewEphemeralGPGSigningMechanism(t *testing.T) {
 	// The various GPG/GPGME failures cases are not obviously easy to reach.
 }
 
+// newOpenPGPTestEntity returns a new OpenPGP key with a single user ID name, created at creationTime.
+func newOpenPGPTestEntity(t *testing.T, name string, creationTime time.Time) *openpgp.Entity {
+	e, err := openpgp.NewEntity(name, "", name+"@example.com", &packet.Config{
+		Time: func() time.Time { return creationTime },
+	})
+	require.NoError(t, err)
+	// openpgp.Sign only uses hashes preferred by the key, and defaults to RIPEMD160.
+	for name, identity := range e.Identities {
+		identity.SelfSignature.PreferredHash = []uint8{8} // SHA256
+		err := identity.SelfSignature.SignUserId(name, e.PrimaryKey, e.PrivateKey, nil)
+		require.NoError(t, err)
+	}
+	return e
+}
+
+// openpgpTestFingerprint returns the key identity of e, as returned by the signing mechanisms.
+func openpgpTestFingerprint(e *openpgp.Entity) string {
+	return strings.ToUpper(fmt.Sprintf("%x", e.PrimaryKey.Fingerprint))
+}
+
+// openpgpTestUserIDSignature adds a signature of sigType by signer, over the only user ID of e.
+// If lifetime is not 0, the signature expires lifetime after creationTime.
+func openpgpTestUserIDSignature(t *testing.T, e, signer *openpgp.Entity, sigType packet.SignatureType, creationTime time.Time, lifetime time.Duration) {
+	require.Len(t, e.Identities, 1)
+	for name, identity := range e.Identities {
+		sig := &packet.Signature{
+			SigType:      sigType,
+			PubKeyAlgo:   signer.PrivateKey.PubKeyAlgo,
+			Hash:         crypto.SHA256,
+			CreationTime: creationTime,
+			IssuerKeyId:  &signer.PrivateKey.KeyId,
+		}
+		if lifetime != 0 {
+			secs := uint32(lifetime / time.Second)
+			sig.SigLifetimeSecs = &secs
+		}
+		err := sig.SignUserId(name, e.PrimaryKey, signer.PrivateKey, nil)
+		require.NoError(t, err)
+		identity.Signatures = append(identity.Signatures, sig)
+	}
+}
+
+// openpgpTestExpire modifies e to expire after lifetime.
+func openpgpTestExpire(t *testing.T, e *openpgp.Entity, lifetime time.Duration) {
+	for name, identity := range e.Identities {
+		secs := uint32(lifetime / time.Second)
+		identity.SelfSignature.KeyLifetimeSecs = &secs
+		err := identity.SelfSignature.SignUserId(name, e.PrimaryKey, e.PrivateKey, nil)
+		require.NoError(t, err)
+	}
+}
+
+// openpgpTestRevoke adds a key revocation signature to e.
+func openpgpTestRevoke(t *testing.T, e *openpgp.Entity) {
+	// RFC 4880 section 5.2.4: The hash covers the public key packet body, with a fixed 3-byte header.
+	var packetBuf bytes.Buffer
+	err := e.PrimaryKey.Serialize(&packetBuf)
+	require.NoError(t, err)
+	serialized := packetBuf.Bytes()
+	require.Equal(t, byte(0xC6), serialized[0])                  // A new-format public key packet, …
+	require.True(t, serialized[1] >= 192 && serialized[1] < 224) // … with a two-octet length.
+	h := crypto.SHA256.New()
+	e.PrimaryKey.SerializeSignaturePrefix(h)
+	h.Write(serialized[3:])
+
+	sig := &packet.Signature{
+		SigType:      packet.SigTypeKeyRevocation,
+		PubKeyAlgo:   e.PrivateKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: time.Now(),
+		IssuerKeyId:  &e.PrivateKey.KeyId,
+	}
+	err = sig.Sign(h, e.PrivateKey, nil)
+	require.NoError(t, err)
+	e.Revocations = append(e.Revocations, sig)
+}
+
+// openpgpTestKeyring returns a binary keyring containing public keys of entities.
+// Unlike openpgp.Entity.Serialize, this includes key revocations.
+func openpgpTestKeyring(t *testing.T, entities ...*openpgp.Entity) []byte {
+	var buf bytes.Buffer
+	for _, e := range entities {
+		err := e.PrimaryKey.Serialize(&buf)
+		require.NoError(t, err)
+		for _, sig := range e.Revocations {
+			err := sig.Serialize(&buf)
+			require.NoError(t, err)
+		}
+		for _, identity := range e.Identities {
+			err := identity.UserId.Serialize(&buf)
+			require.NoError(t, err)
+			err = identity.SelfSignature.Serialize(&buf)
+			require.NoError(t, err)
+			for _, sig := range identity.Signatures {
+				err := sig.Serialize(&buf)
+				require.NoError(t, err)
+			}
+		}
+		for _, subkey := range e.Subkeys {
+			err := subkey.PublicKey.Serialize(&buf)
+			require.NoError(t, err)
+			err = subkey.Sig.Serialize(&buf)
+			require.NoError(t, err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// openpgpTestSign returns a (non-detached) signature of input made by e.
+func openpgpTestSign(t *testing.T, e *openpgp.Entity, input []byte) []byte {
+	var buf bytes.Buffer
+	w, err := openpgp.Sign(&buf, e, nil, nil)
+	require.NoError(t, err)
+	_, err = w.Write(input)
+	require.NoError(t, err)
+	err = w.Close()
+	require.NoError(t, err)
+	return buf.Bytes()
+}
+
+// openpgpTestCertifiedKeys is a set of OpenPGP keys for testing newEphemeralGPGSigningMechanismForCertifiedKeys.
+type openpgpTestCertifiedKeys struct {
+	master, revokedMaster                                     *openpgp.Entity
+	certified, uncertified, revokedCertification, expiredCert *openpgp.Entity
+	expiredKey, revokedKey, certifiedByRevokedMaster          *openpgp.Entity
+}
+
+func newOpenPGPTestCertifiedKeys(t *testing.T) openpgpTestCertifiedKeys {
+	now := time.Now()
+	past := now.Add(-2 * time.Hour)
+	res := openpgpTestCertifiedKeys{
+		master:                   newOpenPGPTestEntity(t, "master", past),
+		revokedMaster:            newOpenPGPTestEntity(t, "revoked master", past),
+		certified:                newOpenPGPTestEntity(t, "certified", past),
+		uncertified:              newOpenPGPTestEntity(t, "uncertified", past),
+		revokedCertification:     newOpenPGPTestEntity(t, "revoked certification", past),
+		expiredCert:              newOpenPGPTestEntity(t, "expired certification", past),
+		expiredKey:               newOpenPGPTestEntity(t, "expired key", past),
+		revokedKey:               newOpenPGPTestEntity(t, "revoked key", past),
+		certifiedByRevokedMaster: newOpenPGPTestEntity(t, "certified by revoked master", past),
+	}
+	openpgpTestRevoke(t, res.revokedMaster)
+	openpgpTestExpire(t, res.expiredKey, time.Hour)
+	openpgpTestRevoke(t, res.revokedKey)
+	for _, e := range []*openpgp.Entity{res.certified, res.revokedCertification, res.expiredKey, res.revokedKey} {
+		openpgpTestUserIDSignature(t, e, res.master, packet.SigTypeGenericCert, past, 0)
+	}
+	openpgpTestUserIDSignature(t, res.revokedCertification, res.master, sigTypeCertificationRevocation, past.Add(time.Hour), 0)
+	openpgpTestUserIDSignature(t, res.expiredCert, res.master, packet.SigTypeGenericCert, past, time.Hour)
+	openpgpTestUserIDSignature(t, res.certifiedByRevokedMaster, res.revokedMaster, packet.SigTypeGenericCert, past, 0)
+	return res
+}
+
+func TestNewEphemeralGPGSigningMechanismForCertifiedKeys(t *testing.T) {
+	keys := newOpenPGPTestCertifiedKeys(t)
+	trustedBlob := openpgpTestKeyring(t, keys.master, keys.revokedMaster)
+	candidateBlob := openpgpTestKeyring(t, keys.certified, keys.uncertified, keys.revokedCertification, keys.expiredCert,
+		keys.expiredKey, keys.revokedKey, keys.certifiedByRevokedMaster)
+	input := []byte("This is not JSON\n")
+
+	// Separate trusted and candidate keys
+	mech, keyIdentities, err := newEphemeralGPGSigningMechanismForCertifiedKeys(trustedBlob, candidateBlob, nil)
+	require.NoError(t, err)
+	defer mech.Close()
+	assert.Equal(t, []string{openpgpTestFingerprint(keys.certified)}, keyIdentities)
+	content, signingFingerprint, err := mech.Verify(openpgpTestSign(t, keys.certified, input))
+	require.NoError(t, err)
+	assert.Equal(t, input, content)
+	assert.Equal(t, openpgpTestFingerprint(keys.certified), signingFingerprint)
+	// Signatures by keys which are not certified still verify, the caller must check the key identity.
+	_, signingFingerprint, err = mech.Verify(openpgpTestSign(t, keys.uncertified, input))
+	require.NoError(t, err)
+	assert.Equal(t, openpgpTestFingerprint(keys.uncertified), signingFingerprint)
+
+	// Candidate keys are looked up in trustedBlob if candidateBlob is nil; the trusted keys don't certify themselves.
+	mech, keyIdentities, err = newEphemeralGPGSigningMechanismForCertifiedKeys(openpgpTestKeyring(t, keys.master, keys.certified, keys.uncertified), nil, nil)
+	require.NoError(t, err)
+	defer mech.Close()
+	assert.Equal(t, []string{openpgpTestFingerprint(keys.certified)}, keyIdentities)
+
+	// Certifications by trusted keys which are not accepted are ignored
+	mech, keyIdentities, err = newEphemeralGPGSigningMechanismForCertifiedKeys(trustedBlob, candidateBlob, func(keyIdentity string) bool {
+		return keyIdentity != openpgpTestFingerprint(keys.master)
+	})
+	require.NoError(t, err)
+	defer mech.Close()
+	assert.Empty(t, keyIdentities)
+
+	// No trusted keys
+	mech, keyIdentities, err = newEphemeralGPGSigningMechanismForCertifiedKeys([]byte{}, candidateBlob, nil)
+	require.NoError(t, err)
+	defer mech.Close()
+	assert.Empty(t, keyIdentities)
+
+	// Invalid input: This is, sadly, accepted anyway by GPG, just returns no keys.
+	// For openpgpSigningMechanism we can detect this and fail.
+	mech, keyIdentities, err = newEphemeralGPGSigningMechanismForCertifiedKeys(trustedBlob, []byte("This is invalid"), nil)
+	assert.True(t, err != nil || len(keyIdentities) == 0)
+	if err == nil {
+		mech.Close()
+	}
+	assert.Empty(t, keyIdentities)
+}
+
 func TestGPGSigningMechanismClose(t *testing.T) {
 	// Closing a non-ephemeral mechanism does not remove anything in the directory.
 	mech, err := newGPGSigningMechanismInDirectory(testGPGHomeDirectory)
@@ -0,0 +1,330 @@
+package signature
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// x509SignatureEnvelope is the serialized form of a signature created by the X.509 signing mechanism.
+// It is a non-detached signature: it contains the signed payload, a signature of the payload made by the private key
+// corresponding to the first certificate, and the certificate chain (leaf first, followed by any intermediate certificates
+// needed to verify it; the root CA is not required).
+type x509SignatureEnvelope struct {
+	Payload      []byte   `json:"payload"`
+	Signature    []byte   `json:"signature"`
+	Certificates [][]byte `json:"certificates"` // DER-encoded
+}
+
+// A signing mechanism using X.509 certificates and the corresponding private keys.
+type x509SigningMechanism struct {
+	// Exactly one of trustedCertificates and roots is set.
+	trustedCertificates []*x509.Certificate // Signatures made by exactly these certificates are accepted.
+	roots               *x509.CertPool      // Signatures made by certificates issued by these CAs are accepted.
+
+	signingKey   crypto.Signer // nil if signing is not supported
+	signingChain [][]byte      // DER-encoded certificate chain for signingKey, leaf first
+	// currentTime is used when checking certificate validity periods; it can be replaced in tests.
+	currentTime func() time.Time
+}
+
+// NewX509SigningMechanism returns a new X.509 signing mechanism which creates signatures using privateKeyPEM,
+// and includes certificateChainPEM (the certificate for the private key, followed by any intermediate certificates) in them.
+// It also returns the key identity of the signing certificate, to be used in .Sign(); it only accepts signatures by the same certificate.
+// The caller must call .Close() on the returned SigningMechanism.
+func NewX509SigningMechanism(certificateChainPEM, privateKeyPEM []byte) (SigningMechanism, string, error) {
+	chain, err := parsePEMCertificates(certificateChainPEM)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(chain) == 0 {
+		return nil, "", errors.New("No X.509 certificates found")
+	}
+	key, err := parsePEMPrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, "", err
+	}
+	if !publicKeysEqual(key.Public(), chain[0].PublicKey) {
+		return nil, "", errors.New("The private key does not match the first X.509 certificate")
+	}
+	if err := checkX509SigningUsage(chain[0]); err != nil {
+		return nil, "", err
+	}
+	signingChain := make([][]byte, len(chain))
+	for i, c := range chain {
+		signingChain[i] = c.Raw
+	}
+	return &x509SigningMechanism{
+		trustedCertificates: chain[:1],
+		signingKey:          key,
+		signingChain:        signingChain,
+		currentTime:         time.Now,
+	}, x509KeyIdentity(chain[0]), nil
+}
+
+// NewEphemeralX509SigningMechanism returns a new X.509 signing mechanism which
+// recognizes _only_ signatures made by certificates in the supplied PEM blob, and returns the identities
+// of these certificates.
+// The caller must call .Close() on the returned SigningMechanism.
+func NewEphemeralX509SigningMechanism(certificatesPEM []byte) (SigningMechanism, []string, error) {
+	certs, err := parsePEMCertificates(certificatesPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyIdentities := make([]string, len(certs))
+	for i, c := range certs {
+		keyIdentities[i] = x509KeyIdentity(c)
+	}
+	return &x509SigningMechanism{
+		trustedCertificates: certs,
+		currentTime:         time.Now,
+	}, keyIdentities, nil
+}
+
+// NewX509CASigningMechanism returns a new X.509 signing mechanism which recognizes signatures made by
+// any certificate issued (directly or through intermediate CAs included in the signature) by one of the CAs
+// in the supplied PEM blob.
+// The caller must call .Close() on the returned SigningMechanism.
+func NewX509CASigningMechanism(caCertificatesPEM []byte) (SigningMechanism, error) {
+	certs, err := parsePEMCertificates(caCertificatesPEM)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("No X.509 CA certificates found")
+	}
+	roots := x509.NewCertPool()
+	for _, c := range certs {
+		roots.AddCert(c)
+	}
+	return &x509SigningMechanism{
+		roots:       roots,
+		currentTime: time.Now,
+	}, nil
+}
+
+func (m *x509SigningMechanism) Close() error {
+	return nil
+}
+
+// SupportsSigning returns nil if the mechanism supports signing, or a SigningNotSupportedError.
+func (m *x509SigningMechanism) SupportsSigning() error {
+	if m.signingKey == nil {
+		return SigningNotSupportedError("X.509 signing requires a private key")
+	}
+	return nil
+}
+
+// Sign creates a (non-detached) signature of input using keyIdentity.
+// Fails with a SigningNotSupportedError if the mechanism does not support signing.
+func (m *x509SigningMechanism) Sign(input []byte, keyIdentity string) ([]byte, error) {
+	if err := m.SupportsSigning(); err != nil {
+		return nil, err
+	}
+	if keyIdentity != x509KeyIdentity(m.trustedCertificates[0]) {
+		return nil, fmt.Errorf("Unknown X.509 key identity %s", keyIdentity)
+	}
+	hash := sha256.Sum256(input)
+	sig, err := m.signingKey.Sign(rand.Reader, hash[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(x509SignatureEnvelope{
+		Payload:      input,
+		Signature:    sig,
+		Certificates: m.signingChain,
+	})
+}
+
+// Verify parses unverifiedSignature and returns the content and the signer's identity
+func (m *x509SigningMechanism) Verify(unverifiedSignature []byte) (contents []byte, keyIdentity string, err error) {
+	envelope, certs, err := parseX509SignatureEnvelope(unverifiedSignature)
+	if err != nil {
+		return nil, "", err
+	}
+	leaf := certs[0]
+	now := m.currentTime()
+
+	if m.roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			intermediates.AddCert(c)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         m.roots,
+			Intermediates: intermediates,
+			CurrentTime:   now,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		}); err != nil {
+			return nil, "", InvalidSignatureError{msg: fmt.Sprintf("Invalid X.509 certificate chain: %v", err)}
+		}
+	} else {
+		trusted := false
+		for _, c := range m.trustedCertificates {
+			if bytes.Equal(c.Raw, leaf.Raw) {
+				trusted = true
+				break
+			}
+		}
+		if !trusted {
+			return nil, "", InvalidSignatureError{msg: fmt.Sprintf("Signature by unknown X.509 certificate %s", x509KeyIdentity(leaf))}
+		}
+		if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+			return nil, "", InvalidSignatureError{msg: fmt.Sprintf("X.509 certificate %s is not valid at %s (valid from %s to %s)",
+				x509KeyIdentity(leaf), now.Format(time.RFC3339), leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))}
+		}
+	}
+
+	// x509.Certificate.Verify above accepts leaf certificates without any extended key usages, so check the leaf explicitly.
+	if err := checkX509SigningUsage(leaf); err != nil {
+		return nil, "", InvalidSignatureError{msg: err.Error()}
+	}
+
+	algorithm, err := x509SignatureAlgorithm(leaf.PublicKey)
+	if err != nil {
+		return nil, "", InvalidSignatureError{msg: err.Error()}
+	}
+	if err := leaf.CheckSignature(algorithm, envelope.Payload, envelope.Signature); err != nil {
+		return nil, "", InvalidSignatureError{msg: fmt.Sprintf("Invalid X.509 signature: %v", err)}
+	}
+	return envelope.Payload, x509KeyIdentity(leaf), nil
+}
+
+// checkX509SigningUsage returns an error if cert is not allowed to make signatures of images,
+// i.e. unless it has the digitalSignature key usage and the codeSigning extended key usage.
+func checkX509SigningUsage(cert *x509.Certificate) error {
+	if cert.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return fmt.Errorf("X.509 certificate %s does not allow digital signatures", x509KeyIdentity(cert))
+	}
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageCodeSigning {
+			return nil
+		}
+	}
+	return fmt.Errorf("X.509 certificate %s does not allow code signing", x509KeyIdentity(cert))
+}
+
+// UntrustedSignatureContents returns UNTRUSTED contents of the signature WITHOUT ANY VERIFICATION,
+// along with a short identifier of the key used for signing.
+// WARNING: The short key identifier (which correponds to "Key ID" for OpenPGP keys)
+// is NOT the same as a "key identity" used in other calls ot this interface, and
+// the values may have no recognizable relationship if the public key is not available.
+func (m *x509SigningMechanism) UntrustedSignatureContents(untrustedSignature []byte) (untrustedContents []byte, shortKeyIdentifier string, err error) {
+	envelope, certs, err := parseX509SignatureEnvelope(untrustedSignature)
+	if err != nil {
+		return nil, "", err
+	}
+	return envelope.Payload, x509KeyIdentity(certs[0]), nil
+}
+
+// parseX509SignatureEnvelope parses an X.509 signature envelope and the certificates it contains.
+// On success, at least one certificate is returned.
+func parseX509SignatureEnvelope(signature []byte) (*x509SignatureEnvelope, []*x509.Certificate, error) {
+	var envelope x509SignatureEnvelope
+	if err := json.Unmarshal(signature, &envelope); err != nil {
+		return nil, nil, InvalidSignatureError{msg: fmt.Sprintf("Invalid X.509 signature: %v", err)}
+	}
+	if len(envelope.Certificates) == 0 {
+		return nil, nil, InvalidSignatureError{msg: "X.509 signature does not contain a certificate"}
+	}
+	certs := make([]*x509.Certificate, len(envelope.Certificates))
+	for i, der := range envelope.Certificates {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, nil, InvalidSignatureError{msg: fmt.Sprintf("Invalid X.509 certificate in signature: %v", err)}
+		}
+		certs[i] = c
+	}
+	return &envelope, certs, nil
+}
+
+// x509KeyIdentity returns the key identity of cert, i.e. the hex-encoded SHA-256 fingerprint of the certificate.
+func x509KeyIdentity(cert *x509.Certificate) string {
+	return fmt.Sprintf("%X", sha256.Sum256(cert.Raw))
+}
+
+// x509SignatureAlgorithm returns the signature algorithm used by the X.509 signing mechanism for publicKey.
+func x509SignatureAlgorithm(publicKey interface{}) (x509.SignatureAlgorithm, error) {
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA, nil
+	case *ecdsa.PublicKey:
+		return x509.ECDSAWithSHA256, nil
+	default:
+		return x509.UnknownSignatureAlgorithm, fmt.Errorf("Unsupported X.509 public key type %T", publicKey)
+	}
+}
+
+// publicKeysEqual returns true if a and b are the same RSA or ECDSA public key.
+func publicKeysEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case *rsa.PublicKey:
+		b, ok := b.(*rsa.PublicKey)
+		return ok && a.N.Cmp(b.N) == 0 && a.E == b.E
+	case *ecdsa.PublicKey:
+		b, ok := b.(*ecdsa.PublicKey)
+		return ok && a.Curve == b.Curve && a.X.Cmp(b.X) == 0 && a.Y.Cmp(b.Y) == 0
+	default:
+		return false
+	}
+}
+
+// parsePEMCertificates returns all certificates in a PEM blob.
+func parsePEMCertificates(blob []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, blob = pem.Decode(blob)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	return certs, nil
+}
+
+// parsePEMPrivateKey returns the first RSA or ECDSA private key in a PEM blob.
+func parsePEMPrivateKey(blob []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, blob = pem.Decode(blob)
+		if block == nil {
+			return nil, errors.New("No private key found")
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			switch key := key.(type) {
+			case *rsa.PrivateKey:
+				return key, nil
+			case *ecdsa.PrivateKey:
+				return key, nil
+			default:
+				return nil, fmt.Errorf("Unsupported private key type %T", key)
+			}
+		}
+	}
+}
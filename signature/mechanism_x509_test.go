@@ -0,0 +1,346 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// x509TestCert is a certificate and its private key, generated for tests.
+type x509TestCert struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// certPEM returns the PEM encoding of c.
+func (c x509TestCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+// keyPEM returns the PKCS#8 PEM encoding of the private key of c.
+func (c x509TestCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(c.key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+var x509TestSerial int64
+
+// newX509TestCert generates a new certificate for commonName, valid between notBefore and notAfter, issued by issuer
+// (or self-signed if issuer is nil).  Certificates which are not CAs can be used for code signing, unless modified by modify.
+func newX509TestCert(t *testing.T, commonName string, isCA bool, issuer *x509TestCert, notBefore, notAfter time.Time, modify ...func(*x509.Certificate)) x509TestCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	x509TestSerial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(x509TestSerial),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	if isCA {
+		template.IsCA = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}
+	}
+	for _, m := range modify {
+		m(template)
+	}
+	parent, parentKey := template, crypto.Signer(key)
+	if issuer != nil {
+		parent, parentKey = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return x509TestCert{cert: cert, key: key}
+}
+
+// x509TestPKI is a set of certificates for tests: root → intermediate → leaf, an expired leaf, and an unrelated self-signed leaf.
+type x509TestPKI struct {
+	root, intermediate, leaf, expiredLeaf, otherLeaf x509TestCert
+}
+
+func newX509TestPKI(t *testing.T) x509TestPKI {
+	now := time.Now()
+	notBefore, notAfter := now.Add(-time.Hour), now.Add(24*time.Hour)
+	root := newX509TestCert(t, "Test root CA", true, nil, notBefore, notAfter)
+	intermediate := newX509TestCert(t, "Test intermediate CA", true, &root, notBefore, notAfter)
+	return x509TestPKI{
+		root:         root,
+		intermediate: intermediate,
+		leaf:         newX509TestCert(t, "Test signer", false, &intermediate, notBefore, notAfter),
+		expiredLeaf:  newX509TestCert(t, "Expired test signer", false, &intermediate, now.Add(-48*time.Hour), now.Add(-24*time.Hour)),
+		otherLeaf:    newX509TestCert(t, "Other signer", false, nil, notBefore, notAfter),
+	}
+}
+
+// x509TestSign signs input using c, including chain (after the certificate of c) in the signature.
+func x509TestSign(t *testing.T, c x509TestCert, input []byte, chain ...x509TestCert) []byte {
+	chainPEM := c.certPEM()
+	for _, c := range chain {
+		chainPEM = append(chainPEM, c.certPEM()...)
+	}
+	mech, keyIdentity, err := NewX509SigningMechanism(chainPEM, c.keyPEM(t))
+	require.NoError(t, err)
+	defer mech.Close()
+	sig, err := mech.Sign(input, keyIdentity)
+	require.NoError(t, err)
+	return sig
+}
+
+func TestNewX509SigningMechanism(t *testing.T) {
+	pki := newX509TestPKI(t)
+	input := []byte("This is not JSON")
+
+	mech, keyIdentity, err := NewX509SigningMechanism(append(pki.leaf.certPEM(), pki.intermediate.certPEM()...), pki.leaf.keyPEM(t))
+	require.NoError(t, err)
+	defer mech.Close()
+	assert.Equal(t, x509KeyIdentity(pki.leaf.cert), keyIdentity)
+	assert.NoError(t, mech.SupportsSigning())
+
+	sig, err := mech.Sign(input, keyIdentity)
+	require.NoError(t, err)
+	contents, signingIdentity, err := mech.Verify(sig)
+	require.NoError(t, err)
+	assert.Equal(t, input, contents)
+	assert.Equal(t, keyIdentity, signingIdentity)
+
+	// Unknown key identity
+	_, err = mech.Sign(input, x509KeyIdentity(pki.otherLeaf.cert))
+	assert.Error(t, err)
+
+	// An RSA key in PKCS#1 format
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(1000),
+		Subject:      pkix.Name{CommonName: "RSA signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	rsaCertDER, err := x509.CreateCertificate(rand.Reader, rsaTemplate, rsaTemplate, rsaKey.Public(), rsaKey)
+	require.NoError(t, err)
+	rsaMech, rsaKeyIdentity, err := NewX509SigningMechanism(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rsaCertDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	require.NoError(t, err)
+	defer rsaMech.Close()
+	sig, err = rsaMech.Sign(input, rsaKeyIdentity)
+	require.NoError(t, err)
+	contents, signingIdentity, err = rsaMech.Verify(sig)
+	require.NoError(t, err)
+	assert.Equal(t, input, contents)
+	assert.Equal(t, rsaKeyIdentity, signingIdentity)
+
+	// No certificates
+	_, _, err = NewX509SigningMechanism([]byte{}, pki.leaf.keyPEM(t))
+	assert.Error(t, err)
+	// No private key
+	_, _, err = NewX509SigningMechanism(pki.leaf.certPEM(), []byte{})
+	assert.Error(t, err)
+	// The private key does not match the certificate
+	_, _, err = NewX509SigningMechanism(pki.leaf.certPEM(), pki.otherLeaf.keyPEM(t))
+	assert.Error(t, err)
+}
+
+func TestNewEphemeralX509SigningMechanism(t *testing.T) {
+	pki := newX509TestPKI(t)
+	input := []byte("This is not JSON")
+
+	mech, keyIdentities, err := NewEphemeralX509SigningMechanism(append(pki.leaf.certPEM(), pki.expiredLeaf.certPEM()...))
+	require.NoError(t, err)
+	defer mech.Close()
+	assert.Equal(t, []string{x509KeyIdentity(pki.leaf.cert), x509KeyIdentity(pki.expiredLeaf.cert)}, keyIdentities)
+	assert.IsType(t, SigningNotSupportedError(""), mech.SupportsSigning())
+	_, err = mech.Sign(input, keyIdentities[0])
+	assert.IsType(t, SigningNotSupportedError(""), err)
+
+	// Success
+	contents, keyIdentity, err := mech.Verify(x509TestSign(t, pki.leaf, input))
+	require.NoError(t, err)
+	assert.Equal(t, input, contents)
+	assert.Equal(t, keyIdentities[0], keyIdentity)
+
+	// A certificate chain is not necessary, but it is not rejected either
+	_, _, err = mech.Verify(x509TestSign(t, pki.leaf, input, pki.intermediate))
+	assert.NoError(t, err)
+
+	// An expired certificate
+	expiredSig := x509TestSign(t, pki.expiredLeaf, input)
+	_, _, err = mech.Verify(expiredSig)
+	assert.IsType(t, InvalidSignatureError{}, err)
+	// … which was valid at an earlier time
+	mech.(*x509SigningMechanism).currentTime = func() time.Time { return time.Now().Add(-36 * time.Hour) }
+	_, _, err = mech.Verify(expiredSig)
+	assert.NoError(t, err)
+	// … but not before it was issued
+	mech.(*x509SigningMechanism).currentTime = func() time.Time { return time.Now().Add(-72 * time.Hour) }
+	_, _, err = mech.Verify(expiredSig)
+	assert.IsType(t, InvalidSignatureError{}, err)
+	mech.(*x509SigningMechanism).currentTime = time.Now
+
+	// An unknown certificate
+	_, _, err = mech.Verify(x509TestSign(t, pki.otherLeaf, input))
+	assert.IsType(t, InvalidSignatureError{}, err)
+
+	// No certificates at all
+	mech, keyIdentities, err = NewEphemeralX509SigningMechanism([]byte{})
+	require.NoError(t, err)
+	defer mech.Close()
+	assert.Empty(t, keyIdentities)
+}
+
+func TestNewX509CASigningMechanism(t *testing.T) {
+	pki := newX509TestPKI(t)
+	input := []byte("This is not JSON")
+
+	mech, err := NewX509CASigningMechanism(pki.root.certPEM())
+	require.NoError(t, err)
+	defer mech.Close()
+	assert.IsType(t, SigningNotSupportedError(""), mech.SupportsSigning())
+
+	// Success
+	contents, keyIdentity, err := mech.Verify(x509TestSign(t, pki.leaf, input, pki.intermediate))
+	require.NoError(t, err)
+	assert.Equal(t, input, contents)
+	assert.Equal(t, x509KeyIdentity(pki.leaf.cert), keyIdentity)
+
+	// The intermediate CA is missing
+	_, _, err = mech.Verify(x509TestSign(t, pki.leaf, input))
+	assert.IsType(t, InvalidSignatureError{}, err)
+
+	// An expired certificate
+	_, _, err = mech.Verify(x509TestSign(t, pki.expiredLeaf, input, pki.intermediate))
+	assert.IsType(t, InvalidSignatureError{}, err)
+
+	// A certificate issued by a different CA
+	_, _, err = mech.Verify(x509TestSign(t, pki.otherLeaf, input))
+	assert.IsType(t, InvalidSignatureError{}, err)
+
+	// The intermediate CA can be trusted directly
+	mech, err = NewX509CASigningMechanism(pki.intermediate.certPEM())
+	require.NoError(t, err)
+	defer mech.Close()
+	_, _, err = mech.Verify(x509TestSign(t, pki.leaf, input))
+	assert.NoError(t, err)
+
+	// No CA certificates
+	_, err = NewX509CASigningMechanism([]byte{})
+	assert.Error(t, err)
+}
+
+func TestX509SigningMechanismVerifyInvalid(t *testing.T) {
+	pki := newX509TestPKI(t)
+	input := []byte("This is not JSON")
+	mech, err := NewX509CASigningMechanism(pki.root.certPEM())
+	require.NoError(t, err)
+	defer mech.Close()
+
+	validSig := x509TestSign(t, pki.leaf, input, pki.intermediate)
+	var envelope x509SignatureEnvelope
+	err = json.Unmarshal(validSig, &envelope)
+	require.NoError(t, err)
+
+	for _, modify := range []func(e *x509SignatureEnvelope){
+		func(e *x509SignatureEnvelope) { e.Payload = []byte("This is modified") },
+		func(e *x509SignatureEnvelope) { e.Signature = []byte("invalid") },
+		func(e *x509SignatureEnvelope) { e.Certificates = nil },
+		func(e *x509SignatureEnvelope) { e.Certificates = [][]byte{[]byte("invalid")} },
+		func(e *x509SignatureEnvelope) { e.Certificates[0] = pki.otherLeaf.cert.Raw },
+	} {
+		e := envelope
+		e.Certificates = append([][]byte{}, envelope.Certificates...)
+		modify(&e)
+		sig, err := json.Marshal(e)
+		require.NoError(t, err)
+		_, _, err = mech.Verify(sig)
+		assert.IsType(t, InvalidSignatureError{}, err)
+	}
+
+	// Not JSON at all
+	_, _, err = mech.Verify([]byte("invalid signature"))
+	assert.IsType(t, InvalidSignatureError{}, err)
+}
+
+func TestX509SigningMechanismUntrustedSignatureContents(t *testing.T) {
+	pki := newX509TestPKI(t)
+	input := []byte("This is not JSON")
+	mech, _, err := NewEphemeralX509SigningMechanism([]byte{})
+	require.NoError(t, err)
+	defer mech.Close()
+
+	contents, shortKeyIdentifier, err := mech.UntrustedSignatureContents(x509TestSign(t, pki.otherLeaf, input))
+	require.NoError(t, err)
+	assert.Equal(t, input, contents)
+	assert.Equal(t, x509KeyIdentity(pki.otherLeaf.cert), shortKeyIdentifier)
+
+	_, _, err = mech.UntrustedSignatureContents([]byte("invalid signature"))
+	assert.Error(t, err)
+}
+
+func TestX509SigningMechanismKeyUsage(t *testing.T) {
+	pki := newX509TestPKI(t)
+	input := []byte("This is not JSON")
+	now := time.Now()
+	notBefore, notAfter := now.Add(-time.Hour), now.Add(24*time.Hour)
+
+	for _, c := range []struct {
+		name   string
+		modify func(*x509.Certificate)
+	}{
+		{"no digitalSignature", func(c *x509.Certificate) { c.KeyUsage = x509.KeyUsageKeyEncipherment }},
+		{"no extended key usage", func(c *x509.Certificate) { c.ExtKeyUsage = nil }},
+		{"TLS server", func(c *x509.Certificate) { c.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth} }},
+	} {
+		leaf := newX509TestCert(t, "Test "+c.name, false, &pki.intermediate, notBefore, notAfter, c.modify)
+
+		// Such a certificate can not be used for signing
+		_, _, err := NewX509SigningMechanism(leaf.certPEM(), leaf.keyPEM(t))
+		assert.Error(t, err, c.name)
+
+		// Signatures made by such a certificate are rejected, whether the certificate is trusted directly or through a CA
+		envelope, err := json.Marshal(x509SignatureEnvelope{
+			Payload:      input,
+			Signature:    x509TestRawSignature(t, leaf, input),
+			Certificates: [][]byte{leaf.cert.Raw, pki.intermediate.cert.Raw},
+		})
+		require.NoError(t, err)
+		caMech, err := NewX509CASigningMechanism(pki.root.certPEM())
+		require.NoError(t, err)
+		defer caMech.Close()
+		_, _, err = caMech.Verify(envelope)
+		assert.IsType(t, InvalidSignatureError{}, err, c.name)
+		certMech, _, err := NewEphemeralX509SigningMechanism(leaf.certPEM())
+		require.NoError(t, err)
+		defer certMech.Close()
+		_, _, err = certMech.Verify(envelope)
+		assert.IsType(t, InvalidSignatureError{}, err, c.name)
+	}
+}
+
+// x509TestRawSignature returns a signature of input made by the key of c, as used in x509SignatureEnvelope.
+func x509TestRawSignature(t *testing.T, c x509TestCert, input []byte) []byte {
+	hash := sha256.Sum256(input)
+	sig, err := c.key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	require.NoError(t, err)
+	return sig
+}
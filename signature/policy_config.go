@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"time"
 
 	"github.com/containers/image/docker/reference"
 	"github.com/containers/image/transports"
@@ -100,6 +101,8 @@ func (p *Policy) UnmarshalJSON(data []byte) error {
 			return &p.Default
 		case "transports":
 			return &transports
+		case "revocations":
+			return &p.Revocations
 		default:
 			return nil
 		}
@@ -114,6 +117,33 @@ func (p *Policy) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// Compile-time check that PolicyRevocations implements json.Unmarshaler.
+var _ json.Unmarshaler = (*PolicyRevocations)(nil)
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (pr *PolicyRevocations) UnmarshalJSON(data []byte) error {
+	*pr = PolicyRevocations{}
+	var tmp PolicyRevocations
+	if err := paranoidUnmarshalJSONObject(data, func(key string) interface{} {
+		switch key {
+		case "path":
+			return &tmp.Path
+		case "keyPath":
+			return &tmp.KeyPath
+		default:
+			return nil
+		}
+	}); err != nil {
+		return err
+	}
+
+	if tmp.Path == "" {
+		return InvalidPolicyFormatError("revocations.path not specified")
+	}
+	*pr = tmp
+	return nil
+}
+
 // policyTransportsMap is a specialization of this map type for the strict JSON parsing semantics appropriate for the Policy.Transports member.
 type policyTransportsMap map[string]PolicyTransportScopes
 
@@ -233,6 +263,8 @@ func newPolicyRequirementFromJSON(data []byte) (PolicyRequirement, error) {
 		res = &prSignedBy{}
 	case prTypeSignedBaseLayer:
 		res = &prSignedBaseLayer{}
+	case prTypeSignedByThreshold:
+		res = &prSignedByThreshold{}
 	default:
 		return nil, InvalidPolicyFormatError(fmt.Sprintf("Unknown policy requirement type \"%s\"", typeField.Type))
 	}
@@ -322,6 +354,25 @@ func newPRSignedBy(keyType sbKeyType, keyPath string, keyData []byte, signedIden
 	}, nil
 }
 
+// newPRSignedByWithSignerKeys is newPRSignedBy, also setting SignerKeyPath and SignerKeyData.
+func newPRSignedByWithSignerKeys(keyType sbKeyType, keyPath string, keyData []byte, signerKeyPath string, signerKeyData []byte, signedIdentity PolicyReferenceMatch) (*prSignedBy, error) {
+	pr, err := newPRSignedBy(keyType, keyPath, keyData, signedIdentity)
+	if err != nil {
+		return nil, err
+	}
+	if len(signerKeyPath) > 0 || len(signerKeyData) > 0 {
+		if keyType != SBKeyTypeSignedByGPGKeys {
+			return nil, InvalidPolicyFormatError(fmt.Sprintf("signerKeyPath and signerKeyData can not be used with keyType \"%s\"", keyType))
+		}
+		if len(signerKeyPath) > 0 && len(signerKeyData) > 0 {
+			return nil, InvalidPolicyFormatError("signerKeyPath and signerKeyData cannot be used simultaneously")
+		}
+	}
+	pr.SignerKeyPath = signerKeyPath
+	pr.SignerKeyData = signerKeyData
+	return pr, nil
+}
+
 // newPRSignedByKeyPath is NewPRSignedByKeyPath, except it returns the private type.
 func newPRSignedByKeyPath(keyType sbKeyType, keyPath string, signedIdentity PolicyReferenceMatch) (*prSignedBy, error) {
 	return newPRSignedBy(keyType, keyPath, nil, signedIdentity)
@@ -342,6 +393,40 @@ func NewPRSignedByKeyData(keyType sbKeyType, keyData []byte, signedIdentity Poli
 	return newPRSignedByKeyData(keyType, keyData, signedIdentity)
 }
 
+// NewPRSignedByGPGKeysWithSignerKeyPath returns a new "signedBy" PolicyRequirement with keyType "signedByGPGKeys",
+// accepting signatures by keys in signerKeyPath which are certified by keys in keyPath.
+func NewPRSignedByGPGKeysWithSignerKeyPath(keyPath, signerKeyPath string, signedIdentity PolicyReferenceMatch) (PolicyRequirement, error) {
+	return newPRSignedByWithSignerKeys(SBKeyTypeSignedByGPGKeys, keyPath, nil, signerKeyPath, nil, signedIdentity)
+}
+
+// NewPRSignedByGPGKeysWithSignerKeyData returns a new "signedBy" PolicyRequirement with keyType "signedByGPGKeys",
+// accepting signatures by keys in signerKeyData which are certified by keys in keyData.
+func NewPRSignedByGPGKeysWithSignerKeyData(keyData, signerKeyData []byte, signedIdentity PolicyReferenceMatch) (PolicyRequirement, error) {
+	return newPRSignedByWithSignerKeys(SBKeyTypeSignedByGPGKeys, "", keyData, "", signerKeyData, signedIdentity)
+}
+
+// newPRSignedByWithSignatureTimeLimits is NewPRSignedByWithSignatureTimeLimits, except it returns the private type.
+func newPRSignedByWithSignatureTimeLimits(pr PolicyRequirement, maxAgeSeconds int64, notBefore *time.Time) (*prSignedBy, error) {
+	signedBy, ok := pr.(*prSignedBy)
+	if !ok {
+		return nil, InvalidPolicyFormatError(fmt.Sprintf("signature time limits can only be used with %s requirements", prTypeSignedBy))
+	}
+	if maxAgeSeconds < 0 {
+		return nil, InvalidPolicyFormatError(fmt.Sprintf("invalid maxSignatureAgeSeconds %d", maxAgeSeconds))
+	}
+	res := *signedBy
+	res.MaxSignatureAgeSeconds = maxAgeSeconds
+	res.SignedNotBefore = notBefore
+	return &res, nil
+}
+
+// NewPRSignedByWithSignatureTimeLimits returns a copy of the "signedBy" PolicyRequirement pr, which additionally
+// only accepts signatures at most maxAgeSeconds old (if maxAgeSeconds is not 0),
+// and created at or after notBefore (if notBefore is not nil).
+func NewPRSignedByWithSignatureTimeLimits(pr PolicyRequirement, maxAgeSeconds int64, notBefore *time.Time) (PolicyRequirement, error) {
+	return newPRSignedByWithSignatureTimeLimits(pr, maxAgeSeconds, notBefore)
+}
+
 // Compile-time check that prSignedBy implements json.Unmarshaler.
 var _ json.Unmarshaler = (*prSignedBy)(nil)
 
@@ -350,6 +435,7 @@ func (pr *prSignedBy) UnmarshalJSON(data []byte) error {
 	*pr = prSignedBy{}
 	var tmp prSignedBy
 	var gotKeyPath, gotKeyData = false, false
+	var gotSignerKeyPath, gotSignerKeyData = false, false
 	var signedIdentity json.RawMessage
 	if err := paranoidUnmarshalJSONObject(data, func(key string) interface{} {
 		switch key {
@@ -363,8 +449,18 @@ func (pr *prSignedBy) UnmarshalJSON(data []byte) error {
 		case "keyData":
 			gotKeyData = true
 			return &tmp.KeyData
+		case "signerKeyPath":
+			gotSignerKeyPath = true
+			return &tmp.SignerKeyPath
+		case "signerKeyData":
+			gotSignerKeyData = true
+			return &tmp.SignerKeyData
 		case "signedIdentity":
 			return &signedIdentity
+		case "maxSignatureAgeSeconds":
+			return &tmp.MaxSignatureAgeSeconds
+		case "signedNotBefore":
+			return &tmp.SignedNotBefore
 		default:
 			return nil
 		}
@@ -385,15 +481,19 @@ func (pr *prSignedBy) UnmarshalJSON(data []byte) error {
 		tmp.SignedIdentity = si
 	}
 
+	if gotSignerKeyPath && gotSignerKeyData {
+		return InvalidPolicyFormatError("signerKeyPath and signerKeyData cannot be used simultaneously")
+	}
+
 	var res *prSignedBy
 	var err error
 	switch {
 	case gotKeyPath && gotKeyData:
 		return InvalidPolicyFormatError("keyPath and keyData cannot be used simultaneously")
 	case gotKeyPath && !gotKeyData:
-		res, err = newPRSignedByKeyPath(tmp.KeyType, tmp.KeyPath, tmp.SignedIdentity)
+		res, err = newPRSignedByWithSignerKeys(tmp.KeyType, tmp.KeyPath, nil, tmp.SignerKeyPath, tmp.SignerKeyData, tmp.SignedIdentity)
 	case !gotKeyPath && gotKeyData:
-		res, err = newPRSignedByKeyData(tmp.KeyType, tmp.KeyData, tmp.SignedIdentity)
+		res, err = newPRSignedByWithSignerKeys(tmp.KeyType, "", tmp.KeyData, tmp.SignerKeyPath, tmp.SignerKeyData, tmp.SignedIdentity)
 	case !gotKeyPath && !gotKeyData:
 		return InvalidPolicyFormatError("At least one of keyPath and keyData mus be specified")
 	default: // Coverage: This should never happen
@@ -402,6 +502,12 @@ func (pr *prSignedBy) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
+	if tmp.MaxSignatureAgeSeconds != 0 || tmp.SignedNotBefore != nil {
+		res, err = newPRSignedByWithSignatureTimeLimits(res, tmp.MaxSignatureAgeSeconds, tmp.SignedNotBefore)
+		if err != nil {
+			return err
+		}
+	}
 	*pr = *res
 
 	return nil
@@ -482,6 +588,74 @@ func (pr *prSignedBaseLayer) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// newPRSignedByThreshold is NewPRSignedByThreshold, except it returns the private type.
+func newPRSignedByThreshold(threshold int, signers map[string]PolicyRequirement) (*prSignedByThreshold, error) {
+	if len(signers) == 0 {
+		return nil, InvalidPolicyFormatError("signers not specified")
+	}
+	if threshold < 1 || threshold > len(signers) {
+		return nil, InvalidPolicyFormatError(fmt.Sprintf("threshold %d is out of range, must be between 1 and the number of signers (%d)", threshold, len(signers)))
+	}
+	s := map[string]*prSignedBy{}
+	for name, req := range signers {
+		if name == "" {
+			return nil, InvalidPolicyFormatError("Signer names must not be empty")
+		}
+		sb, ok := req.(*prSignedBy)
+		if !ok {
+			return nil, InvalidPolicyFormatError(fmt.Sprintf("Signer \"%s\" is not a \"%s\" requirement", name, prTypeSignedBy))
+		}
+		s[name] = sb
+	}
+	return &prSignedByThreshold{
+		prCommon:  prCommon{Type: prTypeSignedByThreshold},
+		Threshold: threshold,
+		Signers:   s,
+	}, nil
+}
+
+// NewPRSignedByThreshold returns a new "signedByThreshold" PolicyRequirement, accepting images signed by at least threshold of signers.
+// Each of signers must be a "signedBy" PolicyRequirement; the map keys are used to identify the signers in error messages.
+func NewPRSignedByThreshold(threshold int, signers map[string]PolicyRequirement) (PolicyRequirement, error) {
+	return newPRSignedByThreshold(threshold, signers)
+}
+
+// Compile-time check that prSignedByThreshold implements json.Unmarshaler.
+var _ json.Unmarshaler = (*prSignedByThreshold)(nil)
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (pr *prSignedByThreshold) UnmarshalJSON(data []byte) error {
+	*pr = prSignedByThreshold{}
+	var tmp prSignedByThreshold
+	var signersJSON json.RawMessage
+	if err := paranoidUnmarshalJSONObjectExactFields(data, map[string]interface{}{
+		"type":      &tmp.Type,
+		"threshold": &tmp.Threshold,
+		"signers":   &signersJSON,
+	}); err != nil {
+		return err
+	}
+
+	if tmp.Type != prTypeSignedByThreshold {
+		return InvalidPolicyFormatError(fmt.Sprintf("Unexpected policy requirement type \"%s\"", tmp.Type))
+	}
+	signers := map[string]PolicyRequirement{}
+	if err := paranoidUnmarshalJSONObject(signersJSON, func(key string) interface{} {
+		// prSignedBy.UnmarshalJSON rejects requirements of other types.
+		sb := &prSignedBy{}
+		signers[key] = sb
+		return sb
+	}); err != nil {
+		return err
+	}
+	res, err := newPRSignedByThreshold(tmp.Threshold, signers)
+	if err != nil {
+		return err
+	}
+	*pr = *res
+	return nil
+}
+
 // newPolicyReferenceMatchFromJSON parses JSON data into a PolicyReferenceMatch implementation.
 func newPolicyReferenceMatchFromJSON(data []byte) (PolicyReferenceMatch, error) {
 	var typeField prmCommon
@@ -3,9 +3,11 @@ package signature
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/containers/image/directory"
 	"github.com/containers/image/docker"
@@ -50,6 +52,19 @@ var policyFixtureContents = &Policy{
 					"/keys/public-key-signing-ca-file",
 					NewPRMMatchRepoDigestOrExact()),
 			},
+			"example.com/release": {
+				xNewPRSignedByThreshold(2, map[string]PolicyRequirement{
+					"build": xNewPRSignedByKeyPath(SBKeyTypeGPGKeys,
+						"/keys/build-system-gpg-keyring",
+						NewPRMMatchRepoDigestOrExact()),
+					"qa": xNewPRSignedByKeyPath(SBKeyTypeGPGKeys,
+						"/keys/qa-gpg-keyring",
+						NewPRMMatchRepoDigestOrExact()),
+					"security": xNewPRSignedByKeyPath(SBKeyTypeX509Certificates,
+						"/keys/security-cert-file",
+						NewPRMMatchRepoDigestOrExact()),
+				}),
+			},
 			"registry.access.redhat.com": {
 				xNewPRSignedByKeyPath(SBKeyTypeSignedByGPGKeys,
 					"/keys/RH-key-signing-key-gpg-keyring",
@@ -223,6 +238,32 @@ func xNewPRSignedByKeyData(keyType sbKeyType, keyData []byte, signedIdentity Pol
 	return pr
 }
 
+// xNewPRSignedByGPGKeysWithSignerKeyPath is like NewPRSignedByGPGKeysWithSignerKeyPath, except it must not fail.
+func xNewPRSignedByGPGKeysWithSignerKeyPath(keyPath, signerKeyPath string, signedIdentity PolicyReferenceMatch) PolicyRequirement {
+	pr, err := NewPRSignedByGPGKeysWithSignerKeyPath(keyPath, signerKeyPath, signedIdentity)
+	if err != nil {
+		panic("xNewPRSignedByGPGKeysWithSignerKeyPath failed")
+	}
+	return pr
+}
+
+// xNewPRSignedByGPGKeysWithSignerKeyData is like NewPRSignedByGPGKeysWithSignerKeyData, except it must not fail.
+func xNewPRSignedByWithSignatureTimeLimits(pr PolicyRequirement, maxAgeSeconds int64, notBefore *time.Time) PolicyRequirement {
+	res, err := NewPRSignedByWithSignatureTimeLimits(pr, maxAgeSeconds, notBefore)
+	if err != nil {
+		panic("xNewPRSignedByWithSignatureTimeLimits failed")
+	}
+	return res
+}
+
+func xNewPRSignedByGPGKeysWithSignerKeyData(keyData, signerKeyData []byte, signedIdentity PolicyReferenceMatch) PolicyRequirement {
+	pr, err := NewPRSignedByGPGKeysWithSignerKeyData(keyData, signerKeyData, signedIdentity)
+	if err != nil {
+		panic("xNewPRSignedByGPGKeysWithSignerKeyData failed")
+	}
+	return pr
+}
+
 func TestPolicyUnmarshalJSON(t *testing.T) {
 	var p Policy
 
@@ -253,6 +294,7 @@ func TestPolicyUnmarshalJSON(t *testing.T) {
 				},
 			},
 		},
+		Revocations: &PolicyRevocations{Path: "/etc/containers/revocations.json", KeyPath: "/etc/pki/revocations.gpg"},
 	}
 	validJSON, err := json.Marshal(validPolicy)
 	require.NoError(t, err)
@@ -277,6 +319,9 @@ func TestPolicyUnmarshalJSON(t *testing.T) {
 		func(v mSI) { v["transports"] = []string{} },
 		// "default" is an invalid PolicyRequirements
 		func(v mSI) { v["default"] = PolicyRequirements{} },
+		// "revocations" is not a valid PolicyRevocations
+		func(v mSI) { v["revocations"] = 1 },
+		func(v mSI) { v["revocations"] = mSI{} },
 	}
 	for _, fn := range breakFns {
 		err = tryUnmarshalModifiedPolicy(t, &p, validJSON, fn)
@@ -284,7 +329,7 @@ func TestPolicyUnmarshalJSON(t *testing.T) {
 	}
 
 	// Duplicated fields
-	for _, field := range []string{"default", "transports"} {
+	for _, field := range []string{"default", "transports", "revocations"} {
 		var tmp mSI
 		err := json.Unmarshal(validJSON, &tmp)
 		require.NoError(t, err)
@@ -302,6 +347,8 @@ func TestPolicyUnmarshalJSON(t *testing.T) {
 		func(v mSI) { delete(v, "transports") },
 		// Use an empty map of transport-specific scopes
 		func(v mSI) { v["transports"] = map[string]PolicyTransportScopes{} },
+		// Delete the revocation list
+		func(v mSI) { delete(v, "revocations") },
 	}
 	for _, fn := range allowedModificationFns {
 		err = tryUnmarshalModifiedPolicy(t, &p, validJSON, fn)
@@ -309,6 +356,58 @@ func TestPolicyUnmarshalJSON(t *testing.T) {
 	}
 }
 
+func TestPolicyRevocationsUnmarshalJSON(t *testing.T) {
+	var pr PolicyRevocations
+
+	testInvalidJSONInput(t, &pr)
+
+	// Start with a valid JSON.
+	validPR := PolicyRevocations{Path: "/etc/containers/revocations.json", KeyPath: "/etc/pki/revocations.gpg"}
+	validJSON, err := json.Marshal(validPR)
+	require.NoError(t, err)
+
+	// Success
+	pr = PolicyRevocations{}
+	err = json.Unmarshal(validJSON, &pr)
+	require.NoError(t, err)
+	assert.Equal(t, validPR, pr)
+
+	// Success without a key
+	pr = PolicyRevocations{}
+	err = json.Unmarshal([]byte(`{"path":"/etc/containers/revocations.json"}`), &pr)
+	require.NoError(t, err)
+	assert.Equal(t, PolicyRevocations{Path: "/etc/containers/revocations.json"}, pr)
+
+	// Various ways to corrupt the JSON
+	for _, invalid := range []string{
+		// The "path" field is missing or empty
+		`{}`,
+		`{"keyPath":"/etc/pki/revocations.gpg"}`,
+		`{"path":""}`,
+		// Invalid field types
+		`{"path":1}`,
+		`{"path":"/etc/containers/revocations.json","keyPath":1}`,
+		// Extra top-level sub-object
+		`{"path":"/etc/containers/revocations.json","unexpected":1}`,
+	} {
+		err = json.Unmarshal([]byte(invalid), &pr)
+		assert.Error(t, err, invalid)
+	}
+
+	// Duplicated fields
+	for _, field := range []string{"path", "keyPath"} {
+		var tmp mSI
+		err := json.Unmarshal(validJSON, &tmp)
+		require.NoError(t, err)
+
+		testJSON := addExtraJSONMember(t, validJSON, field, tmp[field])
+
+		pr = PolicyRevocations{}
+		err = json.Unmarshal(testJSON, &pr)
+		assert.Error(t, err)
+	}
+}
+
 func TestPolicyTransportScopesUnmarshalJSON(t *testing.T) {
 	var pts PolicyTransportScopes
 
@@ -694,6 +793,105 @@ func TestNewPRSignedByKeyData(t *testing.T) {
 	// Failure cases tested in TestNewPRSignedBy.
 }
 
+func TestNewPRSignedByWithSignerKeys(t *testing.T) {
+	const testPath, testSignerPath = "/foo/bar", "/foo/signers"
+	testData, testSignerData := []byte("abc"), []byte("def")
+	testIdentity := NewPRMMatchRepoDigestOrExact()
+
+	// Success
+	pr, err := newPRSignedByWithSignerKeys(SBKeyTypeSignedByGPGKeys, testPath, nil, testSignerPath, nil, testIdentity)
+	require.NoError(t, err)
+	assert.Equal(t, &prSignedBy{
+		prCommon:       prCommon{prTypeSignedBy},
+		KeyType:        SBKeyTypeSignedByGPGKeys,
+		KeyPath:        testPath,
+		SignerKeyPath:  testSignerPath,
+		SignedIdentity: testIdentity,
+	}, pr)
+	pr, err = newPRSignedByWithSignerKeys(SBKeyTypeSignedByGPGKeys, "", testData, "", testSignerData, testIdentity)
+	require.NoError(t, err)
+	assert.Equal(t, &prSignedBy{
+		prCommon:       prCommon{prTypeSignedBy},
+		KeyType:        SBKeyTypeSignedByGPGKeys,
+		KeyData:        testData,
+		SignerKeyData:  testSignerData,
+		SignedIdentity: testIdentity,
+	}, pr)
+	// No signer keys are accepted with any keyType
+	pr, err = newPRSignedByWithSignerKeys(SBKeyTypeGPGKeys, testPath, nil, "", nil, testIdentity)
+	require.NoError(t, err)
+
+	// Signer keys with a keyType other than signedByGPGKeys
+	for _, keyType := range []sbKeyType{SBKeyTypeGPGKeys, SBKeyTypeX509Certificates, SBKeyTypeSignedByX509CAs} {
+		_, err = newPRSignedByWithSignerKeys(keyType, testPath, nil, testSignerPath, nil, testIdentity)
+		assert.Error(t, err)
+	}
+
+	// Both signerKeyPath and signerKeyData specified
+	_, err = newPRSignedByWithSignerKeys(SBKeyTypeSignedByGPGKeys, testPath, nil, testSignerPath, testSignerData, testIdentity)
+	assert.Error(t, err)
+
+	// Failures of newPRSignedBy are propagated
+	_, err = newPRSignedByWithSignerKeys(SBKeyTypeSignedByGPGKeys, testPath, testData, testSignerPath, nil, testIdentity)
+	assert.Error(t, err)
+}
+
+func TestNewPRSignedByGPGKeysWithSignerKeyPath(t *testing.T) {
+	const testPath, testSignerPath = "/foo/bar", "/foo/signers"
+	_pr, err := NewPRSignedByGPGKeysWithSignerKeyPath(testPath, testSignerPath, NewPRMMatchRepoDigestOrExact())
+	require.NoError(t, err)
+	pr, ok := _pr.(*prSignedBy)
+	require.True(t, ok)
+	assert.Equal(t, SBKeyTypeSignedByGPGKeys, pr.KeyType)
+	assert.Equal(t, testPath, pr.KeyPath)
+	assert.Equal(t, testSignerPath, pr.SignerKeyPath)
+	// Failure cases tested in TestNewPRSignedByWithSignerKeys.
+}
+
+func TestNewPRSignedByGPGKeysWithSignerKeyData(t *testing.T) {
+	testData, testSignerData := []byte("abc"), []byte("def")
+	_pr, err := NewPRSignedByGPGKeysWithSignerKeyData(testData, testSignerData, NewPRMMatchRepoDigestOrExact())
+	require.NoError(t, err)
+	pr, ok := _pr.(*prSignedBy)
+	require.True(t, ok)
+	assert.Equal(t, SBKeyTypeSignedByGPGKeys, pr.KeyType)
+	assert.Equal(t, testData, pr.KeyData)
+	assert.Equal(t, testSignerData, pr.SignerKeyData)
+	// Failure cases tested in TestNewPRSignedByWithSignerKeys.
+}
+
+func TestNewPRSignedByWithSignatureTimeLimits(t *testing.T) {
+	basePR := xNewPRSignedByKeyData(SBKeyTypeGPGKeys, []byte("abc"), NewPRMMatchRepoDigestOrExact())
+	notBefore := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, c := range []struct {
+		maxAgeSeconds int64
+		notBefore     *time.Time
+	}{
+		{0, nil},
+		{86400, nil},
+		{0, &notBefore},
+		{86400, &notBefore},
+	} {
+		_pr, err := NewPRSignedByWithSignatureTimeLimits(basePR, c.maxAgeSeconds, c.notBefore)
+		require.NoError(t, err)
+		pr, ok := _pr.(*prSignedBy)
+		require.True(t, ok)
+		assert.Equal(t, c.maxAgeSeconds, pr.MaxSignatureAgeSeconds)
+		assert.Equal(t, c.notBefore, pr.SignedNotBefore)
+		assert.Equal(t, []byte("abc"), pr.KeyData)
+		// The original requirement is not modified
+		assert.Equal(t, xNewPRSignedByKeyData(SBKeyTypeGPGKeys, []byte("abc"), NewPRMMatchRepoDigestOrExact()), basePR)
+	}
+
+	// Negative maximum age
+	_, err := NewPRSignedByWithSignatureTimeLimits(basePR, -1, nil)
+	assert.Error(t, err)
+	// Not a signedBy requirement
+	_, err = NewPRSignedByWithSignatureTimeLimits(NewPRInsecureAcceptAnything(), 86400, nil)
+	assert.Error(t, err)
+}
+
 // Return the result of modifying vaoidJSON with fn and unmarshalingit into *pr
 func tryUnmarshalModifiedSignedBy(t *testing.T, pr *prSignedBy, validJSON []byte, modifyFn func(mSI)) error {
 	var tmp mSI
@@ -736,6 +934,34 @@ func TestPRSignedByUnmarshalJSON(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, kpPR, &pr)
 
+	// Success with signature time limits
+	notBefore := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, limitedPR := range []PolicyRequirement{
+		xNewPRSignedByWithSignatureTimeLimits(validPR, 86400, nil),
+		xNewPRSignedByWithSignatureTimeLimits(validPR, 0, &notBefore),
+		xNewPRSignedByWithSignatureTimeLimits(validPR, 86400, &notBefore),
+	} {
+		testJSON, err := json.Marshal(limitedPR)
+		require.NoError(t, err)
+		pr = prSignedBy{}
+		err = json.Unmarshal(testJSON, &pr)
+		require.NoError(t, err)
+		assert.Equal(t, limitedPR, &pr)
+	}
+
+	// Success with SignerKeyPath and SignerKeyData
+	for _, signerPR := range []PolicyRequirement{
+		xNewPRSignedByGPGKeysWithSignerKeyPath("/foo/bar", "/foo/signers", NewPRMMatchRepoDigestOrExact()),
+		xNewPRSignedByGPGKeysWithSignerKeyData([]byte("abc"), []byte("def"), NewPRMMatchRepoDigestOrExact()),
+	} {
+		testJSON, err := json.Marshal(signerPR)
+		require.NoError(t, err)
+		pr = prSignedBy{}
+		err = json.Unmarshal(testJSON, &pr)
+		require.NoError(t, err)
+		assert.Equal(t, signerPR, &pr)
+	}
+
 	// newPolicyRequirementFromJSON recognizes this type
 	_pr, err := newPolicyRequirementFromJSON(validJSON)
 	require.NoError(t, err)
@@ -750,6 +976,19 @@ func TestPRSignedByUnmarshalJSON(t *testing.T) {
 		func(v mSI) { v["type"] = "this is invalid" },
 		// Extra top-level sub-object
 		func(v mSI) { v["unexpected"] = 1 },
+		// "signerKeyPath" or "signerKeyData" with a keyType other than "signedByGPGKeys"
+		func(v mSI) { v["signerKeyPath"] = "/foo/signers" },
+		func(v mSI) { v["signerKeyData"] = []byte("def") },
+		// Both "signerKeyPath" and "signerKeyData" is present
+		func(v mSI) {
+			v["keyType"] = SBKeyTypeSignedByGPGKeys
+			v["signerKeyPath"] = "/foo/signers"
+			v["signerKeyData"] = []byte("def")
+		},
+		// Invalid "signerKeyPath" field
+		func(v mSI) { v["keyType"] = SBKeyTypeSignedByGPGKeys; v["signerKeyPath"] = 1 },
+		// Invalid "signerKeyData" field
+		func(v mSI) { v["keyType"] = SBKeyTypeSignedByGPGKeys; v["signerKeyData"] = "this is invalid base64" },
 		// The "keyType" field is missing
 		func(v mSI) { delete(v, "keyType") },
 		// Invalid "keyType" field
@@ -768,6 +1007,14 @@ func TestPRSignedByUnmarshalJSON(t *testing.T) {
 		func(v mSI) { v["signedIdentity"] = "this is invalid" },
 		// "signedIdentity" an explicit nil
 		func(v mSI) { v["signedIdentity"] = nil },
+		// Invalid "maxSignatureAgeSeconds" field
+		func(v mSI) { v["maxSignatureAgeSeconds"] = "this is invalid" },
+		func(v mSI) { v["maxSignatureAgeSeconds"] = 1.5 },
+		func(v mSI) { v["maxSignatureAgeSeconds"] = -1 },
+		// Invalid "signedNotBefore" field
+		func(v mSI) { v["signedNotBefore"] = 1 },
+		func(v mSI) { v["signedNotBefore"] = "this is invalid" },
+		func(v mSI) { v["signedNotBefore"] = "2018-01-01" },
 	}
 	for _, fn := range breakFns {
 		err = tryUnmarshalModifiedSignedBy(t, &pr, validJSON, fn)
@@ -960,6 +1207,147 @@ func TestPRSignedBaseLayerUnmarshalJSON(t *testing.T) {
 	}
 }
 
+// xNewPRSignedByThreshold is like NewPRSignedByThreshold, except it must not fail.
+func xNewPRSignedByThreshold(threshold int, signers map[string]PolicyRequirement) PolicyRequirement {
+	pr, err := NewPRSignedByThreshold(threshold, signers)
+	if err != nil {
+		panic("xNewPRSignedByThreshold failed")
+	}
+	return pr
+}
+
+func TestNewPRSignedByThreshold(t *testing.T) {
+	build := xNewPRSignedByKeyPath(SBKeyTypeGPGKeys, "/foo/build.gpg", NewPRMMatchRepoDigestOrExact())
+	qa := xNewPRSignedByKeyData(SBKeyTypeX509Certificates, []byte("qa"), NewPRMMatchRepository())
+
+	// Success
+	_pr, err := NewPRSignedByThreshold(2, map[string]PolicyRequirement{"build": build, "qa": qa})
+	require.NoError(t, err)
+	pr, ok := _pr.(*prSignedByThreshold)
+	require.True(t, ok)
+	assert.Equal(t, &prSignedByThreshold{
+		prCommon:  prCommon{prTypeSignedByThreshold},
+		Threshold: 2,
+		Signers:   map[string]*prSignedBy{"build": build.(*prSignedBy), "qa": qa.(*prSignedBy)},
+	}, pr)
+
+	// Invalid threshold
+	for _, threshold := range []int{-1, 0, 3} {
+		_, err = NewPRSignedByThreshold(threshold, map[string]PolicyRequirement{"build": build, "qa": qa})
+		assert.Error(t, err, fmt.Sprintf("%d", threshold))
+	}
+	// No signers
+	_, err = NewPRSignedByThreshold(1, map[string]PolicyRequirement{})
+	assert.Error(t, err)
+	_, err = NewPRSignedByThreshold(1, nil)
+	assert.Error(t, err)
+	// Empty signer name
+	_, err = NewPRSignedByThreshold(1, map[string]PolicyRequirement{"": build})
+	assert.Error(t, err)
+	// Signers which are not "signedBy"
+	for _, invalid := range []PolicyRequirement{nil, NewPRInsecureAcceptAnything(), NewPRReject(),
+		xNewPRSignedByThreshold(1, map[string]PolicyRequirement{"build": build})} {
+		_, err = NewPRSignedByThreshold(1, map[string]PolicyRequirement{"build": build, "invalid": invalid})
+		assert.Error(t, err, fmt.Sprintf("%#v", invalid))
+	}
+}
+
+func TestPRSignedByThresholdUnmarshalJSON(t *testing.T) {
+	var pr prSignedByThreshold
+
+	testInvalidJSONInput(t, &pr)
+
+	// Start with a valid JSON.
+	validPR := xNewPRSignedByThreshold(2, map[string]PolicyRequirement{
+		"build":    xNewPRSignedByKeyPath(SBKeyTypeGPGKeys, "/foo/build.gpg", NewPRMMatchRepoDigestOrExact()),
+		"qa":       xNewPRSignedByKeyData(SBKeyTypeX509Certificates, []byte("qa"), NewPRMMatchRepository()),
+		"security": xNewPRSignedByGPGKeysWithSignerKeyPath("/foo/ca.gpg", "/foo/security.gpg", NewPRMMatchExact()),
+	})
+	validJSON, err := json.Marshal(validPR)
+	require.NoError(t, err)
+
+	// Success
+	pr = prSignedByThreshold{}
+	err = json.Unmarshal(validJSON, &pr)
+	require.NoError(t, err)
+	assert.Equal(t, validPR, &pr)
+
+	// newPolicyRequirementFromJSON recognizes this type
+	_pr, err := newPolicyRequirementFromJSON(validJSON)
+	require.NoError(t, err)
+	assert.Equal(t, validPR, _pr)
+
+	// Various ways to corrupt the JSON
+	breakFns := []func(mSI){
+		// The "type" field is missing
+		func(v mSI) { delete(v, "type") },
+		// Wrong "type" field
+		func(v mSI) { v["type"] = 1 },
+		func(v mSI) { v["type"] = "this is invalid" },
+		// Extra top-level sub-object
+		func(v mSI) { v["unexpected"] = 1 },
+		// The "threshold" field is missing
+		func(v mSI) { delete(v, "threshold") },
+		// Invalid "threshold" field
+		func(v mSI) { v["threshold"] = "2" },
+		func(v mSI) { v["threshold"] = 1.5 },
+		func(v mSI) { v["threshold"] = 0 },
+		func(v mSI) { v["threshold"] = 4 },
+		// The "signers" field is missing
+		func(v mSI) { delete(v, "signers") },
+		// Invalid "signers" field
+		func(v mSI) { v["signers"] = 1 },
+		func(v mSI) { v["signers"] = []interface{}{} },
+		func(v mSI) { v["signers"] = nil },
+		func(v mSI) { v["signers"] = mSI{} },
+		// Invalid signer
+		func(v mSI) { x(v, "signers")["qa"] = 1 },
+		func(v mSI) { x(v, "signers")["qa"] = nil },
+		func(v mSI) { x(v, "signers")["qa"] = NewPRInsecureAcceptAnything() },
+		func(v mSI) { x(v, "signers")["qa"] = mSI{"type": prTypeSignedBy, "keyType": "this is invalid"} },
+		// Empty signer name
+		func(v mSI) { x(v, "signers")[""] = x(v, "signers")["qa"] },
+	}
+	for _, fn := range breakFns {
+		var tmp mSI
+		err := json.Unmarshal(validJSON, &tmp)
+		require.NoError(t, err)
+
+		fn(tmp)
+
+		testJSON, err := json.Marshal(tmp)
+		require.NoError(t, err)
+
+		pr = prSignedByThreshold{}
+		err = json.Unmarshal(testJSON, &pr)
+		assert.Error(t, err, string(testJSON))
+	}
+
+	// Duplicated fields
+	for _, field := range []string{"type", "threshold", "signers"} {
+		var tmp mSI
+		err := json.Unmarshal(validJSON, &tmp)
+		require.NoError(t, err)
+
+		testJSON := addExtraJSONMember(t, validJSON, field, tmp[field])
+
+		pr = prSignedByThreshold{}
+		err = json.Unmarshal(testJSON, &pr)
+		assert.Error(t, err)
+	}
+	// Duplicated signer names
+	var tmp mSI
+	err = json.Unmarshal(validJSON, &tmp)
+	require.NoError(t, err)
+	signersJSON, err := json.Marshal(x(tmp, "signers"))
+	require.NoError(t, err)
+	duplicateJSON := addExtraJSONMember(t, signersJSON, "qa", x(tmp, "signers")["qa"])
+	testJSON := addExtraJSONMember(t, []byte(`{"type":"signedByThreshold","threshold":1}`), "signers", json.RawMessage(duplicateJSON))
+	pr = prSignedByThreshold{}
+	err = json.Unmarshal(testJSON, &pr)
+	assert.Error(t, err, string(testJSON))
+}
+
 func TestNewPolicyReferenceMatchFromJSON(t *testing.T) {
 	// Sample success. Others tested in the individual PolicyReferenceMatch.UnmarshalJSON implementations.
 	validPRM := NewPRMMatchRepoDigestOrExact()
@@ -78,7 +78,30 @@ type PolicyReferenceMatch interface {
 // for speeding up its evaluation.
 type PolicyContext struct {
 	Policy *Policy
-	state  policyContextState // Internal consistency checking
+	// SystemContext, if not nil, is used to access other images referenced by the policy (e.g. the base images of signedBaseLayer),
+	// and to choose the instance for the current platform when comparing images which are manifest lists.
+	SystemContext *types.SystemContext
+	state         policyContextState // Internal consistency checking
+	revocations   *revocationList    // Loaded from Policy.Revocations; nil if not configured
+}
+
+// policyContextKey is the context.Context key used to make the PolicyContext being evaluated available
+// to requirements which need to evaluate the policy for other images (e.g. signedBaseLayer).
+type policyContextKey struct{}
+
+// policyContextFromContext returns the PolicyContext being evaluated in ctx, or nil if there is none.
+func policyContextFromContext(ctx context.Context) *PolicyContext {
+	pc, _ := ctx.Value(policyContextKey{}).(*PolicyContext)
+	return pc
+}
+
+// revocationsFromContext returns the revocation list of the PolicyContext being evaluated in ctx,
+// or nil if there is none.
+func revocationsFromContext(ctx context.Context) *revocationList {
+	if pc := policyContextFromContext(ctx); pc != nil {
+		return pc.revocations
+	}
+	return nil
 }
 
 // policyContextState is used internally to verify the users are not misusing a PolicyContext.
@@ -104,9 +127,18 @@ func (pc *PolicyContext) changeState(expected, new policyContextState) error {
 
 // NewPolicyContext sets up and initializes a context for the specified policy.
 // The policy must not be modified while the context exists. FIXME: make a deep copy?
+// The revocation list referenced by policy.Revocations, if any, is read only once here;
+// create a new context to use an updated revocation list.
 // If this function succeeds, the caller should call PolicyContext.Destroy() when done.
 func NewPolicyContext(policy *Policy) (*PolicyContext, error) {
 	pc := &PolicyContext{Policy: policy, state: pcInitializing}
+	if policy.Revocations != nil {
+		revocations, err := loadRevocationList(policy.Revocations)
+		if err != nil {
+			return nil, err
+		}
+		pc.revocations = revocations
+	}
 	// FIXME: initialize
 	if err := pc.changeState(pcInitializing, pcReady); err != nil {
 		// Huh?! This should never fail, we didn't give the pointer to anybody.
@@ -133,6 +165,14 @@ func policyIdentityLogName(ref types.ImageReference) string {
 
 // requirementsForImageRef selects the appropriate requirements for ref.
 func (pc *PolicyContext) requirementsForImageRef(ref types.ImageReference) PolicyRequirements {
+	reqs, _, _ := pc.policyScopeForImageRef(ref)
+	return reqs
+}
+
+// policyScopeForImageRef selects the appropriate requirements for ref, and also returns the scope
+// within pc.Policy.Transports[ref.Transport().Name()] they were found in, and whether such a scope was found at all
+// (if not, the requirements are pc.Policy.Default).
+func (pc *PolicyContext) policyScopeForImageRef(ref types.ImageReference) (PolicyRequirements, string, bool) {
 	// Do we have a PolicyTransportScopes for this transport?
 	transportName := ref.Transport().Name()
 	if transportScopes, ok := pc.Policy.Transports[transportName]; ok {
@@ -140,26 +180,26 @@ func (pc *PolicyContext) requirementsForImageRef(ref types.ImageReference) Polic
 		identity := ref.PolicyConfigurationIdentity()
 		if req, ok := transportScopes[identity]; ok {
 			logrus.Debugf(` Using transport "%s" policy section %s`, transportName, identity)
-			return req
+			return req, identity, true
 		}
 
 		// Look for a match of the possible parent namespaces.
 		for _, name := range ref.PolicyConfigurationNamespaces() {
 			if req, ok := transportScopes[name]; ok {
 				logrus.Debugf(` Using transport "%s" specific policy section %s`, transportName, name)
-				return req
+				return req, name, true
 			}
 		}
 
 		// Look for a default match for the transport.
 		if req, ok := transportScopes[""]; ok {
 			logrus.Debugf(` Using transport "%s" policy section ""`, transportName)
-			return req
+			return req, "", true
 		}
 	}
 
 	logrus.Debugf(" Using default policy section")
-	return pc.Policy.Default
+	return pc.Policy.Default, "", false
 }
 
 // GetSignaturesWithAcceptedAuthor returns those signatures from an image
@@ -188,6 +228,7 @@ func (pc *PolicyContext) GetSignaturesWithAcceptedAuthor(ctx context.Context, im
 
 	logrus.Debugf("GetSignaturesWithAcceptedAuthor for image %s", policyIdentityLogName(image.Reference()))
 	reqs := pc.requirementsForImageRef(image.Reference())
+	ctx = context.WithValue(ctx, policyContextKey{}, pc)
 
 	// FIXME: rename Signatures to UnverifiedSignatures
 	// FIXME: pass context.Context
@@ -216,7 +257,7 @@ func (pc *PolicyContext) GetSignaturesWithAcceptedAuthor(ctx context.Context, im
 				logrus.Debugf(" Requirement %d: signature accepted", reqNumber)
 				if acceptedSig == nil {
 					acceptedSig = as
-				} else if *as != *acceptedSig { // Coverage: this should never happen
+				} else if !as.equal(acceptedSig) { // Coverage: this should never happen
 					// Huh?! Two ways of verifying the same signature blob resulted in two different parses of its already accepted contents?
 					logrus.Debugf(" Requirement %d: internal inconsistency: sarAccepted but different parsed contents", reqNumber)
 					rejected = true
@@ -267,22 +308,91 @@ func (pc *PolicyContext) IsRunningImageAllowed(ctx context.Context, image types.
 		}
 	}()
 
+	return pc.isRunningImageAllowed(ctx, image)
+}
+
+// IsRunningImageAllowedWithReport is IsRunningImageAllowed, but it also returns a report describing the evaluation
+// (the policy scope which applied to the image, and the results of individual requirements and signatures),
+// intended for diagnosing why an image was rejected.
+// Unlike IsRunningImageAllowed, all requirements are evaluated even after one of them rejects the image.
+// The report is returned even if the image is rejected; it is nil only if the evaluation could not be started at all.
+// WARNING: This validates signatures and the manifest, but does not download or validate the
+// layers. Users must validate that the layers match their expected digests.
+func (pc *PolicyContext) IsRunningImageAllowedWithReport(ctx context.Context, image types.UnparsedImage) (res bool, report *PolicyEvaluationReport, finalErr error) {
+	if err := pc.changeState(pcReady, pcInUse); err != nil {
+		return false, nil, err
+	}
+	defer func() {
+		if err := pc.changeState(pcInUse, pcReady); err != nil {
+			res = false
+			finalErr = err
+		}
+	}()
+
+	report = &PolicyEvaluationReport{}
+	res, finalErr = pc.evaluateRunningImage(ctx, image, report)
+	return res, report, finalErr
+}
+
+// isRunningImageAllowed is IsRunningImageAllowed, for a pc which is already in use.
+// It can be used to evaluate the policy for other images while evaluating a requirement.
+func (pc *PolicyContext) isRunningImageAllowed(ctx context.Context, image types.UnparsedImage) (bool, error) {
+	return pc.evaluateRunningImage(ctx, image, nil)
+}
+
+// evaluateRunningImage is isRunningImageAllowed; if report is not nil, it is filled with details of the evaluation,
+// and all requirements are evaluated even after one of them rejects the image.
+func (pc *PolicyContext) evaluateRunningImage(ctx context.Context, image types.UnparsedImage, report *PolicyEvaluationReport) (bool, error) {
 	logrus.Debugf("IsRunningImageAllowed for image %s", policyIdentityLogName(image.Reference()))
-	reqs := pc.requirementsForImageRef(image.Reference())
+	reqs, scope, transportScoped := pc.policyScopeForImageRef(image.Reference())
+	if report != nil {
+		report.Transport = image.Reference().Transport().Name()
+		report.Scope = scope
+		report.DefaultPolicy = !transportScoped
+	}
 
 	if len(reqs) == 0 {
 		return false, PolicyRequirementError("List of verification policy requirements must not be empty")
 	}
 
+	ctx = context.WithValue(ctx, policyContextKey{}, pc)
+	var rejection error // The error returned by the first requirement which rejected the image, if report != nil
+	rejected := false
 	for reqNumber, req := range reqs {
+		var rr *PolicyRequirementReport // nil if report == nil; always set, so that reports of enclosing evaluations are not modified
+		if report != nil {
+			rr = &PolicyRequirementReport{}
+			if c, ok := req.(interface{ typeIdentifier() prTypeIdentifier }); ok {
+				rr.Type = string(c.typeIdentifier())
+			}
+		}
 		// FIXME: supply state
-		allowed, err := req.isRunningImageAllowed(ctx, image)
+		allowed, err := req.isRunningImageAllowed(context.WithValue(ctx, requirementReportKey{}, rr), image)
+		if rr != nil {
+			rr.Allowed = allowed
+			if !allowed {
+				rr.Error = err
+			}
+			report.Requirements = append(report.Requirements, *rr)
+		}
 		if !allowed {
-			logrus.Debugf("Requirement %d: denied, done", reqNumber)
-			return false, err
+			if report == nil {
+				logrus.Debugf("Requirement %d: denied, done", reqNumber)
+				return false, err
+			}
+			logrus.Debugf("Requirement %d: denied", reqNumber)
+			if !rejected {
+				rejected = true
+				rejection = err
+			}
+			continue
 		}
 		logrus.Debugf(" Requirement %d: allowed", reqNumber)
 	}
+	if rejected {
+		logrus.Debugf("Overall: denied")
+		return false, rejection
+	}
 	// We have tested that len(reqs) != 0, so at least one req must have explicitly allowed this image.
 	logrus.Debugf("Overall: allowed")
 	return true, nil
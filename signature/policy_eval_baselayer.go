@@ -4,17 +4,166 @@ package signature
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/image"
+	"github.com/containers/image/internal/iolimits"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/blobinfocache"
+	"github.com/containers/image/transports"
 	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// newBaseImageReference returns a types.ImageReference for the base image identified by ref.
+// The "docker" transport is used through the transports registry, so it must have been registered by the caller
+// (e.g. by importing the alltransports package).
+// This is a variable so that tests can use base images in other transports.
+var newBaseImageReference = func(ref reference.Named) (types.ImageReference, error) {
+	transport := transports.Get("docker")
+	if transport == nil {
+		return nil, errors.New(`signedBaseLayer requires the "docker" transport, which is not available`)
+	}
+	return transport.ParseReference("//" + ref.String())
+}
+
+// baseImageChainKey is the context.Context key for the base image references (as strings) being evaluated,
+// used to detect cycles in signedBaseLayer requirements.
+type baseImageChainKey struct{}
+
 func (pr *prSignedBaseLayer) isSignatureAuthorAccepted(ctx context.Context, image types.UnparsedImage, sig []byte) (signatureAcceptanceResult, *Signature, error) {
 	return sarUnknown, nil, nil
 }
 
-func (pr *prSignedBaseLayer) isRunningImageAllowed(ctx context.Context, image types.UnparsedImage) (bool, error) {
-	// FIXME? Reject this at policy parsing time already?
-	logrus.Errorf("signedBaseLayer not implemented yet!")
-	return false, PolicyRequirementError("signedBaseLayer not implemented yet!")
+func (pr *prSignedBaseLayer) isRunningImageAllowed(ctx context.Context, unparsedImage types.UnparsedImage) (bool, error) {
+	pc := policyContextFromContext(ctx)
+	if pc == nil {
+		return false, errors.New("Internal error: signedBaseLayer evaluated outside of a PolicyContext")
+	}
+	// The base image must be a specific image; the other PolicyReferenceMatch types only describe
+	// relationships between an image and its signatures.
+	exactRef, ok := pr.BaseLayerIdentity.(*prmExactReference)
+	if !ok {
+		return false, PolicyRequirementError(`signedBaseLayer requires an "exactReference" baseLayerIdentity`)
+	}
+	baseRef, err := reference.ParseNormalizedNamed(exactRef.DockerReference)
+	if err != nil {
+		return false, err
+	}
+
+	chain, _ := ctx.Value(baseImageChainKey{}).([]string)
+	for _, r := range chain {
+		if r == baseRef.String() {
+			return false, PolicyRequirementError(fmt.Sprintf("signedBaseLayer requirements form a cycle at base image %s", baseRef.String()))
+		}
+	}
+	ctx = context.WithValue(ctx, baseImageChainKey{}, append(chain[:len(chain):len(chain)], baseRef.String()))
+
+	baseImageRef, err := newBaseImageReference(baseRef)
+	if err != nil {
+		return false, err
+	}
+	baseSrc, err := baseImageRef.NewImageSource(ctx, pc.SystemContext)
+	if err != nil {
+		return false, errors.Wrapf(err, "Error reading base image %s", baseRef.String())
+	}
+	defer baseSrc.Close()
+	baseImage := image.UnparsedInstance(baseSrc, nil)
+
+	// Verify the base image using the policy for its own location, e.g. requiring it to be signed.
+	logrus.Debugf("signedBaseLayer: evaluating base image %s", policyIdentityLogName(baseImageRef))
+	if allowed, err := pc.isRunningImageAllowed(ctx, baseImage); !allowed || err != nil { // Be paranoid and fail if either return value indicates so.
+		if err == nil { // Coverage: This should never happen.
+			err = errors.New("Internal error: base image rejected without a reason")
+		}
+		return false, PolicyRequirementError(fmt.Sprintf("Base image %s rejected: %v", baseRef.String(), err))
+	}
+
+	baseLayers, err := layerDiffIDs(ctx, pc.SystemContext, baseSrc, baseImage)
+	if err != nil {
+		return false, errors.Wrapf(err, "Error reading layers of base image %s", baseRef.String())
+	}
+	// unparsedImage does not provide access to its config; read it from a new ImageSource.  The manifest is still
+	// the one provided by unparsedImage, and the config and manifest list instances are verified to match it.
+	src, err := unparsedImage.Reference().NewImageSource(ctx, pc.SystemContext)
+	if err != nil {
+		return false, errors.Wrap(err, "Error reading image")
+	}
+	defer src.Close()
+	imageLayers, err := layerDiffIDs(ctx, pc.SystemContext, src, unparsedImage)
+	if err != nil {
+		return false, errors.Wrap(err, "Error reading layers of image")
+	}
+	if len(imageLayers) < len(baseLayers) {
+		return false, PolicyRequirementError(fmt.Sprintf("Image has %d layers, fewer than the %d layers of base image %s", len(imageLayers), len(baseLayers), baseRef.String()))
+	}
+	for i, d := range baseLayers {
+		if imageLayers[i] != d {
+			return false, PolicyRequirementError(fmt.Sprintf("Layer %d of image (DiffID %s) does not match base image %s (DiffID %s)", i, imageLayers[i], baseRef.String(), d))
+		}
+	}
+	return true, nil
+}
+
+// layerDiffIDs returns the DiffIDs of the layers of unparsedImage, the root layer first, as recorded in its config read from src.
+// If unparsedImage is a manifest list, the instance for the platform specified by sys is used.
+// Comparing DiffIDs, unlike blob digests, does not depend on how the layers have been compressed.
+func layerDiffIDs(ctx context.Context, sys *types.SystemContext, src types.ImageSource, unparsedImage types.UnparsedImage) ([]digest.Digest, error) {
+	manifestBlob, mimeType, err := unparsedImage.Manifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mimeType = manifest.NormalizedMIMEType(mimeType)
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(manifestBlob, mimeType)
+		if err != nil {
+			return nil, err
+		}
+		instanceDigest, err := list.ChooseInstance(sys)
+		if err != nil {
+			return nil, err
+		}
+		manifestBlob, mimeType, err = src.GetManifest(ctx, &instanceDigest)
+		if err != nil {
+			return nil, err
+		}
+		matches, err := manifest.MatchesDigest(manifestBlob, instanceDigest)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error computing manifest digest")
+		}
+		if !matches {
+			return nil, errors.Errorf("Manifest does not match selected manifest digest %s", instanceDigest)
+		}
+		mimeType = manifest.NormalizedMIMEType(mimeType)
+	}
+	m, err := manifest.FromBlob(manifestBlob, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	configInfo := m.ConfigInfo()
+	if configInfo.Digest == "" {
+		return nil, errors.Errorf("manifest type %s does not reference a config with layer DiffIDs", mimeType)
+	}
+	stream, _, err := src.GetBlob(ctx, configInfo, blobinfocache.NoCache)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	configBlob, err := iolimits.ReadAtMost(stream, iolimits.MaxConfigBodySize)
+	if err != nil {
+		return nil, err
+	}
+	if computedDigest := digest.FromBytes(configBlob); computedDigest != configInfo.Digest {
+		return nil, errors.Errorf("Config digest %s does not match expected %s", computedDigest, configInfo.Digest)
+	}
+	config := imgspecv1.Image{}
+	if err := json.Unmarshal(configBlob, &config); err != nil {
+		return nil, errors.Wrap(err, "Error parsing image config")
+	}
+	return config.RootFS.DiffIDs, nil
 }
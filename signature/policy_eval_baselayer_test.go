@@ -2,11 +2,136 @@ package signature
 
 import (
 	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/containers/image/directory"
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// baseImageReferenceMock is a pcImageReferenceMock for the "docker" transport, which reads the image from dir.
+type baseImageReferenceMock struct {
+	pcImageReferenceMock
+	dir string
+}
+
+func (ref baseImageReferenceMock) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	dirRef, err := directory.NewReference(ref.dir)
+	if err != nil {
+		return nil, err
+	}
+	src, err := dirRef.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &dirImageSourceMock{ImageSource: src, ref: ref}, nil
+}
+
+// useBaseImageDirs replaces newBaseImageReference to read base images from the directories in dirs (indexed by reference.Named.String()).
+// The caller must call the returned function to restore the original value.
+func useBaseImageDirs(t *testing.T, dirs map[string]string) func() {
+	original := newBaseImageReference
+	newBaseImageReference = func(ref reference.Named) (types.ImageReference, error) {
+		dir, ok := dirs[ref.String()]
+		require.True(t, ok, ref.String())
+		return baseImageReferenceMock{pcImageReferenceMock{"docker", ref}, dir}, nil
+	}
+	return func() { newBaseImageReference = original }
+}
+
+// writeLayeredImageInstance writes a config listing diffIDs into dir, and returns a manifest referencing it.
+// The layer digests in the manifest depend on dir, as if the layers were compressed differently in each image.
+func writeLayeredImageInstance(t *testing.T, dir string, diffIDs []digest.Digest) []byte {
+	config, err := json.Marshal(imgspecv1.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS:       imgspecv1.RootFS{Type: "layers", DiffIDs: diffIDs},
+	})
+	require.NoError(t, err)
+	configDigest := digest.FromBytes(config)
+	err = ioutil.WriteFile(filepath.Join(dir, configDigest.Hex()), config, 0644)
+	require.NoError(t, err)
+	layers := []manifest.Schema2Descriptor{}
+	for _, d := range diffIDs {
+		layers = append(layers, manifest.Schema2Descriptor{
+			MediaType: manifest.DockerV2Schema2LayerMediaType,
+			Size:      1,
+			Digest:    digest.FromString(dir + d.String()),
+		})
+	}
+	manifestBlob, err := manifest.Schema2FromComponents(manifest.Schema2Descriptor{
+		MediaType: manifest.DockerV2Schema2ConfigMediaType,
+		Size:      int64(len(config)),
+		Digest:    configDigest,
+	}, layers).Serialize()
+	require.NoError(t, err)
+	return manifestBlob
+}
+
+// layeredImageDir creates a directory containing an image with layers with diffIDs.
+// If arm64DiffIDs is not nil, the image is a manifest list containing that image for linux/amd64, and an image
+// with arm64DiffIDs for linux/arm64.
+// The caller must remove the returned directory.
+func layeredImageDir(t *testing.T, diffIDs, arm64DiffIDs []digest.Digest) string {
+	dir, err := ioutil.TempDir("", "signedBaseLayer")
+	require.NoError(t, err)
+	var manifestBlob []byte
+	if arm64DiffIDs == nil {
+		manifestBlob = writeLayeredImageInstance(t, dir, diffIDs)
+	} else {
+		instances := []manifest.Schema2ManifestDescriptor{}
+		for _, i := range []struct {
+			arch    string
+			diffIDs []digest.Digest
+		}{{"amd64", diffIDs}, {"arm64", arm64DiffIDs}} {
+			instance := writeLayeredImageInstance(t, dir, i.diffIDs)
+			instanceDigest := digest.FromBytes(instance)
+			err = ioutil.WriteFile(filepath.Join(dir, instanceDigest.Hex()+".manifest.json"), instance, 0644)
+			require.NoError(t, err)
+			instances = append(instances, manifest.Schema2ManifestDescriptor{
+				Schema2Descriptor: manifest.Schema2Descriptor{
+					MediaType: manifest.DockerV2Schema2MediaType,
+					Size:      int64(len(instance)),
+					Digest:    instanceDigest,
+				},
+				Platform: manifest.Schema2PlatformSpec{Architecture: i.arch, OS: "linux"},
+			})
+		}
+		manifestBlob, err = manifest.Schema2ListFromComponents(instances).Serialize()
+		require.NoError(t, err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "manifest.json"), manifestBlob, 0644)
+	require.NoError(t, err)
+	return dir
+}
+
+// layeredImageMock returns a types.UnparsedImage for dir, claiming dockerReference, which can also be opened using
+// its Reference().NewImageSource.
+// The caller must call the returned close callback when done.
+func layeredImageMock(t *testing.T, dir, dockerReference string) (types.UnparsedImage, func() error) {
+	ref, err := reference.ParseNormalizedNamed(dockerReference)
+	require.NoError(t, err)
+	return dirImageMockWithRef(t, dir, baseImageReferenceMock{pcImageReferenceMock{"docker", ref}, dir})
+}
+
+func TestNewBaseImageReference(t *testing.T) {
+	ref, err := reference.ParseNormalizedNamed("testing/manifest:latest")
+	require.NoError(t, err)
+	baseRef, err := newBaseImageReference(ref)
+	require.NoError(t, err)
+	assert.Equal(t, "docker", baseRef.Transport().Name())
+	assert.Equal(t, "docker.io/testing/manifest:latest", baseRef.DockerReference().String())
+}
+
 func TestPRSignedBaseLayerIsSignatureAuthorAccepted(t *testing.T) {
 	pr, err := NewPRSignedBaseLayer(NewPRMMatchRepository())
 	require.NoError(t, err)
@@ -16,10 +141,95 @@ func TestPRSignedBaseLayerIsSignatureAuthorAccepted(t *testing.T) {
 }
 
 func TestPRSignedBaseLayerIsRunningImageAllowed(t *testing.T) {
-	// This will obviously need to change after signedBaseLayer is implemented.
+	layers := []digest.Digest{}
+	for _, s := range []string{"layer 1", "layer 2", "layer 3", "other layer"} {
+		layers = append(layers, digest.FromString(s))
+	}
+	baseLayers, otherLayer := layers[:3], layers[3]
+	dirs := map[string]string{}
+	for tag, dir := range map[string]string{
+		"latest":   layeredImageDir(t, baseLayers, nil),
+		"list":     layeredImageDir(t, baseLayers, []digest.Digest{otherLayer}),
+		"unsigned": layeredImageDir(t, baseLayers, nil),
+		"reject":   layeredImageDir(t, baseLayers, nil),
+		"cycle":    layeredImageDir(t, baseLayers, nil),
+	} {
+		defer os.RemoveAll(dir)
+		dirs["docker.io/testing/manifest:"+tag] = dir
+	}
+	restore := useBaseImageDirs(t, dirs)
+	defer restore()
+
+	newBaseLayerRequirement := func(baseRef string) PolicyRequirement {
+		prm, err := NewPRMExactReference(baseRef)
+		require.NoError(t, err)
+		pr, err := NewPRSignedBaseLayer(prm)
+		require.NoError(t, err)
+		return pr
+	}
+	pc, err := NewPolicyContext(&Policy{
+		Default: PolicyRequirements{NewPRReject()},
+		Transports: map[string]PolicyTransportScopes{
+			"docker": {
+				"docker.io/testing/manifest:latest":   {NewPRInsecureAcceptAnything()},
+				"docker.io/testing/manifest:list":     {NewPRInsecureAcceptAnything()},
+				"docker.io/testing/manifest:unsigned": {xNewPRSignedByKeyPath(SBKeyTypeGPGKeys, "fixtures/public-key.gpg", NewPRMMatchRepository())},
+				"docker.io/testing/manifest:reject":   {NewPRReject()},
+				"docker.io/testing/manifest:cycle":    {newBaseLayerRequirement("testing/manifest:cycle")},
+				"docker.io/testing/app:latest":        {newBaseLayerRequirement("testing/manifest:latest")},
+				"docker.io/testing/app:list":          {newBaseLayerRequirement("testing/manifest:list")},
+				"docker.io/testing/app:unsigned":      {newBaseLayerRequirement("testing/manifest:unsigned")},
+				"docker.io/testing/app:reject":        {newBaseLayerRequirement("testing/manifest:reject")},
+				"docker.io/testing/app:cycle":         {newBaseLayerRequirement("testing/manifest:cycle")},
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer pc.Destroy()
+
+	for _, c := range []struct {
+		name, ref    string
+		diffIDs      []digest.Digest
+		arm64DiffIDs []digest.Digest // If not nil, the image is a manifest list
+		arch         string
+		allowed      bool
+	}{
+		{"same layers", "testing/app:latest", baseLayers, nil, "amd64", true},
+		{"added layers", "testing/app:latest", append(baseLayers[:3:3], otherLayer, otherLayer), nil, "amd64", true},
+		{"fewer layers", "testing/app:latest", baseLayers[:2], nil, "amd64", false},
+		{"modified layer", "testing/app:latest", append(baseLayers[:2:2], otherLayer), nil, "amd64", false},
+		{"base not signed", "testing/app:unsigned", baseLayers, nil, "amd64", false},
+		{"base rejected", "testing/app:reject", baseLayers, nil, "amd64", false},
+		{"cycle", "testing/app:cycle", baseLayers, nil, "amd64", false},
+		{"base list", "testing/app:list", baseLayers, nil, "amd64", true},
+		{"base list, other platform", "testing/app:list", baseLayers, nil, "arm64", false},
+		{"image list", "testing/app:latest", baseLayers, []digest.Digest{otherLayer}, "amd64", true},
+		{"image list, other platform", "testing/app:latest", baseLayers, []digest.Digest{otherLayer}, "arm64", false},
+	} {
+		pc.SystemContext = &types.SystemContext{ArchitectureChoice: c.arch, OSChoice: "linux"}
+		dir := layeredImageDir(t, c.diffIDs, c.arm64DiffIDs)
+		defer os.RemoveAll(dir)
+		img, closer := layeredImageMock(t, dir, c.ref)
+		defer closer()
+		res, err := pc.IsRunningImageAllowed(context.Background(), img)
+		if c.allowed {
+			assertRunningAllowed(t, res, err)
+		} else {
+			assertRunningRejectedPolicyRequirement(t, res, err)
+		}
+	}
+
+	// baseLayerIdentity does not identify a specific image
 	pr, err := NewPRSignedBaseLayer(NewPRMMatchRepository())
 	require.NoError(t, err)
-	// Pass a nil pointer to, kind of, test that the return value does not depend on the image.
-	res, err := pr.isRunningImageAllowed(context.Background(), nil)
+	img, closer := pcImageMock(t, "fixtures/dir-img-valid", "testing/app:latest")
+	defer closer()
+	ctx := context.WithValue(context.Background(), policyContextKey{}, pc)
+	res, err := pr.isRunningImageAllowed(ctx, img)
 	assertRunningRejectedPolicyRequirement(t, res, err)
+
+	// Evaluated outside of a PolicyContext
+	pr = newBaseLayerRequirement("testing/manifest:latest")
+	res, err = pr.isRunningImageAllowed(context.Background(), img)
+	assertRunningRejected(t, res, err)
 }
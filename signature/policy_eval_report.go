@@ -0,0 +1,71 @@
+// Structured reports of policy evaluation, for diagnosing rejected images.
+
+package signature
+
+import "context"
+
+// PolicyEvaluationReport describes how the policy was evaluated for an image, see PolicyContext.IsRunningImageAllowedWithReport.
+type PolicyEvaluationReport struct {
+	// Transport is the name of the transport of the image.
+	Transport string
+	// Scope is the scope within the transport's PolicyTransportScopes which applied to the image ("" for the transport-wide default).
+	// It is not meaningful if DefaultPolicy is true.
+	Scope string
+	// DefaultPolicy is true if no scope for the transport applied to the image, and the top-level "default" requirements were used.
+	DefaultPolicy bool
+	// Requirements contains the results of the individual requirements, in the order they appear in the policy.
+	Requirements []PolicyRequirementReport
+}
+
+// PolicyRequirementReport describes the evaluation of a single policy requirement for an image.
+type PolicyRequirementReport struct {
+	// Type is the type of the requirement, as used in policy.json (e.g. "signedBy").
+	Type string
+	// Allowed is true if the requirement allows running the image.
+	Allowed bool
+	// Error is the reason why the requirement rejected the image, if Allowed is false.
+	Error error
+	// Signatures describes the signatures evaluated by the requirement, if it deals with signatures.
+	// Evaluation of signatures may stop once the requirement is satisfied, so not all signatures of the image are necessarily included.
+	Signatures []PolicySignatureReport
+}
+
+// PolicySignatureReport describes the evaluation of a single signature of an image by a policy requirement.
+type PolicySignatureReport struct {
+	// Index is the index of the signature within the signatures of the image.
+	Index int
+	// Signer is the name of the signer the signature was evaluated for, for "signedByThreshold" requirements; "" otherwise.
+	Signer string
+	// KeyIdentity is the identity of the key which created the signature (e.g. a GPG key fingerprint),
+	// or "" if the signature could not be cryptographically verified.
+	KeyIdentity string
+	// SignedDockerReference is the image identity claimed by the signature, or "" if the signature was rejected before checking it.
+	SignedDockerReference string
+	// IdentityMatches is true if SignedDockerReference is accepted by the signedIdentity of the requirement.
+	IdentityMatches bool
+	// Accepted is true if the signature was accepted by the requirement.
+	Accepted bool
+	// Error is the reason why the signature was rejected, if Accepted is false.
+	Error error
+}
+
+// requirementReportKey is the context.Context key for the *PolicyRequirementReport of the requirement being evaluated, if any.
+type requirementReportKey struct{}
+
+// requirementReportFromContext returns the *PolicyRequirementReport to be filled by the requirement being evaluated in ctx, or nil if none.
+func requirementReportFromContext(ctx context.Context) *PolicyRequirementReport {
+	rr, _ := ctx.Value(requirementReportKey{}).(*PolicyRequirementReport)
+	return rr
+}
+
+// addSignature records the evaluation of a signature in rr, if rr is not nil.
+func (rr *PolicyRequirementReport) addSignature(sr PolicySignatureReport) {
+	if rr != nil {
+		rr.Signatures = append(rr.Signatures, sr)
+	}
+}
+
+// typeIdentifier returns the type of the requirement, for PolicyRequirementReport.Type.
+func (pr *prCommon) typeIdentifier() prTypeIdentifier {
+	return pr.Type
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -16,11 +17,19 @@ import (
 )
 
 func (pr *prSignedBy) isSignatureAuthorAccepted(ctx context.Context, image types.UnparsedImage, sig []byte) (signatureAcceptanceResult, *Signature, error) {
+	return pr.isSignatureAuthorAcceptedWithReport(ctx, image, sig, &PolicySignatureReport{})
+}
+
+// isSignatureAuthorAcceptedWithReport is isSignatureAuthorAccepted, also recording details of the evaluation in report,
+// which must not be nil.  Callers can rely on report.KeyIdentity being set if the signature is accepted.
+func (pr *prSignedBy) isSignatureAuthorAcceptedWithReport(ctx context.Context, image types.UnparsedImage, sig []byte, report *PolicySignatureReport) (res signatureAcceptanceResult, signature *Signature, err error) {
+	defer func() {
+		report.Accepted = res == sarAccepted
+		report.Error = err
+	}()
+
 	switch pr.KeyType {
-	case SBKeyTypeGPGKeys:
-	case SBKeyTypeSignedByGPGKeys, SBKeyTypeX509Certificates, SBKeyTypeSignedByX509CAs:
-		// FIXME? Reject this at policy parsing time already?
-		return sarRejected, nil, errors.Errorf(`"Unimplemented "keyType" value "%s"`, string(pr.KeyType))
+	case SBKeyTypeGPGKeys, SBKeyTypeSignedByGPGKeys, SBKeyTypeX509Certificates, SBKeyTypeSignedByX509CAs:
 	default:
 		// This should never happen, newPRSignedBy ensures KeyType.IsValid()
 		return sarRejected, nil, errors.Errorf(`"Unknown "keyType" value "%s"`, string(pr.KeyType))
@@ -40,30 +49,76 @@ func (pr *prSignedBy) isSignatureAuthorAccepted(ctx context.Context, image types
 		}
 		data = d
 	}
+	if pr.SignerKeyPath != "" && pr.SignerKeyData != nil {
+		return sarRejected, nil, errors.New(`Internal inconsistency: both "signerKeyPath" and "signerKeyData" specified`)
+	}
+	// FIXME: move this to per-context initialization
+	var signerData []byte // nil if the signer keys should be looked up in data
+	if pr.SignerKeyData != nil {
+		signerData = pr.SignerKeyData
+	} else if pr.SignerKeyPath != "" {
+		d, err := ioutil.ReadFile(pr.SignerKeyPath)
+		if err != nil {
+			return sarRejected, nil, err
+		}
+		signerData = d
+	}
 
 	// FIXME: move this to per-context initialization
-	mech, trustedIdentities, err := NewEphemeralGPGSigningMechanism(data)
+	var (
+		mech              SigningMechanism
+		trustedIdentities []string
+		anyIdentity       bool // All identities accepted by mech are trusted, trustedIdentities is not used
+	)
+	revocations := revocationsFromContext(ctx)
+	switch pr.KeyType {
+	case SBKeyTypeGPGKeys:
+		mech, trustedIdentities, err = NewEphemeralGPGSigningMechanism(data)
+	case SBKeyTypeSignedByGPGKeys:
+		// Keys certified only by revoked trusted keys are not trusted either.
+		mech, trustedIdentities, err = newEphemeralGPGSigningMechanismForCertifiedKeys(data, signerData, func(keyIdentity string) bool {
+			return revocations.validateKeyIdentity(keyIdentity) == nil
+		})
+	case SBKeyTypeX509Certificates:
+		mech, trustedIdentities, err = NewEphemeralX509SigningMechanism(data)
+	case SBKeyTypeSignedByX509CAs:
+		// The mechanism only accepts certificates issued by the CAs, so any identity it returns is trusted.
+		mech, err = NewX509CASigningMechanism(data)
+		anyIdentity = true
+	}
 	if err != nil {
 		return sarRejected, nil, err
 	}
 	defer mech.Close()
-	if len(trustedIdentities) == 0 {
+	if !anyIdentity && len(trustedIdentities) == 0 {
+		if pr.KeyType == SBKeyTypeSignedByGPGKeys {
+			return sarRejected, nil, PolicyRequirementError("No public keys certified by the trusted keys found")
+		}
 		return sarRejected, nil, PolicyRequirementError("No public keys imported")
 	}
 
-	signature, err := verifyAndExtractSignature(mech, sig, signatureAcceptanceRules{
+	signature, err = verifyAndExtractSignature(mech, sig, signatureAcceptanceRules{
 		validateKeyIdentity: func(keyIdentity string) error {
+			report.KeyIdentity = keyIdentity
+			if err := revocations.validateKeyIdentity(keyIdentity); err != nil {
+				return err
+			}
+			if anyIdentity {
+				return nil
+			}
 			for _, trustedIdentity := range trustedIdentities {
 				if keyIdentity == trustedIdentity {
 					return nil
 				}
 			}
-			// Coverage: We use a private GPG home directory and only import trusted keys, so this should
-			// not be reachable.
+			// Coverage: Except for SBKeyTypeSignedByGPGKeys, we use a private GPG home directory and only import trusted keys,
+			// so this should not be reachable.
 			return PolicyRequirementError(fmt.Sprintf("Signature by key %s is not accepted", keyIdentity))
 		},
 		validateSignedDockerReference: func(ref string) error {
-			if !pr.SignedIdentity.matchesDockerReference(image, ref) {
+			report.SignedDockerReference = ref
+			report.IdentityMatches = pr.SignedIdentity.matchesDockerReference(image, ref)
+			if !report.IdentityMatches {
 				return PolicyRequirementError(fmt.Sprintf("Signature for identity %s is not accepted", ref))
 			}
 			return nil
@@ -80,26 +135,63 @@ func (pr *prSignedBy) isSignatureAuthorAccepted(ctx context.Context, image types
 			if !digestMatches {
 				return PolicyRequirementError(fmt.Sprintf("Signature for digest %s does not match", digest))
 			}
-			return nil
+			return revocations.validateManifestDigest(digest)
 		},
 	})
 	if err != nil {
 		return sarRejected, nil, err
 	}
+	if err := pr.validateSignatureTimestamp(signature.Timestamp, time.Now()); err != nil {
+		return sarRejected, nil, err
+	}
 
 	return sarAccepted, signature, nil
 }
 
+// signatureTimestampClockSkew is the maximum difference between the clocks of the signer and of the verifier
+// tolerated by validateSignatureTimestamp, i.e. how far in the future signature timestamps may be.
+const signatureTimestampClockSkew = 5 * time.Minute
+
+// validateSignatureTimestamp checks that a signature created at timestamp (nil if the signature does not include a timestamp)
+// satisfies pr.MaxSignatureAgeSeconds and pr.SignedNotBefore at time now.
+// If either limit is configured, timestamps in the future (beyond signatureTimestampClockSkew) are rejected as well,
+// so that the limits can not be circumvented by a signer claiming a later creation time.
+func (pr *prSignedBy) validateSignatureTimestamp(timestamp *time.Time, now time.Time) error {
+	if pr.MaxSignatureAgeSeconds == 0 && pr.SignedNotBefore == nil {
+		return nil
+	}
+	if timestamp == nil {
+		return PolicyRequirementError("Signature does not include a timestamp, so its age can not be verified")
+	}
+	if timestamp.After(now.Add(signatureTimestampClockSkew)) {
+		return PolicyRequirementError(fmt.Sprintf("Signature created at %s, which is in the future", timestamp.UTC().Format(time.RFC3339)))
+	}
+	if pr.SignedNotBefore != nil && timestamp.Before(*pr.SignedNotBefore) {
+		return PolicyRequirementError(fmt.Sprintf("Signature created at %s, before the earliest accepted time %s",
+			timestamp.UTC().Format(time.RFC3339), pr.SignedNotBefore.UTC().Format(time.RFC3339)))
+	}
+	// Compare whole seconds, to avoid overflowing time.Duration with very large limits.
+	if pr.MaxSignatureAgeSeconds != 0 && now.Unix()-timestamp.Unix() > pr.MaxSignatureAgeSeconds {
+		return PolicyRequirementError(fmt.Sprintf("Signature created at %s is older than the maximum accepted age of %d seconds",
+			timestamp.UTC().Format(time.RFC3339), pr.MaxSignatureAgeSeconds))
+	}
+	return nil
+}
+
 func (pr *prSignedBy) isRunningImageAllowed(ctx context.Context, image types.UnparsedImage) (bool, error) {
 	// FIXME: pass context.Context
 	sigs, err := image.Signatures(ctx)
 	if err != nil {
 		return false, err
 	}
+	rr := requirementReportFromContext(ctx)
 	var rejections []error
-	for _, s := range sigs {
+	for sigNumber, s := range sigs {
 		var reason error
-		switch res, _, err := pr.isSignatureAuthorAccepted(ctx, image, s); res {
+		sr := PolicySignatureReport{Index: sigNumber}
+		res, _, err := pr.isSignatureAuthorAcceptedWithReport(ctx, image, s, &sr)
+		rr.addSignature(sr)
+		switch res {
 		case sarAccepted:
 			// One accepted signature is enough.
 			return true, nil
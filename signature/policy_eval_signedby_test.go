@@ -5,7 +5,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/containers/image/directory"
 	"github.com/containers/image/docker/reference"
@@ -13,6 +15,7 @@ import (
 	"github.com/containers/image/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
 )
 
 // dirImageMock returns a types.UnparsedImage for a directory, claiming a specified dockerReference.
@@ -46,6 +49,21 @@ func (d *dirImageSourceMock) Reference() types.ImageReference {
 	return d.ref
 }
 
+// newTestUntrustedSignature returns an untrustedSignature of the fixtures/dir-img-valid image for dockerReference,
+// with a fixed timestamp, TestSignatureTimestamp.
+func newTestUntrustedSignature(dockerReference string) untrustedSignature {
+	sig := newUntrustedSignature(TestImageManifestDigest, dockerReference)
+	timestamp := int64(TestSignatureTimestamp)
+	sig.UntrustedTimestamp = &timestamp
+	return sig
+}
+
+// testSignatureTime returns TestSignatureTimestamp in the form used by Signature.Timestamp.
+func testSignatureTime() *time.Time {
+	res := time.Unix(TestSignatureTimestamp, 0)
+	return &res
+}
+
 func TestPRSignedByIsSignatureAuthorAccepted(t *testing.T) {
 	ktGPG := SBKeyTypeGPGKeys
 	prm := NewPRMMatchExact()
@@ -61,6 +79,7 @@ func TestPRSignedByIsSignatureAuthorAccepted(t *testing.T) {
 	assertSARAccepted(t, sar, parsedSig, err, Signature{
 		DockerManifestDigest: TestImageManifestDigest,
 		DockerReference:      "testing/manifest:latest",
+		Timestamp:            testSignatureTime(),
 	})
 
 	keyData, err := ioutil.ReadFile("fixtures/public-key.gpg")
@@ -71,9 +90,10 @@ func TestPRSignedByIsSignatureAuthorAccepted(t *testing.T) {
 	assertSARAccepted(t, sar, parsedSig, err, Signature{
 		DockerManifestDigest: TestImageManifestDigest,
 		DockerReference:      "testing/manifest:latest",
+		Timestamp:            testSignatureTime(),
 	})
 
-	// Unimplemented and invalid KeyType values
+	// Invalid KeyType values, and key types with invalid key data
 	for _, keyType := range []sbKeyType{SBKeyTypeSignedByGPGKeys,
 		SBKeyTypeX509Certificates,
 		SBKeyTypeSignedByX509CAs,
@@ -263,3 +283,273 @@ func TestPRSignedByIsRunningImageAllowed(t *testing.T) {
 	allowed, err = pr.isRunningImageAllowed(context.Background(), image)
 	assertRunningRejectedPolicyRequirement(t, allowed, err)
 }
+
+func TestPRSignedByIsSignatureAuthorAcceptedX509(t *testing.T) {
+	pki := newX509TestPKI(t)
+	prm := NewPRMMatchExact()
+	testImage, closer := dirImageMock(t, "fixtures/dir-img-valid", "testing/manifest:latest")
+	defer closer()
+	expectedSig := Signature{
+		DockerManifestDigest: TestImageManifestDigest,
+		DockerReference:      "testing/manifest:latest",
+		Timestamp:            testSignatureTime(),
+	}
+	signImage := func(c x509TestCert, dockerReference string, chain ...x509TestCert) []byte {
+		chainPEM := c.certPEM()
+		for _, c := range chain {
+			chainPEM = append(chainPEM, c.certPEM()...)
+		}
+		mech, keyIdentity, err := NewX509SigningMechanism(chainPEM, c.keyPEM(t))
+		require.NoError(t, err)
+		defer mech.Close()
+		sig, err := newTestUntrustedSignature(dockerReference).sign(mech, keyIdentity)
+		require.NoError(t, err)
+		return sig
+	}
+
+	// X509Certificates: Successful validation
+	pr, err := NewPRSignedByKeyData(SBKeyTypeX509Certificates, append(pki.otherLeaf.certPEM(), pki.leaf.certPEM()...), prm)
+	require.NoError(t, err)
+	sar, parsedSig, err := pr.isSignatureAuthorAccepted(context.Background(), testImage, signImage(pki.leaf, "testing/manifest:latest"))
+	assertSARAccepted(t, sar, parsedSig, err, expectedSig)
+	// X509Certificates: A certificate which is not trusted, even if issued by the same CA
+	sar, parsedSig, err = pr.isSignatureAuthorAccepted(context.Background(), testImage, signImage(pki.expiredLeaf, "testing/manifest:latest"))
+	assertSARRejected(t, sar, parsedSig, err)
+	// X509Certificates: No certificates
+	pr, err = NewPRSignedByKeyData(SBKeyTypeX509Certificates, []byte{}, prm)
+	require.NoError(t, err)
+	sar, parsedSig, err = pr.isSignatureAuthorAccepted(context.Background(), testImage, signImage(pki.leaf, "testing/manifest:latest"))
+	assertSARRejectedPolicyRequirement(t, sar, parsedSig, err)
+
+	// signedByX509CAs: Successful validation
+	pr, err = NewPRSignedByKeyData(SBKeyTypeSignedByX509CAs, pki.root.certPEM(), prm)
+	require.NoError(t, err)
+	sar, parsedSig, err = pr.isSignatureAuthorAccepted(context.Background(), testImage, signImage(pki.leaf, "testing/manifest:latest", pki.intermediate))
+	assertSARAccepted(t, sar, parsedSig, err, expectedSig)
+	// signedByX509CAs: An expired certificate
+	sar, parsedSig, err = pr.isSignatureAuthorAccepted(context.Background(), testImage, signImage(pki.expiredLeaf, "testing/manifest:latest", pki.intermediate))
+	assertSARRejected(t, sar, parsedSig, err)
+	// signedByX509CAs: A certificate issued by a different CA
+	sar, parsedSig, err = pr.isSignatureAuthorAccepted(context.Background(), testImage, signImage(pki.otherLeaf, "testing/manifest:latest"))
+	assertSARRejected(t, sar, parsedSig, err)
+	// signedByX509CAs: A valid signature for a different identity
+	sar, parsedSig, err = pr.isSignatureAuthorAccepted(context.Background(), testImage, signImage(pki.leaf, "testing/other:latest", pki.intermediate))
+	assertSARRejectedPolicyRequirement(t, sar, parsedSig, err)
+}
+
+func TestPRSignedByIsSignatureAuthorAcceptedSignedByGPGKeys(t *testing.T) {
+	keys := newOpenPGPTestCertifiedKeys(t)
+	prm := NewPRMMatchExact()
+	testImage, closer := dirImageMock(t, "fixtures/dir-img-valid", "testing/manifest:latest")
+	defer closer()
+	expectedSig := Signature{
+		DockerManifestDigest: TestImageManifestDigest,
+		DockerReference:      "testing/manifest:latest",
+		Timestamp:            testSignatureTime(),
+	}
+	signImage := func(e *openpgp.Entity) []byte {
+		payload, err := newTestUntrustedSignature("testing/manifest:latest").MarshalJSON()
+		require.NoError(t, err)
+		return openpgpTestSign(t, e, payload)
+	}
+	trustedKeys := openpgpTestKeyring(t, keys.master)
+	signerKeys := openpgpTestKeyring(t, keys.certified, keys.uncertified, keys.revokedCertification)
+
+	// Successful validation, with SignerKeyData and SignerKeyPath
+	pr, err := NewPRSignedByGPGKeysWithSignerKeyData(trustedKeys, signerKeys, prm)
+	require.NoError(t, err)
+	sar, parsedSig, err := pr.isSignatureAuthorAccepted(context.Background(), testImage, signImage(keys.certified))
+	assertSARAccepted(t, sar, parsedSig, err, expectedSig)
+
+	tmpDir, err := ioutil.TempDir("", "signedByGPGKeys")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	trustedKeysPath := filepath.Join(tmpDir, "trusted.gpg")
+	err = ioutil.WriteFile(trustedKeysPath, trustedKeys, 0644)
+	require.NoError(t, err)
+	signerKeysPath := filepath.Join(tmpDir, "signers.gpg")
+	err = ioutil.WriteFile(signerKeysPath, signerKeys, 0644)
+	require.NoError(t, err)
+	pr, err = NewPRSignedByGPGKeysWithSignerKeyPath(trustedKeysPath, signerKeysPath, prm)
+	require.NoError(t, err)
+	sar, parsedSig, err = pr.isSignatureAuthorAccepted(context.Background(), testImage, signImage(keys.certified))
+	assertSARAccepted(t, sar, parsedSig, err, expectedSig)
+
+	// Successful validation, with signer keys in the same keyring
+	pr, err = NewPRSignedByKeyData(SBKeyTypeSignedByGPGKeys, openpgpTestKeyring(t, keys.master, keys.certified), prm)
+	require.NoError(t, err)
+	sar, parsedSig, err = pr.isSignatureAuthorAccepted(context.Background(), testImage, signImage(keys.certified))
+	assertSARAccepted(t, sar, parsedSig, err, expectedSig)
+
+	// Signatures by keys which are not certified, or whose certification was revoked, and by the trusted key itself
+	pr, err = NewPRSignedByGPGKeysWithSignerKeyData(trustedKeys, signerKeys, prm)
+	require.NoError(t, err)
+	for _, e := range []*openpgp.Entity{keys.uncertified, keys.revokedCertification} {
+		sar, parsedSig, err = pr.isSignatureAuthorAccepted(context.Background(), testImage, signImage(e))
+		assertSARRejectedPolicyRequirement(t, sar, parsedSig, err)
+	}
+	sar, parsedSig, err = pr.isSignatureAuthorAccepted(context.Background(), testImage, signImage(keys.master))
+	assertSARRejectedPolicyRequirement(t, sar, parsedSig, err)
+
+	// Keys certified only by a revoked trusted key
+	for _, c := range []struct {
+		revokedKey string
+		accepted   bool
+	}{
+		{"0123456789ABCDEF0123456789ABCDEF01234567", true},
+		{openpgpTestFingerprint(keys.master), false},
+	} {
+		rl, err := parseRevocationList([]byte(`{"keyFingerprints":["` + c.revokedKey + `"]}`))
+		require.NoError(t, err)
+		ctx := context.WithValue(context.Background(), policyContextKey{}, &PolicyContext{revocations: rl})
+		sar, parsedSig, err = pr.isSignatureAuthorAccepted(ctx, testImage, signImage(keys.certified))
+		if c.accepted {
+			assertSARAccepted(t, sar, parsedSig, err, expectedSig)
+		} else {
+			assertSARRejectedPolicyRequirement(t, sar, parsedSig, err)
+		}
+	}
+
+	// No certified keys
+	pr, err = NewPRSignedByKeyData(SBKeyTypeSignedByGPGKeys, openpgpTestKeyring(t, keys.master, keys.uncertified), prm)
+	require.NoError(t, err)
+	// Pass a nil pointer to, kind of, test that the return value does not depend on the image parmater.
+	sar, parsedSig, err = pr.isSignatureAuthorAccepted(context.Background(), nil, signImage(keys.uncertified))
+	assertSARRejectedPolicyRequirement(t, sar, parsedSig, err)
+
+	// Invalid SignerKeyPath
+	pr, err = NewPRSignedByGPGKeysWithSignerKeyPath(trustedKeysPath, "/this/does/not/exist", prm)
+	require.NoError(t, err)
+	// Pass nil pointers to, kind of, test that the return value does not depend on the parameters.
+	sar, parsedSig, err = pr.isSignatureAuthorAccepted(context.Background(), nil, nil)
+	assertSARRejected(t, sar, parsedSig, err)
+
+	// Both SignerKeyPath and SignerKeyData set. Do not use NewPRSignedBy*, because it would reject this.
+	prSB := &prSignedBy{
+		KeyType:        SBKeyTypeSignedByGPGKeys,
+		KeyData:        trustedKeys,
+		SignerKeyPath:  signerKeysPath,
+		SignerKeyData:  signerKeys,
+		SignedIdentity: prm,
+	}
+	// Pass nil pointers to, kind of, test that the return value does not depend on the parameters.
+	sar, parsedSig, err = prSB.isSignatureAuthorAccepted(context.Background(), nil, nil)
+	assertSARRejected(t, sar, parsedSig, err)
+}
+
+func TestPRSignedByIsSignatureAuthorAcceptedSignatureTimeLimits(t *testing.T) {
+	prm := NewPRMMatchExact()
+	testImage, closer := dirImageMock(t, "fixtures/dir-img-valid", "testing/manifest:latest")
+	defer closer()
+	testImageSig, err := ioutil.ReadFile("fixtures/dir-img-valid/signature-1")
+	require.NoError(t, err)
+	expectedSig := Signature{
+		DockerManifestDigest: TestImageManifestDigest,
+		DockerReference:      "testing/manifest:latest",
+		Timestamp:            testSignatureTime(),
+	}
+	basePR, err := NewPRSignedByKeyPath(SBKeyTypeGPGKeys, "fixtures/public-key.gpg", prm)
+	require.NoError(t, err)
+	before := testSignatureTime().Add(-time.Hour)
+	after := testSignatureTime().Add(time.Hour)
+
+	for _, c := range []struct {
+		maxAgeSeconds int64
+		notBefore     *time.Time
+		accepted      bool
+	}{
+		{0, nil, true},
+		{1 << 40, nil, true},
+		{1, nil, false},
+		{0, &before, true},
+		{0, testSignatureTime(), true},
+		{0, &after, false},
+		{1 << 40, &before, true},
+		{1, &before, false},
+		{1 << 40, &after, false},
+	} {
+		pr, err := NewPRSignedByWithSignatureTimeLimits(basePR, c.maxAgeSeconds, c.notBefore)
+		require.NoError(t, err)
+		sar, parsedSig, err := pr.isSignatureAuthorAccepted(context.Background(), testImage, testImageSig)
+		if c.accepted {
+			assertSARAccepted(t, sar, parsedSig, err, expectedSig)
+		} else {
+			assertSARRejectedPolicyRequirement(t, sar, parsedSig, err)
+		}
+	}
+
+	// A signature without a timestamp
+	e := newOpenPGPTestEntity(t, "no-timestamp", time.Now().Add(-time.Hour))
+	pr, err := NewPRSignedByKeyData(SBKeyTypeGPGKeys, openpgpTestKeyring(t, e), prm)
+	require.NoError(t, err)
+	untrusted := newTestUntrustedSignature("testing/manifest:latest")
+	untrusted.UntrustedTimestamp = nil
+	payload, err := untrusted.MarshalJSON()
+	require.NoError(t, err)
+	noTimestampSig := openpgpTestSign(t, e, payload)
+	sar, parsedSig, err := pr.isSignatureAuthorAccepted(context.Background(), testImage, noTimestampSig)
+	assertSARAccepted(t, sar, parsedSig, err, Signature{
+		DockerManifestDigest: TestImageManifestDigest,
+		DockerReference:      "testing/manifest:latest",
+	})
+	for _, c := range []struct {
+		maxAgeSeconds int64
+		notBefore     *time.Time
+	}{
+		{1 << 40, nil},
+		{0, &before},
+	} {
+		limitedPR, err := NewPRSignedByWithSignatureTimeLimits(pr, c.maxAgeSeconds, c.notBefore)
+		require.NoError(t, err)
+		sar, parsedSig, err := limitedPR.isSignatureAuthorAccepted(context.Background(), testImage, noTimestampSig)
+		assertSARRejectedPolicyRequirement(t, sar, parsedSig, err)
+	}
+}
+
+func TestPRSignedByValidateSignatureTimestamp(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	notBefore := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	ts := func(t time.Time) *time.Time {
+		return &t
+	}
+	for _, c := range []struct {
+		maxAgeSeconds int64
+		notBefore     *time.Time
+		timestamp     *time.Time
+		valid         bool
+	}{
+		// No limits
+		{0, nil, nil, true},
+		{0, nil, ts(now.Add(-24 * 365 * time.Hour)), true},
+		{0, nil, ts(now.Add(24 * 365 * time.Hour)), true},
+		// Maximum age
+		{3600, nil, ts(now), true},
+		{3600, nil, ts(now.Add(-time.Hour)), true},
+		{3600, nil, ts(now.Add(-time.Hour - time.Second)), false},
+		{3600, nil, ts(now.Add(signatureTimestampClockSkew)), true}, // Timestamps slightly in the future are accepted, to tolerate clock skew
+		{3600, nil, ts(now.Add(signatureTimestampClockSkew + time.Second)), false},
+		{3600, nil, ts(now.Add(time.Hour)), false},
+		{3600, nil, nil, false},
+		// Not before
+		{0, &notBefore, ts(notBefore), true},
+		{0, &notBefore, ts(now), true},
+		{0, &notBefore, ts(notBefore.Add(-time.Second)), false},
+		{0, &notBefore, nil, false},
+		{0, &notBefore, ts(now.Add(time.Hour)), false},
+		// Both
+		{3600, &notBefore, ts(now), true},
+		{3600, &notBefore, ts(notBefore), false},
+		{1 << 40, &notBefore, ts(notBefore.Add(-time.Second)), false},
+	} {
+		pr, err := newPRSignedByKeyPath(SBKeyTypeGPGKeys, "/dev/null", NewPRMMatchExact())
+		require.NoError(t, err)
+		pr, err = newPRSignedByWithSignatureTimeLimits(pr, c.maxAgeSeconds, c.notBefore)
+		require.NoError(t, err)
+		err = pr.validateSignatureTimestamp(c.timestamp, now)
+		if c.valid {
+			assert.NoError(t, err, "%#v", c)
+		} else {
+			assert.IsType(t, PolicyRequirementError(""), err, "%#v", c)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/containers/image/docker"
 	"github.com/containers/image/docker/policyconfiguration"
@@ -156,6 +157,9 @@ func TestPolicyContextRequirementsForImageRef(t *testing.T) {
 		{"docker", "deep.com/n1/n2/n3"},
 		{"docker", "deep.com/n1/n2/n3/repo"},
 		{"docker", "deep.com/n1/n2/n3/repo:tag2"},
+		{"docker", "*.corp.example"},
+		{"docker", "*.registry.corp.example"},
+		{"docker", "special.registry.corp.example"},
 		{"atomic", "unmatched"},
 	} {
 		if _, ok := policy.Transports[t.transport]; !ok {
@@ -177,6 +181,13 @@ func TestPolicyContextRequirementsForImageRef(t *testing.T) {
 		{"docker", "deep.com/n1/notn2/n3/repo:tag2", "docker", "deep.com/n1"},
 		// Host name match
 		{"docker", "deep.com/notn1/n2/n3/repo:tag2", "docker", "deep.com"},
+		{"docker", "special.registry.corp.example/ns/repo:tag", "docker", "special.registry.corp.example"},
+		// Wildcard matches, the most specific one wins
+		{"docker", "team1.registry.corp.example/ns/repo:tag", "docker", "*.registry.corp.example"},
+		{"docker", "team1.registry.corp.example:5000/ns/repo:tag", "docker", "*.registry.corp.example"},
+		{"docker", "a.team1.registry.corp.example/ns/repo:tag", "docker", "*.registry.corp.example"},
+		{"docker", "registry.corp.example/ns/repo:tag", "docker", "*.corp.example"},
+		{"docker", "other.corp.example/ns/repo:tag", "docker", "*.corp.example"},
 		// Default
 		{"docker", "this.doesnt/match:anything", "docker", ""},
 		// No match within a matched transport which doesn't have a "" scope
@@ -217,6 +228,13 @@ func TestPolicyContextGetSignaturesWithAcceptedAuthor(t *testing.T) {
 	expectedSig := &Signature{
 		DockerManifestDigest: TestImageManifestDigest,
 		DockerReference:      "testing/manifest:latest",
+		Timestamp:            testSignatureTime(),
+	}
+	secondTimestamp := time.Unix(1464640051, 0)
+	expectedSig2 := &Signature{ // The second signature in "dir-img-valid-2"
+		DockerManifestDigest: TestImageManifestDigest,
+		DockerReference:      "testing/manifest:latest",
+		Timestamp:            &secondTimestamp,
 	}
 
 	pc, err := NewPolicyContext(&Policy{
@@ -268,7 +286,7 @@ func TestPolicyContextGetSignaturesWithAcceptedAuthor(t *testing.T) {
 	defer closer()
 	sigs, err = pc.GetSignaturesWithAcceptedAuthor(context.Background(), img)
 	require.NoError(t, err)
-	assert.Equal(t, []*Signature{expectedSig, expectedSig}, sigs)
+	assert.Equal(t, []*Signature{expectedSig, expectedSig2}, sigs)
 
 	// No signatures
 	img, closer = pcImageMock(t, "fixtures/dir-img-unsigned", "testing/manifest:latest")
@@ -473,6 +491,113 @@ func TestPolicyContextIsRunningImageAllowed(t *testing.T) {
 
 // assertSARRejected verifies that isSignatureAuthorAccepted returns a consistent sarRejected result
 // with the expected signature.
+func TestPolicyContextIsRunningImageAllowedWithReport(t *testing.T) {
+	pc, err := NewPolicyContext(&Policy{
+		Default: PolicyRequirements{NewPRReject()},
+		Transports: map[string]PolicyTransportScopes{
+			"docker": {
+				"docker.io/testing/manifest:latest": {
+					xNewPRSignedByKeyPath(SBKeyTypeGPGKeys, "fixtures/public-key.gpg", NewPRMMatchExact()),
+				},
+				"docker.io/testing/manifest:denyAllow": {
+					NewPRReject(),
+					xNewPRSignedByKeyPath(SBKeyTypeGPGKeys, "fixtures/public-key.gpg", NewPRMMatchRepository()),
+				},
+				"docker.io/testing": {
+					xNewPRSignedByKeyPath(SBKeyTypeGPGKeys, "fixtures/public-key.gpg", NewPRMMatchExact()),
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer pc.Destroy()
+	acceptedSignature := PolicySignatureReport{
+		Index:                 0,
+		KeyIdentity:           TestKeyFingerprint,
+		SignedDockerReference: "testing/manifest:latest",
+		IdentityMatches:       true,
+		Accepted:              true,
+	}
+
+	// Success
+	img, closer := pcImageMock(t, "fixtures/dir-img-valid", "testing/manifest:latest")
+	defer closer()
+	res, report, err := pc.IsRunningImageAllowedWithReport(context.Background(), img)
+	assertRunningAllowed(t, res, err)
+	require.NotNil(t, report)
+	assert.Equal(t, &PolicyEvaluationReport{
+		Transport:     "docker",
+		Scope:         "docker.io/testing/manifest:latest",
+		DefaultPolicy: false,
+		Requirements: []PolicyRequirementReport{
+			{Type: "signedBy", Allowed: true, Signatures: []PolicySignatureReport{acceptedSignature}},
+		},
+	}, report)
+
+	// All requirements are evaluated and reported, even after one rejects the image
+	img, closer = pcImageMock(t, "fixtures/dir-img-valid", "testing/manifest:denyAllow")
+	defer closer()
+	res, report, err = pc.IsRunningImageAllowedWithReport(context.Background(), img)
+	assertRunningRejectedPolicyRequirement(t, res, err)
+	require.NotNil(t, report)
+	assert.Equal(t, "docker.io/testing/manifest:denyAllow", report.Scope)
+	require.Len(t, report.Requirements, 2)
+	assert.Equal(t, "reject", report.Requirements[0].Type)
+	assert.False(t, report.Requirements[0].Allowed)
+	assert.Equal(t, err, report.Requirements[0].Error)
+	assert.Empty(t, report.Requirements[0].Signatures)
+	assert.Equal(t, PolicyRequirementReport{Type: "signedBy", Allowed: true, Signatures: []PolicySignatureReport{acceptedSignature}},
+		report.Requirements[1])
+
+	// A scope matching a parent namespace; a signature with a non-matching identity, and an invalid signature
+	img, closer = pcImageMock(t, "fixtures/dir-img-mixed", "testing/manifest:other")
+	defer closer()
+	res, report, err = pc.IsRunningImageAllowedWithReport(context.Background(), img)
+	assertRunningRejectedPolicyRequirement(t, res, err)
+	require.NotNil(t, report)
+	assert.Equal(t, "docker.io/testing", report.Scope)
+	assert.False(t, report.DefaultPolicy)
+	require.Len(t, report.Requirements, 1)
+	rr := report.Requirements[0]
+	assert.False(t, rr.Allowed)
+	assert.Equal(t, err, rr.Error)
+	require.Len(t, rr.Signatures, 2)
+	assert.Equal(t, 0, rr.Signatures[0].Index)
+	assert.Equal(t, TestKeyFingerprint, rr.Signatures[0].KeyIdentity) // The signature is valid, but its contents are not
+	assert.Equal(t, "", rr.Signatures[0].SignedDockerReference)
+	assert.False(t, rr.Signatures[0].Accepted)
+	assert.IsType(t, InvalidSignatureError{}, rr.Signatures[0].Error)
+	assert.Equal(t, 1, rr.Signatures[1].Index)
+	assert.Equal(t, TestKeyFingerprint, rr.Signatures[1].KeyIdentity)
+	assert.Equal(t, "testing/manifest:latest", rr.Signatures[1].SignedDockerReference)
+	assert.False(t, rr.Signatures[1].IdentityMatches)
+	assert.False(t, rr.Signatures[1].Accepted)
+	assert.IsType(t, PolicyRequirementError(""), rr.Signatures[1].Error)
+
+	// The default policy
+	img, closer = pcImageMock(t, "fixtures/dir-img-valid", "example.com/testing/manifest:latest")
+	defer closer()
+	res, report, err = pc.IsRunningImageAllowedWithReport(context.Background(), img)
+	assertRunningRejectedPolicyRequirement(t, res, err)
+	require.NotNil(t, report)
+	assert.Equal(t, &PolicyEvaluationReport{
+		Transport:     "docker",
+		DefaultPolicy: true,
+		Requirements:  []PolicyRequirementReport{{Type: "reject", Allowed: false, Error: err}},
+	}, report)
+
+	// Unexpected state (context already destroyed)
+	destroyedPC, err := NewPolicyContext(pc.Policy)
+	require.NoError(t, err)
+	err = destroyedPC.Destroy()
+	require.NoError(t, err)
+	img, closer = pcImageMock(t, "fixtures/dir-img-valid", "testing/manifest:latest")
+	defer closer()
+	res, report, err = destroyedPC.IsRunningImageAllowedWithReport(context.Background(), img)
+	assertRunningRejected(t, res, err)
+	assert.Nil(t, report)
+}
+
 func assertSARAccepted(t *testing.T, sar signatureAcceptanceResult, parsedSig *Signature, err error, expectedSig Signature) {
 	assert.Equal(t, sarAccepted, sar)
 	assert.Equal(t, &expectedSig, parsedSig)
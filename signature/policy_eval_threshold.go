@@ -0,0 +1,113 @@
+// Policy evaluation for prSignedByThreshold.
+
+package signature
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containers/image/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// signerNames returns the names of pr.Signers, sorted to make the evaluation and error messages deterministic.
+func (pr *prSignedByThreshold) signerNames() []string {
+	names := make([]string, 0, len(pr.Signers))
+	for name := range pr.Signers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (pr *prSignedByThreshold) isSignatureAuthorAccepted(ctx context.Context, image types.UnparsedImage, sig []byte) (signatureAcceptanceResult, *Signature, error) {
+	var msgs []string
+	for _, name := range pr.signerNames() {
+		res, signature, err := pr.Signers[name].isSignatureAuthorAccepted(ctx, image, sig)
+		if res == sarAccepted {
+			// A signature by any of the signers is a signature by an accepted author; the threshold only matters in isRunningImageAllowed.
+			return sarAccepted, signature, nil
+		}
+		if err == nil { // Coverage: This should never happen, prSignedBy never returns sarUnknown.
+			err = errors.Errorf(`Internal error: Unexpected signature verification result "%s"`, string(res))
+		}
+		msgs = append(msgs, fmt.Sprintf("signer %q: %s", name, err.Error()))
+	}
+	return sarRejected, nil, PolicyRequirementError(fmt.Sprintf("Signature not accepted by any of the signers, reasons: %s",
+		strings.Join(msgs, "; ")))
+}
+
+func (pr *prSignedByThreshold) isRunningImageAllowed(ctx context.Context, image types.UnparsedImage) (bool, error) {
+	// FIXME: pass context.Context
+	sigs, err := image.Signatures(ctx)
+	if err != nil {
+		return false, err
+	}
+	names := pr.signerNames()
+	rr := requirementReportFromContext(ctx)
+	acceptedKeys := map[string][]string{} // signer name -> identities of keys with accepted signatures
+	for sigNumber, s := range sigs {
+		for _, name := range names {
+			sr := PolicySignatureReport{Index: sigNumber, Signer: name}
+			res, _, err := pr.Signers[name].isSignatureAuthorAcceptedWithReport(ctx, image, s, &sr)
+			rr.addSignature(sr)
+			switch res {
+			case sarAccepted:
+				logrus.Debugf("Signature %d accepted for signer %s, key %s", sigNumber, name, sr.KeyIdentity)
+				acceptedKeys[name] = append(acceptedKeys[name], sr.KeyIdentity)
+			case sarRejected:
+				// Signatures by the other signers are expected to be rejected, so this is not worth reporting to the caller.
+				logrus.Debugf("Signature %d rejected for signer %s: %v", sigNumber, name, err)
+			default: // Coverage: This should never happen, prSignedBy never returns sarUnknown.
+				logrus.Debugf("Signature %d for signer %s: internal inconsistency: unexpected result %#v", sigNumber, name, string(res))
+			}
+		}
+	}
+
+	satisfied := thresholdSatisfiedSigners(names, acceptedKeys)
+	if len(satisfied) >= pr.Threshold {
+		return true, nil
+	}
+	var missing []string
+	for _, name := range names {
+		if !satisfied[name] {
+			missing = append(missing, fmt.Sprintf("%q", name))
+		}
+	}
+	return false, PolicyRequirementError(fmt.Sprintf("Signatures by at least %d of %d signers required, but only %d found; missing signatures by %s",
+		pr.Threshold, len(names), len(satisfied), strings.Join(missing, ", ")))
+}
+
+// thresholdSatisfiedSigners returns the largest set of signers (from names) which can each be attributed a signature
+// by a different key, given acceptedKeys mapping signer names to identities of keys which created signatures accepted for that signer.
+// Requiring different keys ensures that a single key listed for several signers can not satisfy more than one of them.
+func thresholdSatisfiedSigners(names []string, acceptedKeys map[string][]string) map[string]bool {
+	// This is a maximum bipartite matching between signers and keys, found using augmenting paths.
+	// The number of signers is small, so the simple O(signers * edges) algorithm is good enough.
+	keyOwners := map[string]string{} // key identity -> signer name
+	var assign func(name string, visited map[string]bool) bool
+	assign = func(name string, visited map[string]bool) bool {
+		for _, key := range acceptedKeys[name] {
+			if visited[key] {
+				continue
+			}
+			visited[key] = true
+			if owner, ok := keyOwners[key]; !ok || assign(owner, visited) {
+				keyOwners[key] = name
+				return true
+			}
+		}
+		return false
+	}
+
+	res := map[string]bool{}
+	for _, name := range names {
+		if assign(name, map[string]bool{}) {
+			res[name] = true
+		}
+	}
+	return res
+}
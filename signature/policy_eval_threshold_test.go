@@ -0,0 +1,202 @@
+package signature
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
+)
+
+// thresholdTestKeys is a set of OpenPGP keys for testing prSignedByThreshold.
+type thresholdTestKeys struct {
+	build, qa, security, other *openpgp.Entity
+}
+
+func newThresholdTestKeys(t *testing.T) thresholdTestKeys {
+	past := time.Now().Add(-2 * time.Hour)
+	return thresholdTestKeys{
+		build:    newOpenPGPTestEntity(t, "build", past),
+		qa:       newOpenPGPTestEntity(t, "qa", past),
+		security: newOpenPGPTestEntity(t, "security", past),
+		other:    newOpenPGPTestEntity(t, "other", past),
+	}
+}
+
+// thresholdTestSignature returns a signature of the fixtures/dir-img-valid image for dockerReference, made by e.
+func thresholdTestSignature(t *testing.T, e *openpgp.Entity, dockerReference string) []byte {
+	payload, err := newTestUntrustedSignature(dockerReference).MarshalJSON()
+	require.NoError(t, err)
+	return openpgpTestSign(t, e, payload)
+}
+
+// thresholdTestImageDir returns a directory containing the fixtures/dir-img-valid manifest, and signatures for
+// testing/manifest:latest made by signers.
+// The caller must remove the directory when done.
+func thresholdTestImageDir(t *testing.T, signers ...*openpgp.Entity) string {
+	manifest, err := ioutil.ReadFile("fixtures/dir-img-valid/manifest.json")
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "signedByThreshold")
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "manifest.json"), manifest, 0644)
+	require.NoError(t, err)
+	for i, e := range signers {
+		err = ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("signature-%d", i+1)), thresholdTestSignature(t, e, "testing/manifest:latest"), 0644)
+		require.NoError(t, err)
+	}
+	return dir
+}
+
+// newThresholdTestRequirement returns a prSignedByThreshold with the specified threshold, and signers using keyrings.
+func newThresholdTestRequirement(t *testing.T, threshold int, keyrings map[string][]byte) PolicyRequirement {
+	signers := map[string]PolicyRequirement{}
+	for name, keyring := range keyrings {
+		signers[name] = xNewPRSignedByKeyData(SBKeyTypeGPGKeys, keyring, NewPRMMatchExact())
+	}
+	pr, err := NewPRSignedByThreshold(threshold, signers)
+	require.NoError(t, err)
+	return pr
+}
+
+func TestPRSignedByThresholdIsSignatureAuthorAccepted(t *testing.T) {
+	keys := newThresholdTestKeys(t)
+	testImage, closer := dirImageMock(t, "fixtures/dir-img-valid", "testing/manifest:latest")
+	defer closer()
+	expectedSig := Signature{
+		DockerManifestDigest: TestImageManifestDigest,
+		DockerReference:      "testing/manifest:latest",
+		Timestamp:            testSignatureTime(),
+	}
+	pr := newThresholdTestRequirement(t, 2, map[string][]byte{
+		"build": openpgpTestKeyring(t, keys.build),
+		"qa":    openpgpTestKeyring(t, keys.qa),
+	})
+
+	// A signature by any of the signers is accepted
+	for _, e := range []*openpgp.Entity{keys.build, keys.qa} {
+		sar, parsedSig, err := pr.isSignatureAuthorAccepted(context.Background(), testImage, thresholdTestSignature(t, e, "testing/manifest:latest"))
+		assertSARAccepted(t, sar, parsedSig, err, expectedSig)
+	}
+
+	// A signature by an unknown key
+	sar, parsedSig, err := pr.isSignatureAuthorAccepted(context.Background(), testImage, thresholdTestSignature(t, keys.other, "testing/manifest:latest"))
+	assertSARRejectedPolicyRequirement(t, sar, parsedSig, err)
+
+	// A valid signature for a different identity
+	sar, parsedSig, err = pr.isSignatureAuthorAccepted(context.Background(), testImage, thresholdTestSignature(t, keys.build, "testing/other:latest"))
+	assertSARRejectedPolicyRequirement(t, sar, parsedSig, err)
+}
+
+func TestPRSignedByThresholdIsRunningImageAllowed(t *testing.T) {
+	keys := newThresholdTestKeys(t)
+	keyrings := map[string][]byte{
+		"build":    openpgpTestKeyring(t, keys.build),
+		"qa":       openpgpTestKeyring(t, keys.qa),
+		"security": openpgpTestKeyring(t, keys.security),
+	}
+
+	for _, c := range []struct {
+		threshold int
+		signers   []*openpgp.Entity
+		allowed   bool
+		missing   string
+	}{
+		// Threshold met exactly
+		{2, []*openpgp.Entity{keys.build, keys.qa}, true, ""},
+		// Threshold exceeded, with signatures in any order
+		{2, []*openpgp.Entity{keys.security, keys.build, keys.qa}, true, ""},
+		// Unrelated signatures are ignored
+		{2, []*openpgp.Entity{keys.other, keys.qa, keys.security}, true, ""},
+		// All signers required
+		{3, []*openpgp.Entity{keys.build, keys.qa, keys.security}, true, ""},
+		{3, []*openpgp.Entity{keys.build, keys.security}, false, `"qa"`},
+		// Too few signers
+		{2, []*openpgp.Entity{keys.build}, false, `"qa", "security"`},
+		{2, []*openpgp.Entity{keys.build, keys.other}, false, `"qa", "security"`},
+		// Several signatures by the same signer count only once
+		{2, []*openpgp.Entity{keys.qa, keys.qa}, false, `"build", "security"`},
+		// No signatures
+		{1, []*openpgp.Entity{}, false, `"build", "qa", "security"`},
+	} {
+		dir := thresholdTestImageDir(t, c.signers...)
+		defer os.RemoveAll(dir)
+		image, closer := dirImageMock(t, dir, "testing/manifest:latest")
+		defer closer()
+		pr := newThresholdTestRequirement(t, c.threshold, keyrings)
+		allowed, err := pr.isRunningImageAllowed(context.Background(), image)
+		if c.allowed {
+			assertRunningAllowed(t, allowed, err)
+		} else {
+			assertRunningRejectedPolicyRequirement(t, allowed, err)
+			assert.Contains(t, err.Error(), "missing signatures by "+c.missing)
+		}
+	}
+
+	// Signatures for a different identity are not accepted
+	dir := thresholdTestImageDir(t, keys.build, keys.qa)
+	defer os.RemoveAll(dir)
+	image, closer := dirImageMock(t, dir, "testing/manifest:notlatest")
+	defer closer()
+	pr := newThresholdTestRequirement(t, 1, keyrings)
+	allowed, err := pr.isRunningImageAllowed(context.Background(), image)
+	assertRunningRejectedPolicyRequirement(t, allowed, err)
+
+	// A single key trusted by several signers satisfies only one of them
+	dir = thresholdTestImageDir(t, keys.build)
+	defer os.RemoveAll(dir)
+	image, closer = dirImageMock(t, dir, "testing/manifest:latest")
+	defer closer()
+	pr = newThresholdTestRequirement(t, 2, map[string][]byte{
+		"build": openpgpTestKeyring(t, keys.build),
+		"qa":    openpgpTestKeyring(t, keys.build, keys.qa),
+	})
+	allowed, err = pr.isRunningImageAllowed(context.Background(), image)
+	assertRunningRejectedPolicyRequirement(t, allowed, err)
+
+	// Error reading signatures
+	invalidSigDir := createInvalidSigDir(t)
+	defer os.RemoveAll(invalidSigDir)
+	image, closer = dirImageMock(t, invalidSigDir, "testing/manifest:latest")
+	defer closer()
+	pr = newThresholdTestRequirement(t, 1, keyrings)
+	allowed, err = pr.isRunningImageAllowed(context.Background(), image)
+	assertRunningRejected(t, allowed, err)
+}
+
+func TestThresholdSatisfiedSigners(t *testing.T) {
+	for _, c := range []struct {
+		acceptedKeys map[string][]string
+		expected     map[string]bool
+	}{
+		// Nothing accepted
+		{map[string][]string{}, map[string]bool{}},
+		// Distinct keys
+		{
+			map[string][]string{"a": {"k1"}, "b": {"k2"}},
+			map[string]bool{"a": true, "b": true},
+		},
+		// A single key can only satisfy one signer
+		{
+			map[string][]string{"a": {"k1"}, "b": {"k1"}},
+			map[string]bool{"a": true},
+		},
+		// A key assigned to an earlier signer is reassigned if that signer has an alternative
+		{
+			map[string][]string{"a": {"k1", "k2"}, "b": {"k1"}},
+			map[string]bool{"a": true, "b": true},
+		},
+		{
+			map[string][]string{"a": {"k1", "k2"}, "b": {"k1", "k2"}, "c": {"k2"}},
+			map[string]bool{"a": true, "b": true},
+		},
+	} {
+		res := thresholdSatisfiedSigners([]string{"a", "b", "c"}, c.acceptedKeys)
+		assert.Equal(t, c.expected, res, fmt.Sprintf("%#v", c.acceptedKeys))
+	}
+}
@@ -0,0 +1,126 @@
+// Revocation lists of manifest digests and signing keys, consulted before accepting any signature.
+
+package signature
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// revocationList is the parsed contents of a revocation list file referenced by PolicyRevocations.
+type revocationList struct {
+	manifestDigests map[digest.Digest]struct{}
+	keyIdentities   map[string]struct{} // Normalized to upper case
+}
+
+// loadRevocationList reads the revocation list referenced by pr, verifying its signature if pr.KeyPath is set.
+func loadRevocationList(pr *PolicyRevocations) (*revocationList, error) {
+	data, err := ioutil.ReadFile(pr.Path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading revocation list")
+	}
+	if pr.KeyPath != "" {
+		data, err = verifyRevocationListSignature(data, pr.KeyPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "verifying revocation list %s", pr.Path)
+		}
+	}
+	res, err := parseRevocationList(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing revocation list %s", pr.Path)
+	}
+	return res, nil
+}
+
+// verifyRevocationListSignature verifies that signed has been signed by one of the GPG keys in keyPath,
+// and returns the signed contents.
+func verifyRevocationListSignature(signed []byte, keyPath string) ([]byte, error) {
+	keyData, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	mech, trustedIdentities, err := newEphemeralGPGSigningMechanism(keyData)
+	if err != nil {
+		return nil, err
+	}
+	defer mech.Close()
+	if len(trustedIdentities) == 0 {
+		return nil, errors.Errorf("No public keys found in %s", keyPath)
+	}
+
+	contents, keyIdentity, err := mech.Verify(signed)
+	if err != nil {
+		return nil, err
+	}
+	for _, trustedIdentity := range trustedIdentities {
+		if keyIdentity == trustedIdentity {
+			return contents, nil
+		}
+	}
+	// Coverage: We use a private GPG home directory and only import trusted keys, so this should not be reachable.
+	return nil, errors.Errorf("Revocation list signed by an untrusted key %s", keyIdentity)
+}
+
+// parseRevocationList parses the JSON contents of a revocation list file.
+func parseRevocationList(data []byte) (*revocationList, error) {
+	var manifestDigests []digest.Digest
+	var keyIdentities []string
+	if err := paranoidUnmarshalJSONObject(data, func(key string) interface{} {
+		switch key {
+		case "manifestDigests":
+			return &manifestDigests
+		case "keyFingerprints":
+			return &keyIdentities
+		default:
+			return nil
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	res := &revocationList{
+		manifestDigests: map[digest.Digest]struct{}{},
+		keyIdentities:   map[string]struct{}{},
+	}
+	for _, d := range manifestDigests {
+		if err := d.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid manifest digest %q", d)
+		}
+		res.manifestDigests[d] = struct{}{}
+	}
+	for _, k := range keyIdentities {
+		if k == "" {
+			return nil, errors.New("empty key fingerprint")
+		}
+		res.keyIdentities[strings.ToUpper(k)] = struct{}{}
+	}
+	return res, nil
+}
+
+// validateKeyIdentity returns a PolicyRequirementError if keyIdentity has been revoked.
+// It is valid to call this on a nil *revocationList, which revokes nothing.
+func (rl *revocationList) validateKeyIdentity(keyIdentity string) error {
+	if rl == nil {
+		return nil
+	}
+	if _, ok := rl.keyIdentities[strings.ToUpper(keyIdentity)]; ok {
+		return PolicyRequirementError(fmt.Sprintf("Signature by key %s is not accepted, the key has been revoked", keyIdentity))
+	}
+	return nil
+}
+
+// validateManifestDigest returns a PolicyRequirementError if signatures of manifestDigest have been revoked.
+// It is valid to call this on a nil *revocationList, which revokes nothing.
+func (rl *revocationList) validateManifestDigest(manifestDigest digest.Digest) error {
+	if rl == nil {
+		return nil
+	}
+	if _, ok := rl.manifestDigests[manifestDigest]; ok {
+		return PolicyRequirementError(fmt.Sprintf("Signature for digest %s is not accepted, it has been revoked", manifestDigest))
+	}
+	return nil
+}
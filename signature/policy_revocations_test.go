@@ -0,0 +1,175 @@
+package signature
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeRevocationTestFile writes contents to name in dir, and returns its path.
+func writeRevocationTestFile(t *testing.T, dir, name string, contents []byte) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, contents, 0644)
+	require.NoError(t, err)
+	return path
+}
+
+func TestParseRevocationList(t *testing.T) {
+	otherDigest := digest.Digest("sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+	// Success
+	rl, err := parseRevocationList([]byte(`{"manifestDigests":["` + TestImageManifestDigest.String() + `","` + otherDigest.String() + `"],` +
+		`"keyFingerprints":["` + strings.ToLower(TestKeyFingerprint) + `"]}`))
+	require.NoError(t, err)
+	assert.Equal(t, &revocationList{
+		manifestDigests: map[digest.Digest]struct{}{TestImageManifestDigest: {}, otherDigest: {}},
+		keyIdentities:   map[string]struct{}{TestKeyFingerprint: {}},
+	}, rl)
+
+	// Both fields are optional
+	rl, err = parseRevocationList([]byte(`{}`))
+	require.NoError(t, err)
+	assert.Equal(t, &revocationList{manifestDigests: map[digest.Digest]struct{}{}, keyIdentities: map[string]struct{}{}}, rl)
+
+	// Failures
+	for _, invalid := range []string{
+		`&`,
+		`[]`,
+		`{"manifestDigests":1}`,
+		`{"manifestDigests":["this is not a digest"]}`,
+		`{"keyFingerprints":"ABCD"}`,
+		`{"keyFingerprints":[""]}`,
+		`{"unexpected":1}`,
+		`{"keyFingerprints":[],"keyFingerprints":[]}`,
+	} {
+		_, err := parseRevocationList([]byte(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestLoadRevocationList(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "revocations")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	past := time.Now().Add(-time.Hour)
+	trustedKey := newOpenPGPTestEntity(t, "trusted", past)
+	untrustedKey := newOpenPGPTestEntity(t, "untrusted", past)
+	keyPath := writeRevocationTestFile(t, tmpDir, "keys.gpg", openpgpTestKeyring(t, trustedKey))
+	contents := []byte(`{"keyFingerprints":["` + TestKeyFingerprint + `"]}`)
+	expected := &revocationList{
+		manifestDigests: map[digest.Digest]struct{}{},
+		keyIdentities:   map[string]struct{}{TestKeyFingerprint: {}},
+	}
+	unsignedPath := writeRevocationTestFile(t, tmpDir, "unsigned.json", contents)
+	signedPath := writeRevocationTestFile(t, tmpDir, "signed", openpgpTestSign(t, trustedKey, contents))
+
+	// Unsigned
+	rl, err := loadRevocationList(&PolicyRevocations{Path: unsignedPath})
+	require.NoError(t, err)
+	assert.Equal(t, expected, rl)
+
+	// Signed
+	rl, err = loadRevocationList(&PolicyRevocations{Path: signedPath, KeyPath: keyPath})
+	require.NoError(t, err)
+	assert.Equal(t, expected, rl)
+
+	for _, c := range []PolicyRevocations{
+		// Missing file
+		{Path: filepath.Join(tmpDir, "this/does/not/exist")},
+		// Signed file read without verifying the signature
+		{Path: signedPath},
+		// Signature required, but missing
+		{Path: unsignedPath, KeyPath: keyPath},
+		// Signed by an untrusted key
+		{Path: writeRevocationTestFile(t, tmpDir, "untrusted", openpgpTestSign(t, untrustedKey, contents)), KeyPath: keyPath},
+		// Missing keyring
+		{Path: signedPath, KeyPath: filepath.Join(tmpDir, "this/does/not/exist")},
+		// No keys in the keyring
+		{Path: signedPath, KeyPath: writeRevocationTestFile(t, tmpDir, "empty.gpg", []byte{})},
+		// Signed invalid contents
+		{Path: writeRevocationTestFile(t, tmpDir, "signed-invalid", openpgpTestSign(t, trustedKey, []byte("{"))), KeyPath: keyPath},
+	} {
+		_, err := loadRevocationList(&c)
+		assert.Error(t, err, "%#v", c)
+	}
+}
+
+func TestRevocationListValidate(t *testing.T) {
+	// A nil list revokes nothing
+	var rl *revocationList
+	assert.NoError(t, rl.validateKeyIdentity(TestKeyFingerprint))
+	assert.NoError(t, rl.validateManifestDigest(TestImageManifestDigest))
+
+	rl, err := parseRevocationList([]byte(`{"manifestDigests":["` + TestImageManifestDigest.String() + `"],` +
+		`"keyFingerprints":["` + TestKeyFingerprint + `"]}`))
+	require.NoError(t, err)
+	for _, keyIdentity := range []string{TestKeyFingerprint, strings.ToLower(TestKeyFingerprint)} {
+		err := rl.validateKeyIdentity(keyIdentity)
+		assert.IsType(t, PolicyRequirementError(""), err, keyIdentity)
+	}
+	assert.NoError(t, rl.validateKeyIdentity("0123456789ABCDEF0123456789ABCDEF01234567"))
+	err = rl.validateManifestDigest(TestImageManifestDigest)
+	assert.IsType(t, PolicyRequirementError(""), err)
+	assert.NoError(t, rl.validateManifestDigest("sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"))
+}
+
+func TestPolicyContextRevocations(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "revocations")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	newPolicy := func(revocations string) *Policy {
+		return &Policy{
+			Default: PolicyRequirements{xNewPRSignedByKeyPath(SBKeyTypeGPGKeys, "fixtures/public-key.gpg", NewPRMMatchRepository())},
+			Revocations: &PolicyRevocations{
+				Path: writeRevocationTestFile(t, tmpDir, "revocations.json", []byte(revocations)),
+			},
+		}
+	}
+	img, closer := pcImageMock(t, "fixtures/dir-img-valid", "testing/manifest:latest")
+	defer closer()
+
+	for _, c := range []struct {
+		revocations string
+		allowed     bool
+	}{
+		{`{}`, true},
+		{`{"manifestDigests":["sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"],"keyFingerprints":["0123456789ABCDEF"]}`, true},
+		{`{"manifestDigests":["` + TestImageManifestDigest.String() + `"]}`, false},
+		{`{"keyFingerprints":["` + strings.ToLower(TestKeyFingerprint) + `"]}`, false},
+	} {
+		pc, err := NewPolicyContext(newPolicy(c.revocations))
+		require.NoError(t, err)
+
+		res, err := pc.IsRunningImageAllowed(context.Background(), img)
+		sigs, sigsErr := pc.GetSignaturesWithAcceptedAuthor(context.Background(), img)
+		require.NoError(t, sigsErr)
+		if c.allowed {
+			assertRunningAllowed(t, res, err)
+			assert.Len(t, sigs, 1)
+		} else {
+			assertRunningRejectedPolicyRequirement(t, res, err)
+			assert.Empty(t, sigs)
+		}
+
+		err = pc.Destroy()
+		require.NoError(t, err)
+	}
+
+	// The revocation list can not be loaded
+	_, err = NewPolicyContext(newPolicy(`{"unexpected":1}`))
+	assert.Error(t, err)
+	_, err = NewPolicyContext(&Policy{
+		Default:     PolicyRequirements{NewPRReject()},
+		Revocations: &PolicyRevocations{Path: filepath.Join(tmpDir, "this/does/not/exist")},
+	})
+	assert.Error(t, err)
+}
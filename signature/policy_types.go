@@ -6,6 +6,8 @@
 
 package signature
 
+import "time"
+
 // NOTE: Keep this in sync with docs/policy.json.md!
 
 // Policy defines requirements for considering a signature, or an image, valid.
@@ -15,6 +17,18 @@ type Policy struct {
 	// if the image matches none of the scopes.
 	Default    PolicyRequirements               `json:"default"`
 	Transports map[string]PolicyTransportScopes `json:"transports"`
+	// Revocations, if not nil, refers to a list of revoked manifest digests and signing keys;
+	// signatures matching any of them are never accepted.
+	Revocations *PolicyRevocations `json:"revocations,omitempty"`
+}
+
+// PolicyRevocations refers to a revocation list file, which is read when creating a PolicyContext.
+type PolicyRevocations struct {
+	// Path is a pathname to a local file containing the revocation list.
+	Path string `json:"path"`
+	// KeyPath, if not empty, is a pathname to a local file containing GPG keys; the revocation list
+	// must then be signed by one of these keys.
+	KeyPath string `json:"keyPath,omitempty"`
 }
 
 // PolicyTransportScopes defines policies for images for a specific transport,
@@ -46,6 +60,7 @@ const (
 	prTypeReject                 prTypeIdentifier = "reject"
 	prTypeSignedBy               prTypeIdentifier = "signedBy"
 	prTypeSignedBaseLayer        prTypeIdentifier = "signedBaseLayer"
+	prTypeSignedByThreshold      prTypeIdentifier = "signedByThreshold"
 )
 
 // prInsecureAcceptAnything is a PolicyRequirement with type = prTypeInsecureAcceptAnything:
@@ -76,9 +91,23 @@ type prSignedBy struct {
 	// KeyData contains the trusted key(s), base64-encoded. Exactly one of KeyPath and KeyData must be specified.
 	KeyData []byte `json:"keyData,omitempty"`
 
+	// SignerKeyPath is a pathname to a local file containing the keys which may have created the signatures, if KeyType is “signedByGPGKeys”;
+	// only signatures by these keys which are certified by the trusted keys are accepted.
+	// At most one of SignerKeyPath and SignerKeyData may be specified; if neither is, the signer keys are looked up in KeyPath/KeyData.
+	SignerKeyPath string `json:"signerKeyPath,omitempty"`
+	// SignerKeyData contains the keys which may have created the signatures, base64-encoded; see SignerKeyPath.
+	SignerKeyData []byte `json:"signerKeyData,omitempty"`
+
 	// SignedIdentity specifies what image identity the signature must be claiming about the image.
 	// Defaults to "match-exact" if not specified.
 	SignedIdentity PolicyReferenceMatch `json:"signedIdentity"`
+
+	// MaxSignatureAgeSeconds, if not 0, is the maximum age of an accepted signature, based on the timestamp it contains.
+	// Signatures without a timestamp are rejected.
+	MaxSignatureAgeSeconds int64 `json:"maxSignatureAgeSeconds,omitempty"`
+	// SignedNotBefore, if not nil, is the earliest acceptable creation time of a signature, based on the timestamp it contains.
+	// Signatures without a timestamp are rejected.
+	SignedNotBefore *time.Time `json:"signedNotBefore,omitempty"`
 }
 
 // sbKeyType are the allowed values for prSignedBy.KeyType
@@ -87,23 +116,31 @@ type sbKeyType string
 const (
 	// SBKeyTypeGPGKeys refers to keys contained in a GPG keyring
 	SBKeyTypeGPGKeys sbKeyType = "GPGKeys"
-	// SBKeyTypeSignedByGPGKeys refers to keys signed by keys in a GPG keyring
+	// SBKeyTypeSignedByGPGKeys refers to keys certified by keys in a GPG keyring
 	SBKeyTypeSignedByGPGKeys sbKeyType = "signedByGPGKeys"
-	// SBKeyTypeX509Certificates refers to keys in a set of X.509 certificates
-	// FIXME: PEM, DER?
+	// SBKeyTypeX509Certificates refers to keys in a set of PEM-encoded X.509 certificates
 	SBKeyTypeX509Certificates sbKeyType = "X509Certificates"
-	// SBKeyTypeSignedByX509CAs refers to keys signed by one of the X.509 CAs
-	// FIXME: PEM, DER?
+	// SBKeyTypeSignedByX509CAs refers to keys signed by one of the PEM-encoded X.509 CAs
 	SBKeyTypeSignedByX509CAs sbKeyType = "signedByX509CAs"
 )
 
 // prSignedBaseLayer is a PolicyRequirement with type = prSignedBaseLayer: the image has a specified, correctly signed, base image.
 type prSignedBaseLayer struct {
 	prCommon
-	// BaseLayerIdentity specifies the base image to look for. "match-exact" is rejected, "match-repository" is unlikely to be useful.
+	// BaseLayerIdentity specifies the base image to look for. Only "exactReference" identifies a specific base image; other values are rejected during evaluation.
 	BaseLayerIdentity PolicyReferenceMatch `json:"baseLayerIdentity"`
 }
 
+// prSignedByThreshold is a PolicyRequirement with type = prTypeSignedByThreshold: the image is signed by at least Threshold of Signers,
+// each using a different key.
+type prSignedByThreshold struct {
+	prCommon
+	// Threshold is the minimum number of Signers which must have signed the image.
+	Threshold int `json:"threshold"`
+	// Signers maps signer names (used in error messages) to "signedBy" requirements describing the keys of that signer.
+	Signers map[string]*prSignedBy `json:"signers"`
+}
+
 // PolicyReferenceMatch specifies a set of image identities accepted in PolicyRequirement.
 // The type is public, but its implementation is private.
 
@@ -32,7 +32,19 @@ func (err InvalidSignatureError) Error() string {
 // The only way to get this structure from a blob should be as a return value from a successful call to verifyAndExtractSignature below.
 type Signature struct {
 	DockerManifestDigest digest.Digest
-	DockerReference      string // FIXME: more precise type?
+	DockerReference      string     // FIXME: more precise type?
+	Timestamp            *time.Time // The time the signature claims to have been created at, or nil if it does not include a timestamp
+}
+
+// equal returns true iff s and other contain the same data.
+func (s *Signature) equal(other *Signature) bool {
+	if s.DockerManifestDigest != other.DockerManifestDigest || s.DockerReference != other.DockerReference {
+		return false
+	}
+	if s.Timestamp == nil || other.Timestamp == nil {
+		return s.Timestamp == nil && other.Timestamp == nil
+	}
+	return s.Timestamp.Equal(*other.Timestamp)
 }
 
 // untrustedSignature is a parsed content of a signature.
@@ -232,10 +244,16 @@ func verifyAndExtractSignature(mech SigningMechanism, unverifiedSignature []byte
 	if err := rules.validateSignedDockerReference(unmatchedSignature.UntrustedDockerReference); err != nil {
 		return nil, err
 	}
+	var timestamp *time.Time // = nil
+	if unmatchedSignature.UntrustedTimestamp != nil {
+		ts := time.Unix(*unmatchedSignature.UntrustedTimestamp, 0)
+		timestamp = &ts
+	}
 	// signatureAcceptanceRules have accepted this value.
 	return &Signature{
 		DockerManifestDigest: unmatchedSignature.UntrustedDockerManifestDigest,
 		DockerReference:      unmatchedSignature.UntrustedDockerReference,
+		Timestamp:            timestamp,
 	}, nil
 }
 
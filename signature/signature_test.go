@@ -253,6 +253,8 @@ func TestSign(t *testing.T) {
 
 	assert.Equal(t, sig.UntrustedDockerManifestDigest, verified.DockerManifestDigest)
 	assert.Equal(t, sig.UntrustedDockerReference, verified.DockerReference)
+	require.NotNil(t, verified.Timestamp)
+	assert.Equal(t, *sig.UntrustedTimestamp, verified.Timestamp.Unix())
 
 	// Error creating blob to sign
 	_, err = untrustedSignature{}.sign(mech, TestKeyFingerprint)
@@ -315,6 +317,8 @@ func TestVerifyAndExtractSignature(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, TestImageSignatureReference, sig.DockerReference)
 	assert.Equal(t, TestImageManifestDigest, sig.DockerManifestDigest)
+	require.NotNil(t, sig.Timestamp)
+	assert.Equal(t, int64(1458239713), sig.Timestamp.Unix())
 	assert.Equal(t, signatureData, recorded)
 
 	// For extra paranoia, test that we return a nil signature object on error.
@@ -372,6 +376,33 @@ func TestVerifyAndExtractSignature(t *testing.T) {
 	assert.Equal(t, signatureData, recorded)
 }
 
+func TestSignatureEqual(t *testing.T) {
+	t1 := time.Unix(1458239713, 0)
+	t1Copy := time.Unix(1458239713, 0).UTC()
+	t2 := time.Unix(1458239714, 0)
+	base := Signature{DockerManifestDigest: TestImageManifestDigest, DockerReference: "testing/manifest:latest", Timestamp: &t1}
+	same := base
+	same.Timestamp = &t1Copy
+	assert.True(t, base.equal(&base))
+	assert.True(t, base.equal(&same))
+
+	for _, modify := range []func(*Signature){
+		func(s *Signature) { s.DockerManifestDigest = "sha256:0000" },
+		func(s *Signature) { s.DockerReference = "testing/manifest:other" },
+		func(s *Signature) { s.Timestamp = &t2 },
+		func(s *Signature) { s.Timestamp = nil },
+	} {
+		other := base
+		modify(&other)
+		assert.False(t, base.equal(&other), "%#v", other)
+		assert.False(t, other.equal(&base), "%#v", other)
+	}
+
+	noTimestamp := base
+	noTimestamp.Timestamp = nil
+	assert.True(t, noTimestamp.equal(&noTimestamp))
+}
+
 func TestGetUntrustedSignatureInformationWithoutVerifying(t *testing.T) {
 	signature, err := ioutil.ReadFile("./fixtures/image.signature")
 	require.NoError(t, err)
@@ -18,6 +18,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/containers/image/pkg/blobinfocache"
 	"github.com/containers/image/types"
 	"github.com/containers/storage"
 	"github.com/containers/storage/pkg/archive"
@@ -281,6 +282,8 @@ func makeLayer(t *testing.T, compression archive.Compression) (ddigest.Digest, i
 }
 
 func TestWriteRead(t *testing.T) {
+	cache := blobinfocache.NewMemoryCache()
+
 	if os.Geteuid() != 0 {
 		t.Skip("TestWriteRead requires root privileges")
 	}
@@ -378,11 +381,11 @@ func TestWriteRead(t *testing.T) {
 		if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob), types.BlobInfo{
 			Size:   size,
 			Digest: digest,
-		}, false); err != nil {
+		}, cache, false); err != nil {
 			t.Fatalf("Error saving randomly-generated layer to destination: %v", err)
 		}
 		t.Logf("Wrote randomly-generated layer %q (%d/%d bytes) to destination", digest, size, decompressedSize)
-		if _, err := dest.PutBlob(context.Background(), bytes.NewBufferString(config), configInfo, false); err != nil {
+		if _, err := dest.PutBlob(context.Background(), bytes.NewBufferString(config), configInfo, cache, false); err != nil {
 			t.Fatalf("Error saving config to destination: %v", err)
 		}
 		manifest := strings.Replace(manifestFmt, "%lh", digest.String(), -1)
@@ -393,10 +396,10 @@ func TestWriteRead(t *testing.T) {
 		manifest = strings.Replace(manifest, "%li", li, -1)
 		manifest = strings.Replace(manifest, "%ci", sum.Hex(), -1)
 		t.Logf("this manifest is %q", manifest)
-		if err := dest.PutManifest(context.Background(), []byte(manifest)); err != nil {
+		if err := dest.PutManifest(context.Background(), []byte(manifest), nil); err != nil {
 			t.Fatalf("Error saving manifest to destination: %v", err)
 		}
-		if err := dest.PutSignatures(context.Background(), signatures); err != nil {
+		if err := dest.PutSignatures(context.Background(), signatures, nil); err != nil {
 			t.Fatalf("Error saving signatures to destination: %v", err)
 		}
 		if err := dest.Commit(context.Background()); err != nil {
@@ -479,7 +482,7 @@ func TestWriteRead(t *testing.T) {
 		}
 		for _, layerInfo := range layerInfos {
 			buf := bytes.Buffer{}
-			layer, size, err := src.GetBlob(context.Background(), layerInfo)
+			layer, size, err := src.GetBlob(context.Background(), layerInfo, cache)
 			if err != nil {
 				t.Fatalf("Error reading layer %q from %q", layerInfo.Digest, ref.StringWithinTransport())
 			}
@@ -513,6 +516,8 @@ func TestWriteRead(t *testing.T) {
 }
 
 func TestDuplicateName(t *testing.T) {
+	cache := blobinfocache.NewMemoryCache()
+
 	if os.Geteuid() != 0 {
 		t.Skip("TestDuplicateName requires root privileges")
 	}
@@ -538,7 +543,7 @@ func TestDuplicateName(t *testing.T) {
 	if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob), types.BlobInfo{
 		Size:   size,
 		Digest: digest,
-	}, false); err != nil {
+	}, cache, false); err != nil {
 		t.Fatalf("Error saving randomly-generated layer to destination, first pass: %v", err)
 	}
 	manifest := fmt.Sprintf(`
@@ -554,7 +559,7 @@ func TestDuplicateName(t *testing.T) {
 		    ]
 		}
 	`, digest, size)
-	if err := dest.PutManifest(context.Background(), []byte(manifest)); err != nil {
+	if err := dest.PutManifest(context.Background(), []byte(manifest), nil); err != nil {
 		t.Fatalf("Error storing manifest to destination: %v", err)
 	}
 	if err := dest.Commit(context.Background()); err != nil {
@@ -573,7 +578,7 @@ func TestDuplicateName(t *testing.T) {
 	if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob), types.BlobInfo{
 		Size:   int64(size),
 		Digest: digest,
-	}, false); err != nil {
+	}, cache, false); err != nil {
 		t.Fatalf("Error saving randomly-generated layer to destination, second pass: %v", err)
 	}
 	manifest = fmt.Sprintf(`
@@ -589,7 +594,7 @@ func TestDuplicateName(t *testing.T) {
 		    ]
 		}
 	`, digest, size)
-	if err := dest.PutManifest(context.Background(), []byte(manifest)); err != nil {
+	if err := dest.PutManifest(context.Background(), []byte(manifest), nil); err != nil {
 		t.Fatalf("Error storing manifest to destination: %v", err)
 	}
 	if err := dest.Commit(context.Background()); err != nil {
@@ -599,6 +604,8 @@ func TestDuplicateName(t *testing.T) {
 }
 
 func TestDuplicateID(t *testing.T) {
+	cache := blobinfocache.NewMemoryCache()
+
 	if os.Geteuid() != 0 {
 		t.Skip("TestDuplicateID requires root privileges")
 	}
@@ -624,7 +631,7 @@ func TestDuplicateID(t *testing.T) {
 	if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob), types.BlobInfo{
 		Size:   size,
 		Digest: digest,
-	}, false); err != nil {
+	}, cache, false); err != nil {
 		t.Fatalf("Error saving randomly-generated layer to destination, first pass: %v", err)
 	}
 	manifest := fmt.Sprintf(`
@@ -640,7 +647,7 @@ func TestDuplicateID(t *testing.T) {
 		    ]
 		}
 	`, digest, size)
-	if err := dest.PutManifest(context.Background(), []byte(manifest)); err != nil {
+	if err := dest.PutManifest(context.Background(), []byte(manifest), nil); err != nil {
 		t.Fatalf("Error storing manifest to destination: %v", err)
 	}
 	if err := dest.Commit(context.Background()); err != nil {
@@ -659,7 +666,7 @@ func TestDuplicateID(t *testing.T) {
 	if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob), types.BlobInfo{
 		Size:   int64(size),
 		Digest: digest,
-	}, false); err != nil {
+	}, cache, false); err != nil {
 		t.Fatalf("Error saving randomly-generated layer to destination, second pass: %v", err)
 	}
 	manifest = fmt.Sprintf(`
@@ -675,7 +682,7 @@ func TestDuplicateID(t *testing.T) {
 		    ]
 		}
 	`, digest, size)
-	if err := dest.PutManifest(context.Background(), []byte(manifest)); err != nil {
+	if err := dest.PutManifest(context.Background(), []byte(manifest), nil); err != nil {
 		t.Fatalf("Error storing manifest to destination: %v", err)
 	}
 	if err := dest.Commit(context.Background()); errors.Cause(err) != storage.ErrDuplicateID {
@@ -688,6 +695,8 @@ func TestDuplicateID(t *testing.T) {
 }
 
 func TestDuplicateNameID(t *testing.T) {
+	cache := blobinfocache.NewMemoryCache()
+
 	if os.Geteuid() != 0 {
 		t.Skip("TestDuplicateNameID requires root privileges")
 	}
@@ -713,7 +722,7 @@ func TestDuplicateNameID(t *testing.T) {
 	if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob), types.BlobInfo{
 		Size:   size,
 		Digest: digest,
-	}, false); err != nil {
+	}, cache, false); err != nil {
 		t.Fatalf("Error saving randomly-generated layer to destination, first pass: %v", err)
 	}
 	manifest := fmt.Sprintf(`
@@ -729,7 +738,7 @@ func TestDuplicateNameID(t *testing.T) {
 		    ]
 		}
 	`, digest, size)
-	if err := dest.PutManifest(context.Background(), []byte(manifest)); err != nil {
+	if err := dest.PutManifest(context.Background(), []byte(manifest), nil); err != nil {
 		t.Fatalf("Error storing manifest to destination: %v", err)
 	}
 	if err := dest.Commit(context.Background()); err != nil {
@@ -748,7 +757,7 @@ func TestDuplicateNameID(t *testing.T) {
 	if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob), types.BlobInfo{
 		Size:   int64(size),
 		Digest: digest,
-	}, false); err != nil {
+	}, cache, false); err != nil {
 		t.Fatalf("Error saving randomly-generated layer to destination, second pass: %v", err)
 	}
 	manifest = fmt.Sprintf(`
@@ -764,7 +773,7 @@ func TestDuplicateNameID(t *testing.T) {
 		    ]
 		}
 	`, digest, size)
-	if err := dest.PutManifest(context.Background(), []byte(manifest)); err != nil {
+	if err := dest.PutManifest(context.Background(), []byte(manifest), nil); err != nil {
 		t.Fatalf("Error storing manifest to destination: %v", err)
 	}
 	if err := dest.Commit(context.Background()); errors.Cause(err) != storage.ErrDuplicateID {
@@ -816,6 +825,8 @@ func TestNamespaces(t *testing.T) {
 }
 
 func TestSize(t *testing.T) {
+	cache := blobinfocache.NewMemoryCache()
+
 	if os.Geteuid() != 0 {
 		t.Skip("TestSize requires root privileges")
 	}
@@ -844,21 +855,21 @@ func TestSize(t *testing.T) {
 	if dest == nil {
 		t.Fatalf("NewImageDestination(%q) returned no destination", ref.StringWithinTransport())
 	}
-	if _, err := dest.PutBlob(context.Background(), bytes.NewBufferString(config), configInfo, false); err != nil {
+	if _, err := dest.PutBlob(context.Background(), bytes.NewBufferString(config), configInfo, cache, false); err != nil {
 		t.Fatalf("Error saving config to destination: %v", err)
 	}
 	digest1, usize1, size1, blob := makeLayer(t, archive.Gzip)
 	if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob), types.BlobInfo{
 		Size:   size1,
 		Digest: digest1,
-	}, false); err != nil {
+	}, cache, false); err != nil {
 		t.Fatalf("Error saving randomly-generated layer 1 to destination: %v", err)
 	}
 	digest2, usize2, size2, blob := makeLayer(t, archive.Gzip)
 	if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob), types.BlobInfo{
 		Size:   size2,
 		Digest: digest2,
-	}, false); err != nil {
+	}, cache, false); err != nil {
 		t.Fatalf("Error saving randomly-generated layer 2 to destination: %v", err)
 	}
 	manifest := fmt.Sprintf(`
@@ -884,7 +895,7 @@ func TestSize(t *testing.T) {
 		    ]
 		}
 	`, configInfo.Size, configInfo.Digest, digest1, size1, digest2, size2)
-	if err := dest.PutManifest(context.Background(), []byte(manifest)); err != nil {
+	if err := dest.PutManifest(context.Background(), []byte(manifest), nil); err != nil {
 		t.Fatalf("Error storing manifest to destination: %v", err)
 	}
 	if err := dest.Commit(context.Background()); err != nil {
@@ -907,6 +918,8 @@ func TestSize(t *testing.T) {
 }
 
 func TestDuplicateBlob(t *testing.T) {
+	cache := blobinfocache.NewMemoryCache()
+
 	if os.Geteuid() != 0 {
 		t.Skip("TestDuplicateBlob requires root privileges")
 	}
@@ -939,26 +952,26 @@ func TestDuplicateBlob(t *testing.T) {
 	if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob1), types.BlobInfo{
 		Size:   size1,
 		Digest: digest1,
-	}, false); err != nil {
+	}, cache, false); err != nil {
 		t.Fatalf("Error saving randomly-generated layer 1 to destination (first copy): %v", err)
 	}
 	digest2, _, size2, blob2 := makeLayer(t, archive.Gzip)
 	if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob2), types.BlobInfo{
 		Size:   size2,
 		Digest: digest2,
-	}, false); err != nil {
+	}, cache, false); err != nil {
 		t.Fatalf("Error saving randomly-generated layer 2 to destination (first copy): %v", err)
 	}
 	if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob1), types.BlobInfo{
 		Size:   size1,
 		Digest: digest1,
-	}, false); err != nil {
+	}, cache, false); err != nil {
 		t.Fatalf("Error saving randomly-generated layer 1 to destination (second copy): %v", err)
 	}
 	if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob2), types.BlobInfo{
 		Size:   size2,
 		Digest: digest2,
-	}, false); err != nil {
+	}, cache, false); err != nil {
 		t.Fatalf("Error saving randomly-generated layer 2 to destination (second copy): %v", err)
 	}
 	manifest := fmt.Sprintf(`
@@ -994,7 +1007,7 @@ func TestDuplicateBlob(t *testing.T) {
 		    ]
 		}
 	`, configInfo.Size, configInfo.Digest, digest1, size1, digest2, size2, digest1, size1, digest2, size2)
-	if err := dest.PutManifest(context.Background(), []byte(manifest)); err != nil {
+	if err := dest.PutManifest(context.Background(), []byte(manifest), nil); err != nil {
 		t.Fatalf("Error storing manifest to destination: %v", err)
 	}
 	if err := dest.Commit(context.Background()); err != nil {